@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+type DataExport struct {
+	ID        int     `json:"ID"`
+	CreatedAt string  `json:"CreatedAt"`
+	Status    string  `json:"status"`
+	Size      int64   `json:"size"`
+	Error     string  `json:"error"`
+	ExpiresAt *string `json:"expires_at"`
+}
+
+func renderNotice(w http.ResponseWriter, r *http.Request, title string, message string) {
+	err := noticePage(title, message).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	}
+}
+
+func handelVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	payload := map[string]string{"token": r.URL.Query().Get("token")}
+	err := apiRequest("POST", "/verifyEmail", "", payload)
+	if err != nil {
+		fmt.Println(err)
+		renderNotice(w, r, "Verification failed", "The link is invalid or has expired. Log in to get a new one.")
+		return
+	}
+	log.Println("Email verified")
+	renderNotice(w, r, "Email verified", "Your email address is verified. You can now post offers and requests.")
+}
+
+func handelResendVerification(w http.ResponseWriter, r *http.Request) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	err = apiRequest("POST", "/resendVerification", token.Value, map[string]string{})
+	if err != nil {
+		fmt.Println(err)
+		renderNotice(w, r, "Could not send the link", "Your address may already be verified, or try again later.")
+		return
+	}
+	renderNotice(w, r, "Check your email", "We sent you a new verification link.")
+}
+
+func handelForgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/forgotPassword", http.StatusSeeOther)
+		return
+	}
+	err = apiRequest("POST", "/forgotPassword", "", map[string]string{"email": r.Form.Get("email")})
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/forgotPassword", http.StatusSeeOther)
+		return
+	}
+	renderNotice(w, r, "Check your email", "If an account uses that address, we sent it a link to reset the password.")
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	err := resetPasswordPage(r.URL.Query().Get("token")).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+	}
+}
+
+func handelResetPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/forgotPassword", http.StatusSeeOther)
+		return
+	}
+	payload := map[string]string{
+		"token":    r.Form.Get("token"),
+		"password": r.Form.Get("password"),
+	}
+	err = apiRequest("POST", "/resetPassword", "", payload)
+	if err != nil {
+		fmt.Println(err)
+		renderNotice(w, r, "Reset failed", "The link is invalid or has expired. Ask for a new one.")
+		return
+	}
+	log.Println("Password reset")
+	clearSessionCookies(w)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// accountRequest is apiRequest for the account settings. The api signs out
+// every other session when the email or password changes and hands this one
+// new tokens, which are stored right away.
+func accountRequest(w http.ResponseWriter, method string, path string, token string, payload map[string]string) error {
+	req, err := http.NewRequest(method, apiURL+path, bytes.NewBuffer(map2json(payload)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error: %v", resp.Status)
+	}
+	if resp.Header.Get("token") != "" {
+		setSessionCookies(w, resp)
+	}
+	return nil
+}
+
+func settingsPageHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	var profile Profile
+	err = apiGet("/profile", token.Value, &profile)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	exports := []DataExport{}
+	err = apiGet("/account/exports", token.Value, &exports)
+	if err != nil {
+		fmt.Println(err)
+	}
+	for i := range exports {
+		exports[i].CreatedAt = convertTime(exports[i].CreatedAt)
+		if exports[i].ExpiresAt != nil {
+			expires := convertTime(*exports[i].ExpiresAt)
+			exports[i].ExpiresAt = &expires
+		}
+	}
+	err = settingsPage(profile, exports).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+	}
+}
+
+func handelChangeEmail(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	payload := map[string]string{
+		"email":            r.Form.Get("email"),
+		"current_password": r.Form.Get("currentPassword"),
+	}
+	err = accountRequest(w, "POST", "/account/email", token.Value, payload)
+	if err != nil {
+		fmt.Println(err)
+		renderNotice(w, r, "Email not changed", "Check your password. The new address may already be in use.")
+		return
+	}
+	log.Println("Email changed")
+	renderNotice(w, r, "Check your email", "We sent a verification link to your new address. Posting is paused until you open it.")
+}
+
+func handelChangePassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	payload := map[string]string{
+		"current_password": r.Form.Get("currentPassword"),
+		"new_password":     r.Form.Get("newPassword"),
+	}
+	err = accountRequest(w, "POST", "/account/password", token.Value, payload)
+	if err != nil {
+		fmt.Println(err)
+		renderNotice(w, r, "Password not changed", "Your current password was not correct.")
+		return
+	}
+	log.Println("Password changed")
+	renderNotice(w, r, "Password changed", "You were signed out on your other devices.")
+}
+
+func handelDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	if r.Form.Get("confirm") != "true" {
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	payload := map[string]string{"current_password": r.Form.Get("currentPassword")}
+	err = accountRequest(w, "DELETE", "/account", token.Value, payload)
+	if err != nil {
+		fmt.Println(err)
+		renderNotice(w, r, "Account not deleted",
+			"Check your password. Communities you own with other members need a new owner first.")
+		return
+	}
+	log.Println("Account deleted")
+	clearSessionCookies(w)
+	renderNotice(w, r, "Account deleted", "Your account and everything you posted has been removed.")
+}
+
+func handelRequestExport(w http.ResponseWriter, r *http.Request) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	err = apiRequest("POST", "/account/export", token.Value, map[string]string{})
+	if err != nil {
+		fmt.Println(err)
+		renderNotice(w, r, "Export not started", "An export is already being prepared.")
+		return
+	}
+	renderNotice(w, r, "Export started", "We are putting your data together and will email you when it is ready.")
+}
+
+// exportDownloadHandler passes the export archive in the id parameter on
+// from the api to the browser.
+func exportDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), "GET", apiURL+"/account/export/"+r.URL.Query().Get("id")+"/download", nil)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token.Value)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println("Error: ", resp.Status)
+		renderNotice(w, r, "Export not found", "The export has expired. Ask for a new one in your settings.")
+		return
+	}
+	for _, header := range []string{"Content-Type", "Content-Length", "Content-Disposition", "Cache-Control"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// refreshTokenMaxAge matches the lifetime of refresh tokens on the api.
+const refreshTokenMaxAge = 30 * 24 * 60 * 60
+
+// setSessionCookies stores the tokens the api sent with a sign in or a
+// refresh. The access token cookie expires a little before the token itself
+// so that it is refreshed instead of being rejected by the api.
+func setSessionCookies(w http.ResponseWriter, resp *http.Response) {
+	maxAge, err := strconv.Atoi(resp.Header.Get("token_expires_in"))
+	if err != nil || maxAge <= 30 {
+		maxAge = 60
+	}
+	http.SetCookie(w, &http.Cookie{Name: "token", Value: resp.Header.Get("token"), Path: "/",
+		MaxAge: maxAge - 30, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	http.SetCookie(w, &http.Cookie{Name: "refresh_token", Value: resp.Header.Get("refresh_token"), Path: "/",
+		MaxAge: refreshTokenMaxAge, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	http.SetCookie(w, &http.Cookie{Name: "token_id", Value: resp.Header.Get("token_id"), Path: "/",
+		MaxAge: refreshTokenMaxAge, SameSite: http.SameSiteLaxMode})
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{"token", "refresh_token", "token_id"} {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1})
+	}
+}
+
+// sessionToken returns the access token cookie, using the refresh token to
+// get a new access token from the api when the old one has expired.
+func sessionToken(w http.ResponseWriter, r *http.Request) (*http.Cookie, error) {
+	token, err := r.Cookie("token")
+	if err == nil && token.Value != "" {
+		return token, nil
+	}
+	refreshToken, err := r.Cookie("refresh_token")
+	if err != nil {
+		return nil, http.ErrNoCookie
+	}
+	jstring := map2json(map[string]string{"refresh_token": refreshToken.Value})
+	req, err := http.NewRequest("POST", apiURL+"/refresh", bytes.NewBuffer(jstring))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		clearSessionCookies(w)
+		return nil, fmt.Errorf("error refreshing session: %v", resp.Status)
+	}
+	setSessionCookies(w, resp)
+	return &http.Cookie{Name: "token", Value: resp.Header.Get("token")}, nil
+}
+
+// signOut revokes the session on the api. The cookies are cleared by the
+// caller whether this succeeds or not.
+func signOut(r *http.Request) error {
+	refreshToken, err := r.Cookie("refresh_token")
+	if err != nil {
+		return nil
+	}
+	jstring := map2json(map[string]string{"refresh_token": refreshToken.Value})
+	req, err := http.NewRequest("POST", apiURL+"/signout", bytes.NewBuffer(jstring))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error signing out: %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSessionRefresh(t *testing.T) {
+	api := newFakeAPI(t)
+	api.replySession("POST", "/refresh", "fresh-token", map[string]string{})
+	api.reply("GET", "/blocks", http.StatusOK, []BlockedUser{})
+
+	// an expired access token cookie is gone, the refresh token gets a new one
+	req := httptest.NewRequest("GET", "/blocks", nil)
+	req.AddCookie(&http.Cookie{Name: "refresh_token", Value: testRefreshToken})
+	req.AddCookie(&http.Cookie{Name: "token_id", Value: testUserID})
+	rec := httptest.NewRecorder()
+	blocksPageHandler(rec, req)
+	wantStatus(t, rec, http.StatusOK)
+	if call := api.called("POST", "/refresh"); call.Body["refresh_token"] != testRefreshToken {
+		t.Fatalf("unexpected refresh %v", call.Body)
+	}
+	if call := api.called("GET", "/blocks"); call.Token != "fresh-token" {
+		t.Fatalf("the page was loaded with %q", call.Token)
+	}
+	if c := cookie(rec, "token"); c == nil || c.Value != "fresh-token" {
+		t.Fatalf("unexpected token cookie %+v", c)
+	}
+
+	// a revoked refresh token ends the session
+	api.reply("POST", "/refresh", http.StatusUnauthorized, map[string]string{"error": "invalid refresh token"})
+	rec = httptest.NewRecorder()
+	blocksPageHandler(rec, req)
+	wantRedirect(t, rec, http.StatusTemporaryRedirect, "/login")
+	if c := cookie(rec, "refresh_token"); c == nil || c.MaxAge >= 0 {
+		t.Fatalf("the refresh cookie was not cleared: %+v", c)
+	}
+
+	rec = httptest.NewRecorder()
+	blocksPageHandler(rec, httptest.NewRequest("GET", "/blocks", nil))
+	wantRedirect(t, rec, http.StatusTemporaryRedirect, "/login")
+	if len(api.requests("POST", "/refresh")) != 2 {
+		t.Fatal("refreshed without a refresh token")
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("POST", "/verifyEmail", http.StatusOK, map[string]string{})
+	rec := get(handelVerifyEmail, "/verifyEmail?token=abc")
+	wantHTML(t, rec, "Email verified")
+	if call := api.called("POST", "/verifyEmail"); call.Body["token"] != "abc" || call.Token != "" {
+		t.Fatalf("unexpected verification %v", call)
+	}
+
+	api.reply("POST", "/verifyEmail", http.StatusBadRequest, map[string]string{"error": "invalid or expired token"})
+	wantHTML(t, get(handelVerifyEmail, "/verifyEmail?token=abc"), "Verification failed")
+
+	api.reply("POST", "/resendVerification", http.StatusOK, map[string]string{})
+	wantHTML(t, get(handelResendVerification, "/handelResendVerification"), "We sent you a new verification link")
+	api.reply("POST", "/resendVerification", http.StatusBadRequest, map[string]string{"error": "email is already verified"})
+	wantHTML(t, get(handelResendVerification, "/handelResendVerification"), "Could not send the link")
+}
+
+func TestResetPassword(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("POST", "/forgotPassword", http.StatusOK, map[string]string{})
+	rec := postForm(handelForgotPassword, "/handelForgotPassword", url.Values{"email": {"ada@example.com"}})
+	wantHTML(t, rec, "If an account uses that address")
+	if call := api.called("POST", "/forgotPassword"); call.Body["email"] != "ada@example.com" {
+		t.Fatalf("unexpected request %v", call.Body)
+	}
+
+	wantHTML(t, get(resetPasswordHandler, "/resetPassword?token=abc"), `name="token" value="abc"`)
+
+	api.reply("POST", "/resetPassword", http.StatusOK, map[string]string{})
+	rec = postForm(handelResetPassword, "/handelResetPassword", url.Values{"token": {"abc"}, "password": {"new secret"}})
+	wantRedirect(t, rec, http.StatusSeeOther, "/login")
+	if call := api.called("POST", "/resetPassword"); call.Body["token"] != "abc" || call.Body["password"] != "new secret" {
+		t.Fatalf("unexpected reset %v", call.Body)
+	}
+	if c := cookie(rec, "token"); c == nil || c.MaxAge >= 0 {
+		t.Fatal("the old session was kept after the reset")
+	}
+
+	api.reply("POST", "/resetPassword", http.StatusBadRequest, map[string]string{"error": "invalid or expired token"})
+	wantHTML(t, postForm(handelResetPassword, "/handelResetPassword", url.Values{"token": {"abc"}}), "Reset failed")
+}
+
+func TestSettingsPage(t *testing.T) {
+	api := newFakeAPI(t)
+	expires := "2026-03-11T10:20:00Z"
+	api.reply("GET", "/profile", http.StatusOK, Profile{ID: 1, Username: "ada", Email: "ada@example.com"})
+	api.reply("GET", "/account/exports", http.StatusOK, []DataExport{
+		{ID: 3, Status: "pending", CreatedAt: "2026-03-05T10:20:00Z"},
+		{ID: 2, Status: "ready", CreatedAt: "2026-03-04T10:20:00Z", ExpiresAt: &expires},
+		{ID: 1, Status: "failed", CreatedAt: "2026-03-03T10:20:00Z"},
+	})
+
+	rec := get(settingsPageHandler, "/settings")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, "Signed in as ada@example.com", "This address is not verified yet.", "Being prepared",
+		`href="/exportDownload?id=2"`, "until 26/03/11 10:20", "Failed, please try again")
+
+	api.reply("GET", "/profile", http.StatusUnauthorized, map[string]string{"error": "signed out"})
+	wantRedirect(t, get(settingsPageHandler, "/settings"), http.StatusTemporaryRedirect, "/login")
+}
+
+func TestChangeAccount(t *testing.T) {
+	api := newFakeAPI(t)
+	api.replySession("POST", "/account/password", "changed-token", map[string]string{"changed": "password"})
+	rec := postForm(handelChangePassword, "/handelChangePassword", url.Values{"currentPassword": {"secret"}, "newPassword": {"new secret"}})
+	wantHTML(t, rec, "Password changed")
+	if call := api.called("POST", "/account/password"); call.Body["current_password"] != "secret" ||
+		call.Body["new_password"] != "new secret" {
+		t.Fatalf("unexpected change %v", call.Body)
+	}
+	// the api signed out every session, this one goes on with the new tokens
+	if c := cookie(rec, "token"); c == nil || c.Value != "changed-token" {
+		t.Fatalf("unexpected token cookie %+v", c)
+	}
+
+	api.reply("POST", "/account/password", http.StatusForbidden, map[string]string{"error": "incorrect password"})
+	rec = postForm(handelChangePassword, "/handelChangePassword", url.Values{"currentPassword": {"wrong"}})
+	wantHTML(t, rec, "Password not changed")
+	if cookie(rec, "token") != nil {
+		t.Fatal("a failed change replaced the session")
+	}
+
+	api.replySession("POST", "/account/email", "changed-token", map[string]string{"changed": "email"})
+	rec = postForm(handelChangeEmail, "/handelChangeEmail", url.Values{"currentPassword": {"secret"}, "email": {"ada@new.example.com"}})
+	wantHTML(t, rec, "We sent a verification link to your new address")
+	if call := api.called("POST", "/account/email"); call.Body["email"] != "ada@new.example.com" {
+		t.Fatalf("unexpected change %v", call.Body)
+	}
+	api.reply("POST", "/account/email", http.StatusBadRequest, map[string]string{"error": "email address is already in use"})
+	wantHTML(t, postForm(handelChangeEmail, "/handelChangeEmail", url.Values{"email": {"bob@example.com"}}), "Email not changed")
+}
+
+func TestDeleteAccount(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("DELETE", "/account", http.StatusOK, map[string]int{"deleted": 1})
+
+	// nothing happens without ticking the box
+	rec := postForm(handelDeleteAccount, "/handelDeleteAccount", url.Values{"currentPassword": {"secret"}})
+	wantRedirect(t, rec, http.StatusSeeOther, "/settings")
+	if len(api.requests("DELETE", "/account")) != 0 {
+		t.Fatal("the account was deleted without confirmation")
+	}
+
+	rec = postForm(handelDeleteAccount, "/handelDeleteAccount", url.Values{"currentPassword": {"secret"}, "confirm": {"true"}})
+	wantHTML(t, rec, "Account deleted")
+	if call := api.called("DELETE", "/account"); call.Body["current_password"] != "secret" {
+		t.Fatalf("unexpected deletion %v", call.Body)
+	}
+	if c := cookie(rec, "token"); c == nil || c.MaxAge >= 0 {
+		t.Fatal("the session was kept after deleting the account")
+	}
+
+	api.reply("DELETE", "/account", http.StatusBadRequest, map[string]string{"error": "transfer ownership of garden before deleting your account"})
+	rec = postForm(handelDeleteAccount, "/handelDeleteAccount", url.Values{"currentPassword": {"secret"}, "confirm": {"true"}})
+	wantHTML(t, rec, "Account not deleted", "need a new owner first")
+}
+
+func TestDataExport(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("POST", "/account/export", http.StatusOK, DataExport{ID: 4, Status: "pending"})
+	wantHTML(t, get(handelRequestExport, "/handelRequestExport"), "Export started")
+	api.reply("POST", "/account/export", http.StatusBadRequest, map[string]string{"error": "an export is already being prepared"})
+	wantHTML(t, get(handelRequestExport, "/handelRequestExport"), "Export not started")
+
+	api.handle("GET", "/account/export/4/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="comradary-export-4.zip"`)
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Header().Set("X-Internal", "not for browsers")
+		w.Write([]byte("PK zip bytes"))
+	})
+	rec := get(exportDownloadHandler, "/exportDownload?id=4")
+	wantStatus(t, rec, http.StatusOK)
+	if rec.Body.String() != "PK zip bytes" || rec.Header().Get("Content-Type") != "application/zip" ||
+		!strings.HasPrefix(rec.Header().Get("Content-Disposition"), "attachment") || rec.Header().Get("X-Internal") != "" {
+		t.Fatalf("unexpected download %v %q", rec.Header(), rec.Body.String())
+	}
+	if call := api.called("GET", "/account/export/4/download"); call.Token != testToken {
+		t.Fatalf("downloaded with %q", call.Token)
+	}
+
+	wantHTML(t, get(exportDownloadHandler, "/exportDownload?id=5"), "Export not found")
+}
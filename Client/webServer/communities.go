@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var roleRank = map[string]int{
+	"member":    1,
+	"moderator": 2,
+	"owner":     3,
+}
+
+type Member struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	JoinedAt string `json:"joined_at"`
+}
+
+// CommunityMembers is a community with its members and the role the current
+// user has in it.
+type CommunityMembers struct {
+	Community Community `json:"community"`
+	Role      string    `json:"role"`
+	Members   []Member  `json:"members"`
+}
+
+func (c CommunityMembers) isModerator() bool {
+	return roleRank[c.Role] >= roleRank["moderator"]
+}
+
+func (c CommunityMembers) isOwner() bool {
+	return c.Role == "owner"
+}
+
+// canModerate reports whether the current user outranks the member.
+func (c CommunityMembers) canModerate(member Member) bool {
+	return c.isModerator() && roleRank[member.Role] < roleRank[c.Role]
+}
+
+type Ban struct {
+	UserID    int    `json:"user_id"`
+	Reason    string `json:"reason"`
+	CreatedAt string
+}
+
+type ModerationAction struct {
+	Action       string `json:"action"`
+	ActorID      int    `json:"actor_id"`
+	TargetUserID *int   `json:"target_user_id"`
+	Reason       string `json:"reason"`
+	CreatedAt    string
+}
+
+type JoinRequest struct {
+	ID        int    `json:"ID"`
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	Message   string `json:"message"`
+	CreatedAt string
+}
+
+type Invite struct {
+	ID        int     `json:"ID"`
+	Code      string  `json:"code"`
+	MaxUses   int     `json:"max_uses"`
+	Uses      int     `json:"uses"`
+	ExpiresAt *string `json:"expires_at"`
+}
+
+type moderationLog struct {
+	Items []ModerationAction `json:"items"`
+}
+
+func getCommunityMembers(token string, communityID string) (CommunityMembers, error) {
+	var members CommunityMembers
+	err := apiGet("/community/"+communityID+"/members", token, &members)
+	return members, err
+}
+
+// canModeratePosts reports whether the user may remove posts from the
+// community.
+func canModeratePosts(token string, communityID int) bool {
+	members, err := getCommunityMembers(token, strconv.Itoa(communityID))
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	return members.isModerator()
+}
+
+func myCommunitiesHandler(w http.ResponseWriter, r *http.Request) {
+	communities := getUserCommunities(w, r)
+	if communities == nil {
+		communities = []Community{}
+	}
+	err := myCommunitiesPage(communities).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+	}
+}
+
+func communityPageHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	communityID := r.URL.Query().Get("communityID")
+	members, err := getCommunityMembers(token.Value, communityID)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/myCommunities", http.StatusSeeOther)
+		return
+	}
+	bans := []Ban{}
+	var actions moderationLog
+	joinRequests := []JoinRequest{}
+	invites := []Invite{}
+	if members.isModerator() {
+		err = apiGet("/community/"+communityID+"/bans", token.Value, &bans)
+		if err != nil {
+			fmt.Println(err)
+		}
+		err = apiGet("/community/"+communityID+"/moderation", token.Value, &actions)
+		if err != nil {
+			fmt.Println(err)
+		}
+		for i := range actions.Items {
+			actions.Items[i].CreatedAt = convertTime(actions.Items[i].CreatedAt)
+		}
+		err = apiGet("/community/"+communityID+"/joinRequests", token.Value, &joinRequests)
+		if err != nil {
+			fmt.Println(err)
+		}
+		for i := range joinRequests {
+			joinRequests[i].CreatedAt = convertTime(joinRequests[i].CreatedAt)
+		}
+		err = apiGet("/community/"+communityID+"/invites", token.Value, &invites)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	err = communityPage(members, bans, actions.Items, joinRequests, invites).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+	}
+}
+
+// moderationActions are the actions the community page can post, with the
+// form fields each of them passes on to the api.
+var moderationActions = map[string][]string{
+	"kick":         {"user_id", "reason"},
+	"ban":          {"user_id", "reason"},
+	"unban":        {"user_id", "reason"},
+	"promote":      {"user_id", "reason"},
+	"demote":       {"user_id", "reason"},
+	"transfer":     {"user_id", "reason"},
+	"approveJoin":  {"request_id"},
+	"rejectJoin":   {"request_id"},
+	"invites":      {"max_uses", "expires_in_hours"},
+	"revokeInvite": {"invite_id"},
+	"visibility":   {"visibility"},
+}
+
+func handelModerate(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/myCommunities", http.StatusSeeOther)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	communityID := r.Form.Get("communityID")
+	action := r.Form.Get("action")
+	fields, ok := moderationActions[action]
+	if !ok {
+		http.Redirect(w, r, "/community?communityID="+communityID, http.StatusSeeOther)
+		return
+	}
+	payload := map[string]string{}
+	for _, field := range fields {
+		payload[field] = r.Form.Get(field)
+	}
+	err = apiRequest("POST", "/community/"+communityID+"/"+action, token.Value, payload)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		log.Printf("Moderation action %v done", action)
+	}
+	http.Redirect(w, r, "/community?communityID="+communityID, http.StatusSeeOther)
+}
+
+func handelLeaveCommunity(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/myCommunities", http.StatusSeeOther)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	communityID := r.Form.Get("communityID")
+	err = apiRequest("POST", "/community/"+communityID+"/leave", token.Value, map[string]string{})
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/community?communityID="+communityID, http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/myCommunities", http.StatusSeeOther)
+}
+
+func handelRemovePost(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	payload := map[string]string{
+		"kind":   r.Form.Get("kind"),
+		"id":     r.Form.Get("postID"),
+		"reason": r.Form.Get("reason"),
+	}
+	err = apiRequest("POST", "/community/"+r.Form.Get("communityID")+"/removePost", token.Value, payload)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		log.Println("Post removed")
+	}
+	if payload["kind"] == "request" {
+		http.Redirect(w, r, "/requests", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// invitePageHandler shows the community an invite link leads to.
+func invitePageHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	code := r.URL.Query().Get("code")
+	var invite struct {
+		Community Community `json:"community"`
+	}
+	err = apiGet("/invite/"+url.PathEscape(code), token.Value, &invite)
+	if err != nil {
+		fmt.Println(err)
+		noticePage("Invite not valid", "This invite has expired, was used up or revoked.").Render(r.Context(), w)
+		return
+	}
+	err = invitePage(invite.Community, code).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+	}
+}
+
+func handelJoinWithInvite(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/joinCommunity", http.StatusSeeOther)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	payload := map[string]string{"code": r.Form.Get("code")}
+	err = apiRequest("POST", "/joinWithInvite", token.Value, payload)
+	if err != nil {
+		fmt.Println(err)
+		noticePage("Could not join", "This invite has expired, was used up or revoked.").Render(r.Context(), w)
+		return
+	}
+	log.Println("Community joined with invite")
+	http.Redirect(w, r, "/myCommunities", http.StatusSeeOther)
+}
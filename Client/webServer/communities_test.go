@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestCommunityPage(t *testing.T) {
+	api := newFakeAPI(t)
+	banned := 9
+	members := CommunityMembers{
+		Community: Community{ID: 3, Name: "garden", Visibility: "request"},
+		Role:      "moderator",
+		Members: []Member{
+			{UserID: 2, Username: "owner", Role: "owner"},
+			{UserID: 1, Username: "ada", Role: "moderator"},
+			{UserID: 4, Username: "bob", Role: "member"},
+		},
+	}
+	api.reply("GET", "/community/3/members", http.StatusOK, members)
+	api.reply("GET", "/community/3/bans", http.StatusOK, []Ban{{UserID: 9, Reason: "spam"}})
+	api.reply("GET", "/community/3/moderation", http.StatusOK, moderationLog{Items: []ModerationAction{
+		{Action: "ban", ActorID: 1, TargetUserID: &banned, Reason: "spam", CreatedAt: "2026-03-04T10:20:00Z"},
+	}})
+	api.reply("GET", "/community/3/joinRequests", http.StatusOK, []JoinRequest{{ID: 6, Username: "cat", Message: "I live next door"}})
+	api.reply("GET", "/community/3/invites", http.StatusOK, []Invite{{ID: 5, Code: "abc123", MaxUses: 3, Uses: 1}})
+
+	rec := get(communityPageHandler, "/community?communityID=3")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, "<h1>garden</h1>", "Your role: moderator", "cat", "I live next door", `name="request_id" value="6"`,
+		`href="/invite?code=abc123"`, " used 1", " of 3", "User 9: spam", "26/03/04 10:20: user 1 ban", " user 9", " (spam)",
+		`name="user_id" value="4"`, `action="/handelLeaveCommunity"`)
+	// moderators act on members only, and only the owner hands out roles
+	wantNoHTML(t, rec, `name="user_id" value="2"`, `value="promote"`, `value="transfer"`, `value="visibility"`)
+
+	members.Role = "owner"
+	api.reply("GET", "/community/3/members", http.StatusOK, members)
+	rec = get(communityPageHandler, "/community?communityID=3")
+	wantHTML(t, rec, `value="promote"`, `value="demote"`, `value="transfer"`, `<option value="request" selected>`)
+	wantNoHTML(t, rec, `action="/handelLeaveCommunity"`)
+
+	// members see who else is in it and nothing to moderate
+	members.Role = "member"
+	api.reply("GET", "/community/3/members", http.StatusOK, members)
+	calls := len(api.requests("GET", "/community/3/bans"))
+	rec = get(communityPageHandler, "/community?communityID=3")
+	wantHTML(t, rec, "bob", `action="/handelLeaveCommunity"`)
+	wantNoHTML(t, rec, "Join Requests", "/handelModerate")
+	if len(api.requests("GET", "/community/3/bans")) != calls {
+		t.Fatal("the bans were loaded for a member")
+	}
+
+	api.reply("GET", "/community/3/members", http.StatusForbidden, map[string]string{"error": "user does not belong to community"})
+	wantRedirect(t, get(communityPageHandler, "/community?communityID=3"), http.StatusSeeOther, "/myCommunities")
+}
+
+func TestModerate(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("POST", "/community/3/kick", http.StatusOK, map[string]string{})
+	api.reply("POST", "/community/3/invites", http.StatusOK, map[string]string{})
+
+	rec := postForm(handelModerate, "/handelModerate", url.Values{
+		"communityID": {"3"}, "action": {"kick"}, "user_id": {"4"}, "reason": {"rude"}, "request_id": {"6"},
+	})
+	wantRedirect(t, rec, http.StatusSeeOther, "/community?communityID=3")
+	call := api.called("POST", "/community/3/kick")
+	if len(call.Body) != 2 || call.Body["user_id"] != "4" || call.Body["reason"] != "rude" {
+		t.Fatalf("unexpected kick %v", call.Body)
+	}
+
+	postForm(handelModerate, "/handelModerate", url.Values{"communityID": {"3"}, "action": {"invites"}, "max_uses": {"3"}})
+	if call := api.called("POST", "/community/3/invites"); call.Body["max_uses"] != "3" || call.Body["expires_in_hours"] != "" {
+		t.Fatalf("unexpected invite %v", call.Body)
+	}
+
+	// only the actions of the community page are passed on
+	rec = postForm(handelModerate, "/handelModerate", url.Values{"communityID": {"3"}, "action": {"removePost"}})
+	wantRedirect(t, rec, http.StatusSeeOther, "/community?communityID=3")
+	if len(api.requests("POST", "/community/3/removePost")) != 0 {
+		t.Fatal("an unknown action was passed on")
+	}
+}
+
+func TestLeaveCommunity(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("POST", "/community/3/leave", http.StatusOK, map[string]string{})
+	wantRedirect(t, postForm(handelLeaveCommunity, "/handelLeaveCommunity", url.Values{"communityID": {"3"}}),
+		http.StatusSeeOther, "/myCommunities")
+	api.reply("POST", "/community/3/leave", http.StatusBadRequest, map[string]string{"error": "the owner can not leave"})
+	wantRedirect(t, postForm(handelLeaveCommunity, "/handelLeaveCommunity", url.Values{"communityID": {"3"}}),
+		http.StatusSeeOther, "/community?communityID=3")
+
+	api.reply("GET", "/userCommunities", http.StatusOK, []Community{{ID: 3, Name: "garden"}})
+	wantHTML(t, get(myCommunitiesHandler, "/myCommunities"), "garden", `href="/community?communityID=3"`)
+}
+
+func TestRemovePost(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("POST", "/community/3/removePost", http.StatusOK, map[string]string{})
+
+	rec := postForm(handelRemovePost, "/handelRemovePost", url.Values{
+		"communityID": {"3"}, "kind": {"request"}, "postID": {"7"}, "reason": {"spam"},
+	})
+	wantRedirect(t, rec, http.StatusSeeOther, "/requests")
+	if call := api.called("POST", "/community/3/removePost"); call.Body["kind"] != "request" || call.Body["id"] != "7" ||
+		call.Body["reason"] != "spam" {
+		t.Fatalf("unexpected removal %v", call.Body)
+	}
+	rec = postForm(handelRemovePost, "/handelRemovePost", url.Values{"communityID": {"3"}, "kind": {"offer"}, "postID": {"5"}})
+	wantRedirect(t, rec, http.StatusSeeOther, "/")
+}
+
+func TestInvite(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("GET", "/invite/abc 123", http.StatusOK, map[string]Community{"community": {ID: 3, Name: "garden"}})
+
+	rec := get(invitePageHandler, "/invite?code=abc+123")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, "<h1>garden</h1>", `name="code" value="abc 123"`)
+	wantHTML(t, get(invitePageHandler, "/invite?code=gone"), "Invite not valid")
+
+	api.reply("POST", "/joinWithInvite", http.StatusOK, map[string]string{})
+	rec = postForm(handelJoinWithInvite, "/handelJoinWithInvite", url.Values{"code": {"abc 123"}})
+	wantRedirect(t, rec, http.StatusSeeOther, "/myCommunities")
+	if call := api.called("POST", "/joinWithInvite"); call.Body["code"] != "abc 123" {
+		t.Fatalf("unexpected join %v", call.Body)
+	}
+	api.reply("POST", "/joinWithInvite", http.StatusBadRequest, map[string]string{"error": "invite has been used up"})
+	wantHTML(t, postForm(handelJoinWithInvite, "/handelJoinWithInvite", url.Values{"code": {"abc 123"}}), "Could not join")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// Config is everything the web client can be configured with. APIURL is
+// where this server reaches the api, which need not be the address browsers
+// use for it.
+type Config struct {
+	ListenAddr string `json:"listen_addr"`
+	APIURL     string `json:"api_url"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		ListenAddr: "127.0.0.1:8080",
+		APIURL:     "http://127.0.0.1:8000",
+	}
+}
+
+// loadConfig builds the configuration from the defaults, then the JSON file
+// named by -config or COMRADARY_WEB_CONFIG, then COMRADARY_WEB_*
+// environment variables and last the command line flags.
+func loadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+	var flagCfg Config
+	flags := flag.NewFlagSet("webServer", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("COMRADARY_WEB_CONFIG"), "path of a JSON config file")
+	flags.StringVar(&flagCfg.ListenAddr, "listen", "", "address to listen on")
+	flags.StringVar(&flagCfg.APIURL, "api-url", "", "where the api is reachable")
+	err := flags.Parse(args)
+	if err != nil {
+		return cfg, err
+	}
+	if *configPath != "" {
+		file, err := os.Open(*configPath)
+		if err != nil {
+			return cfg, fmt.Errorf("error opening config file: %v", err)
+		}
+		defer file.Close()
+		decoder := json.NewDecoder(file)
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("error reading config file %v: %v", *configPath, err)
+		}
+	}
+	if value := os.Getenv("COMRADARY_WEB_LISTEN_ADDR"); value != "" {
+		cfg.ListenAddr = value
+	}
+	if value := os.Getenv("COMRADARY_WEB_API_URL"); value != "" {
+		cfg.APIURL = value
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.ListenAddr = flagCfg.ListenAddr
+		case "api-url":
+			cfg.APIURL = flagCfg.APIURL
+		}
+	})
+	return cfg, cfg.validate()
+}
+
+func (cfg Config) validate() error {
+	var errs []error
+	if cfg.ListenAddr == "" {
+		errs = append(errs, errors.New("listen_addr is required"))
+	}
+	u, err := url.Parse(cfg.APIURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("api_url must be an http or https URL, got %q", cfg.APIURL))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{"listen_addr": ":9000", "api_url": "http://file.test"}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("COMRADARY_WEB_CONFIG", "")
+	t.Setenv("COMRADARY_WEB_LISTEN_ADDR", "")
+	t.Setenv("COMRADARY_WEB_API_URL", "")
+
+	cfg, err := loadConfig(nil)
+	if err != nil || cfg != defaultConfig() {
+		t.Fatalf("got %+v, %v, want the defaults", cfg, err)
+	}
+
+	// flags win over the environment, which wins over the file
+	t.Setenv("COMRADARY_WEB_API_URL", "https://env.test")
+	cfg, err = loadConfig([]string{"-config", path})
+	if err != nil || cfg.ListenAddr != ":9000" || cfg.APIURL != "https://env.test" {
+		t.Fatalf("got %+v, %v", cfg, err)
+	}
+	cfg, err = loadConfig([]string{"-config", path, "-api-url", "http://flag.test"})
+	if err != nil || cfg.APIURL != "http://flag.test" {
+		t.Fatalf("got %+v, %v", cfg, err)
+	}
+
+	_, err = loadConfig([]string{"-api-url", "api.test"})
+	if err == nil || !strings.Contains(err.Error(), "api_url must be an http or https URL") {
+		t.Fatalf("got %v for an api url without a scheme", err)
+	}
+	os.WriteFile(path, []byte(`{"api": "http://file.test"}`), 0o600)
+	_, err = loadConfig([]string{"-config", path})
+	if err == nil || !strings.Contains(err.Error(), "unknown field") {
+		t.Fatalf("got %v for an unknown field", err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		error string
+	}{
+		{"no listen address", nil, []string{"-listen", ""}, "listen_addr is required"},
+		{"api url without a scheme", map[string]string{"COMRADARY_WEB_API_URL": "api.test"}, nil, "api_url must be an http or https URL"},
+		{"api url without a host", nil, []string{"-api-url", "http://"}, "api_url must be an http or https URL"},
+		{"api url of another scheme", nil, []string{"-api-url", "ftp://api.test"}, "api_url must be an http or https URL"},
+		{"missing file", map[string]string{"COMRADARY_WEB_CONFIG": filepath.Join(t.TempDir(), "missing.json")}, nil,
+			"error opening config file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("COMRADARY_WEB_CONFIG", "")
+			t.Setenv("COMRADARY_WEB_LISTEN_ADDR", "")
+			t.Setenv("COMRADARY_WEB_API_URL", "")
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			_, err := loadConfig(test.args)
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("got error %v, want one containing %q", err, test.error)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiEvent is one server-sent event read from the api's /events stream.
+type apiEvent struct {
+	Type string
+	Data string
+}
+
+// streamAPIEvents reads the /events stream of the user until the context is
+// done or the api closes the stream, calling handle for every event.
+func streamAPIEvents(ctx context.Context, token string, handle func(apiEvent) error) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL+"/events", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error: %v", resp.Status)
+	}
+	var event apiEvent
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event.Type != "" {
+				err = handle(event)
+				if err != nil {
+					return err
+				}
+			}
+			event = apiEvent{}
+		case strings.HasPrefix(line, "event:"):
+			event.Type = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if event.Data != "" {
+				event.Data += "\n"
+			}
+			event.Data += strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+		}
+	}
+	return scanner.Err()
+}
+
+// writeSSE writes a server-sent event to the browser, splitting data over as
+// many data lines as it needs.
+func writeSSE(w http.ResponseWriter, event string, data string) error {
+	var b strings.Builder
+	b.WriteString("event: " + event + "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	_, err := w.Write([]byte(b.String()))
+	if err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// chatEventsHandler passes the messages, read receipts and typing notes about
+// one offer or request on to the browser as they arrive, rendered for the
+// htmx sse extension. Each event is named after the other user, like
+// "message-<other user id>", so the open chat box only picks up the
+// conversation it shows. The chat box still polls, so messages missed while
+// the stream was down show up eventually.
+func chatEventsHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		http.Error(w, "not signed in", http.StatusUnauthorized)
+		return
+	}
+	tokenID, err := r.Cookie("token_id")
+	if err != nil {
+		http.Error(w, "not signed in", http.StatusUnauthorized)
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	offerID := r.URL.Query().Get("offerID")
+	requestID := r.URL.Query().Get("requestID")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	err = streamAPIEvents(r.Context(), token.Value, func(event apiEvent) error {
+		switch event.Type {
+		case "message":
+			var m MessageFromServer
+			err := json.Unmarshal([]byte(event.Data), &m)
+			if err != nil {
+				fmt.Println(err)
+				return nil
+			}
+			// the sender's own chat box is refreshed by the reply to the send form
+			if !postMatches(offerID, requestID, m.OfferID, m.RequestID) || strconv.Itoa(m.SenderID) == tokenID.Value {
+				return nil
+			}
+			var html bytes.Buffer
+			err = chatMessage(Message{Text: m.Text, OfferID: m.OfferID}).Render(r.Context(), &html)
+			if err != nil {
+				return err
+			}
+			return writeSSE(w, "message-"+strconv.Itoa(m.SenderID), html.String())
+		case "read", "typing":
+			var e struct {
+				OfferID   int `json:"offer_id"`
+				RequestID int `json:"request_id"`
+				ReaderID  int `json:"reader_id"`
+				SenderID  int `json:"sender_id"`
+			}
+			err := json.Unmarshal([]byte(event.Data), &e)
+			if err != nil {
+				fmt.Println(err)
+				return nil
+			}
+			if !postMatches(offerID, requestID, e.OfferID, e.RequestID) {
+				return nil
+			}
+			if event.Type == "read" {
+				// the chat box reloads on this event to show the receipts
+				return writeSSE(w, "read-"+strconv.Itoa(e.ReaderID), "read")
+			}
+			var html bytes.Buffer
+			err = typingNote().Render(r.Context(), &html)
+			if err != nil {
+				return err
+			}
+			return writeSSE(w, "typing-"+strconv.Itoa(e.SenderID), html.String())
+		}
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		fmt.Println("Error streaming events: ", err)
+	}
+}
+
+// postMatches tells whether an event is about the offer or request the chat
+// is open for.
+func postMatches(offerID string, requestID string, eventOfferID int, eventRequestID int) bool {
+	if requestID != "" {
+		return strconv.Itoa(eventRequestID) == requestID
+	}
+	return strconv.Itoa(eventOfferID) == offerID
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// postPage is the page of the offer or request a gallery belongs to.
+func postPage(kind string, postID string) string {
+	if kind == "request" {
+		return "/viewRequest?requestID=" + postID
+	}
+	return "/viewOffer?offerID=" + postID
+}
+
+// movedOrder lists the photo ids, comma separated, with the i-th photo moved
+// by delta places.
+func movedOrder(photos []Photo, i int, delta int) string {
+	ids := make([]string, len(photos))
+	for j, photo := range photos {
+		ids[j] = strconv.Itoa(photo.ID)
+	}
+	k := i + delta
+	if k >= 0 && k < len(ids) {
+		ids[i], ids[k] = ids[k], ids[i]
+	}
+	return strings.Join(ids, ",")
+}
+
+// galleryPath is the api path of the photos of a post, or of one of them.
+func galleryPath(r *http.Request, rest string) string {
+	return "/" + r.Form.Get("kind") + "/" + r.Form.Get("postID") + "/photos" + rest
+}
+
+func handelAddPhotos(w http.ResponseWriter, r *http.Request) {
+	MAX_FORM_SIZE := int64(10 << 20) // 10MB
+	err := r.ParseMultipartForm(MAX_FORM_SIZE)
+	if err != nil {
+		fmt.Println("error parsing multipart form: ", err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	imageIDs, err := uploadImages(r, token.Value)
+	if err != nil {
+		fmt.Println(err)
+	}
+	if len(imageIDs) > 0 {
+		payload := map[string]string{
+			"image_ids": strings.Join(imageIDs, ","),
+			"caption":   r.Form.Get("caption"),
+		}
+		err = apiRequest("POST", galleryPath(r, ""), token.Value, payload)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	http.Redirect(w, r, postPage(r.Form.Get("kind"), r.Form.Get("postID")), http.StatusSeeOther)
+}
+
+func handelCaptionPhoto(w http.ResponseWriter, r *http.Request) {
+	galleryAction(w, r, "PUT", "/"+r.FormValue("photoID"), map[string]string{"caption": r.FormValue("caption")})
+}
+
+func handelMovePhoto(w http.ResponseWriter, r *http.Request) {
+	galleryAction(w, r, "POST", "/order", map[string]string{"photo_ids": r.FormValue("order")})
+}
+
+func handelRemovePhoto(w http.ResponseWriter, r *http.Request) {
+	galleryAction(w, r, "DELETE", "/"+r.FormValue("photoID"), map[string]string{})
+}
+
+// galleryAction sends a change to the gallery of the post in the form to the
+// api and takes the user back to the post.
+func galleryAction(w http.ResponseWriter, r *http.Request, method string, rest string, payload map[string]string) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	err = apiRequest(method, galleryPath(r, rest), token.Value, payload)
+	if err != nil {
+		fmt.Println(err)
+	}
+	http.Redirect(w, r, postPage(r.Form.Get("kind"), r.Form.Get("postID")), http.StatusSeeOther)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type ConversationSummary struct {
+	ID            int                `json:"id"`
+	OfferID       *int               `json:"offer_id"`
+	RequestID     *int               `json:"request_id"`
+	PostTitle     string             `json:"post_title"`
+	OtherUserID   int                `json:"other_user_id"`
+	OtherUserName string             `json:"other_user_name"`
+	LastMessage   *MessageFromServer `json:"last_message"`
+	LastMessageAt *string            `json:"last_message_at"`
+	Unread        int                `json:"unread"`
+}
+
+// postURL links to the offer or request the conversation is about.
+func (c ConversationSummary) postURL() string {
+	if c.RequestID != nil {
+		return "/viewRequest?requestID=" + strconv.Itoa(*c.RequestID)
+	}
+	if c.OfferID != nil {
+		return "/viewOffer?offerID=" + strconv.Itoa(*c.OfferID)
+	}
+	return "/"
+}
+
+// postField returns the id of the post for the chat form field.
+func postField(id *int) string {
+	if id == nil {
+		return ""
+	}
+	return strconv.Itoa(*id)
+}
+
+// chatMessages prepares the messages of a conversation for the chat box.
+func chatMessages(messages []MessageFromServer, otherUserID string) []Message {
+	var chat []Message
+	for _, m := range messages {
+		msg := Message{Text: m.Text, OfferID: m.OfferID, isMyMsg: strconv.Itoa(m.SenderID) != otherUserID}
+		if msg.isMyMsg {
+			switch {
+			case m.ReadAt != nil:
+				msg.Status = "Read"
+			case m.DeliveredAt != nil:
+				msg.Status = "Delivered"
+			default:
+				msg.Status = "Sent"
+			}
+		}
+		chat = append(chat, msg)
+	}
+	return chat
+}
+
+// markMessagesRead marks the conversation read if the other user sent any
+// of the messages that are still unread.
+func markMessagesRead(token string, messages []MessageFromServer, otherUserID string) {
+	for _, m := range messages {
+		if strconv.Itoa(m.SenderID) == otherUserID && m.ReadAt == nil && m.ConversationID != nil {
+			err := apiRequest("POST", "/conversations/"+strconv.Itoa(*m.ConversationID)+"/read", token,
+				map[string]string{})
+			if err != nil {
+				fmt.Println(err)
+			}
+			return
+		}
+	}
+}
+
+// unreadBySender counts the unread messages about a post by who sent them.
+func unreadBySender(token string, offerID string, requestID string) map[int]int {
+	query := url.Values{"offerID": {offerID}}
+	if requestID != "" {
+		query = url.Values{"requestID": {requestID}}
+	}
+	conversations := []ConversationSummary{}
+	err := apiGet("/conversations?"+query.Encode(), token, &conversations)
+	if err != nil {
+		fmt.Println(err)
+	}
+	unread := map[int]int{}
+	for _, c := range conversations {
+		unread[c.OtherUserID] += c.Unread
+	}
+	return unread
+}
+
+func unreadBadgeHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		return
+	}
+	var count struct {
+		Unread int `json:"unread"`
+	}
+	err = apiGet("/unread", token.Value, &count)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = unreadBadge(count.Unread).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func handelTyping(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		return
+	}
+	payload := map[string]string{
+		"receiver_id": r.Form.Get("otherUserID"),
+		"offer_id":    r.Form.Get("offerID"),
+		"request_id":  r.Form.Get("requestID"),
+	}
+	err = apiRequest("POST", "/typing", token.Value, payload)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func inboxHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	conversations := []ConversationSummary{}
+	err = apiGet("/conversations", token.Value, &conversations)
+	if err != nil {
+		fmt.Println(err)
+	}
+	for i, c := range conversations {
+		if c.LastMessageAt != nil {
+			lastMessageAt := convertTime(*c.LastMessageAt)
+			conversations[i].LastMessageAt = &lastMessageAt
+		}
+	}
+	err = inboxPage(conversations).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+	}
+}
+
+func conversationPageHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	var conversation struct {
+		Conversation ConversationSummary `json:"conversation"`
+		Messages     []MessageFromServer `json:"messages"`
+	}
+	err = apiGet("/conversations/"+r.URL.Query().Get("id"), token.Value, &conversation)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/inbox", http.StatusSeeOther)
+		return
+	}
+	otherUserID := strconv.Itoa(conversation.Conversation.OtherUserID)
+	markMessagesRead(token.Value, conversation.Messages, otherUserID)
+	messages := chatMessages(conversation.Messages, otherUserID)
+	err = conversationPage(conversation.Conversation, messages).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+	}
+}
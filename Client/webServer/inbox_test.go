@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestInbox(t *testing.T) {
+	api := newFakeAPI(t)
+	offerID, requestID := 5, 6
+	at := "2026-03-04T10:20:00Z"
+	api.reply("GET", "/conversations", http.StatusOK, []ConversationSummary{
+		{ID: 7, OfferID: &offerID, PostTitle: "Red bike", OtherUserName: "bob", Unread: 2,
+			LastMessage: &MessageFromServer{Text: "is it still there?"}, LastMessageAt: &at},
+		{ID: 8, RequestID: &requestID, PostTitle: "Ladder", OtherUserName: "cat"},
+	})
+
+	rec := get(inboxHandler, "/inbox")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, `href="/conversation?id=7"`, "bob about Red bike", " (2 new)", "is it still there?", "26/03/04 10:20",
+		"cat about Ladder")
+
+	api.reply("GET", "/unread", http.StatusOK, map[string]int{"unread": 3})
+	wantHTML(t, get(unreadBadgeHandler, "/unreadBadge"), "<b>(3)</b>")
+	api.reply("GET", "/unread", http.StatusOK, map[string]int{"unread": 0})
+	if rec := get(unreadBadgeHandler, "/unreadBadge"); rec.Body.Len() != 0 {
+		t.Fatalf("the badge shows %q without unread messages", rec.Body.String())
+	}
+}
+
+func TestConversationPage(t *testing.T) {
+	api := newFakeAPI(t)
+	requestID, conversationID := 6, 8
+	api.reply("GET", "/conversations/8", http.StatusOK, map[string]interface{}{
+		"conversation": ConversationSummary{ID: 8, RequestID: &requestID, PostTitle: "Ladder", OtherUserID: 3, OtherUserName: "cat"},
+		"messages": []MessageFromServer{
+			{Text: "I have one", SenderID: 3, ReceiverID: 1, RequestID: 6, ConversationID: &conversationID},
+			{Text: "great", SenderID: 1, ReceiverID: 3, RequestID: 6, ConversationID: &conversationID},
+		},
+	})
+	api.reply("POST", "/conversations/8/read", http.StatusOK, map[string]string{})
+
+	rec := get(conversationPageHandler, "/conversation?id=8")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, "<h1 style=\"color: #ffffff;\">cat</h1>", `href="/viewRequest?requestID=6"`, "I have one", "great", "Sent",
+		`sse-connect="/chatEvents?offerID=&amp;requestID=6"`, `id="otherUserID" name="otherUserID" value="3"`)
+	api.called("POST", "/conversations/8/read")
+
+	wantRedirect(t, get(conversationPageHandler, "/conversation?id=9"), http.StatusSeeOther, "/inbox")
+}
+
+func TestTyping(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("POST", "/typing", http.StatusOK, map[string]string{})
+	rec := postForm(handelTyping, "/handelTyping", url.Values{"otherUserID": {"2"}, "requestID": {"6"}})
+	wantStatus(t, rec, http.StatusOK)
+	if call := api.called("POST", "/typing"); call.Body["receiver_id"] != "2" || call.Body["request_id"] != "6" ||
+		call.Body["offer_id"] != "" {
+		t.Fatalf("unexpected typing %v", call.Body)
+	}
+}
+
+func TestChatEvents(t *testing.T) {
+	api := newFakeAPI(t)
+	events := []string{
+		`{"Text": "is it still there?", "SenderID": 2, "ReceiverID": 1, "OfferID": 5}`,
+		`{"Text": "about something else", "SenderID": 2, "ReceiverID": 1, "OfferID": 4}`,
+		`{"Text": "my own message", "SenderID": 1, "ReceiverID": 2, "OfferID": 5}`,
+	}
+	api.handle("GET", "/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: ready\ndata: {}\n\n")
+		for _, message := range events {
+			fmt.Fprintf(w, "event: message\ndata: %v\n\n", message)
+		}
+		fmt.Fprint(w, "event: read\ndata: {\"offer_id\": 5, \"reader_id\": 2}\n\n")
+		fmt.Fprint(w, "event: typing\ndata: {\"offer_id\": 5, \"sender_id\": 3}\n\n")
+		fmt.Fprint(w, "event: typing\ndata: {\"request_id\": 5, \"sender_id\": 4}\n\n")
+	})
+
+	// the handler returns once the api ends the stream
+	rec := get(chatEventsHandler, "/chatEvents?offerID=5")
+	wantStatus(t, rec, http.StatusOK)
+	if rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected Content-Type %q", rec.Header().Get("Content-Type"))
+	}
+	if call := api.called("GET", "/events"); call.Token != testToken {
+		t.Fatalf("the stream was opened with %q", call.Token)
+	}
+	var names []string
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, "event: ") {
+			names = append(names, strings.TrimPrefix(line, "event: "))
+		}
+	}
+	if fmt.Sprint(names) != "[message-2 read-2 typing-3]" {
+		t.Fatalf("got the events %v", names)
+	}
+	wantHTML(t, rec, "is it still there?")
+	wantNoHTML(t, rec, "about something else", "my own message")
+
+	rec = httptest.NewRecorder()
+	chatEventsHandler(rec, httptest.NewRequest("GET", "/chatEvents?offerID=5", nil))
+	wantStatus(t, rec, http.StatusUnauthorized)
+}
@@ -8,18 +8,27 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/a-h/templ"
 )
 
-var (
-	apiURL = "http://127.0.0.1:8000"
-)
+// apiURL is where the api is reachable, set from the Config in main.
+var apiURL string
 
+// Photo links come signed from the api and stop working after an hour, so
+// they are never stored, only rendered.
 type Photo struct {
-	ID int
+	ID          int
+	Position    int    `json:"position"`
+	Caption     string `json:"caption"`
+	ThumbURL    string `json:"thumb_url"`
+	URL         string `json:"url"`
+	OriginalURL string `json:"original_url"`
 }
 
 type Offer struct {
@@ -28,15 +37,18 @@ type Offer struct {
 	Description   string
 	User          string
 	Photos        []Photo
-	CommunityName string
+	CommunityName string `json:"community_name"`
+	CommunityID   int    `json:"community_id"`
 	CreatedAt     string
-	UserID        int `json:"user_id"`
+	UserID        int    `json:"user_id"`
+	Status        string `json:"status"`
 }
 
 type Community struct {
-	Name    string
-	Country string
-	ID      int
+	Name       string
+	Country    string
+	ID         int
+	Visibility string
 }
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -75,22 +87,31 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token := resp.Header.Get("token")
-	id := resp.Header.Get("token_id")
-	fmt.Printf("Token: %v, ID: %v", token, id)
-	http.SetCookie(w, &http.Cookie{Name: "token", Value: string(token)})
-	http.SetCookie(w, &http.Cookie{Name: "token_id", Value: string(id)})
+	setSessionCookies(w, resp)
 	log.Println("Login successful")
+	var signIn struct {
+		User struct {
+			EmailVerifiedAt *string `json:"email_verified_at"`
+		} `json:"user"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&signIn)
+	if err == nil && signIn.User.EmailVerifiedAt == nil {
+		http.Redirect(w, r, "/verifyNotice", http.StatusSeeOther)
+		return
+	}
 	http.Redirect(w, r, "/", http.StatusPermanentRedirect)
 
 }
 
 func handelLogout(w http.ResponseWriter, r *http.Request) {
+	err := signOut(r)
+	if err != nil {
+		fmt.Println(err)
+	}
 	//delete cookies
-	http.SetCookie(w, &http.Cookie{Name: "token", Value: "", MaxAge: -1})
-	http.SetCookie(w, &http.Cookie{Name: "token_id", Value: "", MaxAge: -1})
+	clearSessionCookies(w)
 	//render login offerPage
-	err := userLoginPage().Render(r.Context(), w)
+	err = userLoginPage().Render(r.Context(), w)
 	if err != nil {
 		fmt.Println(err)
 		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
@@ -101,133 +122,185 @@ type ImgResponse struct {
 	ImageID string `json:"imageID"`
 }
 
+// uploadImages forwards every file of the "image" form field to the api and
+// returns the ids of the stored images in the order they were picked.
+func uploadImages(r *http.Request, token string) ([]string, error) {
+	var imageIDs []string
+	for _, file := range r.MultipartForm.File["image"] {
+		imageID, err := uploadImage(file, token)
+		if err != nil {
+			return imageIDs, err
+		}
+		imageIDs = append(imageIDs, imageID)
+	}
+	return imageIDs, nil
+}
+
+// uploadImage forwards one uploaded file to the api and returns the id of the
+// stored image.
+func uploadImage(file *multipart.FileHeader, token string) (string, error) {
+	var imgresp ImgResponse
+	var b bytes.Buffer
+	writer := multipart.NewWriter(&b)
+	imageWriter, err := writer.CreateFormFile("image", file.Filename)
+	if err != nil {
+		return "", err
+	}
+	image, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(imageWriter, image)
+	image.Close()
+	if err != nil {
+		return "", err
+	}
+	writer.Close()
+	req, err := http.NewRequest("POST", apiURL+"/image", &b)
+	if err != nil {
+		return "", err
+	}
+	defer req.Body.Close()
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error uploading image: %v", resp.Status)
+	}
+	fmt.Println("Image uploaded")
+	err = json.NewDecoder(resp.Body).Decode(&imgresp)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Image ID: %v\n", imgresp.ImageID)
+	return imgresp.ImageID, nil
+}
+
 func createOffer(w http.ResponseWriter, r *http.Request) {
+	createPost(w, r, "/offers", "/createOffer")
+}
+
+func createRequest(w http.ResponseWriter, r *http.Request) {
+	createPost(w, r, "/requests", "/createRequest")
+}
+
+// createPost uploads the optional images of a create offer or create request
+// form and then posts the form to the given api endpoint.
+func createPost(w http.ResponseWriter, r *http.Request, endpoint string, formPage string) {
 	var resp *http.Response
 	var err error
 	var req *http.Request
-	var imgresp ImgResponse
 	client := &http.Client{}
 	MAX_FORM_SIZE := int64(10 ^ 6*10) // 10MB
 	//parse multipart Form
 
 	err = r.ParseMultipartForm(MAX_FORM_SIZE)
-	fmt.Println("Create Offer")
+	fmt.Println("Create Post")
 	if err != nil {
 		fmt.Println("error parsing multipart form: ", err)
-		http.Redirect(w, r, "/createOffer", http.StatusTemporaryRedirect)
+		http.Redirect(w, r, formPage, http.StatusTemporaryRedirect)
 		return
 	}
-	token, err := r.Cookie("token")
+	token, err := sessionToken(w, r)
 	if err != nil {
 		fmt.Println(err)
 		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
 		return
 	}
-	id, err := r.Cookie("token_id")
+	//Upload images to server
+	imageIDs, err := uploadImages(r, token.Value)
 	if err != nil {
 		fmt.Println(err)
-		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		http.Redirect(w, r, formPage, http.StatusTemporaryRedirect)
 		return
 	}
-	fmt.Printf("Token: %v, ID: %v", token.Value, id)
-
-	//Upload image to server
-	var b bytes.Buffer
-	writer := multipart.NewWriter(&b)
-	if len(r.MultipartForm.File["image"]) > 0 {
-		//check if file is an image
-		imageWriter, err := writer.CreateFormFile("image", r.MultipartForm.File["image"][0].Filename)
-		image, fileErr := r.MultipartForm.File["image"][0].Open()
-		if err != nil || fileErr != nil {
-			fmt.Println(err)
-			http.Redirect(w, r, "/createOffer", http.StatusTemporaryRedirect)
-			return
-		}
-		_, err = io.Copy(imageWriter, image)
-		image.Close()
-		if err != nil {
-			fmt.Println(err)
-			http.Redirect(w, r, "/createOffer", http.StatusTemporaryRedirect)
-			return
-		}
-		writer.Close()
-		req, err = http.NewRequest("POST", apiURL+"/image", &b)
-		if err != nil {
-			fmt.Println(err)
-			http.Redirect(w, r, "/createOffer", http.StatusTemporaryRedirect)
-			return
-		}
-		defer req.Body.Close()
-		req.Header.Set("Content-Type", writer.FormDataContentType())
-		req.Header.Set("token", token.Value)
-		resp, err = client.Do(req)
-		if err != nil {
-			fmt.Println(err)
-			http.Redirect(w, r, "/createOffer", http.StatusTemporaryRedirect)
-			return
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			fmt.Println("Error: ", resp.Status)
-			http.Redirect(w, r, "/createOffer", http.StatusTemporaryRedirect)
-			return
-		}
-		fmt.Println("Image uploaded")
-		// get image id
-		//bind response to struct
-		err = json.NewDecoder(resp.Body).Decode(&imgresp)
-		if err != nil {
-			fmt.Println(err)
-			http.Redirect(w, r, "/createOffer", http.StatusTemporaryRedirect)
-			return
-		}
-		fmt.Printf("Image ID: %v\n", imgresp.ImageID)
-	} else {
-		fmt.Println(err)
-		imgresp.ImageID = " "
-	}
-
-	// get image id
 
 	// create Request
-	fmt.Printf("Form: %v\n", r.Body)
-	// convert id from string to uint
 	payload := map[string]string{
 		"title":        r.MultipartForm.Value["title"][0],
 		"description":  r.MultipartForm.Value["description"][0],
-		"user_id":      id.Value,
 		"community_id": r.MultipartForm.Value["community_id"][0],
-		"user_token":   token.Value,
-		"image_id":     imgresp.ImageID,
+		"image_ids":    strings.Join(imageIDs, ","),
 	}
 	fmt.Printf("Payload: %v\n", payload)
 	encodedPayload := map2json(payload)
 
-	req, err = http.NewRequest("POST", apiURL+"/offers", bytes.NewBuffer(encodedPayload))
+	req, err = http.NewRequest("POST", apiURL+endpoint, bytes.NewBuffer(encodedPayload))
 	if err != nil {
 		fmt.Println(err)
-		http.Redirect(w, r, "/createOffer", http.StatusTemporaryRedirect)
+		http.Redirect(w, r, formPage, http.StatusTemporaryRedirect)
 		return
 	}
 	defer req.Body.Close()
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token.Value)
 	resp, err = client.Do(req)
 	if err != nil {
 		fmt.Println(err)
-		http.Redirect(w, r, "/createOffer", http.StatusTemporaryRedirect)
+		http.Redirect(w, r, formPage, http.StatusTemporaryRedirect)
 		return
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		fmt.Println("Error: ", resp.Status)
-		http.Redirect(w, r, "/createOffer", http.StatusTemporaryRedirect)
+		http.Redirect(w, r, formPage, http.StatusTemporaryRedirect)
 		return
 	}
-	log.Println("Offer created")
+	log.Println("Post created")
 	http.Redirect(w, r, "/", http.StatusPermanentRedirect)
 
 }
 
+// apiRequest sends a json payload to the api on behalf of the user the token
+// belongs to, or anonymously if the token is empty, and returns an error
+// unless the api answers with 200.
+func apiRequest(method string, path string, token string, payload map[string]string) error {
+	req, err := http.NewRequest(method, apiURL+path, bytes.NewBuffer(map2json(payload)))
+	if err != nil {
+		return err
+	}
+	defer req.Body.Close()
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error: %v", resp.Status)
+	}
+	return nil
+}
+
+// apiGet fetches path from the api on behalf of the user the token belongs to
+// and decodes the json answer into out.
+func apiGet(path string, token string, out interface{}) error {
+	req, err := http.NewRequest("GET", apiURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error: %v", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
 func map2json(m map[string]string) []byte {
 	json, err := json.Marshal(m)
 	if err != nil {
@@ -274,56 +347,101 @@ func handleSignup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Println("Signup successful")
-	http.Redirect(w, r, "/login", http.StatusPermanentRedirect)
+	err = noticePage("Check your email", "We sent you a link to verify your email address. Open it, then log in.").Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+type offerListPage struct {
+	Items      []Offer `json:"items"`
+	NextCursor string  `json:"next_cursor"`
+}
+
+// OfferFilters are the listing filters of the offer page, passed through to
+// the api as query parameters.
+type OfferFilters struct {
+	Keyword  string
+	Sort     string
+	HasPhoto bool
+	Closed   bool
 }
 
-type communityOffer struct {
-	Name   string
-	Offers []Offer
+func offerFiltersFrom(r *http.Request) OfferFilters {
+	query := r.URL.Query()
+	return OfferFilters{
+		Keyword:  query.Get("q"),
+		Sort:     query.Get("sort"),
+		HasPhoto: query.Get("has_photo") == "true",
+		Closed:   query.Get("closed") == "true",
+	}
 }
 
-func getMyOffers(w http.ResponseWriter, r *http.Request) []Offer {
-	token, err := r.Cookie("token")
+func (f OfferFilters) query(cursor string) url.Values {
+	values := url.Values{}
+	if f.Keyword != "" {
+		values.Set("q", f.Keyword)
+	}
+	if f.Sort != "" {
+		values.Set("sort", f.Sort)
+	}
+	if f.HasPhoto {
+		values.Set("has_photo", "true")
+	}
+	if f.Closed {
+		values.Set("closed", "true")
+	}
+	if cursor != "" {
+		values.Set("cursor", cursor)
+	}
+	return values
+}
+
+// nextOffersURL is the url the last offer of a page loads the next page from,
+// or "" if there are no more offers.
+func nextOffersURL(filters OfferFilters, cursor string) string {
+	if cursor == "" {
+		return ""
+	}
+	return "/offerItems?" + filters.query(cursor).Encode()
+}
+
+func getMyOffers(w http.ResponseWriter, r *http.Request, filters OfferFilters, cursor string) ([]Offer, string) {
+	token, err := sessionToken(w, r)
 	if err != nil {
 		fmt.Println(err)
 		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
-		return nil
+		return nil, ""
 	}
 
-	req, err := http.NewRequest("GET", apiURL+"/myOffers/", bytes.NewBuffer([]byte("")))
+	req, err := http.NewRequest("GET", apiURL+"/myOffers?"+filters.query(cursor).Encode(), bytes.NewBuffer([]byte("")))
 	if err != nil {
 		fmt.Println(err)
-		return nil
+		return nil, ""
 	}
 	defer req.Body.Close()
-	req.Header.Set("token", token.Value)
+	req.Header.Set("Authorization", "Bearer "+token.Value)
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		fmt.Println(err)
-		return nil
+		return nil, ""
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		fmt.Println("Error: ", resp.Status)
-		return nil
+		return nil, ""
 	}
-	comOff := []communityOffer{}
-	err = json.NewDecoder(resp.Body).Decode(&comOff)
+	page := offerListPage{}
+	err = json.NewDecoder(resp.Body).Decode(&page)
 	if err != nil {
 		fmt.Println(err)
-		return nil
+		return nil, ""
 	}
-	var allOffers []Offer
-	for _, co := range comOff {
-		offers := co.Offers
-		for _, o := range offers {
-			o.CommunityName = co.Name
-			o.CreatedAt = convertTime(o.CreatedAt)
-			allOffers = append([]Offer{o}, allOffers...)
-		}
+	for i := range page.Items {
+		page.Items[i].CreatedAt = convertTime(page.Items[i].CreatedAt)
 	}
-	return allOffers
+	return page.Items, page.NextCursor
 }
 
 func convertTime(t string) string {
@@ -336,44 +454,48 @@ func convertTime(t string) string {
 	return time.Format("06/01/02 15:04")
 }
 func offerPagehandler(w http.ResponseWriter, r *http.Request) {
-	comOff := getMyOffers(w, r)
-	if comOff == nil {
-		fmt.Println("Error getting offers")
+	filters := offerFiltersFrom(r)
+	comOff, cursor := getMyOffers(w, r, filters, "")
+	if len(comOff) == 0 {
+		fmt.Println("No offers found")
 		comOff = []Offer{}
 		comOff = append(comOff, Offer{Title: "No offers found"})
 	}
 
-	err := offerPage(comOff).Render(r.Context(), w)
+	err := offerPage(comOff, nextOffersURL(filters, cursor), filters).Render(r.Context(), w)
 	if err != nil {
 		fmt.Println(err)
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 	}
 }
 
-func handleJoinCommunity(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+// offerItemsHandler renders the next page of offers for infinite scrolling.
+func offerItemsHandler(w http.ResponseWriter, r *http.Request) {
+	filters := offerFiltersFrom(r)
+	offers, cursor := getMyOffers(w, r, filters, r.URL.Query().Get("cursor"))
+	err := offerItems(offers, nextOffersURL(filters, cursor)).Render(r.Context(), w)
 	if err != nil {
 		fmt.Println(err)
-		http.Redirect(w, r, "/joinCommunity", http.StatusTemporaryRedirect)
-		return
+		http.NotFound(w, r)
 	}
-	token, err := r.Cookie("token")
+}
+
+func handleJoinCommunity(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
 	if err != nil {
 		fmt.Println(err)
-		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		http.Redirect(w, r, "/joinCommunity", http.StatusTemporaryRedirect)
 		return
 	}
-	id, err := r.Cookie("token_id")
+	token, err := sessionToken(w, r)
 	if err != nil {
 		fmt.Println(err)
 		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
 		return
 	}
-	fmt.Printf("Token: %v, ID: %v", token.Value, id)
 	payload := map[string]string{
 		"community_id": r.Form.Get("community_id"),
-		"user_id":      id.Value,
-		"user_token":   token.Value,
+		"message":      r.Form.Get("message"),
 	}
 	encodedPayload := map2json(payload)
 	req, err := http.NewRequest("POST", apiURL+"/joinCommunity", bytes.NewBuffer(encodedPayload))
@@ -384,6 +506,7 @@ func handleJoinCommunity(w http.ResponseWriter, r *http.Request) {
 	}
 	defer req.Body.Close()
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token.Value)
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -392,6 +515,14 @@ func handleJoinCommunity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusAccepted {
+		noticePage("Request sent", "The moderators of the community will have a look at your request.").Render(r.Context(), w)
+		return
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		noticePage("Invite only", "This community can only be joined with an invite link.").Render(r.Context(), w)
+		return
+	}
 	if resp.StatusCode != http.StatusOK {
 		fmt.Println("Error: ", resp.Status)
 		http.Redirect(w, r, "/joinCommunity", http.StatusTemporaryRedirect)
@@ -408,7 +539,7 @@ func handleCreateCommunity(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/createCommunity", http.StatusTemporaryRedirect)
 		return
 	}
-	token, err := r.Cookie("token")
+	token, err := sessionToken(w, r)
 	if err != nil {
 		fmt.Println(err)
 		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
@@ -416,9 +547,10 @@ func handleCreateCommunity(w http.ResponseWriter, r *http.Request) {
 	}
 
 	payload := map[string]string{
-		"name":    r.Form.Get("name"),
-		"country": r.Form.Get("country"),
-		"city":    r.Form.Get("city"),
+		"name":       r.Form.Get("name"),
+		"country":    r.Form.Get("country"),
+		"city":       r.Form.Get("city"),
+		"visibility": r.Form.Get("visibility"),
 	}
 	encodedPayload := map2json(payload)
 	req, err := http.NewRequest("POST", apiURL+"/createCommunity", bytes.NewBuffer(encodedPayload))
@@ -429,7 +561,7 @@ func handleCreateCommunity(w http.ResponseWriter, r *http.Request) {
 	}
 	defer req.Body.Close()
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("token", token.Value)
+	req.Header.Set("Authorization", "Bearer "+token.Value)
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -448,7 +580,7 @@ func handleCreateCommunity(w http.ResponseWriter, r *http.Request) {
 }
 
 func getUserCommunities(w http.ResponseWriter, r *http.Request) []Community {
-	token, err := r.Cookie("token")
+	token, err := sessionToken(w, r)
 	if err != nil {
 		fmt.Println(err)
 		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
@@ -460,7 +592,7 @@ func getUserCommunities(w http.ResponseWriter, r *http.Request) []Community {
 		return nil
 	}
 	defer req.Body.Close()
-	req.Header.Set("token", token.Value)
+	req.Header.Set("Authorization", "Bearer "+token.Value)
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -487,7 +619,7 @@ func getCommunities(w http.ResponseWriter, r *http.Request) ([]Community, string
 		fmt.Println(err)
 		return nil, ""
 	}
-	token, err := r.Cookie("token")
+	token, err := sessionToken(w, r)
 	if err != nil {
 		fmt.Println(err)
 		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
@@ -501,7 +633,7 @@ func getCommunities(w http.ResponseWriter, r *http.Request) ([]Community, string
 		return nil, ""
 	}
 	defer req.Body.Close()
-	req.Header.Set("token", token.Value)
+	req.Header.Set("Authorization", "Bearer "+token.Value)
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -553,7 +685,7 @@ func generateOffer(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusPermanentRedirect)
 		return
 	}
-	token, err := r.Cookie("token")
+	token, err := sessionToken(w, r)
 	if err != nil {
 		fmt.Println(err)
 		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
@@ -567,7 +699,7 @@ func generateOffer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer req.Body.Close()
-	req.Header.Set("token", token.Value)
+	req.Header.Set("Authorization", "Bearer "+token.Value)
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -591,12 +723,18 @@ func generateOffer(w http.ResponseWriter, r *http.Request) {
 	offer.CreatedAt = convertTime(offer.CreatedAt)
 	offer.CommunityName = r.URL.Query().Get("communityName")
 
-	user, err := getUser(strconv.Itoa(offer.UserID), client)
+	user, err := getUser(strconv.Itoa(offer.UserID), token.Value, client)
 	if err != nil {
 		fmt.Println("Error getting user: ", err)
 	}
-	offer.User = user.Username
-	err = viewOfferPage(offer).Render(r.Context(), w)
+	offer.User = user.name()
+	isOwner := false
+	tokenID, err := r.Cookie("token_id")
+	if err == nil {
+		isOwner = strconv.Itoa(offer.UserID) == tokenID.Value
+	}
+	canModerate := !isOwner && canModeratePosts(token.Value, offer.CommunityID)
+	err = viewOfferPage(offer, isOwner, canModerate).Render(r.Context(), w)
 	if err != nil {
 		fmt.Println(err)
 		fmt.Println(id, offer)
@@ -609,25 +747,41 @@ type Message struct {
 	Text    string
 	isMyMsg bool
 	OfferID int
+	Status  string
 }
 
 type MessageFromServer struct {
-	Text      string
-	SenderID  int
-	ReciverID int
-	OfferID   int
+	Text           string
+	SenderID       int
+	ReceiverID     int
+	OfferID        int
+	RequestID      int
+	ConversationID *int
+	DeliveredAt    *string
+	ReadAt         *string
 }
 type User struct {
-	ID       int
-	Username string
+	ID          int
+	Username    string
+	DisplayName string `json:"display_name"`
+	Unread      int
+}
+
+// name is what the user is called on the site, the display name if they set one.
+func (u User) name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Username
 }
 
-func getUser(id string, client *http.Client) (User, error) {
+func getUser(id string, token string, client *http.Client) (User, error) {
 	req, err := http.NewRequest("GET", apiURL+"/user/"+id, bytes.NewBuffer([]byte("")))
 	if err != nil {
 		return User{}, err
 	}
 	defer req.Body.Close()
+	req.Header.Set("Authorization", "Bearer "+token)
 	resp, err := client.Do(req)
 	if err != nil {
 		return User{}, err
@@ -651,13 +805,14 @@ func renderInboxOptions(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 	}
 	offerID := r.Form.Get("offerID")
+	requestID := r.Form.Get("requestID")
 	posterID := r.Form.Get("posterID")
 	posterIDInt, err := strconv.Atoi(posterID)
 	if err != nil {
 		fmt.Println(err)
 		http.NotFound(w, r)
 	}
-	token, err := r.Cookie("token")
+	token, err := sessionToken(w, r)
 	if err != nil {
 		fmt.Println(err)
 		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
@@ -678,14 +833,18 @@ func renderInboxOptions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	client := &http.Client{}
-	req, err := http.NewRequest("GET", apiURL+"/offerResp/"+offerID, bytes.NewBuffer([]byte("")))
+	respURL := apiURL + "/offerResp/" + offerID
+	if requestID != "" {
+		respURL = apiURL + "/requestResp/" + requestID
+	}
+	req, err := http.NewRequest("GET", respURL, bytes.NewBuffer([]byte("")))
 	if err != nil {
 		fmt.Println(err)
 		http.NotFound(w, r)
 		return
 	}
 	defer req.Body.Close()
-	req.Header.Set("token", token.Value)
+	req.Header.Set("Authorization", "Bearer "+token.Value)
 	resp, err := client.Do(req)
 	if err != nil {
 		fmt.Println(err)
@@ -711,6 +870,10 @@ func renderInboxOptions(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 	}
+	unread := unreadBySender(token.Value, offerID, requestID)
+	for i := range users {
+		users[i].Unread = unread[users[i].ID]
+	}
 	if len(users) == 0 {
 		err = selectChatBox([]User{{ID: posterIDInt, Username: "No Messages Yet"}}).Render(r.Context(), w)
 		if err != nil {
@@ -735,12 +898,13 @@ func renderMessageBox(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 	}
 	offerID := r.Form.Get("offerID")
+	requestID := r.Form.Get("requestID")
 	posterID := r.Form.Get("posterID")
 	otherUserID := r.Form.Get("otherUserID")
 
 	fmt.Printf("OfferID: %v, PosterID: %v, OtherUserID: %v\n", offerID, posterID, otherUserID)
 
-	token, err := r.Cookie("token")
+	token, err := sessionToken(w, r)
 	if err != nil {
 		fmt.Println(err)
 		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
@@ -753,8 +917,10 @@ func renderMessageBox(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer req.Body.Close()
-	req.Header.Set("token", token.Value)
+	req.Header.Set("Authorization", "Bearer "+token.Value)
 	req.Header.Set("otherUserID", otherUserID)
+	req.Header.Set("offerID", offerID)
+	req.Header.Set("requestID", requestID)
 	resp, err := client.Do(req)
 	if err != nil {
 		fmt.Println(err)
@@ -774,22 +940,8 @@ func renderMessageBox(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	var relevantMessages []Message
-	for _, m := range messages {
-		if fmt.Sprint(m.OfferID) == offerID &&
-			(fmt.Sprint(m.SenderID) == otherUserID || fmt.Sprint(m.ReciverID) == otherUserID) {
-			msg := Message{Text: m.Text, OfferID: m.OfferID}
-			msgSenderID := fmt.Sprint(m.SenderID)
-			if msgSenderID == otherUserID {
-				msg.isMyMsg = false
-			} else {
-				msg.isMyMsg = true
-			}
-			relevantMessages = append(relevantMessages, msg)
-		}
-
-	}
-	err = chatBox(relevantMessages).Render(r.Context(), w)
+	markMessagesRead(token.Value, messages, otherUserID)
+	err = chatBox(chatMessages(messages, otherUserID), otherUserID).Render(r.Context(), w)
 	if err != nil {
 		fmt.Println(err)
 		http.NotFound(w, r)
@@ -803,7 +955,7 @@ func handelSendMessage(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	token, err := r.Cookie("token")
+	token, err := sessionToken(w, r)
 	if err != nil {
 		fmt.Println(err)
 		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
@@ -812,9 +964,10 @@ func handelSendMessage(w http.ResponseWriter, r *http.Request) {
 	offerID := r.Form.Get("offerID")
 
 	payload := map[string]string{
-		"text":       r.Form.Get("message"),
-		"reciver_id": r.Form.Get("otherUserID"),
-		"offer_id":   offerID,
+		"text":        r.Form.Get("message"),
+		"receiver_id": r.Form.Get("otherUserID"),
+		"offer_id":    offerID,
+		"request_id":  r.Form.Get("requestID"),
 	}
 	encodedPayload := map2json(payload)
 	req, err := http.NewRequest("POST", apiURL+"/messages", bytes.NewBuffer(encodedPayload))
@@ -825,7 +978,7 @@ func handelSendMessage(w http.ResponseWriter, r *http.Request) {
 	}
 	defer req.Body.Close()
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("token", token.Value)
+	req.Header.Set("Authorization", "Bearer "+token.Value)
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -844,7 +997,15 @@ func handelSendMessage(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal("Error in the configuration: ", err)
+	}
+	apiURL = cfg.APIURL
 	http.HandleFunc("/", offerPagehandler)
+	http.HandleFunc("/offerItems", offerItemsHandler)
+	http.HandleFunc("/requestItems", requestItemsHandler)
+	http.HandleFunc("/search", renderSearchResults)
 	http.Handle("/signup", templ.Handler(userSignupPage()))
 	http.Handle("/login", templ.Handler(userLoginPage()))
 	http.Handle("/createOffer", templ.Handler(createOfferPage()))
@@ -853,6 +1014,13 @@ func main() {
 	http.HandleFunc("/handelSignup", handleSignup)
 	http.HandleFunc("/handelLogin", handleLogin)
 	http.HandleFunc("/handelLogout", handelLogout)
+	http.HandleFunc("/verifyEmail", handelVerifyEmail)
+	http.Handle("/verifyNotice", templ.Handler(verifyNoticePage()))
+	http.HandleFunc("/handelResendVerification", handelResendVerification)
+	http.Handle("/forgotPassword", templ.Handler(forgotPasswordPage()))
+	http.HandleFunc("/handelForgotPassword", handelForgotPassword)
+	http.HandleFunc("/resetPassword", resetPasswordHandler)
+	http.HandleFunc("/handelResetPassword", handelResetPassword)
 	http.HandleFunc("/handelCreateOffer", createOffer)
 	http.HandleFunc("/handelJoinCommunity", handleJoinCommunity)
 	http.HandleFunc("/handelCreateCommunity", handleCreateCommunity)
@@ -861,10 +1029,48 @@ func main() {
 	http.HandleFunc("/viewOffer", generateOffer)
 	http.HandleFunc("/chatBox", renderMessageBox)
 	http.HandleFunc("/handelSendMessage", handelSendMessage)
+	http.HandleFunc("/chatEvents", chatEventsHandler)
 	http.HandleFunc("/offerInbox", renderInboxOptions)
-	ip := "127.0.0.1"
-	fmt.Printf("Server running on: %v:8080\n", ip)
-	err := http.ListenAndServe(ip+":8080", nil)
+	http.HandleFunc("/inbox", inboxHandler)
+	http.HandleFunc("/conversation", conversationPageHandler)
+	http.HandleFunc("/unreadBadge", unreadBadgeHandler)
+	http.HandleFunc("/handelTyping", handelTyping)
+	http.HandleFunc("/handelReport", handelReport)
+	http.HandleFunc("/handelBlock", handelBlock)
+	http.HandleFunc("/blocks", blocksPageHandler)
+	http.HandleFunc("/reports", reportsPageHandler)
+	http.HandleFunc("/handelResolveReport", handelResolveReport)
+	http.HandleFunc("/profile", profilePageHandler)
+	http.HandleFunc("/handelEditProfile", handelEditProfile)
+	http.HandleFunc("/handelAvatar", handelAvatar)
+	http.HandleFunc("/settings", settingsPageHandler)
+	http.HandleFunc("/handelChangeEmail", handelChangeEmail)
+	http.HandleFunc("/handelChangePassword", handelChangePassword)
+	http.HandleFunc("/handelDeleteAccount", handelDeleteAccount)
+	http.HandleFunc("/handelRequestExport", handelRequestExport)
+	http.HandleFunc("/exportDownload", exportDownloadHandler)
+	http.HandleFunc("/handelAddPhotos", handelAddPhotos)
+	http.HandleFunc("/handelCaptionPhoto", handelCaptionPhoto)
+	http.HandleFunc("/handelMovePhoto", handelMovePhoto)
+	http.HandleFunc("/handelRemovePhoto", handelRemovePhoto)
+	http.HandleFunc("/handelEditOffer", handelEditOffer)
+	http.HandleFunc("/handelOfferStatus", handelOfferStatus)
+	http.HandleFunc("/handelDeleteOffer", handelDeleteOffer)
+	http.HandleFunc("/myCommunities", myCommunitiesHandler)
+	http.HandleFunc("/community", communityPageHandler)
+	http.HandleFunc("/handelModerate", handelModerate)
+	http.HandleFunc("/handelLeaveCommunity", handelLeaveCommunity)
+	http.HandleFunc("/invite", invitePageHandler)
+	http.HandleFunc("/handelJoinWithInvite", handelJoinWithInvite)
+	http.HandleFunc("/handelRemovePost", handelRemovePost)
+	http.HandleFunc("/requests", requestPageHandler)
+	http.Handle("/createRequest", templ.Handler(createRequestPage()))
+	http.HandleFunc("/handelCreateRequest", createRequest)
+	http.HandleFunc("/viewRequest", generateRequest)
+	http.HandleFunc("/handelEditRequest", handelEditRequest)
+	http.HandleFunc("/handelDeleteRequest", handelDeleteRequest)
+	fmt.Printf("Server running on: %v\n", cfg.ListenAddr)
+	err = http.ListenAndServe(cfg.ListenAddr, nil)
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The tests act as the signed in user testUserID, whose access token is
+// testToken.
+const (
+	testToken        = "access-token"
+	testRefreshToken = "refresh-token"
+	testUserID       = "1"
+)
+
+// apiCall is a request the client made to the fake api.
+type apiCall struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Token  string
+	Header http.Header
+	Body   map[string]string
+}
+
+// fakeAPI stands in for the api. It answers with the handlers the test set
+// up, 404 for everything else, and records every request it gets.
+type fakeAPI struct {
+	t        *testing.T
+	mu       sync.Mutex
+	handlers map[string]http.HandlerFunc
+	calls    []apiCall
+}
+
+// newFakeAPI starts a fake api and points the client at it for the rest of
+// the test.
+func newFakeAPI(t *testing.T) *fakeAPI {
+	api := &fakeAPI{t: t, handlers: map[string]http.HandlerFunc{}}
+	server := httptest.NewServer(api)
+	previous := apiURL
+	apiURL = server.URL
+	t.Cleanup(func() {
+		server.Close()
+		apiURL = previous
+	})
+	return api
+}
+
+func (api *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	call := apiCall{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+		Token:  strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "),
+		Header: r.Header,
+	}
+	if r.Header.Get("Content-Type") == "application/json" {
+		raw, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(raw))
+		json.Unmarshal(raw, &call.Body)
+	}
+	api.mu.Lock()
+	api.calls = append(api.calls, call)
+	handler, ok := api.handlers[r.Method+" "+r.URL.Path]
+	api.mu.Unlock()
+	if !ok {
+		http.Error(w, `{"error": "no such route"}`, http.StatusNotFound)
+		return
+	}
+	handler(w, r)
+}
+
+// handle answers requests to the path with the handler.
+func (api *fakeAPI) handle(method string, path string, handler http.HandlerFunc) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.handlers[method+" "+path] = handler
+}
+
+// reply answers requests to the path with the status and body as json.
+func (api *fakeAPI) reply(method string, path string, status int, body interface{}) {
+	api.handle(method, path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	})
+}
+
+// replySession answers like a sign in, with the tokens in the headers.
+func (api *fakeAPI) replySession(method string, path string, token string, body interface{}) {
+	api.handle(method, path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("token", token)
+		w.Header().Set("token_expires_in", "900")
+		w.Header().Set("refresh_token", "new-"+testRefreshToken)
+		w.Header().Set("token_id", testUserID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	})
+}
+
+// requests returns the calls made to the path.
+func (api *fakeAPI) requests(method string, path string) []apiCall {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	var calls []apiCall
+	for _, call := range api.calls {
+		if call.Method == method && call.Path == path {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// called returns the last call made to the path and fails the test if there
+// was none.
+func (api *fakeAPI) called(method string, path string) apiCall {
+	api.t.Helper()
+	calls := api.requests(method, path)
+	if len(calls) == 0 {
+		api.t.Fatalf("the api got no %v %v", method, path)
+	}
+	return calls[len(calls)-1]
+}
+
+// signedIn adds the session cookies of the test user to the request.
+func signedIn(req *http.Request) *http.Request {
+	req.AddCookie(&http.Cookie{Name: "token", Value: testToken})
+	req.AddCookie(&http.Cookie{Name: "refresh_token", Value: testRefreshToken})
+	req.AddCookie(&http.Cookie{Name: "token_id", Value: testUserID})
+	return req
+}
+
+// get runs the handler for a GET of target as the signed in test user.
+func get(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, signedIn(httptest.NewRequest("GET", target, nil)))
+	return rec
+}
+
+// postForm runs the handler for a form posted to target as the signed in
+// test user.
+func postForm(handler http.HandlerFunc, target string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler(rec, signedIn(req))
+	return rec
+}
+
+// multipartForm builds a multipart form with the fields and a file in the
+// "image" field for every entry of files.
+func multipartForm(t *testing.T, target string, fields map[string]string, files ...string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, value := range fields {
+		writer.WriteField(name, value)
+	}
+	for i, content := range files {
+		part, err := writer.CreateFormFile("image", fmt.Sprintf("photo%v.png", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+	writer.Close()
+	req := httptest.NewRequest("POST", target, &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return signedIn(req)
+}
+
+func wantStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("got status %v, want %v: %v", rec.Code, status, rec.Body.String())
+	}
+}
+
+func wantRedirect(t *testing.T, rec *httptest.ResponseRecorder, status int, location string) {
+	t.Helper()
+	wantStatus(t, rec, status)
+	if got := rec.Header().Get("Location"); got != location {
+		t.Fatalf("redirected to %q, want %q", got, location)
+	}
+}
+
+// wantHTML fails the test unless the page contains every one of parts.
+func wantHTML(t *testing.T, rec *httptest.ResponseRecorder, parts ...string) {
+	t.Helper()
+	for _, part := range parts {
+		if !strings.Contains(rec.Body.String(), part) {
+			t.Fatalf("the page has no %q:\n%v", part, rec.Body.String())
+		}
+	}
+}
+
+// wantNoHTML fails the test if the page contains any of parts.
+func wantNoHTML(t *testing.T, rec *httptest.ResponseRecorder, parts ...string) {
+	t.Helper()
+	for _, part := range parts {
+		if strings.Contains(rec.Body.String(), part) {
+			t.Fatalf("the page has %q:\n%v", part, rec.Body.String())
+		}
+	}
+}
+
+// cookie returns the cookie the handler set, or nil.
+func cookie(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	api := newFakeAPI(t)
+	verified := "2026-01-02T15:04:05Z"
+	login := func(email string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/handelLogin", strings.NewReader(url.Values{
+			"email": {email}, "password": {"secret"},
+		}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handleLogin(rec, req)
+		return rec
+	}
+
+	api.replySession("POST", "/signin", testToken, map[string]interface{}{"user": map[string]interface{}{"email_verified_at": verified}})
+	rec := login("ada@example.com")
+	wantRedirect(t, rec, http.StatusPermanentRedirect, "/")
+	if call := api.called("POST", "/signin"); call.Body["email"] != "ada@example.com" || call.Body["password"] != "secret" {
+		t.Fatalf("unexpected sign in %v", call.Body)
+	}
+	token := cookie(rec, "token")
+	if token == nil || token.Value != testToken || !token.HttpOnly || token.MaxAge != 870 {
+		t.Fatalf("unexpected token cookie %+v", token)
+	}
+	if c := cookie(rec, "refresh_token"); c == nil || c.Value != "new-"+testRefreshToken || c.MaxAge != refreshTokenMaxAge {
+		t.Fatalf("unexpected refresh cookie %+v", c)
+	}
+	if c := cookie(rec, "token_id"); c == nil || c.Value != testUserID {
+		t.Fatalf("unexpected token_id cookie %+v", c)
+	}
+
+	api.replySession("POST", "/signin", testToken, map[string]interface{}{"user": map[string]interface{}{"email_verified_at": nil}})
+	wantRedirect(t, login("ada@example.com"), http.StatusSeeOther, "/verifyNotice")
+
+	api.reply("POST", "/signin", http.StatusBadRequest, map[string]string{"error": "incorrect password"})
+	rec = login("ada@example.com")
+	wantRedirect(t, rec, http.StatusTemporaryRedirect, "/login")
+	if cookie(rec, "token") != nil {
+		t.Fatal("a failed login set a session cookie")
+	}
+}
+
+func TestSignup(t *testing.T) {
+	api := newFakeAPI(t)
+	form := url.Values{"username": {"ada"}, "email": {"ada@example.com"}, "password": {"secret"}}
+
+	api.reply("POST", "/signup", http.StatusOK, map[string]string{})
+	rec := postForm(handleSignup, "/handelSignup", form)
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, "Check your email", "verify your email address")
+	if call := api.called("POST", "/signup"); call.Body["username"] != "ada" || call.Body["email"] != "ada@example.com" {
+		t.Fatalf("unexpected sign up %v", call.Body)
+	}
+
+	api.reply("POST", "/signup", http.StatusBadRequest, map[string]string{"error": "email address is already in use"})
+	wantRedirect(t, postForm(handleSignup, "/handelSignup", form), http.StatusTemporaryRedirect, "/signup")
+}
+
+func TestLogout(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("POST", "/signout", http.StatusOK, map[string]string{})
+
+	rec := get(handelLogout, "/handelLogout")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, `action="/handelLogin"`)
+	if call := api.called("POST", "/signout"); call.Body["refresh_token"] != testRefreshToken {
+		t.Fatalf("unexpected sign out %v", call.Body)
+	}
+	for _, name := range []string{"token", "refresh_token", "token_id"} {
+		if c := cookie(rec, name); c == nil || c.MaxAge >= 0 {
+			t.Fatalf("the %v cookie was not cleared: %+v", name, c)
+		}
+	}
+}
+
+func TestOfferPage(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("GET", "/myOffers", http.StatusOK, offerListPage{
+		Items: []Offer{
+			{ID: 4, Title: "Red bike", Description: "Needs a new chain", CommunityName: "garden", Status: "reserved",
+				CreatedAt: "2026-03-04T10:20:00Z", Photos: []Photo{{ThumbURL: "http://api.test/images/9?size=thumb"}}},
+			{ID: 3, Title: "Kettle <3", CommunityName: "garden", Status: "open", CreatedAt: "2026-03-03T10:20:00Z"},
+		},
+		NextCursor: "abc",
+	})
+
+	rec := get(offerPagehandler, "/?q=bike&sort=oldest&has_photo=true")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, "Red bike", "Needs a new chain", "Status: reserved", "26/03/04 10:20",
+		`src="http://api.test/images/9?size=thumb"`, "Kettle &lt;3", `href="/viewOffer?offerID=4&amp;communityName=garden"`,
+		`hx-get="/offerItems?cursor=abc&amp;has_photo=true&amp;q=bike&amp;sort=oldest"`)
+	wantNoHTML(t, rec, "Status: open")
+	call := api.called("GET", "/myOffers")
+	if call.Token != testToken || call.Query.Encode() != "has_photo=true&q=bike&sort=oldest" {
+		t.Fatalf("unexpected listing %v with %q", call.Query, call.Token)
+	}
+
+	rec = get(offerItemsHandler, "/offerItems?cursor=abc&q=bike")
+	wantStatus(t, rec, http.StatusOK)
+	wantNoHTML(t, rec, "<html")
+	if call := api.called("GET", "/myOffers"); call.Query.Get("cursor") != "abc" {
+		t.Fatalf("the next page was asked for with %v", call.Query)
+	}
+
+	api.reply("GET", "/myOffers", http.StatusOK, offerListPage{})
+	rec = get(offerPagehandler, "/")
+	wantHTML(t, rec, "No offers found")
+	wantNoHTML(t, rec, "Loading more offers")
+
+	rec = httptest.NewRecorder()
+	offerPagehandler(rec, httptest.NewRequest("GET", "/", nil))
+	wantRedirect(t, rec, http.StatusTemporaryRedirect, "/login")
+}
+
+func TestViewOffer(t *testing.T) {
+	api := newFakeAPI(t)
+	offer := Offer{ID: 5, Title: "Red bike", Description: "Needs a new chain", UserID: 2, CommunityID: 3,
+		Status: "open", CreatedAt: "2026-03-04T10:20:00Z",
+		Photos: []Photo{
+			{ID: 8, URL: "http://api.test/images/8?size=medium", OriginalURL: "http://api.test/images/8?size=original", Caption: "front"},
+			{ID: 9, URL: "http://api.test/images/9?size=medium"},
+		}}
+	api.reply("GET", "/offer/5", http.StatusOK, offer)
+	api.reply("GET", "/user/2", http.StatusOK, User{ID: 2, Username: "bob", DisplayName: "Bob B."})
+	api.reply("GET", "/community/3/members", http.StatusOK, CommunityMembers{Role: "member"})
+
+	rec := get(generateOffer, "/viewOffer?offerID=5&communityName=garden")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, "Red bike", "Posted To: garden", "Bob B.", `href="/profile?id=2"`, "<figcaption>front</figcaption>",
+		`href="http://api.test/images/8?size=original"`, `action="/handelReport"`, `sse-connect="/chatEvents?offerID=5"`)
+	wantNoHTML(t, rec, "/handelOfferStatus", "/handelRemovePost", "/handelRemovePhoto")
+
+	// moderators of the community can remove the post
+	api.reply("GET", "/community/3/members", http.StatusOK, CommunityMembers{Role: "moderator"})
+	wantHTML(t, get(generateOffer, "/viewOffer?offerID=5"), `action="/handelRemovePost"`)
+
+	// the owner gets the controls to edit it and its photos
+	offer.UserID = 1
+	api.reply("GET", "/offer/5", http.StatusOK, offer)
+	api.reply("GET", "/user/1", http.StatusOK, User{ID: 1, Username: "ada"})
+	rec = get(generateOffer, "/viewOffer?offerID=5")
+	wantHTML(t, rec, `action="/handelOfferStatus"`, `action="/handelDeleteOffer"`, `action="/handelAddPhotos"`,
+		`name="order" value="9,8"`)
+	wantNoHTML(t, rec, "/handelReport", "/handelRemovePost")
+
+	api.reply("GET", "/offer/5", http.StatusForbidden, map[string]string{"error": "user does not belong to community"})
+	wantRedirect(t, get(generateOffer, "/viewOffer?offerID=5"), http.StatusTemporaryRedirect, "/")
+}
+
+func TestCreateOffer(t *testing.T) {
+	api := newFakeAPI(t)
+	var uploads []string
+	api.handle("POST", "/image", func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content, _ := io.ReadAll(file)
+		uploads = append(uploads, string(content))
+		json.NewEncoder(w).Encode(ImgResponse{ImageID: fmt.Sprint(10 + len(uploads))})
+	})
+	api.reply("POST", "/offers", http.StatusOK, map[string]string{})
+	fields := map[string]string{"title": "Red bike", "description": "Needs a new chain", "community_id": "3"}
+
+	rec := httptest.NewRecorder()
+	createOffer(rec, multipartForm(t, "/handelCreateOffer", fields, "first photo", "second photo"))
+	wantRedirect(t, rec, http.StatusPermanentRedirect, "/")
+	if fmt.Sprint(uploads) != "[first photo second photo]" || api.called("POST", "/image").Token != testToken {
+		t.Fatalf("uploaded %v", uploads)
+	}
+	call := api.called("POST", "/offers")
+	if call.Body["title"] != "Red bike" || call.Body["community_id"] != "3" || call.Body["image_ids"] != "11,12" {
+		t.Fatalf("unexpected offer %v", call.Body)
+	}
+
+	// nothing is posted when a photo is refused
+	api.reply("POST", "/image", http.StatusUnsupportedMediaType, map[string]string{"error": "not an image"})
+	rec = httptest.NewRecorder()
+	createRequest(rec, multipartForm(t, "/handelCreateRequest", fields, "text"))
+	wantRedirect(t, rec, http.StatusTemporaryRedirect, "/createRequest")
+	if len(api.requests("POST", "/requests")) != 0 {
+		t.Fatal("the request was posted without its photo")
+	}
+}
+
+func TestCommunityLists(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("GET", "/communities/DE", http.StatusOK, []Community{
+		{ID: 3, Name: "garden", Visibility: "public"},
+		{ID: 4, Name: "kitchen", Visibility: "request"},
+	})
+	api.reply("GET", "/userCommunities", http.StatusOK, []Community{{ID: 3, Name: "garden"}})
+
+	rec := get(generateCommunityList, "/communitiesList?country=DE")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, `<option id="community_li" value="3">garden</option>`, `value="4">kitchen (asks to join)</option>`)
+
+	rec = get(generateUserCommunityList, "/userCommunitiesList")
+	wantHTML(t, rec, `value="3">garden</option>`)
+	wantNoHTML(t, rec, "kitchen")
+
+	// an unknown country lists nothing rather than failing
+	rec = get(generateCommunityList, "/communitiesList?country=XX")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, "select community")
+}
+
+func TestJoinCommunity(t *testing.T) {
+	api := newFakeAPI(t)
+	form := url.Values{"community_id": {"3"}, "message": {"I live next door"}}
+	tests := []struct {
+		name   string
+		status int
+		notice string
+	}{
+		{"asks to join", http.StatusAccepted, "Request sent"},
+		{"invite only", http.StatusForbidden, "Invite only"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api.reply("POST", "/joinCommunity", test.status, map[string]string{})
+			rec := postForm(handleJoinCommunity, "/handelJoinCommunity", form)
+			wantStatus(t, rec, http.StatusOK)
+			wantHTML(t, rec, test.notice)
+		})
+	}
+	if call := api.called("POST", "/joinCommunity"); call.Body["community_id"] != "3" || call.Body["message"] != "I live next door" {
+		t.Fatalf("unexpected join %v", call.Body)
+	}
+
+	api.reply("POST", "/joinCommunity", http.StatusOK, map[string]string{})
+	wantRedirect(t, postForm(handleJoinCommunity, "/handelJoinCommunity", form), http.StatusPermanentRedirect, "/")
+	api.reply("POST", "/joinCommunity", http.StatusBadRequest, map[string]string{"error": "user is banned"})
+	wantRedirect(t, postForm(handleJoinCommunity, "/handelJoinCommunity", form), http.StatusTemporaryRedirect, "/joinCommunity")
+}
+
+func TestChatBox(t *testing.T) {
+	api := newFakeAPI(t)
+	conversation := 7
+	read, delivered := "2026-03-04T10:20:00Z", "2026-03-04T10:10:00Z"
+	api.reply("GET", "/messages", http.StatusOK, []MessageFromServer{
+		{Text: "is the bike still there?", SenderID: 2, ReceiverID: 1, OfferID: 5, ConversationID: &conversation},
+		{Text: "yes", SenderID: 1, ReceiverID: 2, OfferID: 5, ConversationID: &conversation, DeliveredAt: &delivered, ReadAt: &read},
+		{Text: "come by at six", SenderID: 1, ReceiverID: 2, OfferID: 5, ConversationID: &conversation, DeliveredAt: &delivered},
+		{Text: "on my way", SenderID: 1, ReceiverID: 2, OfferID: 5, ConversationID: &conversation},
+	})
+	api.reply("POST", "/conversations/7/read", http.StatusOK, map[string]string{})
+
+	rec := get(renderMessageBox, "/chatBox?offerID=5&posterID=1&otherUserID=2")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, "is the bike still there?", "Read", "Delivered", "Sent", `sse-swap="message-2"`, "sse:read-2")
+	call := api.called("GET", "/messages")
+	if call.Header.Get("otherUserID") != "2" || call.Header.Get("offerID") != "5" || call.Token != testToken {
+		t.Fatalf("unexpected history request %v", call.Header)
+	}
+	// the unread message from bob is marked read
+	api.called("POST", "/conversations/7/read")
+
+	api.reply("POST", "/messages", http.StatusOK, map[string]string{})
+	rec = postForm(handelSendMessage, "/handelSendMessage", url.Values{
+		"message": {"see you"}, "otherUserID": {"2"}, "offerID": {"5"},
+	})
+	wantRedirect(t, rec, http.StatusPermanentRedirect, "/chatBox?offerID=5")
+	if call := api.called("POST", "/messages"); call.Body["text"] != "see you" || call.Body["receiver_id"] != "2" ||
+		call.Body["offer_id"] != "5" {
+		t.Fatalf("unexpected message %v", call.Body)
+	}
+}
+
+func TestOfferInbox(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("GET", "/offerResp/5", http.StatusOK, []User{{ID: 2, Username: "bob"}, {ID: 1, Username: "ada"}, {ID: 3, Username: "cat"}})
+	api.reply("GET", "/conversations", http.StatusOK, []ConversationSummary{{OtherUserID: 3, Unread: 2}})
+
+	// the poster picks who to talk to, with the unread messages of each
+	rec := get(renderInboxOptions, "/offerInbox?offerID=5&posterID=1")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, `<option value="2">bob</option>`, `<option value="3">cat (2 new)</option>`)
+	wantNoHTML(t, rec, "ada")
+	if call := api.called("GET", "/conversations"); call.Query.Get("offerID") != "5" {
+		t.Fatalf("unread counts were asked for with %v", call.Query)
+	}
+
+	// everyone else talks to the poster
+	rec = get(renderInboxOptions, "/offerInbox?offerID=5&posterID=2")
+	wantHTML(t, rec, `<option value="2">Poster</option>`)
+
+	api.reply("GET", "/offerResp/5", http.StatusOK, []User{})
+	wantHTML(t, get(renderInboxOptions, "/offerInbox?offerID=5&posterID=1"), "No Messages Yet")
+}
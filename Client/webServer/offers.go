@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+func handelEditOffer(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	offerID := r.Form.Get("offerID")
+	payload := map[string]string{
+		"title":       r.Form.Get("title"),
+		"description": r.Form.Get("description"),
+	}
+	err = apiRequest("PUT", "/offer/"+offerID, token.Value, payload)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		log.Println("Offer updated")
+	}
+	http.Redirect(w, r, "/viewOffer?offerID="+offerID, http.StatusSeeOther)
+}
+
+func handelOfferStatus(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	offerID := r.Form.Get("offerID")
+	payload := map[string]string{
+		"status": r.Form.Get("status"),
+	}
+	err = apiRequest("POST", "/offer/"+offerID+"/status", token.Value, payload)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		log.Println("Offer status changed")
+	}
+	http.Redirect(w, r, "/viewOffer?offerID="+offerID, http.StatusSeeOther)
+}
+
+func handelDeleteOffer(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	err = apiRequest("DELETE", "/offer/"+r.Form.Get("offerID"), token.Value, nil)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		log.Println("Offer deleted")
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type Profile struct {
+	ID             int    `json:"id"`
+	Username       string `json:"username"`
+	DisplayName    string `json:"display_name"`
+	Bio            string `json:"bio"`
+	HomeCity       string `json:"home_city"`
+	AvatarURL      string `json:"avatar_url"`
+	AvatarThumbURL string `json:"avatar_thumb_url"`
+	MemberSince    string `json:"member_since"`
+	// Email and EmailVerifiedAt are only set on the user's own profile
+	Email           string  `json:"email"`
+	EmailVerifiedAt *string `json:"email_verified_at"`
+}
+
+// name is what the user is called on the site, the display name if they set one.
+func (p Profile) name() string {
+	return User{Username: p.Username, DisplayName: p.DisplayName}.name()
+}
+
+type Activity struct {
+	Offers   []Offer   `json:"offers"`
+	Requests []Request `json:"requests"`
+}
+
+// profilePageHandler shows the profile in the id parameter, or the user's
+// own profile with the forms to edit it.
+func profilePageHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	tokenID, err := r.Cookie("token_id")
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	isOwn := id == "" || id == tokenID.Value
+	var profile Profile
+	if isOwn {
+		id = tokenID.Value
+		err = apiGet("/profile", token.Value, &profile)
+	} else {
+		err = apiGet("/user/"+id, token.Value, &profile)
+	}
+	if err != nil {
+		fmt.Println(err)
+		noticePage("Profile not found", "This user does not exist.").Render(r.Context(), w)
+		return
+	}
+	profile.MemberSince = convertTime(profile.MemberSince)
+	activity := Activity{}
+	err = apiGet("/user/"+id+"/activity", token.Value, &activity)
+	if err != nil {
+		fmt.Println(err)
+	}
+	for i := range activity.Offers {
+		activity.Offers[i].CreatedAt = convertTime(activity.Offers[i].CreatedAt)
+	}
+	for i := range activity.Requests {
+		activity.Requests[i].CreatedAt = convertTime(activity.Requests[i].CreatedAt)
+	}
+	err = profilePage(profile, activity, isOwn).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+	}
+}
+
+func handelEditProfile(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	payload := map[string]string{
+		"display_name": r.Form.Get("displayName"),
+		"bio":          r.Form.Get("bio"),
+		"home_city":    r.Form.Get("homeCity"),
+	}
+	err = apiRequest("PUT", "/profile", token.Value, payload)
+	if err != nil {
+		fmt.Println(err)
+		noticePage("Profile not saved", "Display name, bio or home city is too long.").Render(r.Context(), w)
+		return
+	}
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+// handelAvatar uploads a new avatar, or removes it when the form has
+// remove=true.
+func handelAvatar(w http.ResponseWriter, r *http.Request) {
+	MAX_FORM_SIZE := int64(10 << 20) // 10MB
+	err := r.ParseMultipartForm(MAX_FORM_SIZE)
+	if err != nil {
+		fmt.Println("error parsing multipart form: ", err)
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	imageID := ""
+	if r.Form.Get("remove") != "true" {
+		imageIDs, err := uploadImages(r, token.Value)
+		if err != nil || len(imageIDs) == 0 {
+			fmt.Println(err)
+			noticePage("Avatar not saved", "The avatar must be a jpeg, png, gif or webp image.").Render(r.Context(), w)
+			return
+		}
+		imageID = imageIDs[0]
+	}
+	err = apiRequest("POST", "/profile/avatar", token.Value, map[string]string{"image_id": imageID})
+	if err != nil {
+		fmt.Println(err)
+	}
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestProfilePage(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("GET", "/profile", http.StatusOK, Profile{ID: 1, Username: "ada", DisplayName: "Ada L.", HomeCity: "Berlin",
+		Bio: "I fix bikes", MemberSince: "2026-01-02T15:04:05Z", AvatarURL: "http://api.test/images/3?size=medium"})
+	api.reply("GET", "/user/1/activity", http.StatusOK, Activity{
+		Offers:   []Offer{{ID: 5, Title: "Red bike", Status: "reserved", CreatedAt: "2026-03-04T10:20:00Z"}},
+		Requests: []Request{{ID: 6, Title: "Ladder", CreatedAt: "2026-03-05T10:20:00Z"}},
+	})
+
+	rec := get(profilePageHandler, "/profile")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, "<h1>Ada L.</h1>", "@ada", "Lives in Berlin", "Member since 26/01/02 15:04", "I fix bikes",
+		`src="http://api.test/images/3?size=medium"`, `href="/viewOffer?offerID=5"`, "26/03/04 10:20 (reserved)",
+		`href="/viewRequest?requestID=6"`, `action="/handelEditProfile"`, "Remove Avatar")
+
+	// the profiles of others can only be looked at
+	api.reply("GET", "/user/2", http.StatusOK, Profile{ID: 2, Username: "bob"})
+	api.reply("GET", "/user/2/activity", http.StatusOK, Activity{})
+	rec = get(profilePageHandler, "/profile?id=2")
+	wantHTML(t, rec, "<h1>bob</h1>")
+	wantNoHTML(t, rec, "/handelEditProfile", "/handelAvatar", "@bob", "Lives in")
+
+	wantHTML(t, get(profilePageHandler, "/profile?id=99"), "Profile not found")
+}
+
+func TestEditProfile(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("PUT", "/profile", http.StatusOK, Profile{})
+	rec := postForm(handelEditProfile, "/handelEditProfile", url.Values{
+		"displayName": {"Ada L."}, "bio": {"I fix bikes"}, "homeCity": {"Berlin"},
+	})
+	wantRedirect(t, rec, http.StatusSeeOther, "/profile")
+	if call := api.called("PUT", "/profile"); call.Body["display_name"] != "Ada L." || call.Body["bio"] != "I fix bikes" ||
+		call.Body["home_city"] != "Berlin" {
+		t.Fatalf("unexpected profile %v", call.Body)
+	}
+
+	api.reply("PUT", "/profile", http.StatusBadRequest, map[string]string{"error": "bio must be at most 1000 characters"})
+	wantHTML(t, postForm(handelEditProfile, "/handelEditProfile", url.Values{}), "Profile not saved")
+}
+
+func TestAvatar(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("POST", "/image", http.StatusOK, ImgResponse{ImageID: "12"})
+	api.reply("POST", "/profile/avatar", http.StatusOK, Profile{})
+
+	rec := httptest.NewRecorder()
+	handelAvatar(rec, multipartForm(t, "/handelAvatar", nil, "photo"))
+	wantRedirect(t, rec, http.StatusSeeOther, "/profile")
+	if call := api.called("POST", "/profile/avatar"); call.Body["image_id"] != "12" {
+		t.Fatalf("unexpected avatar %v", call.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	handelAvatar(rec, multipartForm(t, "/handelAvatar", map[string]string{"remove": "true"}))
+	wantRedirect(t, rec, http.StatusSeeOther, "/profile")
+	if call := api.called("POST", "/profile/avatar"); call.Body["image_id"] != "" {
+		t.Fatalf("unexpected avatar %v", call.Body)
+	}
+	if len(api.requests("POST", "/image")) != 1 {
+		t.Fatal("removing the avatar uploaded an image")
+	}
+
+	api.reply("POST", "/image", http.StatusUnsupportedMediaType, map[string]string{"error": "not an image"})
+	rec = httptest.NewRecorder()
+	handelAvatar(rec, multipartForm(t, "/handelAvatar", nil, "text"))
+	wantHTML(t, rec, "Avatar not saved")
+	if len(api.requests("POST", "/profile/avatar")) != 2 {
+		t.Fatal("a refused image was set as the avatar")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("GET", "/search", http.StatusOK, map[string][]SearchResult{"results": {
+		{Kind: "offer", ID: 5, Title: "Red bike", Snippet: "needs a new chain"},
+		{Kind: "request", ID: 6, Title: "Bike pump"},
+		{Kind: "community", ID: 3, Title: "Bike repair"},
+	}})
+
+	rec := get(renderSearchResults, "/search?q=red+bike")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, `href="/viewOffer?offerID=5"`, "<b>Red bike</b>", "offer: needs a new chain",
+		`href="/viewRequest?requestID=6"`, `href="/joinCommunity"`)
+	if call := api.called("GET", "/search"); call.Query.Get("q") != "red bike" {
+		t.Fatalf("searched for %q", call.Query.Get("q"))
+	}
+
+	// an empty search box shows nothing and asks the api nothing
+	rec = get(renderSearchResults, "/search?q=")
+	if rec.Body.Len() != 0 || len(api.requests("GET", "/search")) != 1 {
+		t.Fatalf("an empty search rendered %q", rec.Body.String())
+	}
+}
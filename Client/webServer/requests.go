@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type Request struct {
+	ID            int
+	Title         string
+	Description   string
+	User          string
+	Photos        []Photo
+	CommunityName string `json:"community_name"`
+	CommunityID   int    `json:"community_id"`
+	CreatedAt     string
+	UserID        int `json:"user_id"`
+}
+
+type requestListPage struct {
+	Items      []Request `json:"items"`
+	NextCursor string    `json:"next_cursor"`
+}
+
+// nextRequestsURL is the url the last request of a page loads the next page
+// from, or "" if there are no more requests.
+func nextRequestsURL(cursor string) string {
+	if cursor == "" {
+		return ""
+	}
+	return "/requestItems?" + url.Values{"cursor": {cursor}}.Encode()
+}
+
+func getMyRequests(w http.ResponseWriter, r *http.Request, cursor string) ([]Request, string) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return nil, ""
+	}
+	query := url.Values{}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	req, err := http.NewRequest("GET", apiURL+"/myRequests?"+query.Encode(), bytes.NewBuffer([]byte("")))
+	if err != nil {
+		fmt.Println(err)
+		return nil, ""
+	}
+	defer req.Body.Close()
+	req.Header.Set("Authorization", "Bearer "+token.Value)
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		return nil, ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println("Error: ", resp.Status)
+		return nil, ""
+	}
+	page := requestListPage{}
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	if err != nil {
+		fmt.Println(err)
+		return nil, ""
+	}
+	for i := range page.Items {
+		page.Items[i].CreatedAt = convertTime(page.Items[i].CreatedAt)
+	}
+	return page.Items, page.NextCursor
+}
+
+func requestPageHandler(w http.ResponseWriter, r *http.Request) {
+	requests, cursor := getMyRequests(w, r, "")
+	if len(requests) == 0 {
+		fmt.Println("No requests found")
+		requests = []Request{{Title: "No requests found"}}
+	}
+	err := requestPage(requests, nextRequestsURL(cursor)).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	}
+}
+
+// requestItemsHandler renders the next page of requests for infinite
+// scrolling.
+func requestItemsHandler(w http.ResponseWriter, r *http.Request) {
+	requests, cursor := getMyRequests(w, r, r.URL.Query().Get("cursor"))
+	err := requestItems(requests, nextRequestsURL(cursor)).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+	}
+}
+
+func generateRequest(w http.ResponseWriter, r *http.Request) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	tokenID, err := r.Cookie("token_id")
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	id := r.URL.Query().Get("requestID")
+	req, err := http.NewRequest("GET", apiURL+"/request/"+id, bytes.NewBuffer([]byte("")))
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/requests", http.StatusTemporaryRedirect)
+		return
+	}
+	defer req.Body.Close()
+	req.Header.Set("Authorization", "Bearer "+token.Value)
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/requests", http.StatusTemporaryRedirect)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println("Error: ", resp.Status)
+		http.Redirect(w, r, "/requests", http.StatusTemporaryRedirect)
+		return
+	}
+	request := Request{}
+	err = json.NewDecoder(resp.Body).Decode(&request)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/requests", http.StatusTemporaryRedirect)
+		return
+	}
+	request.CreatedAt = convertTime(request.CreatedAt)
+	request.CommunityName = r.URL.Query().Get("communityName")
+	user, err := getUser(strconv.Itoa(request.UserID), token.Value, client)
+	if err != nil {
+		fmt.Println("Error getting user: ", err)
+	}
+	request.User = user.name()
+	isOwner := strconv.Itoa(request.UserID) == tokenID.Value
+	canModerate := !isOwner && canModeratePosts(token.Value, request.CommunityID)
+	err = viewRequestPage(request, isOwner, canModerate).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+	}
+}
+
+func handelEditRequest(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/requests", http.StatusTemporaryRedirect)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	requestID := r.Form.Get("requestID")
+	payload := map[string]string{
+		"title":       r.Form.Get("title"),
+		"description": r.Form.Get("description"),
+	}
+	err = apiRequest("PUT", "/request/"+requestID, token.Value, payload)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		log.Println("Request updated")
+	}
+	http.Redirect(w, r, "/viewRequest?requestID="+requestID, http.StatusSeeOther)
+}
+
+func handelDeleteRequest(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/requests", http.StatusTemporaryRedirect)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	err = apiRequest("DELETE", "/request/"+r.Form.Get("requestID"), token.Value, nil)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		log.Println("Request deleted")
+	}
+	http.Redirect(w, r, "/requests", http.StatusSeeOther)
+}
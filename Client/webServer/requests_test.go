@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequestPage(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("GET", "/myRequests", http.StatusOK, requestListPage{
+		Items: []Request{
+			{ID: 7, Title: "Kettle", CommunityName: "kitchen", Photos: []Photo{{ThumbURL: "http://api.test/images/2?size=thumb"}}},
+			{ID: 6, Title: "Ladder", CommunityName: "garden", CreatedAt: "2026-03-04T10:20:00Z"},
+		},
+		NextCursor: "abc",
+	})
+
+	rec := get(requestPageHandler, "/requests")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, "Posted To: garden", "Posted At: 26/03/04 10:20", `href="/viewRequest?requestID=7&amp;communityName=kitchen"`,
+		`src="http://api.test/images/2?size=thumb"`, `hx-get="/requestItems?cursor=abc"`)
+	// the api lists the newest first
+	if body := rec.Body.String(); strings.Index(body, "Kettle") > strings.Index(body, "Ladder") {
+		t.Fatal("the requests are not listed newest first")
+	}
+	if call := api.called("GET", "/myRequests"); call.Token != testToken || call.Query.Encode() != "" {
+		t.Fatalf("unexpected listing %v with %q", call.Query, call.Token)
+	}
+
+	rec = get(requestItemsHandler, "/requestItems?cursor=abc")
+	wantStatus(t, rec, http.StatusOK)
+	wantNoHTML(t, rec, "<html")
+	if call := api.called("GET", "/myRequests"); call.Query.Get("cursor") != "abc" {
+		t.Fatalf("the next page was asked for with %v", call.Query)
+	}
+
+	api.reply("GET", "/myRequests", http.StatusUnauthorized, map[string]string{"error": "signed out"})
+	rec = get(requestPageHandler, "/requests")
+	wantHTML(t, rec, "No requests found")
+	wantNoHTML(t, rec, "Loading more requests")
+}
+
+func TestViewRequest(t *testing.T) {
+	api := newFakeAPI(t)
+	request := Request{ID: 6, Title: "Ladder", Description: "For the roof", UserID: 2, CommunityID: 3,
+		CreatedAt: "2026-03-04T10:20:00Z"}
+	api.reply("GET", "/request/6", http.StatusOK, request)
+	api.reply("GET", "/user/2", http.StatusOK, User{ID: 2, Username: "bob"})
+	api.reply("GET", "/community/3/members", http.StatusOK, CommunityMembers{Role: "owner"})
+
+	rec := get(generateRequest, "/viewRequest?requestID=6&communityName=garden")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, "Ladder", "For the roof", "Posted To: garden", ">bob</a>", `value="Report request"`,
+		`action="/handelRemovePost"`, `sse-connect="/chatEvents?requestID=6"`)
+	wantNoHTML(t, rec, "/handelEditRequest", "/handelAddPhotos")
+
+	request.UserID = 1
+	api.reply("GET", "/request/6", http.StatusOK, request)
+	api.reply("GET", "/user/1", http.StatusOK, User{ID: 1, Username: "ada"})
+	rec = get(generateRequest, "/viewRequest?requestID=6")
+	wantHTML(t, rec, `action="/handelEditRequest"`, `action="/handelDeleteRequest"`, `name="kind" value="request"`)
+	wantNoHTML(t, rec, "/handelReport", "/handelRemovePost")
+
+	wantRedirect(t, get(generateRequest, "/viewRequest?requestID=7"), http.StatusTemporaryRedirect, "/requests")
+}
+
+func TestEditPosts(t *testing.T) {
+	api := newFakeAPI(t)
+	for _, path := range []string{"/offer/5", "/request/6"} {
+		api.reply("PUT", path, http.StatusOK, map[string]string{})
+		api.reply("DELETE", path, http.StatusOK, map[string]string{})
+	}
+	api.reply("POST", "/offer/5/status", http.StatusOK, map[string]string{})
+	edit := url.Values{"title": {"Blue bike"}, "description": {"New chain"}}
+
+	edit.Set("offerID", "5")
+	wantRedirect(t, postForm(handelEditOffer, "/handelEditOffer", edit), http.StatusSeeOther, "/viewOffer?offerID=5")
+	if call := api.called("PUT", "/offer/5"); call.Body["title"] != "Blue bike" || call.Body["description"] != "New chain" {
+		t.Fatalf("unexpected edit %v", call.Body)
+	}
+	rec := postForm(handelOfferStatus, "/handelOfferStatus", url.Values{"offerID": {"5"}, "status": {"given"}})
+	wantRedirect(t, rec, http.StatusSeeOther, "/viewOffer?offerID=5")
+	if call := api.called("POST", "/offer/5/status"); call.Body["status"] != "given" {
+		t.Fatalf("unexpected status %v", call.Body)
+	}
+	wantRedirect(t, postForm(handelDeleteOffer, "/handelDeleteOffer", url.Values{"offerID": {"5"}}), http.StatusSeeOther, "/")
+	api.called("DELETE", "/offer/5")
+
+	edit.Set("requestID", "6")
+	wantRedirect(t, postForm(handelEditRequest, "/handelEditRequest", edit), http.StatusSeeOther, "/viewRequest?requestID=6")
+	if call := api.called("PUT", "/request/6"); call.Body["title"] != "Blue bike" {
+		t.Fatalf("unexpected edit %v", call.Body)
+	}
+	wantRedirect(t, postForm(handelDeleteRequest, "/handelDeleteRequest", url.Values{"requestID": {"6"}}),
+		http.StatusSeeOther, "/requests")
+	api.called("DELETE", "/request/6")
+}
+
+func TestGallery(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("POST", "/image", http.StatusOK, ImgResponse{ImageID: "12"})
+	api.reply("POST", "/request/6/photos", http.StatusOK, []Photo{})
+	api.reply("PUT", "/request/6/photos/8", http.StatusOK, Photo{})
+	api.reply("POST", "/offer/5/photos/order", http.StatusOK, []Photo{})
+	api.reply("DELETE", "/offer/5/photos/8", http.StatusOK, map[string]string{})
+
+	rec := httptest.NewRecorder()
+	handelAddPhotos(rec, multipartForm(t, "/handelAddPhotos", map[string]string{"kind": "request", "postID": "6", "caption": "top"},
+		"first photo", "second photo"))
+	wantRedirect(t, rec, http.StatusSeeOther, "/viewRequest?requestID=6")
+	if call := api.called("POST", "/request/6/photos"); call.Body["image_ids"] != "12,12" || call.Body["caption"] != "top" {
+		t.Fatalf("unexpected photos %v", call.Body)
+	}
+
+	rec = postForm(handelCaptionPhoto, "/handelCaptionPhoto", url.Values{"kind": {"request"}, "postID": {"6"}, "photoID": {"8"}, "caption": {"side"}})
+	wantRedirect(t, rec, http.StatusSeeOther, "/viewRequest?requestID=6")
+	if call := api.called("PUT", "/request/6/photos/8"); call.Body["caption"] != "side" {
+		t.Fatalf("unexpected caption %v", call.Body)
+	}
+	rec = postForm(handelMovePhoto, "/handelMovePhoto", url.Values{"kind": {"offer"}, "postID": {"5"}, "order": {"9,8"}})
+	wantRedirect(t, rec, http.StatusSeeOther, "/viewOffer?offerID=5")
+	if call := api.called("POST", "/offer/5/photos/order"); call.Body["photo_ids"] != "9,8" {
+		t.Fatalf("unexpected order %v", call.Body)
+	}
+	postForm(handelRemovePhoto, "/handelRemovePhoto", url.Values{"kind": {"offer"}, "postID": {"5"}, "photoID": {"8"}})
+	api.called("DELETE", "/offer/5/photos/8")
+}
+
+func TestMovedOrder(t *testing.T) {
+	photos := []Photo{{ID: 1}, {ID: 2}, {ID: 3}}
+	tests := []struct {
+		i     int
+		delta int
+		want  string
+	}{
+		{0, 1, "2,1,3"},
+		{2, -1, "1,3,2"},
+		{0, -1, "1,2,3"},
+		{2, 1, "1,2,3"},
+	}
+	for _, test := range tests {
+		if got := movedOrder(photos, test.i, test.delta); got != test.want {
+			t.Errorf("moving photo %v by %v gave %v, want %v", test.i, test.delta, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+type BlockedUser struct {
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	CreatedAt string `json:"created_at"`
+}
+
+type Report struct {
+	ID             int    `json:"ID"`
+	Kind           string `json:"kind"`
+	TargetID       int    `json:"target_id"`
+	TargetUserID   int    `json:"target_user_id"`
+	CommunityID    *int   `json:"community_id"`
+	Reason         string `json:"reason"`
+	ReporterName   string `json:"reporter_name"`
+	TargetUserName string `json:"target_user_name"`
+	Text           string `json:"text"`
+	CreatedAt      string
+}
+
+// targetURL links to the reported offer or request, empty for other reports.
+func (r Report) targetURL() string {
+	switch r.Kind {
+	case "offer":
+		return fmt.Sprintf("/viewOffer?offerID=%d", r.TargetID)
+	case "request":
+		return fmt.Sprintf("/viewRequest?requestID=%d", r.TargetID)
+	}
+	return ""
+}
+
+func handelReport(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	payload := map[string]string{
+		"kind":   r.Form.Get("kind"),
+		"id":     r.Form.Get("targetID"),
+		"reason": r.Form.Get("reason"),
+	}
+	err = apiRequest("POST", "/report", token.Value, payload)
+	if err != nil {
+		fmt.Println(err)
+		noticePage("Report not sent", "Your report could not be sent, please try again.").Render(r.Context(), w)
+		return
+	}
+	log.Println("Report sent")
+	noticePage("Report sent", "Thank you, the moderators will have a look.").Render(r.Context(), w)
+}
+
+func handelBlock(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	action := "/block"
+	if r.Form.Get("unblock") == "true" {
+		action = "/unblock"
+	}
+	err = apiRequest("POST", action, token.Value, map[string]string{"user_id": r.Form.Get("userID")})
+	if err != nil {
+		fmt.Println(err)
+	}
+	http.Redirect(w, r, "/blocks", http.StatusSeeOther)
+}
+
+func blocksPageHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	blocked := []BlockedUser{}
+	err = apiGet("/blocks", token.Value, &blocked)
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = blocksPage(blocked).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+	}
+}
+
+func reportsPageHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	reports := []Report{}
+	err = apiGet("/reports", token.Value, &reports)
+	if err != nil {
+		fmt.Println(err)
+	}
+	for i := range reports {
+		reports[i].CreatedAt = convertTime(reports[i].CreatedAt)
+	}
+	err = reportsPage(reports).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+	}
+}
+
+func handelResolveReport(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/reports", http.StatusSeeOther)
+		return
+	}
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	payload := map[string]string{
+		"status":      r.Form.Get("status"),
+		"note":        r.Form.Get("note"),
+		"remove_post": r.Form.Get("removePost"),
+	}
+	err = apiRequest("POST", "/reports/"+r.Form.Get("reportID")+"/resolve", token.Value, payload)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		log.Printf("Report %v %v", r.Form.Get("reportID"), payload["status"])
+	}
+	http.Redirect(w, r, "/reports", http.StatusSeeOther)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("POST", "/report", http.StatusOK, Report{ID: 4})
+	rec := postForm(handelReport, "/handelReport", url.Values{"kind": {"offer"}, "targetID": {"5"}, "reason": {"spam"}})
+	wantHTML(t, rec, "Report sent")
+	if call := api.called("POST", "/report"); call.Body["kind"] != "offer" || call.Body["id"] != "5" || call.Body["reason"] != "spam" {
+		t.Fatalf("unexpected report %v", call.Body)
+	}
+
+	api.reply("POST", "/report", http.StatusBadRequest, map[string]string{"error": "can not report yourself"})
+	wantHTML(t, postForm(handelReport, "/handelReport", url.Values{"kind": {"user"}, "targetID": {"1"}}), "Report not sent")
+}
+
+func TestReportsPage(t *testing.T) {
+	api := newFakeAPI(t)
+	community := 3
+	api.reply("GET", "/reports", http.StatusOK, []Report{
+		{ID: 4, Kind: "offer", TargetID: 5, CommunityID: &community, Reason: "spam", ReporterName: "ada",
+			TargetUserName: "bob", CreatedAt: "2026-03-04T10:20:00Z"},
+		{ID: 5, Kind: "message", TargetID: 9, Reason: "rude", ReporterName: "cat", TargetUserName: "bob", Text: "go away"},
+	})
+
+	rec := get(reportsPageHandler, "/reports")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, "26/03/04 10:20: ada reported offer by <b>bob</b>", `href="/viewOffer?offerID=5"`, "Remove offer",
+		"<blockquote>go away</blockquote>", `name="reportID" value="5"`)
+	wantNoHTML(t, rec, "Remove message")
+
+	api.reply("POST", "/reports/4/resolve", http.StatusOK, Report{ID: 4})
+	rec = postForm(handelResolveReport, "/handelResolveReport", url.Values{
+		"reportID": {"4"}, "status": {"resolved"}, "note": {"removed"}, "removePost": {"true"},
+	})
+	wantRedirect(t, rec, http.StatusSeeOther, "/reports")
+	if call := api.called("POST", "/reports/4/resolve"); call.Body["status"] != "resolved" || call.Body["note"] != "removed" ||
+		call.Body["remove_post"] != "true" {
+		t.Fatalf("unexpected resolution %v", call.Body)
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	api := newFakeAPI(t)
+	api.reply("POST", "/block", http.StatusOK, map[string]string{})
+	api.reply("POST", "/unblock", http.StatusOK, map[string]string{})
+	api.reply("GET", "/blocks", http.StatusOK, []BlockedUser{{UserID: 2, Username: "bob"}})
+
+	wantRedirect(t, postForm(handelBlock, "/handelBlock", url.Values{"userID": {"2"}}), http.StatusSeeOther, "/blocks")
+	if call := api.called("POST", "/block"); call.Body["user_id"] != "2" {
+		t.Fatalf("unexpected block %v", call.Body)
+	}
+	postForm(handelBlock, "/handelBlock", url.Values{"userID": {"2"}, "unblock": {"true"}})
+	if call := api.called("POST", "/unblock"); call.Body["user_id"] != "2" {
+		t.Fatalf("unexpected unblock %v", call.Body)
+	}
+
+	rec := get(blocksPageHandler, "/blocks")
+	wantStatus(t, rec, http.StatusOK)
+	wantHTML(t, rec, "bob", `name="userID" value="2"`, `name="unblock" value="true"`)
+}
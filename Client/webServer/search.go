@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type SearchResult struct {
+	Kind        string `json:"kind"`
+	ID          int    `json:"id"`
+	CommunityID int    `json:"community_id"`
+	Title       string `json:"title"`
+	Snippet     string `json:"snippet"`
+}
+
+// link is the client page a search result points at.
+func (result SearchResult) link() string {
+	switch result.Kind {
+	case "offer":
+		return "/viewOffer?offerID=" + strconv.Itoa(result.ID)
+	case "request":
+		return "/viewRequest?requestID=" + strconv.Itoa(result.ID)
+	}
+	return "/joinCommunity"
+}
+
+func renderSearchResults(w http.ResponseWriter, r *http.Request) {
+	token, err := sessionToken(w, r)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		return
+	}
+	req, err := http.NewRequest("GET", apiURL+"/search?q="+url.QueryEscape(query), bytes.NewBuffer([]byte("")))
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	defer req.Body.Close()
+	req.Header.Set("Authorization", "Bearer "+token.Value)
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println("Error: ", resp.Status)
+		http.NotFound(w, r)
+		return
+	}
+	var found struct {
+		Results []SearchResult `json:"results"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&found)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	err = searchResults(found.Results).Render(r.Context(), w)
+	if err != nil {
+		fmt.Println(err)
+		http.NotFound(w, r)
+	}
+}
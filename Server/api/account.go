@@ -0,0 +1,301 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// deletedUserName is what other users see in place of a deleted account.
+const deletedUserName = "Deleted user"
+
+type ChangePasswordInput struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+type ChangeEmailInput struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	Email           string `json:"email" binding:"required,email"`
+}
+
+type DeleteAccountInput struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+}
+
+// checkCurrentPassword makes the user enter their password again before a
+// sensitive change, otherwise it writes the error response.
+func checkCurrentPassword(c *gin.Context, password string) (User, bool) {
+	user := currentUser(c)
+	if !CheckPassword(password, user.PasswordHash) {
+		c.JSON(403, gin.H{"error": "incorrect password"})
+		return user, false
+	}
+	return user, true
+}
+
+// revokeAllSessions signs the user out everywhere: refresh tokens are revoked
+// and access tokens issued until now stop working, see RequireAuth.
+func revokeAllSessions(tx *gorm.DB, userID uint) error {
+	result := tx.Model(&User{}).Where("id = ?", userID).Update("sessions_revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	return revokeUserSessions(tx, userID)
+}
+
+// ChangePassword sets a new password and signs the user out everywhere else.
+// The answer carries a new session for the client that made the change.
+func ChangePassword(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input ChangePasswordInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		user, ok := checkCurrentPassword(c, input.CurrentPassword)
+		if !ok {
+			return
+		}
+		passwordHash, err := HashPassword(input.NewPassword)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Model(&user).Update("password_hash", passwordHash)
+			if result.Error != nil {
+				return result.Error
+			}
+			return revokeAllSessions(tx, user.ID)
+		})
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		err = setSession(c, db, user.ID, "")
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"changed": "password"})
+	}
+}
+
+// ChangeEmail moves the account to a new address, which has to be verified
+// before the user can post again. The old address is told about the change,
+// and every session but the one making the change is signed out.
+func ChangeEmail(db *gorm.DB, mailer Mailer, publicURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input ChangeEmailInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		user, ok := checkCurrentPassword(c, input.CurrentPassword)
+		if !ok {
+			return
+		}
+		email := normalizeEmail(input.Email)
+		if strings.EqualFold(email, user.Email) {
+			c.JSON(400, gin.H{"error": "this is already your email address"})
+			return
+		}
+		var count int64
+		result := db.Model(&User{}).Where("email = ?", email).Count(&count)
+		if result.Error != nil {
+			c.JSON(400, gin.H{"error": result.Error.Error()})
+			return
+		}
+		if count > 0 {
+			c.JSON(400, gin.H{"error": "email address is already in use"})
+			return
+		}
+		oldEmail := user.Email
+		err = db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Model(&user).Updates(map[string]interface{}{"email": email, "email_verified_at": nil})
+			if result.Error != nil {
+				return result.Error
+			}
+			return revokeAllSessions(tx, user.ID)
+		})
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		user.Email = email
+		err = sendVerificationMail(c.Request.Context(), db, mailer, publicURL, user)
+		if err != nil {
+			log.Println("Error sending verification mail: ", err)
+		}
+		err = mailer.Send(c.Request.Context(), Mail{
+			To:      oldEmail,
+			Subject: "Your Comradary email address was changed",
+			Body: fmt.Sprintf("Hi %v,\n\nthe email address of your account was changed to %v.\n\n"+
+				"If you did not do this, reset your password right away.\n", user.UserName, email),
+		})
+		if err != nil {
+			log.Println("Error sending email change notice: ", err)
+		}
+		err = setSession(c, db, user.ID, "")
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"changed": "email"})
+	}
+}
+
+// handOverCommunities checks that the user can leave the communities they own.
+// Communities where they are the last member are left without an owner;
+// anywhere else ownership has to be transferred first, as when leaving.
+func handOverCommunities(tx *gorm.DB, userID uint) error {
+	var owned []Community
+	result := tx.Where("owner_id = ?", userID).Find(&owned)
+	if result.Error != nil {
+		return result.Error
+	}
+	for _, community := range owned {
+		var others int64
+		result = tx.Model(&Membership{}).Where("community_id = ? AND user_id <> ?", community.ID, userID).Count(&others)
+		if result.Error != nil {
+			return result.Error
+		}
+		if others > 0 {
+			return fmt.Errorf("transfer ownership of %v before deleting your account", community.Name)
+		}
+		result = tx.Model(&community).Update("owner_id", nil)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+// deleteAccount deletes the user's posts and photos for good, removes their
+// memberships and data exports and anonymises the account. Messages stay with
+// the people they were sent to, from a "Deleted user", without the link to
+// the deleted post. It returns the stored files the photos and exports used.
+func deleteAccount(tx *gorm.DB, user User) (offerIDs []uint, requestIDs []uint, files []string, err error) {
+	err = handOverCommunities(tx, user.ID)
+	if err != nil {
+		return
+	}
+	result := tx.Unscoped().Model(&Offer{}).Where("user_id = ?", user.ID).Pluck("id", &offerIDs)
+	if result.Error != nil {
+		return nil, nil, nil, result.Error
+	}
+	result = tx.Unscoped().Model(&Request{}).Where("user_id = ?", user.ID).Pluck("id", &requestIDs)
+	if result.Error != nil {
+		return nil, nil, nil, result.Error
+	}
+	var photos []Photo
+	result = tx.Unscoped().Where("user_id = ?", user.ID).Find(&photos)
+	if result.Error != nil {
+		return nil, nil, nil, result.Error
+	}
+	files = photoFiles(photos)
+	var exportFiles []string
+	result = tx.Model(&DataExport{}).Where("user_id = ? AND file <> ''", user.ID).Pluck("file", &exportFiles)
+	if result.Error != nil {
+		return nil, nil, nil, result.Error
+	}
+	files = append(files, exportFiles...)
+	for _, post := range []struct {
+		column string
+		ids    []uint
+	}{{"offer_id", offerIDs}, {"request_id", requestIDs}} {
+		if len(post.ids) == 0 {
+			continue
+		}
+		result = tx.Unscoped().Model(&Message{}).Where(post.column+" IN ?", post.ids).Update(post.column, nil)
+		if result.Error != nil {
+			return nil, nil, nil, result.Error
+		}
+	}
+	// the photos go first, they point at the posts
+	for _, model := range []interface{}{&Photo{}, &Offer{}, &Request{}} {
+		result = tx.Unscoped().Where("user_id = ?", user.ID).Delete(model)
+		if result.Error != nil {
+			return nil, nil, nil, result.Error
+		}
+	}
+	cleanups := []struct {
+		model interface{}
+		where string
+		args  []interface{}
+	}{
+		{&Membership{}, "user_id = ?", []interface{}{user.ID}},
+		{&JoinRequest{}, "user_id = ?", []interface{}{user.ID}},
+		{&Block{}, "blocker_id = ? OR blocked_id = ?", []interface{}{user.ID, user.ID}},
+		{&EmailToken{}, "user_id = ?", []interface{}{user.ID}},
+		{&DataExport{}, "user_id = ?", []interface{}{user.ID}},
+	}
+	for _, cleanup := range cleanups {
+		result = tx.Where(cleanup.where, cleanup.args...).Delete(cleanup.model)
+		if result.Error != nil {
+			return nil, nil, nil, result.Error
+		}
+	}
+	err = revokeAllSessions(tx, user.ID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	result = tx.Model(&user).Updates(map[string]interface{}{
+		"user_name":         deletedUserName,
+		"email":             fmt.Sprintf("deleted-%d@deleted.invalid", user.ID),
+		"email_verified_at": nil,
+		"password_hash":     "",
+		"display_name":      "",
+		"bio":               "",
+		"home_city":         "",
+		"avatar_id":         nil,
+	})
+	if result.Error != nil {
+		return nil, nil, nil, result.Error
+	}
+	result = tx.Delete(&user)
+	return offerIDs, requestIDs, files, result.Error
+}
+
+// DeleteAccount deletes the current user's account for good.
+func DeleteAccount(db *gorm.DB, photos *PhotoService, search SearchIndex) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input DeleteAccountInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		user, ok := checkCurrentPassword(c, input.CurrentPassword)
+		if !ok {
+			return
+		}
+		var offerIDs, requestIDs []uint
+		var files []string
+		err = db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			offerIDs, requestIDs, files, err = deleteAccount(tx, user)
+			return err
+		})
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		ctx := c.Request.Context()
+		for _, id := range offerIDs {
+			removeDocument(ctx, search, SearchOffer, id)
+		}
+		for _, id := range requestIDs {
+			removeDocument(ctx, search, SearchRequest, id)
+		}
+		photos.DeleteUnused(ctx, files)
+		c.JSON(200, gin.H{"deleted": user.ID})
+	}
+}
@@ -0,0 +1,463 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestProfiles(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	outsider := s.newUser("outsider")
+	community := s.newCommunity(ada, "garden", VisibilityPublic)
+	s.join(bob, community)
+
+	rec := s.call("PUT", "/profile", ada.Token, gin.H{"display_name": "  Ada L. ", "bio": "I fix bikes", "home_city": "Berlin"})
+	wantStatus(t, rec, 200)
+	if profile := decode[OwnProfile](t, rec); profile.DisplayName != "Ada L." || profile.Email != ada.Email {
+		t.Fatalf("unexpected profile %+v", profile)
+	}
+	wantError(t, s.call("PUT", "/profile", ada.Token, gin.H{"bio": strings.Repeat("a", maxBio+1)}), 400, "bio must be at most")
+	wantError(t, s.call("PUT", "/profile", ada.Token, gin.H{"display_name": strings.Repeat("é", maxDisplayName+1)}), 400, "display name")
+
+	avatar := s.upload(ada)
+	posted := s.upload(ada)
+	s.newOffer(ada, community, "bike", posted)
+	wantError(t, s.call("POST", "/profile/avatar", ada.Token, gin.H{"image_id": posted}), 400, "not an unused image")
+	wantError(t, s.call("POST", "/profile/avatar", ada.Token, gin.H{"image_id": s.upload(bob)}), 400, "not an unused image")
+	wantError(t, s.call("POST", "/profile/avatar", ada.Token, gin.H{"image_id": "me"}), 400, "must be a number")
+	rec = s.call("POST", "/profile/avatar", ada.Token, gin.H{"image_id": avatar})
+	wantStatus(t, rec, 200)
+	if profile := decode[OwnProfile](t, rec); profile.AvatarURL == "" || profile.AvatarThumbURL == "" {
+		t.Fatalf("the avatar has no links: %+v", profile)
+	}
+
+	// users sharing a community see the avatar, others only the profile
+	rec = s.call("GET", fmt.Sprintf("/user/%v", ada.ID), bob.Token, nil)
+	wantStatus(t, rec, 200)
+	profile := decode[PublicProfile](t, rec)
+	if profile.Bio != "I fix bikes" || profile.AvatarURL == "" {
+		t.Fatalf("unexpected profile %+v", profile)
+	}
+	wantStatus(t, s.fetch(profile.AvatarThumbURL), 200)
+	if strings.Contains(rec.Body.String(), ada.Email) {
+		t.Fatal("the public profile shows the email address")
+	}
+	rec = s.call("GET", fmt.Sprintf("/user/%v", ada.ID), outsider.Token, nil)
+	wantStatus(t, rec, 200)
+	if profile := decode[PublicProfile](t, rec); profile.UserName != "ada" || profile.AvatarURL != "" {
+		t.Fatalf("unexpected profile %+v", profile)
+	}
+	wantError(t, s.call("GET", "/user/999", bob.Token, nil), 404, "user not found")
+	// the id is never read as a query condition
+	for _, id := range []string{"ada", "0%20OR%20id=" + fmt.Sprint(ada.ID), fmt.Sprint(ada.ID) + "%20OR%201=1"} {
+		wantError(t, s.call("GET", "/user/"+id, bob.Token, nil), 400, "id is not a number")
+		wantError(t, s.call("GET", "/user/"+id+"/activity", bob.Token, nil), 400, "id is not a number")
+	}
+
+	rec = s.call("POST", "/profile/avatar", ada.Token, gin.H{"image_id": ""})
+	wantStatus(t, rec, 200)
+	if profile := decode[OwnProfile](t, rec); profile.AvatarURL != "" {
+		t.Fatalf("the avatar was not removed: %+v", profile)
+	}
+}
+
+func TestUserActivity(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	cat := s.newUser("cat")
+	garden := s.newCommunity(ada, "garden", VisibilityPublic)
+	kitchen := s.newCommunity(ada, "kitchen", VisibilityPublic)
+	s.join(bob, garden)
+	s.join(cat, kitchen)
+	s.newOffer(ada, garden, "bike", s.upload(ada))
+	given := s.newOffer(ada, garden, "sofa")
+	s.newOffer(ada, kitchen, "kettle")
+	s.newRequestPost(ada, garden, "ladder")
+	wantStatus(t, s.call("POST", offerPath(given, "status"), ada.Token, gin.H{"status": OfferGiven}), 200)
+
+	// only what is posted in shared communities, and no closed offers
+	rec := s.call("GET", fmt.Sprintf("/user/%v/activity", ada.ID), bob.Token, nil)
+	wantStatus(t, rec, 200)
+	activity := decode[UserActivity](t, rec)
+	if len(activity.Offers) != 1 || activity.Offers[0].Title != "bike" || activity.Offers[0].Photos[0].URL == "" ||
+		len(activity.Requests) != 1 {
+		t.Fatalf("unexpected activity %+v", activity)
+	}
+	rec = s.call("GET", fmt.Sprintf("/user/%v/activity", ada.ID), cat.Token, nil)
+	if activity := decode[UserActivity](t, rec); len(activity.Offers) != 1 || activity.Offers[0].Title != "kettle" ||
+		len(activity.Requests) != 0 {
+		t.Fatalf("unexpected activity %+v", activity)
+	}
+	wantError(t, s.call("GET", "/user/999/activity", bob.Token, nil), 404, "user not found")
+}
+
+func TestReports(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.newUser("owner")
+	mod := s.newUser("mod")
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	admin := s.newUser("admin")
+	community := s.newCommunity(owner, "garden", VisibilityPublic)
+	for _, user := range []testUser{mod, ada, bob} {
+		s.join(user, community)
+	}
+	wantStatus(t, s.call("POST", communityPath(community, "promote"), owner.Token, gin.H{"user_id": fmt.Sprint(mod.ID)}), 200)
+	err := s.db.Model(&User{}).Where("id = ?", admin.ID).Update("is_admin", true).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer := s.newOffer(bob, community, "cheap watches")
+	request := s.newRequestPost(bob, community, "money")
+	s.sendMessage(ada, bob, "which watches?", offer)
+	message := s.sendMessage(bob, ada, "buy my watches", offer)
+
+	report := func(user testUser, kind string, id uint) *Report {
+		t.Helper()
+		rec := s.call("POST", "/report", user.Token, gin.H{"kind": kind, "id": fmt.Sprint(id), "reason": "spam"})
+		wantStatus(t, rec, 200)
+		report := decode[Report](t, rec)
+		return &report
+	}
+	offerReport := report(ada, ReportOffer, offer.ID)
+	if again := report(ada, ReportOffer, offer.ID); again.ID != offerReport.ID {
+		t.Fatal("reporting twice filed a second report")
+	}
+	requestReport := report(ada, ReportRequest, request.ID)
+	messageReport := report(ada, ReportMessage, message.ID)
+	userReport := report(ada, ReportUser, bob.ID)
+	if messageReport.TargetUserID != bob.ID || messageReport.CommunityID == nil || userReport.CommunityID != nil {
+		t.Fatalf("unexpected reports %+v and %+v", messageReport, userReport)
+	}
+
+	reportErrors := []struct {
+		name  string
+		user  testUser
+		input gin.H
+		error string
+	}{
+		{"own post", bob, gin.H{"kind": ReportOffer, "id": fmt.Sprint(offer.ID), "reason": "spam"}, "can not report yourself"},
+		{"message to someone else", mod, gin.H{"kind": ReportMessage, "id": fmt.Sprint(message.ID), "reason": "spam"}, "sent to you"},
+		{"outside the community", admin, gin.H{"kind": ReportOffer, "id": fmt.Sprint(offer.ID), "reason": "spam"}, "does not belong"},
+		{"unknown kind", ada, gin.H{"kind": "community", "id": fmt.Sprint(community.ID), "reason": "spam"}, "kind must be"},
+		{"no reason", ada, gin.H{"kind": ReportUser, "id": fmt.Sprint(bob.ID)}, "Reason"},
+		{"bad id", ada, gin.H{"kind": ReportUser, "id": "bob", "reason": "spam"}, "id must be a number"},
+	}
+	for _, test := range reportErrors {
+		t.Run(test.name, func(t *testing.T) {
+			wantError(t, s.call("POST", "/report", test.user.Token, test.input), 400, test.error)
+		})
+	}
+
+	queue := func(user testUser, query string) []ReportInfo {
+		t.Helper()
+		rec := s.call("GET", "/reports"+query, user.Token, nil)
+		wantStatus(t, rec, 200)
+		return decode[[]ReportInfo](t, rec)
+	}
+	// moderators see the reports of their community, admins every report
+	if got := queue(mod, ""); len(got) != 3 || got[2].Text != "buy my watches" || got[0].TargetUserName != "bob" {
+		t.Fatalf("unexpected moderator queue %+v", got)
+	}
+	if got := queue(admin, ""); len(got) != 4 {
+		t.Fatalf("admin sees %v reports, want 4", len(got))
+	}
+	if got := queue(ada, ""); len(got) != 0 {
+		t.Fatalf("a member sees %v reports", len(got))
+	}
+
+	resolve := func(user testUser, report *Report, input gin.H) *httptest.ResponseRecorder {
+		return s.call("POST", fmt.Sprintf("/reports/%v/resolve", report.ID), user.Token, input)
+	}
+	wantError(t, resolve(ada, offerReport, gin.H{"status": ReportResolved}), 403, "not a moderator")
+	wantError(t, resolve(mod, userReport, gin.H{"status": ReportResolved}), 403, "only site admins")
+	wantError(t, resolve(mod, offerReport, gin.H{"status": "done"}), 400, "resolved or dismissed")
+	wantError(t, resolve(mod, messageReport, gin.H{"status": ReportResolved, "remove_post": "true"}), 400, "only reported offers and requests")
+	wantError(t, s.call("POST", "/reports/999/resolve", mod.Token, gin.H{"status": ReportResolved}), 404, "report not found")
+	wantError(t, s.call("POST", fmt.Sprintf("/reports/999%%20OR%%20id=%v/resolve", userReport.ID), mod.Token,
+		gin.H{"status": ReportResolved}), 400, "id is not a number")
+
+	wantStatus(t, resolve(mod, offerReport, gin.H{"status": ReportResolved, "note": "removed", "remove_post": "true"}), 200)
+	wantStatus(t, s.call("GET", offerPath(offer, ""), ada.Token, nil), 404)
+	wantError(t, resolve(mod, offerReport, gin.H{"status": ReportDismissed}), 400, "already resolved")
+	wantStatus(t, resolve(mod, messageReport, gin.H{"status": ReportDismissed}), 200)
+	wantStatus(t, resolve(admin, userReport, gin.H{"status": ReportResolved, "note": "warned"}), 200)
+	wantStatus(t, resolve(owner, requestReport, gin.H{"status": ReportResolved, "remove_post": "true"}), 200)
+
+	if got := queue(admin, ""); len(got) != 0 {
+		t.Fatalf("%v reports are still open", len(got))
+	}
+	if got := queue(admin, "?status="+ReportDismissed); len(got) != 1 || got[0].ID != messageReport.ID {
+		t.Fatalf("unexpected dismissed reports %+v", got)
+	}
+	rec := s.call("GET", communityPath(community, "moderation"), owner.Token, nil)
+	var actions []string
+	for _, action := range decode[Page[ModerationAction]](t, rec).Items {
+		actions = append(actions, action.Action)
+	}
+	want := []string{ActionResolveReport, ActionRemovePost, ActionDismissReport, ActionResolveReport, ActionRemovePost, ActionPromote}
+	if fmt.Sprint(actions) != fmt.Sprint(want) {
+		t.Fatalf("moderation log is %v, want %v", actions, want)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	outsider := s.newUser("outsider")
+	garden := s.newCommunity(ada, "garden", VisibilityPublic)
+	club := s.newCommunity(outsider, "bike club", VisibilityInvite)
+	s.newCommunity(outsider, "bike repair", VisibilityPublic)
+	s.join(bob, garden)
+	bike := s.newOffer(ada, garden, "red bike")
+	s.newRequestPost(bob, garden, "bike pump")
+	s.newOffer(outsider, club, "bike lights")
+
+	search := func(user testUser, q string) []string {
+		t.Helper()
+		rec := s.call("GET", "/search?q="+q, user.Token, nil)
+		wantStatus(t, rec, 200)
+		var found []string
+		for _, result := range decode[struct{ Results []SearchResult }](t, rec).Results {
+			found = append(found, result.Kind+":"+result.Title)
+		}
+		sort.Strings(found)
+		return found
+	}
+	// posts of the user's communities and communities anyone can find, by kind
+	if got := fmt.Sprint(search(ada, "bike")); got != "[community:bike repair offer:red bike request:bike pump]" {
+		t.Fatalf("ada found %v", got)
+	}
+	if got := search(ada, "watches"); len(got) != 0 {
+		t.Fatalf("ada found %v", got)
+	}
+	wantStatus(t, s.call("POST", "/block", ada.Token, gin.H{"user_id": fmt.Sprint(bob.ID)}), 200)
+	wantStatus(t, s.call("PUT", offerPath(bike, ""), ada.Token, gin.H{"title": "blue bicycle", "description": "fast"}), 200)
+	if got := fmt.Sprint(search(ada, "bike")); got != "[community:bike repair]" {
+		t.Fatalf("after blocking and renaming ada found %v", got)
+	}
+	wantError(t, s.call("GET", "/search?q=bike&limit=0", ada.Token, nil), 400, "limit")
+}
+
+func TestChangePassword(t *testing.T) {
+	s := newTestServer(t)
+	user := s.newUser("ada")
+	old := oldToken(t, user.ID)
+
+	wantError(t, s.call("POST", "/account/password", user.Token, gin.H{"current_password": "wrong", "new_password": "new password"}), 403, "incorrect password")
+	wantStatus(t, s.call("POST", "/account/password", user.Token, gin.H{"current_password": testPassword}), 400)
+	rec := s.call("POST", "/account/password", user.Token, gin.H{"current_password": testPassword, "new_password": "new password"})
+	wantStatus(t, rec, 200)
+	// the client that made the change gets a new session, all others end
+	wantStatus(t, s.call("GET", "/profile", rec.Header().Get("token"), nil), 200)
+	wantStatus(t, s.call("POST", "/refresh", "", gin.H{"refresh_token": rec.Header().Get("refresh_token")}), 200)
+	wantError(t, s.call("GET", "/profile", old, nil), 401, "signed out")
+	wantError(t, s.call("POST", "/refresh", "", gin.H{"refresh_token": user.RefreshToken}), 401, "invalid refresh token")
+	wantError(t, s.call("POST", "/signin", "", gin.H{"email": user.Email, "password": testPassword}), 400, "incorrect password")
+	s.signIn(user.Email, "new password")
+}
+
+func TestChangeEmail(t *testing.T) {
+	s := newTestServer(t)
+	user := s.newUser("ada")
+	s.newUser("bob")
+
+	change := func(email string, password string) *httptest.ResponseRecorder {
+		return s.call("POST", "/account/email", user.Token, gin.H{"current_password": password, "email": email})
+	}
+	wantError(t, change("ada@new.example.com", "wrong"), 403, "incorrect password")
+	wantError(t, change("ADA@example.com", testPassword), 400, "already your email address")
+	wantError(t, change("bob@example.com", testPassword), 400, "already in use")
+	wantStatus(t, change("not an address", testPassword), 400)
+	rec := change("Ada@New.example.com", testPassword)
+	wantStatus(t, rec, 200)
+	token := rec.Header().Get("token")
+
+	sent := s.mailer.Sent()
+	if last := sent[len(sent)-1]; last.To != user.Email || !strings.Contains(last.Body, "ada@new.example.com") {
+		t.Fatalf("the old address was not told: %+v", last)
+	}
+	// the new address has to be verified before posting again
+	profile := decode[OwnProfile](t, s.call("GET", "/profile", token, nil))
+	if profile.Email != "ada@new.example.com" || profile.EmailVerifiedAt != nil {
+		t.Fatalf("unexpected profile %+v", profile)
+	}
+	wantError(t, s.call("POST", "/createCommunity", token, gin.H{"name": "garden", "country": "DE", "city": "Berlin"}), 403, "not verified")
+	wantStatus(t, s.call("POST", "/verifyEmail", "", gin.H{"token": s.mailToken("ada@new.example.com")}), 200)
+	wantStatus(t, s.call("POST", "/createCommunity", token, gin.H{"name": "garden", "country": "DE", "city": "Berlin"}), 200)
+	s.signIn("ada@new.example.com", testPassword)
+}
+
+func TestDeleteAccount(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	lonely := s.newCommunity(ada, "lonely", VisibilityPublic)
+	shared := s.newCommunity(ada, "garden", VisibilityPublic)
+	s.join(bob, shared)
+	photo := s.upload(ada)
+	offer := s.newOffer(ada, shared, "bike", photo)
+	files := s.photoFiles(photo)
+	s.newRequestPost(ada, shared, "ladder")
+	gone := s.newOffer(ada, shared, "lamp")
+	wantStatus(t, s.call("DELETE", offerPath(gone, ""), ada.Token, nil), 200)
+	s.sendMessage(bob, ada, "can I pick it up?", offer)
+	s.sendMessage(ada, bob, "see you tomorrow", offer)
+
+	wantError(t, s.call("DELETE", "/account", ada.Token, gin.H{"current_password": "wrong"}), 403, "incorrect password")
+	wantError(t, s.call("DELETE", "/account", ada.Token, gin.H{"current_password": testPassword}), 400, "transfer ownership of garden")
+	wantStatus(t, s.call("POST", communityPath(shared, "transfer"), ada.Token, gin.H{"user_id": fmt.Sprint(bob.ID)}), 200)
+	wantStatus(t, s.call("DELETE", "/account", ada.Token, gin.H{"current_password": testPassword}), 200)
+
+	wantStatus(t, s.call("GET", "/profile", ada.Token, nil), 401)
+	wantError(t, s.call("POST", "/signin", "", gin.H{"email": ada.Email, "password": testPassword}), 400, "")
+	// messages stay with bob, the posts go
+	if got := messageTexts(s.history(bob, ada, nil)); fmt.Sprint(got) != "[can I pick it up? see you tomorrow]" {
+		t.Fatalf("bob's history is %v", got)
+	}
+	rec := s.call("GET", "/conversations", bob.Token, nil)
+	wantStatus(t, rec, 200)
+	inbox := decode[[]ConversationSummary](t, rec)
+	if len(inbox) != 1 || inbox[0].PostTitle != deletedPostTitle || inbox[0].OtherUserName != deletedUserName ||
+		inbox[0].LastMessage == nil || inbox[0].LastMessage.Text != "see you tomorrow" {
+		t.Fatalf("bob's inbox is %+v", inbox)
+	}
+	wantStatus(t, s.call("GET", offerPath(offer, ""), bob.Token, nil), 404)
+	for _, model := range []interface{}{&Offer{}, &Request{}, &Photo{}} {
+		var left int64
+		s.db.Unscoped().Model(model).Where("user_id = ?", ada.ID).Count(&left)
+		if left != 0 {
+			t.Fatalf("%v %T rows of the deleted user are left", left, model)
+		}
+	}
+	for _, name := range files {
+		if s.stored(name) {
+			t.Fatalf("%v of the deleted user is left", name)
+		}
+	}
+	var community Community
+	s.db.First(&community, lonely.ID)
+	if community.OwnerID != nil {
+		t.Fatalf("the deleted user still owns %v", community.Name)
+	}
+	// the address can be used again
+	s.newUser("ada")
+}
+
+func TestDataExport(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	community := s.newCommunity(ada, "garden", VisibilityPublic)
+	s.join(bob, community)
+	offer := s.newOffer(ada, community, "bike", s.upload(ada))
+	s.sendMessage(bob, ada, "is the bike still there?", offer)
+
+	rec := s.call("POST", "/account/export", ada.Token, nil)
+	wantStatus(t, rec, 200)
+	export := decode[DataExport](t, rec)
+	if export.Status != ExportPending {
+		t.Fatalf("unexpected export %+v", export)
+	}
+	wantError(t, s.call("POST", "/account/export", ada.Token, nil), 400, "already being prepared")
+	path := fmt.Sprintf("/account/export/%v/download", export.ID)
+	wantError(t, s.call("GET", path, ada.Token, nil), 404, "export not found")
+
+	s.runExports()
+	rec = s.call("GET", "/account/exports", ada.Token, nil)
+	wantStatus(t, rec, 200)
+	exports := decode[[]DataExport](t, rec)
+	if len(exports) != 1 || exports[0].Status != ExportReady || exports[0].ExpiresAt == nil {
+		t.Fatalf("unexpected exports %+v", exports)
+	}
+	sent := s.mailer.Sent()
+	if last := sent[len(sent)-1]; last.To != ada.Email || !strings.Contains(last.Body, testPublicURL+"/settings") {
+		t.Fatalf("unexpected export mail %+v", last)
+	}
+
+	wantError(t, s.call("GET", path, bob.Token, nil), 404, "export not found")
+	wantError(t, s.call("GET", fmt.Sprintf("/account/export/0%%20OR%%20id=%v/download", export.ID), bob.Token, nil),
+		400, "id is not a number")
+	rec = s.call("GET", path, ada.Token, nil)
+	wantStatus(t, rec, 200)
+	if !strings.Contains(rec.Header().Get("Content-Disposition"), "comradary-export-") {
+		t.Fatalf("unexpected Content-Disposition %q", rec.Header().Get("Content-Disposition"))
+	}
+	archive, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data PersonalData
+	var files []string
+	for _, file := range archive.File {
+		files = append(files, file.Name)
+		if file.Name != "data.json" {
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := io.ReadAll(reader)
+		reader.Close()
+		err = json.Unmarshal(raw, &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(files) != 2 || data.User.Email != ada.Email || len(data.Offers) != 1 || len(data.Photos) != 1 ||
+		len(data.MessagesInbox) != 1 || strings.Contains(string(rec.Body.Bytes()), "$2a$") {
+		t.Fatalf("unexpected export of %v: %+v", files, data)
+	}
+
+	err = s.db.Model(&DataExport{}).Where("id = ?", export.ID).Update("expires_at", time.Now().Add(-time.Minute)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantError(t, s.call("GET", path, ada.Token, nil), 404, "export not found")
+}
+
+func TestExportRequeue(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	wantStatus(t, s.call("POST", "/account/export", ada.Token, nil), 200)
+	wantStatus(t, s.call("POST", "/account/export", bob.Token, nil), 200)
+	// another process is building ada's export, bob's was claimed by one
+	// that died
+	fresh := time.Now().Add(-time.Minute)
+	stale := time.Now().Add(-exportClaimTimeout - time.Minute)
+	for user, claimed := range map[uint]time.Time{ada.ID: fresh, bob.ID: stale} {
+		err := s.db.Model(&DataExport{}).Where("user_id = ?", user).
+			Updates(map[string]interface{}{"status": ExportRunning, "claimed_at": claimed}).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.runExports()
+	for user, status := range map[uint]string{ada.ID: ExportRunning, bob.ID: ExportReady} {
+		var export DataExport
+		err := s.db.Where("user_id = ?", user).First(&export).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		if export.Status != status {
+			t.Fatalf("export of user %v is %v, want %v", user, export.Status, status)
+		}
+	}
+}
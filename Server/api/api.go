@@ -1,49 +1,70 @@
 package api
 
 import (
+	"errors"
 	"fmt"
-	"image/jpeg"
-	"image/png"
+	"io"
 	"log"
-	"os"
-	"path/filepath"
+	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v4"
-	"github.com/nfnt/resize"
 	"golang.org/x/crypto/bcrypt"
-	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
 
-// creaet random key
-var (
-	jwtKey    = []byte("1asf12vsr2agrasg892yh780gahe780g0sbh8")
-	sqlServer = "root:password@tcp(127.0.0.1:3306)"
-)
-
 type User struct {
 	gorm.Model
-	UserName         string
-	Email            string `gorm:"unique"`
-	PasswordHash     string
-	Offers           []Offer     `gorm:"foreignKey:UserID"`
-	Requests         []Request   `gorm:"foreignKey:UserID"`
-	ProfilePhoto     *Photo      `gorm:"foreignKey:UserID"`
-	Communities      []Community `gorm:"many2many:user_communities;"`
-	OwnedCommunities []Community `gorm:"foreignKey:OwnerID"`
-	MessagesInbox    []Message   `gorm:"foreignKey:ReciverID"`
-	MessagesOutbox   []Message   `gorm:"foreignKey:SenderID"`
+	UserName        string
+	Email           string `gorm:"unique"`
+	EmailVerifiedAt *time.Time
+	PasswordHash    string    `json:"-"`
+	IsAdmin         bool      `gorm:"default:false"` // set by hand in the database
+	Offers          []Offer   `gorm:"foreignKey:UserID"`
+	Requests        []Request `gorm:"foreignKey:UserID"`
+	// DisplayName, Bio and HomeCity are shown on the profile, see PublicProfile
+	DisplayName string `gorm:"size:64"`
+	Bio         string `gorm:"size:1000"`
+	HomeCity    string `gorm:"size:100"`
+	// AvatarID is the photo shown on the profile
+	AvatarID *uint
+	// SessionsRevokedAt invalidates the access tokens issued before it
+	SessionsRevokedAt *time.Time
+	Communities       []Community `gorm:"many2many:user_communities;"`
+	OwnedCommunities  []Community `gorm:"foreignKey:OwnerID"`
+	MessagesInbox     []Message   `gorm:"foreignKey:ReceiverID"`
+	MessagesOutbox    []Message   `gorm:"foreignKey:SenderID"`
 }
 
 type Photo struct {
 	gorm.Model
-	Path      string `gorm:"unique" json:"path"`
+	Path      string `gorm:"index" json:"path"`
 	OfferID   *uint
 	RequestID *uint
 	UserID    uint `json:"user_id"`
+	// MediumPath and ThumbPath are the smaller renditions of the image at
+	// Path, empty for photos uploaded before renditions existed
+	MediumPath string `json:"-"`
+	ThumbPath  string `json:"-"`
+	// Position orders the photos of an offer or request, lowest first
+	Position int    `gorm:"default:0" json:"position"`
+	Caption  string `json:"caption"`
+	// signed links to the renditions, filled in for users who may see them
+	ThumbURL    string `gorm:"-" json:"thumb_url"`
+	URL         string `gorm:"-" json:"url"`
+	OriginalURL string `gorm:"-" json:"original_url"`
+}
+
+// path is the stored file of the given rendition of the photo.
+func (p Photo) path(size string) string {
+	switch {
+	case size == SizeThumb && p.ThumbPath != "":
+		return p.ThumbPath
+	case size != SizeOriginal && p.MediumPath != "":
+		return p.MediumPath
+	}
+	return p.Path
 }
 
 type Offer struct {
@@ -53,6 +74,7 @@ type Offer struct {
 	Photos        []Photo   `gorm:"foreignKey:OfferID"`
 	UserID        uint      `json:"user_id"`
 	CommunityID   uint      `json:"community_id"`
+	Status        string    `gorm:"default:open" json:"status"`
 	Messages      []Message `gorm:"foreignKey:OfferID"`
 	CreatedAt     time.Time
 	MessagesInbox []Message `gorm:"foreignKey:OfferID"`
@@ -60,37 +82,42 @@ type Offer struct {
 
 type Request struct {
 	gorm.Model
-	Title       string
-	Description string
-	Photos      []Photo `gorm:"foreignKey:RequestID"`
-	UserID      uint
-	CommunityID uint
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Photos      []Photo   `gorm:"foreignKey:RequestID"`
+	UserID      uint      `json:"user_id"`
+	CommunityID uint      `json:"community_id"`
 	Messages    []Message `gorm:"foreignKey:RequestID"`
 	CreatedAt   time.Time
 }
 
 type Community struct {
 	gorm.Model
-	Name     string `gorm:"unique"`
-	Country  string
-	City     string
-	OwnerID  *uint
-	Users    []User    `gorm:"many2many:user_communities;"`
-	Offers   []Offer   `gorm:"foreignKey:CommunityID"`
-	Requests []Request `gorm:"foreignKey:CommunityID"`
+	Name    string `gorm:"unique"`
+	Country string
+	City    string
+	OwnerID *uint
+	// Visibility is public, request (members need approval) or invite
+	Visibility string    `gorm:"size:16;default:public"`
+	Users      []User    `gorm:"many2many:user_communities;"`
+	Offers     []Offer   `gorm:"foreignKey:CommunityID"`
+	Requests   []Request `gorm:"foreignKey:CommunityID"`
 }
 
 type Message struct {
 	gorm.Model
-	Text      string
-	SenderID  uint
-	ReciverID uint
-	OfferID   *uint
-	RequestID *uint
+	Text           string
+	SenderID       uint
+	ReceiverID     uint
+	OfferID        *uint
+	RequestID      *uint
+	ConversationID *uint `gorm:"index"`
+	DeliveredAt    *time.Time
+	ReadAt         *time.Time
 }
 type SignUpInput struct {
 	UserName string `json:"username" binding:"required"`
-	Email    string `json:"email" binding:"required"`
+	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required"`
 }
 
@@ -102,30 +129,127 @@ type SignInInput struct {
 type OfferInput struct {
 	Title       string `json:"title" binding:"required"`
 	Description string `json:"description" binding:"required"`
-	UserID      string `json:"user_id" binding:"required"`
 	CommunityID string `json:"community_id" binding:"required"`
-	Token       string `json:"user_token" binding:"required"`
-	ImageID     string `json:"image_id" binding:"required"`
-}
-
-func SetupRoutes(db *gorm.DB, router *gin.Engine) {
-	router.POST("/image", CreateImage(db))
-	router.POST("/signup", SignUp(db))
-	router.POST("/signin", SignIn(db))
-	router.POST("/joinCommunity", JoinCommunity(db))
-	router.POST("/createCommunity", createCommunity(db))
-	router.POST("/offers", CreateOffer(db))
-	router.GET("/offers/:id", GetOffersByCommunityId(db))
-	router.GET("/myOffers", GetOffersByUserId(db))
-	router.GET("/images/:id", GetImageById(db))
-	router.GET("/communities/:country", GetCommunityByCountry(db))
-	router.GET("/userCommunities", GetUserCommunities(db))
-	router.GET("/offer/:id", GetOfferById(db))
-
-	router.POST("/messages", SendMesssage(db))
-	router.GET("/messages", GetMessages(db))
-	router.GET("/user/:id", GetUserById(db))
-	router.GET("/offerResp/:id", GetOfferResp(db))
+	ImageID     string `json:"image_id"`
+	// ImageIDs is a comma separated list of further images, shown in order
+	ImageIDs string `json:"image_ids"`
+}
+
+// Services bundles the backends the handlers need besides the database.
+// PublicURL is where the web client is reachable, for links in mails, and
+// APIURL where browsers reach the api, for image links.
+type Services struct {
+	Images    ImageStore
+	Search    SearchIndex
+	Mail      Mailer
+	Events    *Hub
+	Exports   *ExportWorker
+	PublicURL string
+	APIURL    string
+}
+
+func SetupRoutes(db *gorm.DB, services Services, router *gin.Engine) {
+	store := &GormStore{DB: db}
+	users := NewUserService(store)
+	communities := NewCommunityService(store, services.Search)
+	posts := NewPostService(store, services.Search, services.Images)
+	messages := NewMessageService(store, services.Events)
+	photos := NewPhotoService(store, services.Images)
+
+	public := router.Group("/")
+	public.POST("/signup", SignUp(db, users, services.Mail, services.PublicURL))
+	public.POST("/signin", SignIn(db, users))
+	public.POST("/refresh", RefreshSession(db))
+	public.POST("/signout", SignOut(db))
+	public.POST("/verifyEmail", VerifyEmail(db))
+	public.POST("/forgotPassword", ForgotPassword(db, services.Mail, services.PublicURL))
+	public.POST("/resetPassword", ResetPassword(db))
+	public.GET("/images/:id", GetImageById(photos))
+	public.GET("/communities/:country", GetCommunityByCountry(communities))
+
+	authed := router.Group("/", RequireAuth(db))
+	authed.POST("/resendVerification", ResendVerification(db, services.Mail, services.PublicURL))
+	authed.GET("/userCommunities", GetUserCommunities(communities))
+	authed.GET("/offers/:id", GetOffersByCommunityId(posts, services.APIURL))
+	authed.GET("/myOffers", GetOffersByUserId(posts, services.APIURL))
+	authed.GET("/offer/:id", GetOfferById(posts, services.APIURL))
+	authed.GET("/offerResp/:id", GetPostResponders(posts, SearchOffer))
+	authed.GET("/messages", GetMessages(messages))
+	authed.GET("/conversations", GetConversations(messages))
+	authed.GET("/conversations/:id", GetConversation(messages))
+	authed.POST("/conversations/:id/read", MarkConversationRead(messages))
+	authed.POST("/typing", SendTyping(messages))
+	authed.GET("/unread", GetUnreadCount(messages))
+	authed.GET("/blocks", GetBlocks(users))
+	authed.POST("/block", BlockUser(users))
+	authed.POST("/unblock", UnblockUser(users))
+	authed.POST("/report", CreateReport(db))
+	authed.GET("/reports", GetReports(db))
+	authed.POST("/reports/:id/resolve", ResolveReport(db, services.Search))
+	authed.GET("/events", StreamEvents(services.Events))
+	authed.GET("/user/:id", GetUserById(users, photos, services.APIURL))
+	authed.GET("/user/:id/activity", GetUserActivity(users, services.APIURL))
+	authed.GET("/profile", GetOwnProfile(photos, services.APIURL))
+	authed.PUT("/profile", UpdateProfile(users, photos, services.APIURL))
+	authed.GET("/requests/:id", GetRequestsByCommunityId(posts, services.APIURL))
+	authed.GET("/myRequests", GetRequestsByUserId(posts, services.APIURL))
+	authed.GET("/request/:id", GetRequestById(posts, services.APIURL))
+	authed.GET("/image/:id/url", GetImageURL(photos, services.APIURL))
+	authed.GET("/requestResp/:id", GetPostResponders(posts, SearchRequest))
+	authed.GET("/search", Search(db, services.Search))
+	authed.GET("/community/:id/members", GetCommunityMembers(communities))
+	authed.GET("/community/:id/bans", GetCommunityBans(communities))
+	authed.GET("/community/:id/moderation", GetModerationLog(communities))
+	authed.POST("/community/:id/leave", LeaveCommunity(communities))
+	authed.GET("/community/:id/joinRequests", GetJoinRequests(communities))
+	authed.GET("/community/:id/invites", GetInvites(communities))
+	authed.GET("/invite/:code", GetInvite(communities))
+
+	authed.POST("/account/password", ChangePassword(db))
+	authed.POST("/account/email", ChangeEmail(db, services.Mail, services.PublicURL))
+	authed.DELETE("/account", DeleteAccount(db, photos, services.Search))
+	authed.POST("/account/export", RequestDataExport(db, services.Exports))
+	authed.GET("/account/exports", GetDataExports(db))
+	authed.GET("/account/export/:id/download", DownloadDataExport(db, services.Images))
+
+	// posting anything needs a verified email address
+	verified := authed.Group("/", RequireVerified())
+	verified.POST("/image", CreateImage(photos))
+	verified.POST("/profile/avatar", SetAvatar(users, photos, services.APIURL))
+	verified.POST("/joinCommunity", JoinCommunity(communities))
+	verified.POST("/createCommunity", createCommunity(communities))
+	verified.POST("/community/:id/kick", KickMember(communities))
+	verified.POST("/community/:id/ban", BanMember(communities))
+	verified.POST("/community/:id/unban", UnbanMember(communities))
+	verified.POST("/community/:id/promote", PromoteMember(communities))
+	verified.POST("/community/:id/demote", DemoteMember(communities))
+	verified.POST("/community/:id/transfer", TransferOwnership(communities))
+	verified.POST("/community/:id/removePost", RemovePost(posts))
+	verified.POST("/community/:id/visibility", SetCommunityVisibility(communities))
+	verified.POST("/community/:id/approveJoin", ApproveJoinRequest(communities))
+	verified.POST("/community/:id/rejectJoin", RejectJoinRequest(communities))
+	verified.POST("/community/:id/invites", CreateInvite(communities))
+	verified.POST("/community/:id/revokeInvite", RevokeInvite(communities))
+	verified.POST("/joinWithInvite", JoinWithInvite(communities))
+
+	verified.POST("/offers", CreateOffer(posts))
+	verified.PUT("/offer/:id", UpdateOffer(posts, services.APIURL))
+	verified.DELETE("/offer/:id", DeleteOffer(posts))
+	verified.POST("/offer/:id/status", SetOfferStatus(posts, services.APIURL))
+	verified.POST("/offer/:id/photos", AddPostPhotos(posts, services.APIURL, SearchOffer))
+	verified.POST("/offer/:id/photos/order", ReorderPostPhotos(posts, services.APIURL, SearchOffer))
+	verified.PUT("/offer/:id/photos/:photoID", CaptionPostPhoto(posts, services.APIURL, SearchOffer))
+	verified.DELETE("/offer/:id/photos/:photoID", RemovePostPhoto(posts, services.APIURL, SearchOffer))
+
+	verified.POST("/messages", SendMesssage(messages))
+
+	verified.POST("/requests", CreateRequest(posts))
+	verified.PUT("/request/:id", UpdateRequest(posts, services.APIURL))
+	verified.DELETE("/request/:id", DeleteRequest(posts))
+	verified.POST("/request/:id/photos", AddPostPhotos(posts, services.APIURL, SearchRequest))
+	verified.POST("/request/:id/photos/order", ReorderPostPhotos(posts, services.APIURL, SearchRequest))
+	verified.PUT("/request/:id/photos/:photoID", CaptionPostPhoto(posts, services.APIURL, SearchRequest))
+	verified.DELETE("/request/:id/photos/:photoID", RemovePostPhoto(posts, services.APIURL, SearchRequest))
 }
 
 func InsertTestData(db *gorm.DB) {
@@ -154,125 +278,71 @@ func InsertTestData(db *gorm.DB) {
 		log.Fatal("Error creating request: ", result.Error)
 	}
 }
-func ConnectDB() *gorm.DB {
-	dsn := sqlServer + "/mysql?charset=utf8mb4&parseTime=True&loc=Local"
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
-	if err != nil {
-		log.Fatal("Error connecting to the database: ", err)
-	}
-	//DropAllTables(db)
-	err = db.AutoMigrate(&User{}, &Photo{}, &Offer{}, &Request{}, &Community{}, &Message{})
-	if err != nil {
-		log.Fatal("Error Migrating the database: ", err)
-	}
-	//log.Println("Inserting test data")
-	//InsertTestData(db)
-	return db
-}
-
-func CreateImage(db *gorm.DB) gin.HandlerFunc {
+func CreateImage(photos *PhotoService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var err error
-		err = c.Request.ParseMultipartForm(10 ^ 6*5) // 5MB
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImageUpload+1<<20)
+		file, err := c.FormFile("image")
 		if err != nil {
-			c.JSON(399, gin.H{"error": err.Error()})
+			c.JSON(400, gin.H{"error": "no image file"})
 			return
 		}
-		form, err := c.MultipartForm()
-		if err != nil {
-			c.JSON(401, gin.H{"error": err.Error()})
+		if file.Size > maxImageUpload {
+			c.JSON(413, gin.H{"error": fmt.Sprintf("image must be at most %v MB", maxImageUpload>>20)})
 			return
 		}
-		if form.File["image"] == nil {
-			c.JSON(402, gin.H{"error": "no image file"})
-			return
-		}
-		fileName := form.File["image"][0].Filename
-		fileType := fileName[len(fileName)-4:]
-		if fileType != ".jpg" && fileType != ".png" && fileType != "jpeg" {
-			c.JSON(403, gin.H{"error": "file type not supported"})
-			return
-		}
-		tokenString := c.Request.Header.Get("token")
-		userIDstr, err := validateJWT(tokenString)
+		src, err := file.Open()
 		if err != nil {
-			c.JSON(401, gin.H{"error": err.Error()})
+			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		userID, err := strconv.Atoi(userIDstr)
+		data, err := io.ReadAll(src)
+		src.Close()
 		if err != nil {
-			c.JSON(404, gin.H{"error": err.Error()})
+			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		image := form.File["image"][0]
-		src, err := image.Open()
+		photo, err := photos.Upload(c.Request.Context(), currentUser(c).ID, data)
 		if err != nil {
-			c.JSON(405, gin.H{"error": err.Error()})
+			log.Println("Error uploading image: ", err)
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
-		defer src.Close()
-		fmt.Printf("image: %v\n", src)
-		img, err := jpeg.Decode(src)
-		if err != nil {
-			fmt.Printf("error decoding image: %e\n", err)
-			img, err = png.Decode(src)
-			if err != nil {
-				fmt.Printf("error decoding image: %e\n", err)
-				c.JSON(406, gin.H{"error": ""})
-				return
-			}
-		}
-		img = resize.Resize(512, 0, img, resize.Lanczos3)
+		c.JSON(200, gin.H{"imageID": strconv.Itoa(int(photo.ID))})
+	}
+}
+
+// GetImageById serves a photo in the size picked by the size query
+// parameter: thumb, medium (the default) or original. It needs no token, only
+// a link signed by signImageURL, so that browsers can load it in img tags.
+func GetImageById(photos *PhotoService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := parseUint(c.Param("id"))
 		if err != nil {
-			c.JSON(407, gin.H{"error": err.Error()})
+			c.JSON(400, gin.H{"error": "id is not a number"})
 			return
 		}
-
-		time := time.Now().Second()
-		timeString := strconv.Itoa(time)
-		filename := timeString + image.Filename
-		imgFile, err := os.Create(filepath.Join("./images", filename))
-		if err != nil {
-			fmt.Printf("error creating file: %v\n", err)
-			c.JSON(408, gin.H{"error": err.Error()})
+		size := c.DefaultQuery("size", SizeMedium)
+		if _, known := renditionSizes[size]; !known {
+			c.JSON(400, gin.H{"error": "size must be thumb, medium or original"})
 			return
 		}
-		defer imgFile.Close()
-		err = jpeg.Encode(imgFile, img, nil)
+		left, err := verifyImageURL(c, size)
 		if err != nil {
-			err = png.Encode(imgFile, img)
-			if err != nil {
-				fmt.Printf("error encoding image: %v\n", err)
-				c.JSON(409, gin.H{"error": err.Error()})
-				return
-			}
-		}
-		photo := Photo{Path: filename, UserID: uint(userID)}
-		result := db.Create(&photo)
-		if result.Error != nil {
-			fmt.Printf("path: %v\n", photo.Path)
-			c.JSON(406, gin.H{"error": result.Error.Error()})
+			c.JSON(403, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(200, gin.H{"imageID": strconv.Itoa(int(photo.ID))})
-	}
-}
-
-func GetImageById(db *gorm.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var photo Photo
-		id := c.Param("id")
-		_, err := strconv.Atoi(id)
-		if err != nil {
-			c.JSON(400, gin.H{"error": "id is not a number"})
+		file, err := photos.Open(c.Request.Context(), id, size)
+		if errors.Is(err, errNotFound) {
+			c.JSON(404, gin.H{"error": "image not found"})
 			return
 		}
-		result := db.First(&photo, id)
-		if result.Error != nil {
-			c.JSON(400, gin.H{"error": result.Error.Error()})
+		if err != nil {
+			c.JSON(404, gin.H{"error": err.Error()})
 			return
 		}
-		c.File("./images/" + photo.Path)
+		defer file.Close()
+		c.DataFromReader(200, -1, "image/jpeg", file,
+			map[string]string{"Cache-Control": fmt.Sprintf("private, max-age=%d", int(left.Seconds()))})
 	}
 }
 
@@ -291,72 +361,30 @@ func CheckPassword(password string, hashedPassword string) bool {
 	return err == nil
 }
 
-func SignUp(db *gorm.DB) gin.HandlerFunc {
+func SignUp(db *gorm.DB, users *UserService, mailer Mailer, publicURL string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var input SignUpInput
 		err := c.BindJSON(&input)
 		if err != nil {
 			log.Println("Error binding json: ", err)
-			log.Println("json: ", input)
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		log.Printf("username: %s, email: %s, password: %s", input.UserName, input.Email, input.Password)
-		passwordHash, err := HashPassword(input.Password)
+		user, err := users.SignUp(c.Request.Context(), input)
 		if err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
-		user := User{UserName: input.UserName, Email: input.Email, PasswordHash: passwordHash}
-		result := db.Create(&user)
-		if result.Error != nil {
-			c.JSON(400, gin.H{"error": result.Error.Error()})
-			return
+		err = sendVerificationMail(c.Request.Context(), db, mailer, publicURL, user)
+		if err != nil {
+			// the user can ask for a new mail once signed in
+			log.Println("Error sending verification mail: ", err)
 		}
-		c.JSON(200, user)
+		c.JSON(200, ownProfile(basicProfile(user), user))
 	}
 }
 
-func generateJWT(userid string) (string, error) {
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
-	claims["user_id"] = userid
-	claims["exp"] = time.Now().Add(time.Hour * 24).Unix()
-	tokenString, err := token.SignedString(jwtKey)
-	if err != nil {
-		err := fmt.Errorf("error signing token: %v", err)
-		return "", err
-	}
-	fmt.Printf("token: %v\n", tokenString)
-	_, err = validateJWT(tokenString)
-	if err != nil {
-		err := fmt.Errorf("error validating token on creation: %v", err)
-		return "", err
-	}
-	return tokenString, nil
-}
-
-func validateJWT(tokenString string) (string, error) {
-	fmt.Printf("token: %v\n", tokenString)
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
-	if err != nil {
-		fmt.Printf("token: %v\n", tokenString)
-		err := fmt.Errorf("error parsing token: %v", err)
-		return "", err
-	}
-	if !token.Valid {
-		err := fmt.Errorf("token is not valid")
-		return "", err
-	}
-	tokenClaims := token.Claims.(jwt.MapClaims)
-	userID := tokenClaims["user_id"]
-	fmt.Printf("user id: %v\n", userID)
-	return userID.(string), nil
-}
-
-func SignIn(db *gorm.DB) gin.HandlerFunc {
+func SignIn(db *gorm.DB, users *UserService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var input SignInInput
 		err := c.BindJSON(&input)
@@ -365,597 +393,284 @@ func SignIn(db *gorm.DB) gin.HandlerFunc {
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		var user User
-		result := db.Where("email = ?", input.Email).First(&user)
-		if result.Error != nil {
-			log.Println("Error finding user: ", result.Error)
-			c.JSON(400, gin.H{"error": result.Error.Error()})
-			return
-		}
-		if !CheckPassword(input.Password, user.PasswordHash) {
-			log.Println("Incorrect password")
-			c.JSON(400, gin.H{"error": "incorrect password"})
+		user, err := users.SignIn(c.Request.Context(), input)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
-
-		userID := strconv.Itoa(int(user.ID))
-		token, err := generateJWT(string(userID))
+		err = setSession(c, db, user.ID, "")
 		if err != nil {
-			log.Println("Error generating JWT: ", err)
+			log.Println("Error starting session: ", err)
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		c.Header("token", token)
-		c.Header("token_id", strconv.Itoa(int(user.ID)))
-		c.JSON(200, gin.H{"user": user})
-
-	}
-}
-
-func GetUserById(db *gorm.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var user User
-		id := c.Param("id")
-		result := db.First(&user, id)
-		if result.Error != nil {
-			c.JSON(400, gin.H{"error": result.Error.Error()})
-			return
-		}
-		c.JSON(200, user)
+		c.JSON(200, gin.H{"user": ownProfile(basicProfile(user), user)})
 	}
 }
 
 type joinCommunityInput struct {
-	UserID      string `json:"user_id" binding:"required"`
 	CommunityID string `json:"community_id" binding:"required"`
-	UserToken   string `json:"user_token" binding:"required"`
+	Message     string `json:"message"`
 }
 
-func JoinCommunity(db *gorm.DB) gin.HandlerFunc {
+func JoinCommunity(communities *CommunityService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var user User
-		var community Community
 		var input joinCommunityInput
 		err := c.BindJSON(&input)
 		if err != nil {
-			fmt.Printf("error binding json: %v\n", err)
-			c.JSON(400, gin.H{"error": err.Error()})
-		}
-		tokenOwnID, err := validateJWT(input.UserToken)
-		if err != nil {
-			fmt.Printf("error validating token1: %v\n", err)
-			fmt.Printf("token: %v\n", input.UserToken)
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		if tokenOwnID != input.UserID {
-			fmt.Printf("token id: %v, offer user id: %v\n", tokenOwnID, input.UserID)
-			c.JSON(400, gin.H{"error": "token id does not match offer user id"})
-			return
-		}
-		userID := input.UserID
-		communityID := input.CommunityID
-		if userID == "" || communityID == "" {
-			fmt.Printf("user_id: %v, community_name:%v", userID, communityID)
-			c.JSON(400, gin.H{"error": "user_id or community_id is empty"})
-			return
-		}
-		userResult := db.First(&user, userID)
-		if userResult.Error != nil {
-			c.JSON(400, gin.H{"error": userResult.Error.Error()})
+		communityID, err := parseUint(input.CommunityID)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "community_id is not a number"})
 			return
 		}
-		communityResult := db.First(&community, communityID)
-		if communityResult.Error != nil {
-			c.JSON(400, gin.H{"error": communityResult.Error.Error()})
+		user := currentUser(c)
+		community, request, err := communities.Join(c.Request.Context(), user.ID, communityID, input.Message)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
-		err = db.Model(&user).Association("Communities").Append(&community)
-		if err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
+		if request != nil {
+			c.JSON(202, gin.H{"join_request": request, "community": community})
 			return
 		}
-		c.JSON(200, gin.H{"user": user, "community": community})
+		c.JSON(200, gin.H{"user": ownProfile(basicProfile(user), user), "community": community})
 	}
 }
 
 type createCommunityInput struct {
-	Name    string `json:"name" binding:"required"`
-	Country string `json:"country" binding:"required"`
-	City    string `json:"city" binding:"required"`
+	Name       string `json:"name" binding:"required"`
+	Country    string `json:"country" binding:"required"`
+	City       string `json:"city" binding:"required"`
+	Visibility string `json:"visibility"`
 }
 
-func createCommunity(db *gorm.DB) gin.HandlerFunc {
+func createCommunity(communities *CommunityService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var err error
-		var owner User
-		tokenString := c.Request.Header.Get("token")
-		userID, err := validateJWT(tokenString)
-		if err != nil {
-			c.JSON(400, gin.H{"error token valdiation": err.Error()})
-			return
-		}
-		result := db.First(&owner, userID)
-		if result.Error != nil {
-			c.JSON(401, gin.H{"error finding user": result.Error.Error()})
-			return
-		}
-
 		var input createCommunityInput
-		err = c.BindJSON(&input)
-		if err != nil {
-			c.JSON(402, gin.H{"error parsing json": err.Error()})
-			return
-		}
-		community := Community{Name: input.Name, Country: input.Country, City: input.City}
-		result = db.Create(&community)
-		if result.Error != nil {
-			c.JSON(403, gin.H{"error creating community": result.Error.Error()})
-			return
-		}
-		err = db.Model(&owner).Association("OwnedCommunities").Append(&community)
+		err := c.BindJSON(&input)
 		if err != nil {
-			c.JSON(404, gin.H{"error creatings assisiation to owner": err.Error()})
+			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		err = db.Model(&owner).Association("Communities").Append(&community)
+		community, err := communities.Create(c.Request.Context(), currentUser(c).ID, input)
 		if err != nil {
-			c.JSON(405, gin.H{"error": err.Error()})
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
 		c.JSON(200, community)
 	}
 }
 
-func GetCommunityByCountry(db *gorm.DB) gin.HandlerFunc {
+// GetCommunityByCountry lists the communities anyone can find, leaving out
+// invite only ones.
+func GetCommunityByCountry(communities *CommunityService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var communitys []Community
-		country := c.Param("country")
-		fmt.Printf("country: %v\n", country)
-		if country == "" {
-			result := db.Find(&communitys)
-			if result.Error != nil {
-				c.JSON(400, gin.H{"error": result.Error.Error()})
-				return
-			}
-			c.JSON(200, communitys)
-			return
-		}
-		if country == "ALL" {
-			result := db.Find(&communitys)
-			if result.Error != nil {
-				c.JSON(400, gin.H{"error": result.Error.Error()})
-				return
-			}
-			c.JSON(200, communitys)
-			return
-		}
-		result := db.Find(&communitys, "country = ?", country)
-		if result.Error != nil {
-			c.JSON(400, gin.H{"error": result.Error.Error()})
+		found, err := communities.Discover(c.Request.Context(), c.Param("country"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(200, communitys)
+		c.JSON(200, found)
 	}
 }
 
-func GetUserCommunities(db *gorm.DB) gin.HandlerFunc {
+func GetUserCommunities(communities *CommunityService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var user User
-		var uCom []Community
-		tokenString := c.Request.Header.Get("token")
-		userID, err := validateJWT(tokenString)
-		if err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
-			return
-		}
-		result := db.First(&user, userID)
-		if result.Error != nil {
-			c.JSON(400, gin.H{"error": result.Error.Error()})
-			return
-		}
-		err = db.Model(&user).Association("Communities").Find(&uCom)
+		found, err := communities.ForUser(c.Request.Context(), currentUser(c).ID)
 		if err != nil {
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(200, uCom)
+		c.JSON(200, found)
 	}
 }
 
-func userBelongsToCommunity(db *gorm.DB, userID string, communityID string) (bool, error) {
-	var user User
-	userIDInt, err := strconv.Atoi(userID)
-	if err != nil {
-		return false, fmt.Errorf("error parsing user id: %v", err)
-	}
-	communityIDInt, err := strconv.Atoi(communityID)
-	if err != nil {
-		return false, fmt.Errorf("error parsing community id: %v", err)
-	}
-	result := db.First(&user, userIDInt)
-	if result.Error != nil {
-		return false, result.Error
-	}
-	fmt.Printf("community id: %v\n", communityIDInt)
-	var userCommunities []Community
-	err = db.Model(&user).Association("Communities").Find(&userCommunities)
+// paramID parses the id parameter, otherwise it writes the error response.
+func paramID(c *gin.Context, name string) (uint, bool) {
+	id, err := parseUint(c.Param(name))
 	if err != nil {
-		return false, err
-	}
-	fmt.Printf("userCommunities: %v\n", userCommunities)
-	for _, community := range userCommunities {
-		if community.ID == uint(communityIDInt) {
-			return true, nil
-		}
+		c.JSON(400, gin.H{"error": name + " is not a number"})
+		return 0, false
 	}
-	return false, fmt.Errorf("user does not belong to community")
+	return id, true
 }
 
-func CreateOffer(db *gorm.DB) gin.HandlerFunc {
+func CreateOffer(posts *PostService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var err error
-		log.Println("Creating offer")
-		var offer OfferInput
-		err = c.BindJSON(&offer)
+		var input OfferInput
+		err := c.BindJSON(&input)
 		if err != nil {
-			fmt.Printf("error binding json: %v\n", err)
-			fmt.Printf("data: %v\n", offer)
 			c.JSON(400, gin.H{"binding error": err.Error()})
 			return
 		}
-		tokenOwnID, err := validateJWT(offer.Token)
-		if err != nil {
-			fmt.Printf("error validating token1: %v\n", err)
-			fmt.Printf("token: %v\n", offer.Token)
-			c.JSON(400, gin.H{"error": err.Error()})
-			return
-		}
-		if tokenOwnID != offer.UserID {
-			fmt.Printf("token id: %v, offer user id: %v\n", tokenOwnID, offer.UserID)
-			c.JSON(400, gin.H{"error": "token id does not match offer user id"})
-			return
-		}
-		isInCommunity, err := userBelongsToCommunity(db, offer.UserID, offer.CommunityID)
+		_, err = posts.CreateOffer(c.Request.Context(), currentUser(c).ID, PostInput{Title: input.Title,
+			Description: input.Description, CommunityID: input.CommunityID,
+			ImageIDs: postImageIDs(input.ImageID, input.ImageIDs)})
 		if err != nil {
-			fmt.Printf("error checking if user is in community: %v\n", err)
-			c.JSON(400, gin.H{"error": err.Error()})
-			return
-		}
-		if !isInCommunity {
-			c.JSON(400, gin.H{"error": "user does not belong to community"})
-			return
-		}
-
-		var dbOffer Offer
-		OfferID, err := strconv.Atoi(offer.UserID)
-		if err != nil {
-			fmt.Printf("error parsing user id: %v\n", err)
-			c.JSON(400, gin.H{"error": err.Error()})
-			return
-		}
-		dbOffer.UserID = uint(OfferID)
-		CommunityID, err := strconv.Atoi(offer.CommunityID)
-		if err != nil {
-			fmt.Printf("error parsing community id: %v\n", err)
-			c.JSON(400, gin.H{"error": err.Error()})
+			log.Println("Error creating offer: ", err)
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
-		dbOffer.CommunityID = uint(CommunityID)
-		dbOffer.Title = offer.Title
-		dbOffer.Description = offer.Description
-		result := db.Create(&dbOffer)
-		if result.Error != nil {
-			log.Println("Error creating offer: ", result.Error)
-			log.Println("Offer: ", offer)
-			c.JSON(400, gin.H{"error": result.Error.Error(), "offer": offer.UserID})
-			return
-		}
-		photoID, err := strconv.Atoi(offer.ImageID)
-		if err != nil {
-			fmt.Printf("error parsing photo id: %v\n", err)
-			c.JSON(200, offer)
-			return
-		}
-		var photo Photo
-		result = db.First(&photo, uint(photoID))
-		if result.Error != nil {
-			fmt.Printf("error finding photo: %v\n", result.Error)
-			c.JSON(200, offer)
-			return
-		}
-		err = db.Model(&dbOffer).Association("Photos").Append(&photo)
-		if err != nil {
-			fmt.Printf("error associating photo with offer: %v\n", err)
-			c.JSON(200, offer)
-			return
-		}
-		c.JSON(200, offer)
+		c.JSON(200, input)
 	}
 }
 
-func GetOffersByCommunityId(db *gorm.DB) gin.HandlerFunc {
+func GetOffersByCommunityId(posts *PostService, apiURL string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var offers []Offer
-		param, err := strconv.Atoi(c.Param("id"))
-		id := uint(param)
-		if err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
-			return
-		}
-		results := db.Find(&offers, "community_id = ?", id)
-		if results.Error != nil {
-			c.JSON(400, gin.H{"error": results.Error.Error()})
+		communityID, ok := paramID(c, "id")
+		if !ok {
 			return
 		}
-		c.JSON(200, offers)
-
+		listOffers(c, posts, apiURL, communityID)
 	}
 }
 
-func GetOffersByUserId(db *gorm.DB) gin.HandlerFunc {
+func GetOffersByUserId(posts *PostService, apiURL string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var user User
-		var userCommunities []Community
-		tokenString := c.Request.Header.Get("token")
-		ret, err := validateJWT(tokenString)
-		if err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
-			return
-		}
-		tokenID, err := strconv.Atoi(ret)
-		if err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
-			return
-		}
-		id := uint(tokenID)
-		results := db.Find(&user, id)
-		if results.Error != nil {
-			c.JSON(400, gin.H{"error": results.Error.Error()})
-			return
-		}
-
-		err = db.Model(&user).Association("Communities").Find(&userCommunities)
-		if err != nil {
-			c.JSON(400, gin.H{"error": err})
-			return
-		}
-		for i := range userCommunities {
-			err = db.Model(&userCommunities[i]).Association("Offers").Find(&userCommunities[i].Offers)
-			if err != nil {
-				c.JSON(400, gin.H{"error": err})
-				return
-			}
-			for j, offer := range userCommunities[i].Offers {
-				err = db.Model(&offer).Association("Photos").Find(&userCommunities[i].Offers[j].Photos)
-				if err != nil {
-					c.JSON(400, gin.H{"error": err})
-					return
-				}
-			}
-		}
-
-		c.JSON(200, userCommunities)
+		listOffers(c, posts, apiURL, 0)
 	}
 }
 
-func isIn(user User, offer Offer) bool {
-	for _, community := range user.Communities {
-		if community.ID == offer.CommunityID {
-			return true
-		}
+// listOffers answers with a page of the offers in the community, or in all
+// of the current user's communities for 0.
+func listOffers(c *gin.Context, posts *PostService, apiURL string, communityID uint) {
+	query, err := parseListQuery(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	page, err := posts.Offers(c.Request.Context(), currentUser(c).ID, communityID, query)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
 	}
-	return false
+	for _, item := range page.Items {
+		signPhotos(apiURL, item.Photos)
+	}
+	c.JSON(200, page)
 }
-func GetOfferById(db *gorm.DB) gin.HandlerFunc {
+
+func GetOfferById(posts *PostService, apiURL string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var offer Offer
-		var user User
-		id := c.Param("id")
-		tokenString := c.Request.Header.Get("token")
-		userID, err := validateJWT(tokenString)
-		if err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
+		id, ok := paramID(c, "id")
+		if !ok {
 			return
 		}
-		results := db.First(&offer, id)
-		if results.Error != nil {
-			c.JSON(400, gin.H{"error": results.Error.Error()})
-			return
-		}
-		results = db.First(&user, userID)
-		if results.Error != nil {
-			c.JSON(400, gin.H{"error": results.Error.Error()})
-			return
-		}
-		err = db.Model(&user).Association("Communities").Find(&user.Communities)
-		if err != nil {
-			c.JSON(400, gin.H{"error": err})
-			return
-		}
-		if !isIn(user, offer) {
-			c.JSON(400, gin.H{"error": "user does not belong to community"})
-			return
-		}
-		err = db.Model(&offer).Association("Photos").Find(&offer.Photos)
+		offer, err := posts.Offer(c.Request.Context(), currentUser(c).ID, id)
 		if err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
+		signPhotos(apiURL, offer.Photos)
 		c.JSON(200, offer)
 	}
 }
 
 type MessageInput struct {
-	Text      string `json:"text" binding:"required"`
-	ReciverID string `json:"reciver_id" binding:"required"`
-	OfferID   string `json:"offer_id"`
+	Text       string `json:"text" binding:"required"`
+	ReceiverID string `json:"receiver_id" binding:"required"`
+	OfferID    string `json:"offer_id"`
+	RequestID  string `json:"request_id"`
 }
 
-func SendMesssage(db *gorm.DB) gin.HandlerFunc {
+func SendMesssage(messages *MessageService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var message Message
-		var messageInput MessageInput
-		var offer Offer
-		tokenString := c.Request.Header.Get("token")
-		userID, err := validateJWT(tokenString)
-
+		var input MessageInput
+		err := c.BindJSON(&input)
 		if err != nil {
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		err = c.BindJSON(&messageInput)
+		message, err := messages.Send(c.Request.Context(), currentUser(c).ID, input)
 		if err != nil {
-			fmt.Printf("error binding json: %v\n", err)
-			c.JSON(400, gin.H{"error": err.Error()})
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
-		senderID, err := strconv.Atoi(userID)
+		c.JSON(200, message)
+	}
+}
+
+// optionalHeaderID parses the id in the header if there is one.
+func optionalHeaderID(c *gin.Context, name string) (*uint, error) {
+	value := c.Request.Header.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	id, err := parseUint(value)
+	if err != nil {
+		return nil, fmt.Errorf("%v is not a number", name)
+	}
+	return &id, nil
+}
+
+// GetMessages lists the messages exchanged with the user in the otherUserID
+// header, about the post in the offerID or requestID header if the client
+// names one.
+func GetMessages(messages *MessageService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		otherUserID, err := optionalHeaderID(c, "otherUserID")
+		if err == nil && otherUserID == nil {
+			err = errors.New("otherUserID is empty")
+		}
 		if err != nil {
-			fmt.Printf("error parsing user id: %v\n", err)
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		reciverID, err := strconv.Atoi(messageInput.ReciverID)
+		filter := MessageFilter{UserID: currentUser(c).ID, OtherUserID: *otherUserID}
+		filter.OfferID, err = optionalHeaderID(c, "offerID")
 		if err != nil {
-			fmt.Printf("error parsing reciver id: %v\n", err)
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		offerID, err := strconv.Atoi(messageInput.OfferID)
+		filter.RequestID, err = optionalHeaderID(c, "requestID")
 		if err != nil {
-			fmt.Printf("error parsing offer id: %v\n", err)
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		message = Message{Text: messageInput.Text, SenderID: uint(senderID), ReciverID: uint(reciverID)}
-		result := db.Create(&message)
-		if result.Error != nil {
-			fmt.Printf("error creating message: %v\n", result.Error)
-			c.JSON(400, gin.H{"error": result.Error.Error()})
-			return
-		}
-		result = db.First(&offer, offerID)
-		if result.Error != nil {
-			c.JSON(200, message)
-			return
-		}
-		err = db.Model(&offer).Association("Messages").Append(&message)
+		found, err := messages.History(c.Request.Context(), filter)
 		if err != nil {
 			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(200, message)
-
+		c.JSON(200, found)
 	}
 }
 
-func GetMessages(db *gorm.DB) gin.HandlerFunc {
+func ResolveUserName(users *UserService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var messages []Message
-		tokenString := c.Request.Header.Get("token")
-		userID, err := validateJWT(tokenString)
-		if err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
+		id, ok := paramID(c, "id")
+		if !ok {
 			return
 		}
-		otherUserID := c.Request.Header.Get("otherUserID")
-		if otherUserID == "" {
-			fmt.Printf("otherUserID: %v\n", otherUserID)
-			c.JSON(400, gin.H{"error": "otherUserID is empty"})
-			return
-		}
-
-		result := db.Find(&messages, "sender_id = ? AND reciver_id = ?", userID, otherUserID)
-		if result.Error != nil {
-			c.JSON(400, gin.H{"error": result.Error.Error()})
-			return
-		}
-		fmt.Printf("user id: %v, other user id: %v\n", userID, otherUserID)
-		result = db.Where("reciver_id = ? AND sender_id = ?", userID, otherUserID).
-			Or("reciver_id = ? AND sender_id = ?", otherUserID, userID).
-			Find(&messages)
-		if result.Error != nil {
-			c.JSON(400, gin.H{"error": result.Error.Error()})
-			return
-		}
-		c.JSON(200, messages)
-	}
-}
-
-func ResolveUserName(db *gorm.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var user User
-		userID := c.Param("id")
-		result := db.First(&user, userID)
-		if result.Error != nil {
-			c.JSON(400, gin.H{"error": result.Error.Error()})
+		user, err := users.Find(c.Request.Context(), id)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
 		c.JSON(200, user.UserName)
 	}
 }
 
-func GetOfferResp(db *gorm.DB) gin.HandlerFunc {
+// GetPostResponders lists the profiles of the users who wrote to the current
+// user about their offer or request.
+func GetPostResponders(posts *PostService, kind string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var offer Offer
-		offerID := c.Param("id")
-		tokenString := c.Request.Header.Get("token")
-		userID, err := validateJWT(tokenString)
-		if err != nil {
-			fmt.Printf("error validating token: %v\n", err)
-			c.JSON(400, gin.H{"error": err.Error()})
-			return
-		}
-		result := db.First(&offer, offerID)
-		if result.Error != nil {
-			fmt.Printf("error finding offer: %v\n", result.Error)
-			c.JSON(400, gin.H{"error": result.Error.Error()})
+		id, ok := paramID(c, "id")
+		if !ok {
 			return
 		}
-		if fmt.Sprint(offer.UserID) != userID {
-			fmt.Printf("offer user id: %v, token user id: %v\n", offer.UserID, userID)
-			c.JSON(400, gin.H{"error": "user does not own offer"})
-			return
-		}
-		//get users who have messaged the offer
-		var messages []Message
-		result = db.Find(&messages, "offer_id = ?", offerID)
-		if result.Error != nil {
-			fmt.Printf("error finding messages: %v\n", result.Error)
-			c.JSON(400, gin.H{"error": result.Error.Error()})
+		users, err := posts.Responders(c.Request.Context(), currentUser(c).ID, kind, id)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
-		var users []User
-		for _, message := range messages {
-			var user User
-			result = db.First(&user, message.SenderID)
-			if result.Error != nil {
-				fmt.Printf("error finding user: %v\n", result.Error)
-				c.JSON(400, gin.H{"error": result.Error.Error()})
-				return
-			}
-			if !user.isIn(users) {
-				users = append(users, user)
-			}
-		}
-		c.JSON(200, users)
-	}
-}
-
-func (user User) isIn(users []User) bool {
-	for _, u := range users {
-		if u.ID == user.ID {
-			return true
+		profiles := []PublicProfile{}
+		for _, user := range users {
+			profiles = append(profiles, basicProfile(user))
 		}
-	}
-	return false
-}
-
-func DropAllTables(db *gorm.DB) {
-	log.Println("Droping all tables")
-	err := db.Migrator().DropTable(&User{}, &Photo{}, &Offer{}, &Request{}, &Community{}, &Message{})
-	if err != nil {
-		log.Fatal("Error Dropping the tables: ", err)
+		c.JSON(200, profiles)
 	}
 }
@@ -0,0 +1,345 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	testAPIURL    = "http://api.test"
+	testPublicURL = "http://web.test"
+	testPassword  = "correct horse battery"
+)
+
+var testKeys = SigningKeys{Active: "test", Keys: map[string][]byte{
+	"test": []byte("0123456789abcdef0123456789abcdef"),
+}}
+
+// routesHit records every route the tests called, so TestMain can tell which
+// routes of SetupRoutes no test covers.
+var routesHit sync.Map
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	// the handlers log every failure, the tests cause plenty of them
+	log.SetOutput(io.Discard)
+	err := SetSigningKeys(testKeys)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	if code == 0 && flag.Lookup("test.run").Value.String() == "" {
+		missing := untestedRoutes()
+		if len(missing) > 0 {
+			fmt.Printf("routes no test calls:\n\t%v\n", strings.Join(missing, "\n\t"))
+			code = 1
+		}
+	}
+	os.Exit(code)
+}
+
+func untestedRoutes() []string {
+	router := gin.New()
+	SetupRoutes(nil, Services{}, router)
+	var missing []string
+	for _, route := range router.Routes() {
+		if _, ok := routesHit.Load(route.Method + " " + route.Path); !ok {
+			missing = append(missing, route.Method+" "+route.Path)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// testServer is the api on a fresh in-memory sqlite database, with the
+// backends kept in memory or in a temporary directory.
+type testServer struct {
+	t       *testing.T
+	db      *gorm.DB
+	router  *gin.Engine
+	mailer  *MemoryMailer
+	images  *LocalImageStore
+	search  *MemorySearchIndex
+	events  *Hub
+	exports *ExportWorker
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	db, err := ConnectDB(DatabaseConfig{Driver: DriverSQLite, DSN: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Logger = logger.Discard
+	t.Cleanup(func() {
+		sqlDB, err := db.DB()
+		if err == nil {
+			sqlDB.Close()
+		}
+	})
+	s := &testServer{
+		t:      t,
+		db:     db,
+		router: gin.New(),
+		mailer: &MemoryMailer{},
+		images: &LocalImageStore{Dir: t.TempDir()},
+		search: NewMemorySearchIndex(),
+		events: NewHub(),
+	}
+	s.exports = NewExportWorker(db, s.images, s.mailer, s.events, testPublicURL)
+	s.router.Use(func(c *gin.Context) {
+		c.Next()
+		if c.FullPath() != "" {
+			routesHit.Store(c.Request.Method+" "+c.FullPath(), true)
+		}
+	})
+	SetupRoutes(db, Services{Images: s.images, Search: s.search, Mail: s.mailer, Events: s.events,
+		Exports: s.exports, PublicURL: testPublicURL, APIURL: testAPIURL}, s.router)
+	return s
+}
+
+// newRequest builds a request with the body encoded as JSON, unless it is
+// nil or already a string, sent as the user with the token.
+func (s *testServer) newRequest(method string, path string, token string, body interface{}) *http.Request {
+	s.t.Helper()
+	var reader io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(body)
+	default:
+		raw, err := json.Marshal(body)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// serve runs the request and fails the test if the response gives away a
+// password hash, whatever the route.
+func (s *testServer) serve(req *http.Request) *httptest.ResponseRecorder {
+	s.t.Helper()
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	for _, leak := range []string{"PasswordHash", "password_hash", "$2a$"} {
+		if strings.Contains(body, leak) {
+			s.t.Errorf("%v %v leaks %q: %v", req.Method, req.URL.Path, leak, body)
+		}
+	}
+	return rec
+}
+
+func (s *testServer) call(method string, path string, token string, body interface{}) *httptest.ResponseRecorder {
+	s.t.Helper()
+	return s.serve(s.newRequest(method, path, token, body))
+}
+
+func wantStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("got status %v, want %v: %v", rec.Code, status, rec.Body.String())
+	}
+}
+
+// wantError checks the status and that the error message contains text.
+func wantError(t *testing.T, rec *httptest.ResponseRecorder, status int, text string) {
+	t.Helper()
+	wantStatus(t, rec, status)
+	if !strings.Contains(rec.Body.String(), text) {
+		t.Fatalf("error %v does not mention %q", rec.Body.String(), text)
+	}
+}
+
+func decode[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	err := json.Unmarshal(rec.Body.Bytes(), &v)
+	if err != nil {
+		t.Fatalf("error decoding %v: %v", rec.Body.String(), err)
+	}
+	return v
+}
+
+type testUser struct {
+	ID           uint
+	Name         string
+	Email        string
+	Password     string
+	Token        string
+	RefreshToken string
+}
+
+var mailTokenPattern = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+// mailToken returns the token of the last mail sent to the address.
+func (s *testServer) mailToken(to string) string {
+	s.t.Helper()
+	sent := s.mailer.Sent()
+	for i := len(sent) - 1; i >= 0; i-- {
+		if sent[i].To != to {
+			continue
+		}
+		match := mailTokenPattern.FindStringSubmatch(sent[i].Body)
+		if match != nil {
+			return match[1]
+		}
+	}
+	s.t.Fatalf("no mail with a token was sent to %v", to)
+	return ""
+}
+
+// signIn starts a session and returns its tokens.
+func (s *testServer) signIn(email string, password string) (token string, refreshToken string) {
+	s.t.Helper()
+	rec := s.call("POST", "/signin", "", gin.H{"email": email, "password": password})
+	wantStatus(s.t, rec, 200)
+	return rec.Header().Get("token"), rec.Header().Get("refresh_token")
+}
+
+// newUnverifiedUser signs up and signs in without verifying the address.
+func (s *testServer) newUnverifiedUser(name string) testUser {
+	s.t.Helper()
+	user := testUser{Name: name, Email: name + "@example.com", Password: testPassword}
+	rec := s.call("POST", "/signup", "", gin.H{"username": name, "email": user.Email, "password": user.Password})
+	wantStatus(s.t, rec, 200)
+	user.ID = decode[OwnProfile](s.t, rec).ID
+	user.Token, user.RefreshToken = s.signIn(user.Email, user.Password)
+	return user
+}
+
+// newUser signs up, verifies the address and signs in.
+func (s *testServer) newUser(name string) testUser {
+	s.t.Helper()
+	user := s.newUnverifiedUser(name)
+	rec := s.call("POST", "/verifyEmail", "", gin.H{"token": s.mailToken(user.Email)})
+	wantStatus(s.t, rec, 200)
+	return user
+}
+
+func (s *testServer) newCommunity(owner testUser, name string, visibility string) Community {
+	s.t.Helper()
+	rec := s.call("POST", "/createCommunity", owner.Token,
+		gin.H{"name": name, "country": "DE", "city": "Berlin", "visibility": visibility})
+	wantStatus(s.t, rec, 200)
+	return decode[Community](s.t, rec)
+}
+
+func (s *testServer) join(user testUser, community Community) {
+	s.t.Helper()
+	rec := s.call("POST", "/joinCommunity", user.Token, gin.H{"community_id": fmt.Sprint(community.ID)})
+	wantStatus(s.t, rec, 200)
+}
+
+// newOffer posts an offer and returns it as stored.
+func (s *testServer) newOffer(user testUser, community Community, title string, imageIDs ...string) Offer {
+	s.t.Helper()
+	rec := s.call("POST", "/offers", user.Token, gin.H{"title": title, "description": "description of " + title,
+		"community_id": fmt.Sprint(community.ID), "image_ids": strings.Join(imageIDs, ",")})
+	wantStatus(s.t, rec, 200)
+	var offer Offer
+	err := s.db.Where("title = ? AND user_id = ?", title, user.ID).Last(&offer).Error
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return offer
+}
+
+func (s *testServer) newRequestPost(user testUser, community Community, title string) Request {
+	s.t.Helper()
+	rec := s.call("POST", "/requests", user.Token, gin.H{"title": title, "description": "description of " + title,
+		"community_id": fmt.Sprint(community.ID)})
+	wantStatus(s.t, rec, 200)
+	return decode[Request](s.t, rec)
+}
+
+func (s *testServer) sendMessage(from testUser, to testUser, text string, offer Offer) Message {
+	s.t.Helper()
+	rec := s.call("POST", "/messages", from.Token, gin.H{"text": text, "receiver_id": fmt.Sprint(to.ID),
+		"offer_id": fmt.Sprint(offer.ID)})
+	wantStatus(s.t, rec, 200)
+	return decode[Message](s.t, rec)
+}
+
+// pngImage is a w by h png in one color.
+func pngImage(t *testing.T, w int, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// uploadRequest posts the data as the image field of a multipart form.
+func (s *testServer) uploadRequest(token string, field string, data []byte) *httptest.ResponseRecorder {
+	s.t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile(field, "upload.png")
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+	req := httptest.NewRequest("POST", "/image", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return s.serve(req)
+}
+
+// upload stores a small png as the user's and returns its id.
+func (s *testServer) upload(user testUser) string {
+	s.t.Helper()
+	rec := s.uploadRequest(user.Token, "image", pngImage(s.t, 40, 30))
+	wantStatus(s.t, rec, 200)
+	return decode[map[string]string](s.t, rec)["imageID"]
+}
+
+// fetch gets a signed image link, which needs no token.
+func (s *testServer) fetch(link string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	return s.call("GET", strings.TrimPrefix(link, testAPIURL), "", nil)
+}
+
+func (s *testServer) runExports() {
+	s.exports.runPending(context.Background())
+}
@@ -0,0 +1,307 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// SigningKeys holds the HMAC keys access tokens are signed with, by key id.
+// New tokens are signed with the Active key; tokens signed with any other key
+// in Keys are still accepted, so a key can be rotated by adding a new one,
+// making it active and removing the old one once its tokens have expired.
+type SigningKeys struct {
+	Active string
+	Keys   map[string][]byte
+}
+
+var signingKeys SigningKeys
+
+// SetSigningKeys installs the keys generateJWT and validateJWT use.
+func SetSigningKeys(keys SigningKeys) error {
+	if _, ok := keys.Keys[keys.Active]; !ok {
+		return fmt.Errorf("active signing key %q is not configured", keys.Active)
+	}
+	for id, key := range keys.Keys {
+		if len(key) < 32 {
+			return fmt.Errorf("signing key %q must be at least 32 bytes", id)
+		}
+	}
+	signingKeys = keys
+	return nil
+}
+
+// parseSigningKeys parses the configured keys, see JWTConfig. The active key
+// defaults to the first one.
+func parseSigningKeys(cfg JWTConfig) (SigningKeys, error) {
+	keys := SigningKeys{Active: cfg.ActiveKey, Keys: map[string][]byte{}}
+	for _, pair := range strings.Split(cfg.Keys.Value(), ",") {
+		id, secret, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found || id == "" || secret == "" {
+			return keys, fmt.Errorf("jwt.keys entries must look like id:secret")
+		}
+		if len(secret) < 32 {
+			return keys, fmt.Errorf("signing key %q must be at least 32 bytes", id)
+		}
+		if keys.Active == "" {
+			keys.Active = id
+		}
+		keys.Keys[id] = []byte(secret)
+	}
+	if _, ok := keys.Keys[keys.Active]; !ok {
+		return keys, fmt.Errorf("active signing key %q is not configured", keys.Active)
+	}
+	return keys, nil
+}
+
+// SigningKeysFromConfig returns the configured signing keys. Without any
+// configured keys a random key is generated, which logs everyone out
+// whenever the server restarts.
+func SigningKeysFromConfig(cfg JWTConfig) (SigningKeys, error) {
+	if strings.TrimSpace(cfg.Keys.Value()) != "" {
+		return parseSigningKeys(cfg)
+	}
+	log.Println("no jwt signing keys configured, using a random signing key")
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return SigningKeys{}, err
+	}
+	return SigningKeys{Active: "random", Keys: map[string][]byte{"random": secret}}, nil
+}
+
+// RefreshToken is the server side record of a refresh token. Only the hash
+// of the token is stored. Every refresh replaces the token with a new one of
+// the same family; presenting a token that was already replaced means it was
+// stolen, so the whole family is revoked.
+type RefreshToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	TokenHash string `gorm:"size:64;uniqueIndex"`
+	Family    string `gorm:"size:64;index"`
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
+
+type RefreshInput struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+func generateJWT(userid string) (string, error) {
+	key, ok := signingKeys.Keys[signingKeys.Active]
+	if !ok {
+		return "", fmt.Errorf("no signing key configured")
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": userid,
+		"iat":     now.Unix(),
+		"exp":     now.Add(accessTokenTTL).Unix(),
+	})
+	token.Header["kid"] = signingKeys.Active
+	tokenString, err := token.SignedString(key)
+	if err != nil {
+		err := fmt.Errorf("error signing token: %v", err)
+		return "", err
+	}
+	return tokenString, nil
+}
+
+// validateJWT checks the token and returns the user it was issued to and when.
+func validateJWT(tokenString string) (string, time.Time, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := signingKeys.Keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		err := fmt.Errorf("error parsing token: %v", err)
+		return "", time.Time{}, err
+	}
+	if !token.Valid {
+		err := fmt.Errorf("token is not valid")
+		return "", time.Time{}, err
+	}
+	tokenClaims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("token is not valid")
+	}
+	if _, ok := tokenClaims["exp"]; !ok {
+		return "", time.Time{}, fmt.Errorf("token has no expiry")
+	}
+	userID, ok := tokenClaims["user_id"].(string)
+	if !ok || userID == "" {
+		return "", time.Time{}, fmt.Errorf("token has no user id")
+	}
+	issuedAt, ok := tokenClaims["iat"].(float64)
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("token has no issue time")
+	}
+	return userID, time.Unix(int64(issuedAt), 0), nil
+}
+
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// issueRefreshToken stores a new refresh token for the user and returns it.
+// An empty family starts a new one, as happens on sign in.
+func issueRefreshToken(db *gorm.DB, userID uint, family string) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	if family == "" {
+		family, err = randomToken()
+		if err != nil {
+			return "", err
+		}
+	}
+	result := db.Create(&RefreshToken{
+		UserID:    userID,
+		TokenHash: sha256Hex([]byte(token)),
+		Family:    family,
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	})
+	if result.Error != nil {
+		return "", result.Error
+	}
+	return token, nil
+}
+
+// setSession writes a fresh access token and refresh token to the response
+// headers.
+func setSession(c *gin.Context, db *gorm.DB, userID uint, family string) error {
+	token, err := generateJWT(strconv.Itoa(int(userID)))
+	if err != nil {
+		return err
+	}
+	refreshToken, err := issueRefreshToken(db, userID, family)
+	if err != nil {
+		return err
+	}
+	c.Header("token", token)
+	c.Header("token_expires_in", strconv.Itoa(int(accessTokenTTL.Seconds())))
+	c.Header("refresh_token", refreshToken)
+	c.Header("token_id", strconv.Itoa(int(userID)))
+	return nil
+}
+
+func revokeFamily(db *gorm.DB, family string) error {
+	return db.Model(&RefreshToken{}).
+		Where("family = ? AND revoked_at IS NULL", family).
+		Update("revoked_at", time.Now()).Error
+}
+
+// revokeUserSessions revokes every refresh token of the user.
+func revokeUserSessions(db *gorm.DB, userID uint) error {
+	return db.Model(&RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RefreshSession swaps a refresh token for a new access token and a new
+// refresh token.
+func RefreshSession(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input RefreshInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		var stored RefreshToken
+		result := db.Where("token_hash = ?", sha256Hex([]byte(input.RefreshToken))).First(&stored)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			c.JSON(401, gin.H{"error": "invalid refresh token"})
+			return
+		}
+		if result.Error != nil {
+			c.JSON(400, gin.H{"error": result.Error.Error()})
+			return
+		}
+		if stored.RevokedAt != nil {
+			log.Printf("revoked refresh token reused for user %v, revoking its session", stored.UserID)
+			err = revokeFamily(db, stored.Family)
+			if err != nil {
+				log.Println("Error revoking session: ", err)
+			}
+			c.JSON(401, gin.H{"error": "invalid refresh token"})
+			return
+		}
+		if time.Now().After(stored.ExpiresAt) {
+			c.JSON(401, gin.H{"error": "refresh token has expired"})
+			return
+		}
+		// only the request that flips revoked_at may rotate the token, so two
+		// concurrent refreshes can not both succeed
+		result = db.Model(&RefreshToken{}).
+			Where("id = ? AND revoked_at IS NULL", stored.ID).
+			Update("revoked_at", time.Now())
+		if result.Error != nil {
+			c.JSON(400, gin.H{"error": result.Error.Error()})
+			return
+		}
+		if result.RowsAffected == 0 {
+			c.JSON(401, gin.H{"error": "invalid refresh token"})
+			return
+		}
+		err = setSession(c, db, stored.UserID, stored.Family)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"user_id": stored.UserID})
+	}
+}
+
+// SignOut revokes the session the refresh token belongs to. Access tokens
+// already handed out stay valid until they expire, at most accessTokenTTL.
+func SignOut(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input RefreshInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		var stored RefreshToken
+		result := db.Where("token_hash = ?", sha256Hex([]byte(input.RefreshToken))).First(&stored)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			c.JSON(200, gin.H{"signed_out": true})
+			return
+		}
+		if result.Error != nil {
+			c.JSON(400, gin.H{"error": result.Error.Error()})
+			return
+		}
+		err = revokeFamily(db, stored.Family)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"signed_out": true})
+	}
+}
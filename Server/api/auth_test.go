@@ -0,0 +1,240 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// signedToken is an access token for the user with the given issue and expiry
+// times, signed with the key.
+func signedToken(t *testing.T, kid string, key []byte, userID uint, issuedAt time.Time, expires time.Time) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": fmt.Sprint(userID),
+		"iat":     issuedAt.Unix(),
+		"exp":     expires.Unix(),
+	})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// oldToken is a valid access token issued a minute ago, which revoking the
+// user's sessions invalidates.
+func oldToken(t *testing.T, userID uint) string {
+	now := time.Now()
+	return signedToken(t, testKeys.Active, testKeys.Keys[testKeys.Active], userID, now.Add(-time.Minute), now.Add(time.Minute))
+}
+
+func TestSignUp(t *testing.T) {
+	s := newTestServer(t)
+	rec := s.call("POST", "/signup", "", gin.H{"username": "ada", "email": "Ada@Example.com", "password": testPassword})
+	wantStatus(t, rec, 200)
+	profile := decode[OwnProfile](t, rec)
+	if profile.Email != "ada@example.com" || profile.UserName != "ada" || profile.EmailVerifiedAt != nil {
+		t.Fatalf("unexpected profile %+v", profile)
+	}
+	sent := s.mailer.Sent()
+	if len(sent) != 1 || sent[0].To != "ada@example.com" || !strings.Contains(sent[0].Body, testPublicURL+"/verifyEmail?token=") {
+		t.Fatalf("unexpected verification mail %+v", sent)
+	}
+
+	tests := []struct {
+		name  string
+		input gin.H
+		error string
+	}{
+		{"email in use", gin.H{"username": "ada2", "email": "ADA@example.com", "password": testPassword}, "already in use"},
+		{"no password", gin.H{"username": "bob", "email": "bob@example.com"}, "Password"},
+		{"not an email", gin.H{"username": "bob", "email": "bob", "password": testPassword}, "Email"},
+		{"no username", gin.H{"email": "bob@example.com", "password": testPassword}, "UserName"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wantError(t, s.call("POST", "/signup", "", test.input), 400, test.error)
+		})
+	}
+}
+
+func TestSignIn(t *testing.T) {
+	s := newTestServer(t)
+	user := s.newUser("ada")
+	rec := s.call("POST", "/signin", "", gin.H{"email": "ADA@example.com", "password": testPassword})
+	wantStatus(t, rec, 200)
+	for _, header := range []string{"token", "refresh_token", "token_expires_in"} {
+		if rec.Header().Get(header) == "" {
+			t.Errorf("sign in did not set the %v header", header)
+		}
+	}
+	if rec.Header().Get("token_id") != fmt.Sprint(user.ID) {
+		t.Errorf("token_id is %v, want %v", rec.Header().Get("token_id"), user.ID)
+	}
+	wantError(t, s.call("POST", "/signin", "", gin.H{"email": user.Email, "password": "wrong"}), 400, "incorrect password")
+	wantStatus(t, s.call("POST", "/signin", "", gin.H{"email": "nobody@example.com", "password": testPassword}), 400)
+	wantStatus(t, s.call("POST", "/signin", "", "{"), 400)
+}
+
+func TestRequireAuth(t *testing.T) {
+	s := newTestServer(t)
+	user := s.newUser("ada")
+	gone := s.newUser("gone")
+	wantStatus(t, s.call("GET", "/profile", user.Token, nil), 200)
+	err := s.db.Delete(&User{}, gone.ID).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tests := []struct {
+		name   string
+		header string
+		error  string
+	}{
+		{"no header", "", "missing bearer token"},
+		{"other scheme", "Basic " + user.Token, "missing bearer token"},
+		{"garbage", "Bearer not-a-token", "error parsing token"},
+		{"unknown key", "Bearer " + signedToken(t, "old", []byte("0123456789abcdef0123456789abcdef"), user.ID, now, now.Add(time.Minute)), "unknown signing key"},
+		{"wrong key", "Bearer " + signedToken(t, testKeys.Active, []byte("another key another key another k"), user.ID, now, now.Add(time.Minute)), "signature is invalid"},
+		{"expired", "Bearer " + signedToken(t, testKeys.Active, testKeys.Keys[testKeys.Active], user.ID, now.Add(-time.Hour), now.Add(-time.Minute)), "expired"},
+		{"deleted user", "Bearer " + gone.Token, "user no longer exists"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := s.newRequest("GET", "/profile", "", nil)
+			if test.header != "" {
+				req.Header.Set("Authorization", test.header)
+			}
+			wantError(t, s.serve(req), 401, test.error)
+		})
+	}
+}
+
+func TestRequireVerified(t *testing.T) {
+	s := newTestServer(t)
+	user := s.newUnverifiedUser("ada")
+	wantStatus(t, s.call("GET", "/profile", user.Token, nil), 200)
+	wantError(t, s.call("POST", "/createCommunity", user.Token,
+		gin.H{"name": "garden", "country": "DE", "city": "Berlin"}), 403, "not verified")
+	wantError(t, s.uploadRequest(user.Token, "image", pngImage(t, 8, 8)), 403, "not verified")
+}
+
+func TestVerifyEmail(t *testing.T) {
+	s := newTestServer(t)
+	user := s.newUnverifiedUser("ada")
+	first := s.mailToken(user.Email)
+
+	// asking again invalidates the first link
+	rec := s.call("POST", "/resendVerification", user.Token, nil)
+	wantStatus(t, rec, 200)
+	second := s.mailToken(user.Email)
+	if first == second {
+		t.Fatal("resending mailed the same token")
+	}
+	wantError(t, s.call("POST", "/verifyEmail", "", gin.H{"token": first}), 400, "invalid or expired")
+	wantError(t, s.call("POST", "/verifyEmail", "", gin.H{"token": "made-up"}), 400, "invalid or expired")
+	wantStatus(t, s.call("POST", "/verifyEmail", "", gin.H{"token": second}), 200)
+	wantError(t, s.call("POST", "/verifyEmail", "", gin.H{"token": second}), 400, "invalid or expired")
+	wantError(t, s.call("POST", "/resendVerification", user.Token, nil), 400, "already verified")
+
+	profile := decode[OwnProfile](t, s.call("GET", "/profile", user.Token, nil))
+	if profile.EmailVerifiedAt == nil {
+		t.Fatal("email address is not verified")
+	}
+}
+
+func TestVerifyEmailExpired(t *testing.T) {
+	s := newTestServer(t)
+	user := s.newUnverifiedUser("ada")
+	err := s.db.Model(&EmailToken{}).Where("user_id = ?", user.ID).Update("expires_at", time.Now().Add(-time.Minute)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantError(t, s.call("POST", "/verifyEmail", "", gin.H{"token": s.mailToken(user.Email)}), 400, "invalid or expired")
+}
+
+func TestRefreshSession(t *testing.T) {
+	s := newTestServer(t)
+	user := s.newUser("ada")
+	rec := s.call("POST", "/refresh", "", gin.H{"refresh_token": user.RefreshToken})
+	wantStatus(t, rec, 200)
+	token, refreshToken := rec.Header().Get("token"), rec.Header().Get("refresh_token")
+	if refreshToken == "" || refreshToken == user.RefreshToken {
+		t.Fatalf("refresh did not rotate the refresh token")
+	}
+	wantStatus(t, s.call("GET", "/profile", token, nil), 200)
+
+	// presenting the replaced token again looks like theft and ends the session
+	wantError(t, s.call("POST", "/refresh", "", gin.H{"refresh_token": user.RefreshToken}), 401, "invalid refresh token")
+	wantError(t, s.call("POST", "/refresh", "", gin.H{"refresh_token": refreshToken}), 401, "invalid refresh token")
+
+	wantError(t, s.call("POST", "/refresh", "", gin.H{"refresh_token": "made-up"}), 401, "invalid refresh token")
+	wantStatus(t, s.call("POST", "/refresh", "", gin.H{}), 400)
+}
+
+func TestRefreshSessionExpired(t *testing.T) {
+	s := newTestServer(t)
+	user := s.newUser("ada")
+	err := s.db.Model(&RefreshToken{}).Where("user_id = ?", user.ID).Update("expires_at", time.Now().Add(-time.Minute)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantError(t, s.call("POST", "/refresh", "", gin.H{"refresh_token": user.RefreshToken}), 401, "expired")
+}
+
+func TestSignOut(t *testing.T) {
+	s := newTestServer(t)
+	user := s.newUser("ada")
+	otherToken, otherRefresh := s.signIn(user.Email, user.Password)
+	wantStatus(t, s.call("POST", "/signout", "", gin.H{"refresh_token": user.RefreshToken}), 200)
+	wantError(t, s.call("POST", "/refresh", "", gin.H{"refresh_token": user.RefreshToken}), 401, "invalid refresh token")
+	// other sessions go on
+	wantStatus(t, s.call("POST", "/refresh", "", gin.H{"refresh_token": otherRefresh}), 200)
+	wantStatus(t, s.call("GET", "/profile", otherToken, nil), 200)
+	// signing out twice is fine
+	wantStatus(t, s.call("POST", "/signout", "", gin.H{"refresh_token": user.RefreshToken}), 200)
+	wantStatus(t, s.call("POST", "/signout", "", gin.H{"refresh_token": "made-up"}), 200)
+	wantStatus(t, s.call("POST", "/signout", "", nil), 400)
+}
+
+func TestForgotAndResetPassword(t *testing.T) {
+	s := newTestServer(t)
+	user := s.newUnverifiedUser("ada")
+	mails := len(s.mailer.Sent())
+
+	// unknown addresses get the same answer and no mail
+	wantStatus(t, s.call("POST", "/forgotPassword", "", gin.H{"email": "nobody@example.com"}), 200)
+	if len(s.mailer.Sent()) != mails {
+		t.Fatal("a mail was sent to an unknown address")
+	}
+	wantStatus(t, s.call("POST", "/forgotPassword", "", gin.H{"email": "not an address"}), 400)
+
+	wantStatus(t, s.call("POST", "/forgotPassword", "", gin.H{"email": "ADA@example.com"}), 200)
+	sent := s.mailer.Sent()
+	if len(sent) != mails+1 || !strings.Contains(sent[mails].Body, testPublicURL+"/resetPassword?token=") {
+		t.Fatalf("unexpected reset mail %+v", sent)
+	}
+	token := s.mailToken(user.Email)
+	old := oldToken(t, user.ID)
+	wantStatus(t, s.call("GET", "/profile", old, nil), 200)
+
+	wantError(t, s.call("POST", "/resetPassword", "", gin.H{"token": "made-up", "password": "new password"}), 400, "invalid or expired")
+	wantStatus(t, s.call("POST", "/resetPassword", "", gin.H{"token": token, "password": "new password"}), 200)
+	wantError(t, s.call("POST", "/resetPassword", "", gin.H{"token": token, "password": "another"}), 400, "invalid or expired")
+
+	// every session is signed out, and the mailbox is proven to be the user's
+	wantError(t, s.call("GET", "/profile", old, nil), 401, "signed out")
+	wantError(t, s.call("POST", "/refresh", "", gin.H{"refresh_token": user.RefreshToken}), 401, "invalid refresh token")
+	wantError(t, s.call("POST", "/signin", "", gin.H{"email": user.Email, "password": user.Password}), 400, "incorrect password")
+	fresh, _ := s.signIn(user.Email, "new password")
+	profile := decode[OwnProfile](t, s.call("GET", "/profile", fresh, nil))
+	if profile.EmailVerifiedAt == nil {
+		t.Fatal("resetting the password did not verify the address")
+	}
+}
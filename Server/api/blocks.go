@@ -0,0 +1,123 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Block hides two users from each other: neither can message the other and
+// their posts drop out of each other's listings and search results.
+type Block struct {
+	BlockerID uint      `gorm:"primaryKey" json:"blocker_id"`
+	BlockedID uint      `gorm:"primaryKey;index" json:"blocked_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type BlockInput struct {
+	UserID string `json:"user_id" binding:"required"`
+}
+
+type BlockedUser struct {
+	UserID    uint      `json:"user_id"`
+	UserName  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var errBlocked = errors.New("user is blocked")
+
+// isBlocked tells whether either user blocked the other.
+func isBlocked(db *gorm.DB, userA uint, userB uint) (bool, error) {
+	var count int64
+	result := db.Model(&Block{}).
+		Where("(blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?)", userA, userB, userB, userA).
+		Count(&count)
+	return count > 0, result.Error
+}
+
+// blockedUserIDs returns the users the user blocked or was blocked by.
+func blockedUserIDs(db *gorm.DB, userID uint) ([]uint, error) {
+	var blocks []Block
+	result := db.Where("blocker_id = ? OR blocked_id = ?", userID, userID).Find(&blocks)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	ids := make([]uint, 0, len(blocks))
+	for _, block := range blocks {
+		if block.BlockerID == userID {
+			ids = append(ids, block.BlockedID)
+		} else {
+			ids = append(ids, block.BlockerID)
+		}
+	}
+	return ids, nil
+}
+
+// withoutBlocked drops the rows whose column names a user blocked by or
+// blocking userID.
+func withoutBlocked(db *gorm.DB, tx *gorm.DB, userID uint, column string) (*gorm.DB, error) {
+	ids, err := blockedUserIDs(db, userID)
+	if err != nil || len(ids) == 0 {
+		return tx, err
+	}
+	return tx.Where(column+" NOT IN ?", ids), nil
+}
+
+// shareCommunity tells whether the two users are members of a common
+// community.
+func shareCommunity(db *gorm.DB, userA uint, userB uint) (bool, error) {
+	var count int64
+	result := db.Model(&Membership{}).
+		Where("user_id = ? AND community_id IN (?)", userA,
+			db.Model(&Membership{}).Select("community_id").Where("user_id = ?", userB)).
+		Count(&count)
+	return count > 0, result.Error
+}
+
+func BlockUser(users *UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input BlockInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		block, err := users.Block(c.Request.Context(), currentUser(c).ID, input)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, block)
+	}
+}
+
+func UnblockUser(users *UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input BlockInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		err = users.Unblock(c.Request.Context(), currentUser(c).ID, input)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"unblocked": input.UserID})
+	}
+}
+
+// GetBlocks lists the users the current user blocked.
+func GetBlocks(users *UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		blocked, err := users.Blocks(c.Request.Context(), currentUser(c).ID)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, blocked)
+	}
+}
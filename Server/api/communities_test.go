@@ -0,0 +1,371 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type membersResponse struct {
+	Role    string       `json:"role"`
+	Members []MemberInfo `json:"members"`
+}
+
+// roles maps the member names of the community to their roles, as seen by
+// the user.
+func (s *testServer) roles(user testUser, community Community) map[string]string {
+	s.t.Helper()
+	rec := s.call("GET", fmt.Sprintf("/community/%v/members", community.ID), user.Token, nil)
+	wantStatus(s.t, rec, 200)
+	roles := map[string]string{}
+	for _, member := range decode[membersResponse](s.t, rec).Members {
+		roles[member.UserName] = member.Role
+	}
+	return roles
+}
+
+func communityPath(community Community, action string) string {
+	return fmt.Sprintf("/community/%v/%v", community.ID, action)
+}
+
+func TestCreateCommunity(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.newUser("owner")
+	community := s.newCommunity(owner, "garden", "")
+	if community.Visibility != VisibilityPublic || community.OwnerID == nil || *community.OwnerID != owner.ID {
+		t.Fatalf("unexpected community %+v", community)
+	}
+	if roles := s.roles(owner, community); roles["owner"] != RoleOwner || len(roles) != 1 {
+		t.Fatalf("unexpected members %v", roles)
+	}
+
+	wantStatus(t, s.call("POST", "/createCommunity", owner.Token, gin.H{"name": "garden", "country": "DE", "city": "Berlin"}), 400)
+	wantError(t, s.call("POST", "/createCommunity", owner.Token,
+		gin.H{"name": "kitchen", "country": "DE", "city": "Berlin", "visibility": "secret"}), 400, "visibility must be")
+	wantStatus(t, s.call("POST", "/createCommunity", owner.Token, gin.H{"name": "kitchen", "country": "DE"}), 400)
+}
+
+func TestDiscoverCommunities(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.newUser("owner")
+	s.newCommunity(owner, "garden", VisibilityPublic)
+	s.newCommunity(owner, "club", VisibilityInvite)
+	wantStatus(t, s.call("POST", "/createCommunity", owner.Token,
+		gin.H{"name": "jardin", "country": "FR", "city": "Paris", "visibility": VisibilityRequest}), 200)
+
+	tests := []struct {
+		country string
+		want    []string
+	}{
+		{"DE", []string{"garden"}},
+		{"FR", []string{"jardin"}},
+		{"ALL", []string{"garden", "jardin"}},
+		{"IT", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.country, func(t *testing.T) {
+			rec := s.call("GET", "/communities/"+test.country, "", nil)
+			wantStatus(t, rec, 200)
+			var names []string
+			for _, community := range decode[[]Community](t, rec) {
+				names = append(names, community.Name)
+			}
+			if fmt.Sprint(names) != fmt.Sprint(test.want) {
+				t.Fatalf("found %v, want %v", names, test.want)
+			}
+		})
+	}
+}
+
+func TestJoinCommunity(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.newUser("owner")
+	user := s.newUser("ada")
+	public := s.newCommunity(owner, "garden", VisibilityPublic)
+	request := s.newCommunity(owner, "kitchen", VisibilityRequest)
+	invite := s.newCommunity(owner, "club", VisibilityInvite)
+
+	s.join(user, public)
+	wantError(t, s.call("POST", "/joinCommunity", user.Token, gin.H{"community_id": fmt.Sprint(public.ID)}), 400, "already belongs")
+	wantError(t, s.call("POST", "/joinCommunity", user.Token, gin.H{"community_id": fmt.Sprint(invite.ID)}), 403, "invite only")
+	wantStatus(t, s.call("POST", "/joinCommunity", user.Token, gin.H{"community_id": "999"}), 404)
+	wantError(t, s.call("POST", "/joinCommunity", user.Token, gin.H{"community_id": "garden"}), 400, "not a number")
+
+	rec := s.call("POST", "/joinCommunity", user.Token, gin.H{"community_id": fmt.Sprint(request.ID), "message": "let me in"})
+	wantStatus(t, rec, 202)
+	first := decode[struct {
+		JoinRequest JoinRequest `json:"join_request"`
+	}](t, rec).JoinRequest
+	if first.Status != JoinPending || first.Message != "let me in" {
+		t.Fatalf("unexpected join request %+v", first)
+	}
+	// asking again does not file a second request
+	rec = s.call("POST", "/joinCommunity", user.Token, gin.H{"community_id": fmt.Sprint(request.ID)})
+	wantStatus(t, rec, 202)
+	again := decode[struct {
+		JoinRequest JoinRequest `json:"join_request"`
+	}](t, rec).JoinRequest
+	if again.ID != first.ID {
+		t.Fatalf("a second join request %v was filed", again.ID)
+	}
+
+	rec = s.call("GET", "/userCommunities", user.Token, nil)
+	wantStatus(t, rec, 200)
+	communities := decode[[]Community](t, rec)
+	if len(communities) != 1 || communities[0].ID != public.ID {
+		t.Fatalf("user is in %+v, want only %v", communities, public.Name)
+	}
+}
+
+func TestJoinRequests(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.newUser("owner")
+	member := s.newUser("member")
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	community := s.newCommunity(owner, "kitchen", VisibilityRequest)
+	s.call("POST", "/joinCommunity", member.Token, gin.H{"community_id": fmt.Sprint(community.ID)})
+	rec := s.call("GET", communityPath(community, "joinRequests"), owner.Token, nil)
+	wantStatus(t, rec, 200)
+	wantStatus(t, s.call("POST", communityPath(community, "approveJoin"), owner.Token,
+		gin.H{"request_id": fmt.Sprint(decode[[]JoinRequestInfo](t, rec)[0].ID)}), 200)
+
+	s.call("POST", "/joinCommunity", ada.Token, gin.H{"community_id": fmt.Sprint(community.ID)})
+	s.call("POST", "/joinCommunity", bob.Token, gin.H{"community_id": fmt.Sprint(community.ID)})
+
+	wantError(t, s.call("GET", communityPath(community, "joinRequests"), member.Token, nil), 403, "only a moderator")
+	wantError(t, s.call("GET", communityPath(community, "joinRequests"), ada.Token, nil), 403, "does not belong")
+	rec = s.call("GET", communityPath(community, "joinRequests"), owner.Token, nil)
+	wantStatus(t, rec, 200)
+	pending := map[string]uint{}
+	for _, request := range decode[[]JoinRequestInfo](t, rec) {
+		pending[request.UserName] = request.ID
+	}
+	if len(pending) != 2 {
+		t.Fatalf("unexpected join requests %v", pending)
+	}
+
+	wantError(t, s.call("POST", communityPath(community, "approveJoin"), member.Token,
+		gin.H{"request_id": fmt.Sprint(pending["ada"])}), 403, "only a moderator")
+	wantStatus(t, s.call("POST", communityPath(community, "approveJoin"), owner.Token,
+		gin.H{"request_id": fmt.Sprint(pending["ada"])}), 200)
+	wantStatus(t, s.call("POST", communityPath(community, "rejectJoin"), owner.Token,
+		gin.H{"request_id": fmt.Sprint(pending["bob"])}), 200)
+	wantError(t, s.call("POST", communityPath(community, "rejectJoin"), owner.Token,
+		gin.H{"request_id": fmt.Sprint(pending["ada"])}), 400, "no such pending join request")
+
+	roles := s.roles(owner, community)
+	if roles["ada"] != RoleMember || roles["bob"] != "" {
+		t.Fatalf("unexpected members %v", roles)
+	}
+	rec = s.call("GET", communityPath(community, "joinRequests"), owner.Token, nil)
+	if requests := decode[[]JoinRequestInfo](t, rec); len(requests) != 0 {
+		t.Fatalf("decided requests are still pending: %+v", requests)
+	}
+}
+
+func TestInvites(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.newUser("owner")
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	community := s.newCommunity(owner, "club", VisibilityInvite)
+
+	wantError(t, s.call("POST", communityPath(community, "invites"), owner.Token, gin.H{"max_uses": "-1"}), 400, "max_uses")
+	wantError(t, s.call("POST", communityPath(community, "invites"), owner.Token, gin.H{"expires_in_hours": "soon"}), 400, "expires_in_hours")
+	wantError(t, s.call("POST", communityPath(community, "invites"), ada.Token, gin.H{}), 403, "does not belong")
+	rec := s.call("POST", communityPath(community, "invites"), owner.Token, gin.H{"max_uses": "1", "expires_in_hours": "24"})
+	wantStatus(t, rec, 200)
+	invite := decode[Invite](t, rec)
+	if invite.Code == "" || invite.MaxUses != 1 || invite.ExpiresAt == nil {
+		t.Fatalf("unexpected invite %+v", invite)
+	}
+
+	rec = s.call("GET", "/invite/"+invite.Code, ada.Token, nil)
+	wantStatus(t, rec, 200)
+	if got := decode[struct{ Community Community }](t, rec).Community; got.ID != community.ID {
+		t.Fatalf("invite is for %+v", got)
+	}
+	wantError(t, s.call("GET", "/invite/made-up", ada.Token, nil), 400, "invalid or expired invite")
+
+	wantStatus(t, s.call("POST", "/joinWithInvite", ada.Token, gin.H{"code": invite.Code}), 200)
+	if roles := s.roles(owner, community); roles["ada"] != RoleMember {
+		t.Fatalf("ada did not join: %v", roles)
+	}
+	// the single use is gone
+	wantError(t, s.call("POST", "/joinWithInvite", bob.Token, gin.H{"code": invite.Code}), 400, "invalid or expired invite")
+	wantError(t, s.call("GET", "/invite/"+invite.Code, bob.Token, nil), 400, "invalid or expired invite")
+
+	rec = s.call("POST", communityPath(community, "invites"), owner.Token, gin.H{})
+	wantStatus(t, rec, 200)
+	open := decode[Invite](t, rec)
+	wantError(t, s.call("POST", "/joinWithInvite", ada.Token, gin.H{"code": open.Code}), 400, "already belongs")
+	rec = s.call("GET", communityPath(community, "invites"), owner.Token, nil)
+	wantStatus(t, rec, 200)
+	if invites := decode[[]Invite](t, rec); len(invites) != 2 {
+		t.Fatalf("listed %v invites, want 2", len(invites))
+	}
+	wantError(t, s.call("GET", communityPath(community, "invites"), ada.Token, nil), 403, "only a moderator")
+
+	wantStatus(t, s.call("POST", communityPath(community, "revokeInvite"), owner.Token, gin.H{"invite_id": fmt.Sprint(open.ID)}), 200)
+	wantError(t, s.call("POST", communityPath(community, "revokeInvite"), owner.Token, gin.H{"invite_id": fmt.Sprint(open.ID)}), 400, "no such invite")
+	wantError(t, s.call("POST", "/joinWithInvite", bob.Token, gin.H{"code": open.Code}), 400, "invalid or expired invite")
+}
+
+func TestInviteExpired(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.newUser("owner")
+	ada := s.newUser("ada")
+	community := s.newCommunity(owner, "club", VisibilityInvite)
+	rec := s.call("POST", communityPath(community, "invites"), owner.Token, gin.H{"expires_in_hours": "1"})
+	wantStatus(t, rec, 200)
+	invite := decode[Invite](t, rec)
+	err := s.db.Model(&Invite{}).Where("id = ?", invite.ID).Update("expires_at", time.Now().Add(-time.Minute)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantError(t, s.call("POST", "/joinWithInvite", ada.Token, gin.H{"code": invite.Code}), 400, "invalid or expired invite")
+}
+
+func TestCommunityVisibility(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.newUser("owner")
+	ada := s.newUser("ada")
+	community := s.newCommunity(owner, "garden", VisibilityPublic)
+	s.join(ada, community)
+	wantError(t, s.call("POST", communityPath(community, "visibility"), ada.Token, gin.H{"visibility": VisibilityInvite}), 403, "only a owner")
+	wantError(t, s.call("POST", communityPath(community, "visibility"), owner.Token, gin.H{"visibility": "secret"}), 400, "visibility must be")
+	wantStatus(t, s.call("POST", communityPath(community, "visibility"), owner.Token, gin.H{"visibility": VisibilityInvite}), 200)
+	rec := s.call("GET", "/communities/DE", "", nil)
+	if found := decode[[]Community](t, rec); len(found) != 0 {
+		t.Fatalf("an invite only community can be found: %+v", found)
+	}
+}
+
+func TestModeration(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.newUser("owner")
+	mod := s.newUser("mod")
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	outsider := s.newUser("outsider")
+	community := s.newCommunity(owner, "garden", VisibilityPublic)
+	for _, user := range []testUser{mod, ada, bob} {
+		s.join(user, community)
+	}
+	target := func(user testUser) gin.H {
+		return gin.H{"user_id": fmt.Sprint(user.ID), "reason": "testing"}
+	}
+
+	wantError(t, s.call("GET", communityPath(community, "members"), outsider.Token, nil), 403, "does not belong")
+	wantStatus(t, s.call("GET", "/community/999/members", owner.Token, nil), 404)
+	wantError(t, s.call("POST", communityPath(community, "promote"), mod.Token, target(ada)), 403, "only a owner")
+	wantStatus(t, s.call("POST", communityPath(community, "promote"), owner.Token, target(mod)), 200)
+	wantError(t, s.call("POST", communityPath(community, "promote"), owner.Token, target(mod)), 400, "not a member")
+	wantError(t, s.call("POST", communityPath(community, "promote"), owner.Token, target(outsider)), 403, "does not belong")
+
+	// members can not moderate, moderators only those below them
+	wantError(t, s.call("POST", communityPath(community, "kick"), ada.Token, target(bob)), 403, "only a moderator")
+	wantError(t, s.call("POST", communityPath(community, "kick"), mod.Token, target(owner)), 403, "lower role")
+	wantError(t, s.call("POST", communityPath(community, "kick"), mod.Token, target(mod)), 400, "yourself")
+	wantError(t, s.call("POST", communityPath(community, "kick"), mod.Token, gin.H{"user_id": "ada"}), 400, "must be a number")
+	wantStatus(t, s.call("POST", communityPath(community, "kick"), mod.Token, target(ada)), 200)
+	s.join(ada, community)
+
+	wantStatus(t, s.call("POST", communityPath(community, "ban"), mod.Token, target(bob)), 200)
+	wantError(t, s.call("POST", "/joinCommunity", bob.Token, gin.H{"community_id": fmt.Sprint(community.ID)}), 400, "banned")
+	wantError(t, s.call("GET", communityPath(community, "members"), bob.Token, nil), 403, "does not belong")
+	rec := s.call("GET", communityPath(community, "bans"), mod.Token, nil)
+	wantStatus(t, rec, 200)
+	if bans := decode[[]CommunityBan](t, rec); len(bans) != 1 || bans[0].UserID != bob.ID || bans[0].Reason != "testing" {
+		t.Fatalf("unexpected bans %+v", bans)
+	}
+	wantError(t, s.call("GET", communityPath(community, "bans"), ada.Token, nil), 403, "only a moderator")
+	wantStatus(t, s.call("POST", communityPath(community, "unban"), mod.Token, target(bob)), 200)
+	wantError(t, s.call("POST", communityPath(community, "unban"), mod.Token, target(bob)), 400, "not banned")
+	s.join(bob, community)
+
+	wantStatus(t, s.call("POST", communityPath(community, "demote"), owner.Token, target(mod)), 200)
+	wantError(t, s.call("POST", communityPath(community, "kick"), mod.Token, target(ada)), 403, "only a moderator")
+
+	wantError(t, s.call("POST", communityPath(community, "leave"), owner.Token, nil), 400, "transfer ownership before leaving")
+	wantStatus(t, s.call("POST", communityPath(community, "transfer"), owner.Token, target(ada)), 200)
+	roles := s.roles(ada, community)
+	if roles["ada"] != RoleOwner || roles["owner"] != RoleModerator || roles["mod"] != RoleMember {
+		t.Fatalf("unexpected roles after the transfer %v", roles)
+	}
+	wantStatus(t, s.call("POST", communityPath(community, "leave"), owner.Token, nil), 200)
+	wantError(t, s.call("POST", communityPath(community, "leave"), owner.Token, nil), 403, "does not belong")
+
+	rec = s.call("GET", communityPath(community, "moderation")+"?limit=3", ada.Token, nil)
+	wantStatus(t, rec, 200)
+	page := decode[Page[ModerationAction]](t, rec)
+	if len(page.Items) != 3 || page.NextCursor == "" || page.Items[0].Action != ActionLeave {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+	var actions []string
+	for cursor := ""; ; {
+		rec = s.call("GET", communityPath(community, "moderation")+"?cursor="+cursor, ada.Token, nil)
+		wantStatus(t, rec, 200)
+		page := decode[Page[ModerationAction]](t, rec)
+		for _, action := range page.Items {
+			actions = append(actions, action.Action)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	want := []string{ActionLeave, ActionTransfer, ActionDemote, ActionUnban, ActionBan, ActionKick, ActionPromote}
+	if fmt.Sprint(actions) != fmt.Sprint(want) {
+		t.Fatalf("moderation log is %v, want %v", actions, want)
+	}
+	wantError(t, s.call("GET", communityPath(community, "moderation"), bob.Token, nil), 403, "only a moderator")
+	wantError(t, s.call("GET", communityPath(community, "moderation")+"?limit=none", ada.Token, nil), 400, "limit")
+}
+
+func TestBanNonMember(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.newUser("owner")
+	ada := s.newUser("ada")
+	community := s.newCommunity(owner, "garden", VisibilityPublic)
+	s.join(ada, community)
+	wantStatus(t, s.call("POST", communityPath(community, "leave"), ada.Token, nil), 200)
+
+	// a member who left just before the moderator acts can still be banned
+	ban := gin.H{"user_id": fmt.Sprint(ada.ID), "reason": "spam"}
+	wantStatus(t, s.call("POST", communityPath(community, "ban"), owner.Token, ban), 200)
+	wantError(t, s.call("POST", communityPath(community, "ban"), owner.Token, ban), 400, "already banned")
+	wantError(t, s.call("POST", "/joinCommunity", ada.Token, gin.H{"community_id": fmt.Sprint(community.ID)}), 400, "banned")
+	wantError(t, s.call("POST", communityPath(community, "ban"), owner.Token, gin.H{"user_id": "999"}), 404, "user not found")
+	wantError(t, s.call("POST", communityPath(community, "ban"), owner.Token, gin.H{"user_id": fmt.Sprint(owner.ID)}), 400, "yourself")
+}
+
+func TestRemovePost(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.newUser("owner")
+	mod := s.newUser("mod")
+	ada := s.newUser("ada")
+	community := s.newCommunity(owner, "garden", VisibilityPublic)
+	s.join(mod, community)
+	s.join(ada, community)
+	wantStatus(t, s.call("POST", communityPath(community, "promote"), owner.Token, gin.H{"user_id": fmt.Sprint(mod.ID)}), 200)
+	offer := s.newOffer(ada, community, "bike")
+	request := s.newRequestPost(ada, community, "ladder")
+	ownerOffer := s.newOffer(owner, community, "lamp")
+
+	remove := func(kind string, id uint) gin.H {
+		return gin.H{"kind": kind, "id": fmt.Sprint(id), "reason": "spam"}
+	}
+	wantError(t, s.call("POST", communityPath(community, "removePost"), ada.Token, remove(SearchOffer, offer.ID)), 403, "only a moderator")
+	wantError(t, s.call("POST", communityPath(community, "removePost"), mod.Token, remove(SearchOffer, ownerOffer.ID)), 403, "lower role")
+	wantError(t, s.call("POST", communityPath(community, "removePost"), mod.Token, remove("event", offer.ID)), 400, "kind must be")
+	wantStatus(t, s.call("POST", communityPath(community, "removePost"), mod.Token, remove(SearchOffer, 999)), 404)
+	wantStatus(t, s.call("POST", communityPath(community, "removePost"), mod.Token, remove(SearchOffer, offer.ID)), 200)
+	wantStatus(t, s.call("POST", communityPath(community, "removePost"), owner.Token, remove(SearchRequest, request.ID)), 200)
+
+	wantStatus(t, s.call("GET", fmt.Sprintf("/offer/%v", offer.ID), ada.Token, nil), 404)
+	wantStatus(t, s.call("GET", fmt.Sprintf("/request/%v", request.ID), ada.Token, nil), 404)
+}
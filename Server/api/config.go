@@ -0,0 +1,266 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Secret is a setting that must never show up in logs. It prints and
+// encodes as a placeholder, Value returns the real thing.
+type Secret string
+
+const redacted = "[redacted]"
+
+func (s Secret) Value() string {
+	return string(s)
+}
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return `"` + s.String() + `"`
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// JWTConfig holds the token signing keys, Keys being a comma separated list
+// of id:secret pairs and ActiveKey the id of the key to sign with.
+type JWTConfig struct {
+	Keys      Secret `json:"keys"`
+	ActiveKey string `json:"active_key"`
+}
+
+// Config is everything the api server can be configured with. PublicURL is
+// where the web client is reachable and APIURL where browsers reach the api,
+// see Services.
+type Config struct {
+	ListenAddr string           `json:"listen_addr"`
+	PublicURL  string           `json:"public_url"`
+	APIURL     string           `json:"api_url"`
+	Database   DatabaseConfig   `json:"database"`
+	JWT        JWTConfig        `json:"jwt"`
+	Images     ImageStoreConfig `json:"images"`
+	Mail       MailerConfig     `json:"mail"`
+	// Search is "mysql" or "memory", by default mysql on mysql and memory on
+	// the other databases
+	Search string `json:"search"`
+}
+
+// DefaultConfig runs everything on this machine, with the data in a sqlite
+// file in the working directory.
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr: "127.0.0.1:8000",
+		PublicURL:  "http://127.0.0.1:8080",
+		APIURL:     "http://127.0.0.1:8000",
+		Database:   DatabaseConfig{Driver: DriverSQLite, DSN: "comradary.db"},
+		Images:     ImageStoreConfig{Backend: "local", Dir: "./images", S3Region: "us-east-1"},
+		Mail:       MailerConfig{Backend: "file", Dir: "./mail"},
+	}
+}
+
+// envSettings maps the COMRADARY_* environment variables to the settings
+// they override.
+func (cfg *Config) envSettings() map[string]*string {
+	return map[string]*string{
+		"COMRADARY_LISTEN_ADDR":    &cfg.ListenAddr,
+		"COMRADARY_PUBLIC_URL":     &cfg.PublicURL,
+		"COMRADARY_API_URL":        &cfg.APIURL,
+		"COMRADARY_DB_DRIVER":      &cfg.Database.Driver,
+		"COMRADARY_DB_DSN":         (*string)(&cfg.Database.DSN),
+		"COMRADARY_JWT_KEYS":       (*string)(&cfg.JWT.Keys),
+		"COMRADARY_JWT_ACTIVE_KEY": &cfg.JWT.ActiveKey,
+		"COMRADARY_IMAGE_STORE":    &cfg.Images.Backend,
+		"COMRADARY_IMAGE_DIR":      &cfg.Images.Dir,
+		"COMRADARY_S3_ENDPOINT":    &cfg.Images.S3Endpoint,
+		"COMRADARY_S3_REGION":      &cfg.Images.S3Region,
+		"COMRADARY_S3_BUCKET":      &cfg.Images.S3Bucket,
+		"COMRADARY_S3_ACCESS_KEY":  &cfg.Images.S3AccessKey,
+		"COMRADARY_S3_SECRET_KEY":  (*string)(&cfg.Images.S3SecretKey),
+		"COMRADARY_MAILER":         &cfg.Mail.Backend,
+		"COMRADARY_MAIL_DIR":       &cfg.Mail.Dir,
+		"COMRADARY_SMTP_ADDR":      &cfg.Mail.SMTPAddr,
+		"COMRADARY_SMTP_FROM":      &cfg.Mail.SMTPFrom,
+		"COMRADARY_SMTP_USERNAME":  &cfg.Mail.SMTPUsername,
+		"COMRADARY_SMTP_PASSWORD":  (*string)(&cfg.Mail.SMTPPassword),
+		"COMRADARY_SEARCH":         &cfg.Search,
+	}
+}
+
+// LoadConfig builds the configuration from the defaults, then the JSON file
+// named by -config or COMRADARY_CONFIG, then COMRADARY_* environment
+// variables and last the command line flags. Secrets can not be passed as
+// flags, the command line of a process is visible to every user. The
+// arguments after the flags are returned.
+func LoadConfig(args []string) (Config, []string, error) {
+	cfg := DefaultConfig()
+	var flagCfg Config
+	flags := flag.NewFlagSet("comradary", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("COMRADARY_CONFIG"), "path of a JSON config file")
+	flags.StringVar(&flagCfg.ListenAddr, "listen", "", "address to listen on")
+	flags.StringVar(&flagCfg.PublicURL, "public-url", "", "where the web client is reachable")
+	flags.StringVar(&flagCfg.APIURL, "api-url", "", "where browsers reach the api")
+	flags.StringVar(&flagCfg.Images.Backend, "image-store", "", "image store, local or s3")
+	flags.StringVar(&flagCfg.Images.Dir, "image-dir", "", "directory of the local image store")
+	flags.StringVar(&flagCfg.Mail.Backend, "mailer", "", "mailer, smtp, file or memory")
+	flags.StringVar(&flagCfg.Database.Driver, "db-driver", "", "database driver, mysql, sqlite or postgres")
+	flags.StringVar(&flagCfg.Search, "search", "", "search index, mysql or memory")
+	err := flags.Parse(args)
+	if err != nil {
+		return cfg, nil, err
+	}
+	if *configPath != "" {
+		err = readConfigFile(*configPath, &cfg)
+		if err != nil {
+			return cfg, nil, err
+		}
+	}
+	for name, setting := range cfg.envSettings() {
+		if value, ok := os.LookupEnv(name); ok && value != "" {
+			*setting = value
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.ListenAddr = flagCfg.ListenAddr
+		case "public-url":
+			cfg.PublicURL = flagCfg.PublicURL
+		case "api-url":
+			cfg.APIURL = flagCfg.APIURL
+		case "image-store":
+			cfg.Images.Backend = flagCfg.Images.Backend
+		case "image-dir":
+			cfg.Images.Dir = flagCfg.Images.Dir
+		case "mailer":
+			cfg.Mail.Backend = flagCfg.Mail.Backend
+		case "db-driver":
+			cfg.Database.Driver = flagCfg.Database.Driver
+		case "search":
+			cfg.Search = flagCfg.Search
+		}
+	})
+	if cfg.Search == "" {
+		cfg.Search = "memory"
+		if cfg.Database.Driver == DriverMySQL {
+			cfg.Search = "mysql"
+		}
+	}
+	return cfg, flags.Args(), cfg.Validate()
+}
+
+// readConfigFile reads the settings in the file over cfg. Unknown keys are an
+// error, a typo should not silently leave a setting at its default.
+func readConfigFile(path string, cfg *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening config file: %v", err)
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(cfg)
+	if err != nil {
+		return fmt.Errorf("error reading config file %v: %v", path, err)
+	}
+	return nil
+}
+
+// checkURL checks that setting is an absolute http or https URL.
+func checkURL(name string, setting string) error {
+	u, err := url.Parse(setting)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%v must be an http or https URL, got %q", name, setting)
+	}
+	return nil
+}
+
+// Validate reports every problem with the configuration at once, so a
+// deployment does not have to be fixed one restart at a time.
+func (cfg Config) Validate() error {
+	var errs []error
+	if cfg.ListenAddr == "" {
+		errs = append(errs, errors.New("listen_addr is required"))
+	}
+	err := checkURL("public_url", cfg.PublicURL)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	err = checkURL("api_url", cfg.APIURL)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	switch cfg.Database.Driver {
+	case DriverMySQL, DriverSQLite, DriverPostgres:
+	default:
+		errs = append(errs, fmt.Errorf("unknown database driver %q", cfg.Database.Driver))
+	}
+	if cfg.Database.DSN == "" {
+		errs = append(errs, errors.New("database.dsn (COMRADARY_DB_DSN) is required"))
+	}
+	if strings.TrimSpace(cfg.JWT.Keys.Value()) != "" {
+		_, err := parseSigningKeys(cfg.JWT)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch cfg.Images.Backend {
+	case "local":
+		if cfg.Images.Dir == "" {
+			errs = append(errs, errors.New("images.dir is required for the local image store"))
+		}
+	case "s3":
+		if cfg.Images.S3Endpoint == "" || cfg.Images.S3Bucket == "" {
+			errs = append(errs, errors.New("s3 image store needs an endpoint and a bucket"))
+		}
+		if cfg.Images.S3AccessKey == "" || cfg.Images.S3SecretKey == "" {
+			errs = append(errs, errors.New("s3 image store needs an access key and a secret key (COMRADARY_S3_SECRET_KEY)"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown image store %q", cfg.Images.Backend))
+	}
+	switch cfg.Mail.Backend {
+	case "smtp":
+		if cfg.Mail.SMTPAddr == "" || cfg.Mail.SMTPFrom == "" {
+			errs = append(errs, errors.New("smtp mailer needs an address and a from address"))
+		}
+		if cfg.Mail.SMTPUsername != "" && cfg.Mail.SMTPPassword == "" {
+			errs = append(errs, errors.New("smtp_password (COMRADARY_SMTP_PASSWORD) is required with smtp_username"))
+		}
+	case "file":
+		if cfg.Mail.Dir == "" {
+			errs = append(errs, errors.New("mail.dir is required for the file mailer"))
+		}
+	case "memory":
+	default:
+		errs = append(errs, fmt.Errorf("unknown mailer %q", cfg.Mail.Backend))
+	}
+	switch {
+	case cfg.Search == "mysql" && cfg.Database.Driver != DriverMySQL:
+		errs = append(errs, errors.New("the mysql search index needs the mysql database driver"))
+	case cfg.Search != "mysql" && cfg.Search != "memory":
+		errs = append(errs, fmt.Errorf("unknown search index %q", cfg.Search))
+	}
+	return errors.Join(errs...)
+}
+
+// Redacted is the configuration as it is safe to log.
+func (cfg Config) Redacted() string {
+	out, err := json.Marshal(cfg)
+	if err != nil {
+		return err.Error()
+	}
+	return strings.TrimSpace(string(out))
+}
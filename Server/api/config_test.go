@@ -0,0 +1,147 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// clearConfigEnv hides the COMRADARY_* variables of the environment the tests
+// run in.
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("COMRADARY_CONFIG", "")
+	cfg := DefaultConfig()
+	for name := range cfg.envSettings() {
+		t.Setenv(name, "")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{"listen_addr": ":9000", "database": {"driver": "postgres", "dsn": "host=file"}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(cfg Config) bool
+	}{
+		{"defaults", nil, nil, func(cfg Config) bool {
+			want := DefaultConfig()
+			want.Search = "memory"
+			return cfg == want
+		}},
+		{"file", nil, []string{"-config", path}, func(cfg Config) bool {
+			return cfg.ListenAddr == ":9000" && cfg.Database.Driver == DriverPostgres && cfg.Database.DSN == "host=file" &&
+				cfg.APIURL == DefaultConfig().APIURL
+		}},
+		{"file from the environment", map[string]string{"COMRADARY_CONFIG": path}, nil, func(cfg Config) bool {
+			return cfg.ListenAddr == ":9000"
+		}},
+		{"environment over the file", map[string]string{"COMRADARY_LISTEN_ADDR": ":9100", "COMRADARY_DB_DSN": "host=env"},
+			[]string{"-config", path}, func(cfg Config) bool {
+				return cfg.ListenAddr == ":9100" && cfg.Database.DSN == "host=env"
+			}},
+		{"flags over the environment", map[string]string{"COMRADARY_LISTEN_ADDR": ":9100"}, []string{"-listen", ":9200"},
+			func(cfg Config) bool {
+				return cfg.ListenAddr == ":9200"
+			}},
+		{"secrets from the environment", map[string]string{"COMRADARY_IMAGE_STORE": "s3", "COMRADARY_S3_ENDPOINT": "http://s3.test",
+			"COMRADARY_S3_BUCKET": "images", "COMRADARY_S3_ACCESS_KEY": "access", "COMRADARY_S3_SECRET_KEY": "secret"}, nil,
+			func(cfg Config) bool {
+				return cfg.Images.Backend == "s3" && cfg.Images.S3SecretKey.Value() == "secret"
+			}},
+		{"mysql search on mysql", map[string]string{"COMRADARY_DB_DRIVER": DriverMySQL}, nil, func(cfg Config) bool {
+			return cfg.Search == "mysql"
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			cfg, args, err := LoadConfig(test.args)
+			if err != nil || len(args) != 0 || !test.check(cfg) {
+				t.Fatalf("got %+v, %v, %v", cfg, args, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{"listen": ":9000"}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		error string
+	}{
+		{"unknown field", nil, []string{"-config", path}, "unknown field"},
+		{"missing file", nil, []string{"-config", path + ".missing"}, "error opening config file"},
+		{"secret as a flag", nil, []string{"-jwt-keys", "main:secret"}, "flag provided but not defined"},
+		{"url without a scheme", map[string]string{"COMRADARY_PUBLIC_URL": "web.test"}, nil, "public_url must be an http or https URL"},
+		{"unknown driver", nil, []string{"-db-driver", "oracle"}, `unknown database driver "oracle"`},
+		{"unknown image store", map[string]string{"COMRADARY_IMAGE_STORE": "ftp"}, nil, `unknown image store "ftp"`},
+		{"unknown mailer", nil, []string{"-mailer", "pigeon"}, `unknown mailer "pigeon"`},
+		{"mysql search without mysql", nil, []string{"-search", "mysql"}, "needs the mysql database driver"},
+		{"short signing key", map[string]string{"COMRADARY_JWT_KEYS": "main:short"}, nil, `signing key "main" must be at least 32 bytes`},
+		{"unknown active key", map[string]string{"COMRADARY_JWT_KEYS": "main:" + strings.Repeat("k", 32),
+			"COMRADARY_JWT_ACTIVE_KEY": "old"}, nil, `active signing key "old" is not configured`},
+		{"s3 without a secret key", map[string]string{"COMRADARY_IMAGE_STORE": "s3", "COMRADARY_S3_ENDPOINT": "http://s3.test",
+			"COMRADARY_S3_BUCKET": "images", "COMRADARY_S3_ACCESS_KEY": "access"}, nil, "COMRADARY_S3_SECRET_KEY"},
+		{"smtp without a password", map[string]string{"COMRADARY_MAILER": "smtp", "COMRADARY_SMTP_ADDR": "smtp.test:587",
+			"COMRADARY_SMTP_FROM": "noreply@example.com", "COMRADARY_SMTP_USERNAME": "noreply"}, nil, "COMRADARY_SMTP_PASSWORD"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			_, _, err := LoadConfig(test.args)
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("got error %v, want one containing %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestConfigValidateReportsEveryProblem(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Search = "memory"
+	cfg.ListenAddr = ""
+	cfg.Database.DSN = ""
+	cfg.Images.Dir = ""
+	err := cfg.Validate()
+	for _, want := range []string{"listen_addr is required", "database.dsn", "images.dir"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("error %v does not mention %q", err, want)
+		}
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Database.DSN = "user:dbpass@/comradary"
+	cfg.JWT.Keys = "main:jwtsecret"
+	cfg.Images.S3SecretKey = "s3secret"
+	cfg.Mail.SMTPPassword = "smtppass"
+	out := cfg.Redacted()
+	for _, secret := range []string{"dbpass", "jwtsecret", "s3secret", "smtppass"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("%v shows up in %v", secret, out)
+		}
+	}
+	if !strings.Contains(out, redacted) {
+		t.Errorf("%v does not mark the secrets as redacted", out)
+	}
+}
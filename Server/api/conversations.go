@@ -0,0 +1,378 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Conversation groups the messages two users exchange about one offer or
+// request.
+type Conversation struct {
+	gorm.Model
+	OfferID       *uint                     `gorm:"index" json:"offer_id"`
+	RequestID     *uint                     `gorm:"index" json:"request_id"`
+	LastMessageAt *time.Time                `json:"last_message_at"`
+	Participants  []ConversationParticipant `json:"participants"`
+	// ParticipantKey names the two users and the post, see conversationKey.
+	// Its unique index keeps two messages sent at once from starting two
+	// conversations.
+	ParticipantKey *string `gorm:"size:100;uniqueIndex" json:"-"`
+}
+
+// ConversationParticipant is one side of a conversation. LastReadAt is when
+// the user last read it.
+type ConversationParticipant struct {
+	ConversationID uint       `gorm:"primaryKey" json:"conversation_id"`
+	UserID         uint       `gorm:"primaryKey;index" json:"user_id"`
+	LastReadAt     *time.Time `json:"last_read_at"`
+}
+
+// ConversationSummary is an inbox entry.
+type ConversationSummary struct {
+	ID            uint       `json:"id"`
+	OfferID       *uint      `json:"offer_id"`
+	RequestID     *uint      `json:"request_id"`
+	PostTitle     string     `json:"post_title"`
+	OtherUserID   uint       `json:"other_user_id"`
+	OtherUserName string     `json:"other_user_name"`
+	LastMessage   *Message   `json:"last_message"`
+	LastMessageAt *time.Time `json:"last_message_at"`
+	Unread        int64      `json:"unread"`
+}
+
+// deletedPostTitle is what the inbox shows for a post that was deleted for
+// good, along with the account of its author.
+const deletedPostTitle = "Deleted post"
+
+// postTitle is the title of the post in titles, or deletedPostTitle if the
+// post is gone.
+func postTitle(titles map[uint]string, id uint) string {
+	title, ok := titles[id]
+	if !ok {
+		return deletedPostTitle
+	}
+	return title
+}
+
+// conversationKey identifies the conversation between the two users about the
+// offer or request, whichever user sent the first message.
+func conversationKey(userA uint, userB uint, offerID *uint, requestID *uint) string {
+	if userA > userB {
+		userA, userB = userB, userA
+	}
+	key := fmt.Sprintf("%d-%d", userA, userB)
+	if offerID != nil {
+		key += fmt.Sprintf("/offer-%d", *offerID)
+	}
+	if requestID != nil {
+		key += fmt.Sprintf("/request-%d", *requestID)
+	}
+	return key
+}
+
+func findConversation(db *gorm.DB, key string) (Conversation, error) {
+	var conversation Conversation
+	result := db.Where("participant_key = ?", key).First(&conversation)
+	return conversation, result.Error
+}
+
+// conversationFor returns the conversation between the two users about the
+// post, starting it if they have not talked about it yet. If another request
+// starts it first, the unique key makes the insert a no-op and the row is
+// read back.
+func conversationFor(db *gorm.DB, userA uint, userB uint, offerID *uint, requestID *uint) (Conversation, error) {
+	key := conversationKey(userA, userB, offerID, requestID)
+	conversation, err := findConversation(db, key)
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return conversation, err
+	}
+	conversation = Conversation{OfferID: offerID, RequestID: requestID, ParticipantKey: &key}
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&conversation)
+	if result.Error != nil {
+		return conversation, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return findConversation(db, key)
+	}
+	participants := []ConversationParticipant{{ConversationID: conversation.ID, UserID: userA}}
+	if userB != userA {
+		participants = append(participants, ConversationParticipant{ConversationID: conversation.ID, UserID: userB})
+	}
+	conversation.Participants = participants
+	return conversation, db.Create(&participants).Error
+}
+
+// touchConversation records a new message, which the sender has read.
+func touchConversation(db *gorm.DB, conversationID uint, senderID uint, at time.Time) error {
+	err := db.Model(&Conversation{}).Where("id = ?", conversationID).Update("last_message_at", at).Error
+	if err != nil {
+		return err
+	}
+	_, err = markConversationRead(db, conversationID, senderID, at)
+	return err
+}
+
+// markConversationRead marks the messages the user got in the conversation as
+// read and returns how many were unread.
+func markConversationRead(db *gorm.DB, conversationID uint, userID uint, at time.Time) (int64, error) {
+	result := db.Model(&Message{}).
+		Where("conversation_id = ? AND receiver_id = ? AND read_at IS NULL", conversationID, userID).
+		Updates(map[string]interface{}{
+			"read_at":      at,
+			"delivered_at": gorm.Expr("COALESCE(delivered_at, ?)", at),
+		})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	err := db.Model(&ConversationParticipant{}).
+		Where("conversation_id = ? AND user_id = ?", conversationID, userID).
+		Update("last_read_at", at).Error
+	return result.RowsAffected, err
+}
+
+// summarizeConversations builds the inbox entries of the conversations for
+// the user. The counterparts, post titles, last messages and unread counts
+// are loaded for all conversations at once.
+func summarizeConversations(db *gorm.DB, conversations []Conversation, userID uint) ([]ConversationSummary, error) {
+	summaries := []ConversationSummary{}
+	if len(conversations) == 0 {
+		return summaries, nil
+	}
+	var ids, userIDs, offerIDs, requestIDs []uint
+	for _, conversation := range conversations {
+		summary := ConversationSummary{
+			ID:            conversation.ID,
+			OfferID:       conversation.OfferID,
+			RequestID:     conversation.RequestID,
+			LastMessageAt: conversation.LastMessageAt,
+			OtherUserID:   userID,
+		}
+		for _, participant := range conversation.Participants {
+			if participant.UserID != userID {
+				summary.OtherUserID = participant.UserID
+			}
+		}
+		ids = append(ids, conversation.ID)
+		userIDs = append(userIDs, summary.OtherUserID)
+		if conversation.RequestID != nil {
+			requestIDs = append(requestIDs, *conversation.RequestID)
+		} else if conversation.OfferID != nil {
+			offerIDs = append(offerIDs, *conversation.OfferID)
+		}
+		summaries = append(summaries, summary)
+	}
+
+	var users []User
+	result := db.Unscoped().Select("id", "user_name").Where("id IN ?", userIDs).Find(&users)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	userNames := map[uint]string{}
+	for _, user := range users {
+		userNames[user.ID] = user.UserName
+	}
+	// deleted posts keep their title in the inbox
+	offerTitles := map[uint]string{}
+	if len(offerIDs) > 0 {
+		var offers []Offer
+		result = db.Unscoped().Select("id", "title").Where("id IN ?", offerIDs).Find(&offers)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		for _, offer := range offers {
+			offerTitles[offer.ID] = offer.Title
+		}
+	}
+	requestTitles := map[uint]string{}
+	if len(requestIDs) > 0 {
+		var requests []Request
+		result = db.Unscoped().Select("id", "title").Where("id IN ?", requestIDs).Find(&requests)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		for _, request := range requests {
+			requestTitles[request.ID] = request.Title
+		}
+	}
+
+	// the newest message of a conversation has the highest id
+	var lastMessages []Message
+	result = db.Where("id IN (?)", db.Model(&Message{}).Select("MAX(id)").
+		Where("conversation_id IN ?", ids).Group("conversation_id")).
+		Find(&lastMessages)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	last := map[uint]Message{}
+	for _, message := range lastMessages {
+		last[*message.ConversationID] = message
+	}
+	var counts []struct {
+		ConversationID uint
+		Unread         int64
+	}
+	result = db.Model(&Message{}).Select("conversation_id, COUNT(*) AS unread").
+		Where("conversation_id IN ? AND receiver_id = ? AND read_at IS NULL", ids, userID).
+		Group("conversation_id").Scan(&counts)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	unread := map[uint]int64{}
+	for _, count := range counts {
+		unread[count.ConversationID] = count.Unread
+	}
+
+	for i, summary := range summaries {
+		summaries[i].OtherUserName = userNames[summary.OtherUserID]
+		if summary.RequestID != nil {
+			summaries[i].PostTitle = postTitle(requestTitles, *summary.RequestID)
+		} else if summary.OfferID != nil {
+			summaries[i].PostTitle = postTitle(offerTitles, *summary.OfferID)
+		}
+		if message, ok := last[summary.ID]; ok {
+			summaries[i].LastMessage = &message
+		}
+		summaries[i].Unread = unread[summary.ID]
+	}
+	return summaries, nil
+}
+
+// conversationID parses the conversation id in the path, otherwise it
+// writes the error response.
+func conversationID(c *gin.Context) (uint, bool) {
+	id, err := parseUint(c.Param("id"))
+	if err != nil {
+		c.JSON(404, gin.H{"error": errNoConversation.Error()})
+		return 0, false
+	}
+	return id, true
+}
+
+// optionalID parses the query parameter, which may be left out.
+func optionalID(c *gin.Context, name string) (*uint, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return nil, true
+	}
+	id, err := parseUint(value)
+	if err != nil {
+		c.JSON(400, gin.H{"error": name + " is not a number"})
+		return nil, false
+	}
+	return &id, true
+}
+
+// GetConversations lists the current user's conversations, the most recently
+// active first, optionally only those about the offer or request given in the
+// offerID or requestID query parameter.
+func GetConversations(messages *MessageService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		offerID, ok := optionalID(c, "offerID")
+		if !ok {
+			return
+		}
+		requestID, ok := optionalID(c, "requestID")
+		if !ok {
+			return
+		}
+		summaries, err := messages.Conversations(c.Request.Context(), currentUser(c).ID, offerID, requestID)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, summaries)
+	}
+}
+
+// GetConversation returns a conversation with its messages.
+func GetConversation(messages *MessageService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := conversationID(c)
+		if !ok {
+			return
+		}
+		summary, history, err := messages.Conversation(c.Request.Context(), currentUser(c).ID, id)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"conversation": summary, "messages": history})
+	}
+}
+
+// MarkConversationRead marks the messages the current user got in the
+// conversation as read and tells the other side.
+func MarkConversationRead(messages *MessageService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := conversationID(c)
+		if !ok {
+			return
+		}
+		read, err := messages.MarkRead(c.Request.Context(), currentUser(c).ID, id)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"read": read})
+	}
+}
+
+type TypingInput struct {
+	ReceiverID string `json:"receiver_id" binding:"required"`
+	OfferID    string `json:"offer_id"`
+	RequestID  string `json:"request_id"`
+}
+
+// SendTyping tells the other side of a conversation that the current user is
+// typing. Nothing is stored, and users who have not talked yet or blocked
+// each other are not told.
+func SendTyping(messages *MessageService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input TypingInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		receiverID, err := parseUint(input.ReceiverID)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		var offerID, requestID *uint
+		if input.RequestID != "" {
+			id, err := parseUint(input.RequestID)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			requestID = &id
+		} else if input.OfferID != "" {
+			id, err := parseUint(input.OfferID)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			offerID = &id
+		}
+		sent := messages.Typing(c.Request.Context(), currentUser(c).ID, receiverID, offerID, requestID)
+		c.JSON(200, gin.H{"sent": sent})
+	}
+}
+
+// GetUnreadCount returns how many messages the current user has not read.
+func GetUnreadCount(messages *MessageService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		unread, err := messages.Unread(c.Request.Context(), currentUser(c).ID)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"unread": unread})
+	}
+}
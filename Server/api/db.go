@@ -0,0 +1,106 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+const (
+	DriverMySQL    = "mysql"
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// DatabaseConfig names the database driver and the DSN handed to it:
+//
+//	mysql     user:password@tcp(127.0.0.1:3306)/comradary?charset=utf8mb4&parseTime=True&loc=Local
+//	sqlite    a file name, or :memory: for a database that lives as long as the process
+//	postgres  host=127.0.0.1 user=comradary password=password dbname=comradary
+type DatabaseConfig struct {
+	Driver string `json:"driver"`
+	DSN    Secret `json:"dsn"`
+}
+
+// sqliteDSN adds the pragmas the api relies on to a sqlite file name: a busy
+// timeout, as requests write concurrently, and foreign keys, which sqlite
+// leaves off by default. :memory: becomes a named in-memory database, so all
+// connections of the pool see the same data.
+func sqliteDSN(dsn string) (string, error) {
+	if dsn == ":memory:" {
+		raw := make([]byte, 8)
+		_, err := rand.Read(raw)
+		if err != nil {
+			return "", err
+		}
+		dsn = "file:/comradary-" + hex.EncodeToString(raw) + "?vfs=memdb"
+	}
+	if !strings.HasPrefix(dsn, "file:") {
+		dsn = "file:" + dsn
+	}
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	return dsn + separator + "_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)", nil
+}
+
+func dialector(cfg DatabaseConfig) (gorm.Dialector, error) {
+	switch cfg.Driver {
+	case DriverMySQL:
+		return mysql.Open(cfg.DSN.Value()), nil
+	case DriverSQLite:
+		dsn, err := sqliteDSN(cfg.DSN.Value())
+		if err != nil {
+			return nil, err
+		}
+		return sqlite.Open(dsn), nil
+	case DriverPostgres:
+		return postgres.Open(cfg.DSN.Value()), nil
+	}
+	return nil, fmt.Errorf("unknown database driver %q", cfg.Driver)
+}
+
+// OpenDB connects to the configured database without touching its schema.
+func OpenDB(cfg DatabaseConfig) (*gorm.DB, error) {
+	dialect, err := dialector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db, err := gorm.Open(dialect, &gorm.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the database: %v", err)
+	}
+	err = setupMembership(db)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up memberships: %v", err)
+	}
+	return db, nil
+}
+
+// ConnectDB opens the database and checks that its schema is up to date. An
+// in-memory sqlite database starts out empty and no other process can reach
+// it to run the migrate command, so it is migrated here.
+func ConnectDB(cfg DatabaseConfig) (*gorm.DB, error) {
+	db, err := OpenDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Driver == DriverSQLite && cfg.DSN.Value() == ":memory:" {
+		err = MigrateUp(db)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = CheckSchema(db)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
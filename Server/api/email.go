@@ -0,0 +1,252 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	EmailVerify        = "verify"
+	EmailPasswordReset = "reset"
+
+	verifyTokenTTL = 48 * time.Hour
+	resetTokenTTL  = time.Hour
+)
+
+// EmailToken is a single use token mailed to a user to prove they can read
+// the mailbox, either to verify the address or to reset the password. Only
+// the hash of the token is stored.
+type EmailToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	Purpose   string `gorm:"size:16"`
+	TokenHash string `gorm:"size:64;uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+type EmailTokenInput struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type ForgotPasswordInput struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordInput struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// issueEmailToken invalidates the user's earlier tokens for the purpose and
+// returns a new one.
+func issueEmailToken(db *gorm.DB, userID uint, purpose string, ttl time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&EmailToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		return tx.Create(&EmailToken{
+			UserID:    userID,
+			Purpose:   purpose,
+			TokenHash: sha256Hex([]byte(token)),
+			ExpiresAt: time.Now().Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+var errInvalidEmailToken = errors.New("invalid or expired token")
+
+// useEmailToken marks the token as used and returns it. A token can only be
+// used once, even by concurrent requests.
+func useEmailToken(db *gorm.DB, token string, purpose string) (EmailToken, error) {
+	var stored EmailToken
+	result := db.Where("token_hash = ? AND purpose = ?", sha256Hex([]byte(token)), purpose).First(&stored)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return stored, errInvalidEmailToken
+	}
+	if result.Error != nil {
+		return stored, result.Error
+	}
+	if stored.UsedAt != nil || time.Now().After(stored.ExpiresAt) {
+		return stored, errInvalidEmailToken
+	}
+	result = db.Model(&EmailToken{}).
+		Where("id = ? AND used_at IS NULL", stored.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return stored, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return stored, errInvalidEmailToken
+	}
+	return stored, nil
+}
+
+// normalizeEmail lower-cases an email address before it is stored or looked
+// up. MySQL compares them case-insensitively anyway, sqlite and postgres do
+// not.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// clientLink builds a link to a page of the web client.
+func clientLink(publicURL string, path string, token string) string {
+	return strings.TrimRight(publicURL, "/") + path + "?" + url.Values{"token": {token}}.Encode()
+}
+
+func sendVerificationMail(ctx context.Context, db *gorm.DB, mailer Mailer, publicURL string, user User) error {
+	token, err := issueEmailToken(db, user.ID, EmailVerify, verifyTokenTTL)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(ctx, Mail{
+		To:      user.Email,
+		Subject: "Verify your Comradary email address",
+		Body: fmt.Sprintf("Hi %v,\n\nopen this link to verify your email address:\n\n%v\n\n"+
+			"The link expires in %v hours.\n", user.UserName, clientLink(publicURL, "/verifyEmail", token),
+			int(verifyTokenTTL.Hours())),
+	})
+}
+
+// RequireVerified rejects users who have not verified their email address
+// yet. It has to run after RequireAuth.
+func RequireVerified() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if currentUser(c).EmailVerifiedAt == nil {
+			c.AbortWithStatusJSON(403, gin.H{"error": "email address is not verified"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func VerifyEmail(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input EmailTokenInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		token, err := useEmailToken(db, input.Token, EmailVerify)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		result := db.Model(&User{}).Where("id = ? AND email_verified_at IS NULL", token.UserID).
+			Update("email_verified_at", time.Now())
+		if result.Error != nil {
+			c.JSON(400, gin.H{"error": result.Error.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"verified": true})
+	}
+}
+
+func ResendVerification(db *gorm.DB, mailer Mailer, publicURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := currentUser(c)
+		if user.EmailVerifiedAt != nil {
+			c.JSON(400, gin.H{"error": "email address is already verified"})
+			return
+		}
+		err := sendVerificationMail(c.Request.Context(), db, mailer, publicURL, user)
+		if err != nil {
+			log.Println("Error sending verification mail: ", err)
+			c.JSON(400, gin.H{"error": "could not send verification mail"})
+			return
+		}
+		c.JSON(200, gin.H{"sent": true})
+	}
+}
+
+// ForgotPassword mails a reset link if an account with the address exists.
+// It answers the same either way so it can not be used to find accounts.
+func ForgotPassword(db *gorm.DB, mailer Mailer, publicURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input ForgotPasswordInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		var user User
+		result := db.Where("email = ?", normalizeEmail(input.Email)).First(&user)
+		if result.Error != nil {
+			c.JSON(200, gin.H{"sent": true})
+			return
+		}
+		token, err := issueEmailToken(db, user.ID, EmailPasswordReset, resetTokenTTL)
+		if err != nil {
+			log.Println("Error creating reset token: ", err)
+			c.JSON(200, gin.H{"sent": true})
+			return
+		}
+		err = mailer.Send(c.Request.Context(), Mail{
+			To:      user.Email,
+			Subject: "Reset your Comradary password",
+			Body: fmt.Sprintf("Hi %v,\n\nopen this link to choose a new password:\n\n%v\n\n"+
+				"The link expires in an hour. If you did not ask for it you can ignore this mail.\n",
+				user.UserName, clientLink(publicURL, "/resetPassword", token)),
+		})
+		if err != nil {
+			log.Println("Error sending reset mail: ", err)
+		}
+		c.JSON(200, gin.H{"sent": true})
+	}
+}
+
+// ResetPassword sets a new password and signs the user out everywhere.
+func ResetPassword(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input ResetPasswordInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		passwordHash, err := HashPassword(input.Password)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		token, err := useEmailToken(db, input.Token, EmailPasswordReset)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		// the reset link reached the mailbox, so the address is verified too
+		result := db.Model(&User{}).Where("id = ?", token.UserID).Updates(map[string]interface{}{
+			"password_hash":     passwordHash,
+			"email_verified_at": gorm.Expr("COALESCE(email_verified_at, ?)", time.Now()),
+		})
+		if result.Error != nil {
+			c.JSON(400, gin.H{"error": result.Error.Error()})
+			return
+		}
+		err = revokeAllSessions(db, token.UserID)
+		if err != nil {
+			log.Println("Error revoking sessions: ", err)
+		}
+		c.JSON(200, gin.H{"reset": true})
+	}
+}
@@ -0,0 +1,476 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+
+	// exportTTL is how long a finished export can be downloaded
+	exportTTL        = 7 * 24 * time.Hour
+	exportPollGap    = 30 * time.Second
+	exportCleanupGap = time.Hour
+	// exportClaimTimeout is how long an export can be running before it is
+	// taken to belong to a process that died and is started over
+	exportClaimTimeout = 30 * time.Minute
+)
+
+// DataExport is a request for a copy of the user's data. The rows double as
+// the job queue of the ExportWorker, so exports asked for just before a
+// restart are still built afterwards.
+type DataExport struct {
+	gorm.Model
+	UserID uint   `gorm:"index" json:"user_id"`
+	Status string `gorm:"size:16;default:pending;index" json:"status"`
+	// File is the archive in the image store, set once the export is ready
+	File      string     `json:"-"`
+	Size      int64      `json:"size"`
+	Error     string     `json:"error,omitempty"`
+	ReadyAt   *time.Time `json:"ready_at"`
+	ExpiresAt *time.Time `gorm:"index" json:"expires_at"`
+	// ClaimedAt is when a worker started building the export
+	ClaimedAt *time.Time `json:"-"`
+}
+
+// exportedUser is the user row without the password hash and session state.
+type exportedUser struct {
+	ID              uint       `json:"id"`
+	UserName        string     `json:"username"`
+	Email           string     `json:"email"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	DisplayName     string     `json:"display_name"`
+	Bio             string     `json:"bio"`
+	HomeCity        string     `json:"home_city"`
+	AvatarPhotoID   *uint      `json:"avatar_photo_id"`
+	IsAdmin         bool       `json:"is_admin"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+type exportedMembership struct {
+	CommunityID   uint      `json:"community_id"`
+	CommunityName string    `json:"community_name"`
+	Role          string    `json:"role"`
+	JoinedAt      time.Time `json:"joined_at"`
+}
+
+// exportedPhoto points at the original image in the archive, if there is one.
+type exportedPhoto struct {
+	ID        uint      `json:"id"`
+	OfferID   *uint     `json:"offer_id"`
+	RequestID *uint     `json:"request_id"`
+	Caption   string    `json:"caption"`
+	Position  int       `json:"position"`
+	CreatedAt time.Time `json:"created_at"`
+	File      string    `json:"file"`
+}
+
+// PersonalData is the data.json of an export. Posts and messages the user
+// removed are included as long as the database still holds them.
+type PersonalData struct {
+	ExportedAt     time.Time            `json:"exported_at"`
+	User           exportedUser         `json:"user"`
+	Memberships    []exportedMembership `json:"memberships"`
+	Offers         []Offer              `json:"offers"`
+	Requests       []Request            `json:"requests"`
+	Photos         []exportedPhoto      `json:"photos"`
+	MessagesInbox  []Message            `json:"messages_inbox"`
+	MessagesOutbox []Message            `json:"messages_outbox"`
+
+	photoPaths map[uint]string
+}
+
+// collectPersonalData loads everything the database holds on the user.
+func collectPersonalData(db *gorm.DB, userID uint) (PersonalData, error) {
+	data := PersonalData{
+		ExportedAt:     time.Now(),
+		Memberships:    []exportedMembership{},
+		Offers:         []Offer{},
+		Requests:       []Request{},
+		Photos:         []exportedPhoto{},
+		MessagesInbox:  []Message{},
+		MessagesOutbox: []Message{},
+		photoPaths:     map[uint]string{},
+	}
+	var user User
+	result := db.First(&user, userID)
+	if result.Error != nil {
+		return data, result.Error
+	}
+	data.User = exportedUser{
+		ID:              user.ID,
+		UserName:        user.UserName,
+		Email:           user.Email,
+		EmailVerifiedAt: user.EmailVerifiedAt,
+		DisplayName:     user.DisplayName,
+		Bio:             user.Bio,
+		HomeCity:        user.HomeCity,
+		AvatarPhotoID:   user.AvatarID,
+		IsAdmin:         user.IsAdmin,
+		CreatedAt:       user.CreatedAt,
+		UpdatedAt:       user.UpdatedAt,
+	}
+	result = db.Table("user_communities").
+		Select("user_communities.community_id, communities.name AS community_name, user_communities.role, user_communities.created_at AS joined_at").
+		Joins("JOIN communities ON communities.id = user_communities.community_id").
+		Where("user_communities.user_id = ?", userID).
+		Order("user_communities.created_at").Scan(&data.Memberships)
+	if result.Error != nil {
+		return data, result.Error
+	}
+	result = db.Unscoped().Where("user_id = ?", userID).Order("id").Find(&data.Offers)
+	if result.Error != nil {
+		return data, result.Error
+	}
+	result = db.Unscoped().Where("user_id = ?", userID).Order("id").Find(&data.Requests)
+	if result.Error != nil {
+		return data, result.Error
+	}
+	var photos []Photo
+	result = db.Unscoped().Where("user_id = ?", userID).Order("id").Find(&photos)
+	if result.Error != nil {
+		return data, result.Error
+	}
+	for _, photo := range photos {
+		file := fmt.Sprintf("images/%d.jpg", photo.ID)
+		data.photoPaths[photo.ID] = photo.Path
+		data.Photos = append(data.Photos, exportedPhoto{
+			ID:        photo.ID,
+			OfferID:   photo.OfferID,
+			RequestID: photo.RequestID,
+			Caption:   photo.Caption,
+			Position:  photo.Position,
+			CreatedAt: photo.CreatedAt,
+			File:      file,
+		})
+	}
+	result = db.Unscoped().Where("receiver_id = ?", userID).Order("id").Find(&data.MessagesInbox)
+	if result.Error != nil {
+		return data, result.Error
+	}
+	result = db.Unscoped().Where("sender_id = ?", userID).Order("id").Find(&data.MessagesOutbox)
+	return data, result.Error
+}
+
+// buildExportArchive zips data.json and the original of every photo. Photos
+// whose file has gone missing are listed without one.
+func buildExportArchive(ctx context.Context, images ImageStore, data PersonalData) ([]byte, error) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for i, photo := range data.Photos {
+		err := copyImageToArchive(ctx, images, archive, photo.File, data.photoPaths[photo.ID])
+		if errors.Is(err, ErrImageNotFound) {
+			log.Printf("export of user %v: image of photo %v is missing", data.User.ID, photo.ID)
+			data.Photos[i].File = ""
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	file, err := archive.Create("data.json")
+	if err != nil {
+		return nil, err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+	err = archive.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func copyImageToArchive(ctx context.Context, images ImageStore, archive *zip.Writer, name string, path string) error {
+	image, err := images.Open(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+	// jpegs do not get any smaller, so store them as they are
+	file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, image)
+	return err
+}
+
+// ExportWorker builds the exports users ask for in the background and
+// removes them once they expire. Start it once with Run.
+type ExportWorker struct {
+	db        *gorm.DB
+	images    ImageStore
+	mailer    Mailer
+	events    *Hub
+	publicURL string
+	wake      chan struct{}
+}
+
+func NewExportWorker(db *gorm.DB, images ImageStore, mailer Mailer, events *Hub, publicURL string) *ExportWorker {
+	return &ExportWorker{
+		db:        db,
+		images:    images,
+		mailer:    mailer,
+		events:    events,
+		publicURL: publicURL,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Enqueue tells the worker there is a new export waiting, so it does not wait
+// for the next poll.
+func (w *ExportWorker) Enqueue() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run works through pending exports and cleans up expired ones until the
+// context is done.
+func (w *ExportWorker) Run(ctx context.Context) {
+	poll := time.NewTicker(exportPollGap)
+	defer poll.Stop()
+	cleanup := time.NewTicker(exportCleanupGap)
+	defer cleanup.Stop()
+	w.cleanup(ctx)
+	w.runPending(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.wake:
+			w.runPending(ctx)
+		case <-poll.C:
+			w.runPending(ctx)
+		case <-cleanup.C:
+			w.cleanup(ctx)
+		}
+	}
+}
+
+// requeueStale starts over the exports a crashed process was working on. The
+// ones other processes are still building have been claimed too recently.
+func (w *ExportWorker) requeueStale() {
+	result := w.db.Model(&DataExport{}).
+		Where("status = ? AND (claimed_at IS NULL OR claimed_at < ?)", ExportRunning, time.Now().Add(-exportClaimTimeout)).
+		Update("status", ExportPending)
+	if result.Error != nil {
+		log.Println("Error requeueing exports: ", result.Error)
+	}
+}
+
+// runPending builds pending exports, oldest first, until none are left.
+func (w *ExportWorker) runPending(ctx context.Context) {
+	w.requeueStale()
+	for ctx.Err() == nil {
+		var pending []DataExport
+		// Find rather than First, an empty queue is not worth a log line
+		result := w.db.Where("status = ?", ExportPending).Order("id").Limit(1).Find(&pending)
+		if result.Error != nil {
+			log.Println("Error finding pending exports: ", result.Error)
+			return
+		}
+		if len(pending) == 0 {
+			return
+		}
+		export := pending[0]
+		// claim the export, another api process may have picked it up
+		result = w.db.Model(&DataExport{}).Where("id = ? AND status = ?", export.ID, ExportPending).
+			Updates(map[string]interface{}{"status": ExportRunning, "claimed_at": time.Now()})
+		if result.Error != nil {
+			log.Println("Error claiming export: ", result.Error)
+			return
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		w.build(ctx, export)
+	}
+}
+
+func (w *ExportWorker) build(ctx context.Context, export DataExport) {
+	file, size, err := w.store(ctx, export.UserID)
+	if err != nil {
+		log.Printf("Error exporting data of user %v: %v", export.UserID, err)
+		result := w.db.Model(&export).Updates(map[string]interface{}{"status": ExportFailed, "error": "the export could not be built"})
+		if result.Error != nil {
+			log.Println("Error saving export: ", result.Error)
+		}
+		return
+	}
+	now := time.Now()
+	expires := now.Add(exportTTL)
+	result := w.db.Model(&export).Updates(map[string]interface{}{
+		"status":     ExportReady,
+		"file":       file,
+		"size":       size,
+		"ready_at":   now,
+		"expires_at": expires,
+	})
+	if result.Error != nil {
+		log.Println("Error saving export: ", result.Error)
+		return
+	}
+	w.notify(ctx, export, expires)
+}
+
+// store builds the archive for the user and saves it to the image store.
+func (w *ExportWorker) store(ctx context.Context, userID uint) (string, int64, error) {
+	data, err := collectPersonalData(w.db, userID)
+	if err != nil {
+		return "", 0, err
+	}
+	archive, err := buildExportArchive(ctx, w.images, data)
+	if err != nil {
+		return "", 0, err
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", 0, err
+	}
+	file := "export-" + token + ".zip"
+	err = w.images.Put(ctx, file, archive, "application/zip")
+	if err != nil {
+		return "", 0, err
+	}
+	return file, int64(len(archive)), nil
+}
+
+// notify tells the user their export can be downloaded, by mail and to any
+// page they have open.
+func (w *ExportWorker) notify(ctx context.Context, export DataExport, expires time.Time) {
+	w.events.Publish(export.UserID, Event{Type: EventExport, Data: gin.H{
+		"export_id": export.ID,
+		"status":    ExportReady,
+	}})
+	var user User
+	result := w.db.First(&user, export.UserID)
+	if result.Error != nil {
+		log.Println("Error finding export user: ", result.Error)
+		return
+	}
+	err := w.mailer.Send(ctx, Mail{
+		To:      user.Email,
+		Subject: "Your Comradary data export is ready",
+		Body: fmt.Sprintf("Hi %v,\n\nthe copy of your data you asked for is ready. Download it from your "+
+			"account settings:\n\n%v\n\nIt is deleted on %v.\n", user.UserName,
+			strings.TrimRight(w.publicURL, "/")+"/settings", expires.Format("2 January 2006")),
+	})
+	if err != nil {
+		log.Println("Error sending export mail: ", err)
+	}
+}
+
+// cleanup removes exports that expired, and failed ones once they are as old
+// as an export lives.
+func (w *ExportWorker) cleanup(ctx context.Context) {
+	now := time.Now()
+	var expired []DataExport
+	result := w.db.Where("(status = ? AND expires_at < ?) OR (status = ? AND created_at < ?)",
+		ExportReady, now, ExportFailed, now.Add(-exportTTL)).Find(&expired)
+	if result.Error != nil {
+		log.Println("Error finding expired exports: ", result.Error)
+		return
+	}
+	for _, export := range expired {
+		if export.File != "" {
+			err := w.images.Delete(ctx, export.File)
+			if err != nil {
+				log.Println("Error deleting export: ", err)
+				continue
+			}
+		}
+		result = w.db.Unscoped().Delete(&export)
+		if result.Error != nil {
+			log.Println("Error deleting export: ", result.Error)
+		}
+	}
+}
+
+// RequestDataExport queues a new export of the current user's data. Only one
+// export is built for a user at a time.
+func RequestDataExport(db *gorm.DB, exports *ExportWorker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := currentUser(c)
+		var count int64
+		result := db.Model(&DataExport{}).
+			Where("user_id = ? AND status IN ?", user.ID, []string{ExportPending, ExportRunning}).Count(&count)
+		if result.Error != nil {
+			c.JSON(400, gin.H{"error": result.Error.Error()})
+			return
+		}
+		if count > 0 {
+			c.JSON(400, gin.H{"error": "an export is already being prepared"})
+			return
+		}
+		export := DataExport{UserID: user.ID, Status: ExportPending}
+		result = db.Create(&export)
+		if result.Error != nil {
+			c.JSON(400, gin.H{"error": result.Error.Error()})
+			return
+		}
+		exports.Enqueue()
+		c.JSON(200, export)
+	}
+}
+
+func GetDataExports(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		exports := []DataExport{}
+		result := db.Where("user_id = ?", currentUser(c).ID).Order("id DESC").Find(&exports)
+		if result.Error != nil {
+			c.JSON(400, gin.H{"error": result.Error.Error()})
+			return
+		}
+		c.JSON(200, exports)
+	}
+}
+
+func DownloadDataExport(db *gorm.DB, images ImageStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		var export DataExport
+		result := db.Where("user_id = ? AND status = ? AND expires_at > ?", currentUser(c).ID, ExportReady, time.Now()).
+			First(&export, id)
+		if result.Error != nil {
+			c.JSON(404, gin.H{"error": "export not found"})
+			return
+		}
+		file, err := images.Open(c.Request.Context(), export.File)
+		if err != nil {
+			c.JSON(404, gin.H{"error": err.Error()})
+			return
+		}
+		defer file.Close()
+		name := fmt.Sprintf("comradary-export-%v.zip", export.ReadyAt.Format("2006-01-02"))
+		c.DataFromReader(200, export.Size, "application/zip", file, map[string]string{
+			"Content-Disposition": `attachment; filename="` + name + `"`,
+			"Cache-Control":       "private, no-store",
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EventMessage = "message"
+	EventRead    = "read"
+	EventTyping  = "typing"
+	EventExport  = "export"
+
+	eventBuffer       = 16
+	eventKeepAliveGap = 25 * time.Second
+)
+
+// Event is pushed to the connected clients of a user, with Data encoded as
+// JSON.
+type Event struct {
+	Type string
+	Data interface{}
+}
+
+// Hub delivers events to the users connected to this server process. A user
+// can be connected more than once, say from two browser tabs, and gets every
+// event on each connection. Users who are not connected miss the event and
+// pick the data up the next time they load it.
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[uint]map[chan Event]bool
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: map[uint]map[chan Event]bool{}}
+}
+
+// Subscribe returns the events for the user and a function that ends the
+// subscription.
+func (h *Hub) Subscribe(userID uint) (<-chan Event, func()) {
+	events := make(chan Event, eventBuffer)
+	h.mu.Lock()
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = map[chan Event]bool{}
+	}
+	h.subscribers[userID][events] = true
+	h.mu.Unlock()
+	return events, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if !h.subscribers[userID][events] {
+			return
+		}
+		delete(h.subscribers[userID], events)
+		if len(h.subscribers[userID]) == 0 {
+			delete(h.subscribers, userID)
+		}
+		close(events)
+	}
+}
+
+// Publish sends the event to every connection of the user and returns how
+// many connections got it. A connection that is too slow to keep up loses
+// the event rather than holding up the sender.
+func (h *Hub) Publish(userID uint, event Event) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delivered := 0
+	for events := range h.subscribers[userID] {
+		select {
+		case events <- event:
+			delivered++
+		default:
+			log.Printf("dropping %v event for user %v, connection is not keeping up", event.Type, userID)
+		}
+	}
+	return delivered
+}
+
+// StreamEvents streams the events of the current user as server-sent events
+// until the client disconnects.
+func StreamEvents(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		events, unsubscribe := hub.Subscribe(currentUser(c).ID)
+		defer unsubscribe()
+		keepAlive := time.NewTicker(eventKeepAliveGap)
+		defer keepAlive.Stop()
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.SSEvent("ready", "")
+		c.Writer.Flush()
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case <-c.Request.Context().Done():
+				return false
+			case event, ok := <-events:
+				if !ok {
+					return false
+				}
+				c.SSEvent(event.Type, event.Data)
+				return true
+			case <-keepAlive.C:
+				c.SSEvent("ping", "")
+				return true
+			}
+		})
+	}
+}
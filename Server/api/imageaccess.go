@@ -0,0 +1,107 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// imageURLTTL is how long a signed image link works at most. Links expire at
+// the end of a fixed window rather than a fixed time after signing, so the
+// same photo keeps the same link for a while and browsers can cache it.
+const imageURLTTL = time.Hour
+
+var errBadImageURL = errors.New("image link is invalid or has expired")
+
+// imageURLKey derives the key image links are signed with from one of the
+// token signing keys, so both rotate together.
+func imageURLKey(kid string) ([]byte, bool) {
+	key, ok := signingKeys.Keys[kid]
+	if !ok {
+		return nil, false
+	}
+	return hmacSHA256(key, "image-url"), true
+}
+
+func imageSignature(key []byte, photoID string, size string, expires string) string {
+	return base64.RawURLEncoding.EncodeToString(hmacSHA256(key, photoID+":"+size+":"+expires))
+}
+
+// signImageURL returns a link to a rendition of the photo that works without
+// a token until it expires. apiURL is where browsers reach the api.
+func signImageURL(apiURL string, photoID uint, size string, now time.Time) string {
+	key, ok := imageURLKey(signingKeys.Active)
+	if !ok {
+		return ""
+	}
+	id := strconv.FormatUint(uint64(photoID), 10)
+	expires := strconv.FormatInt(now.Truncate(imageURLTTL/2).Add(imageURLTTL).Unix(), 10)
+	query := url.Values{
+		"size":    {size},
+		"expires": {expires},
+		"kid":     {signingKeys.Active},
+		"sig":     {imageSignature(key, id, size, expires)},
+	}
+	return apiURL + "/images/" + id + "?" + query.Encode()
+}
+
+// signPhotos fills in the links of photos the current user may see. Only call
+// it once the user's access to the post or profile was checked.
+func signPhotos(apiURL string, photos []Photo) {
+	now := time.Now()
+	for i := range photos {
+		photos[i].ThumbURL = signImageURL(apiURL, photos[i].ID, SizeThumb, now)
+		photos[i].URL = signImageURL(apiURL, photos[i].ID, SizeMedium, now)
+		photos[i].OriginalURL = signImageURL(apiURL, photos[i].ID, SizeOriginal, now)
+	}
+}
+
+// verifyImageURL checks the signature and expiry of an image link and
+// returns how long it stays valid.
+func verifyImageURL(c *gin.Context, size string) (time.Duration, error) {
+	key, ok := imageURLKey(c.Query("kid"))
+	if !ok {
+		return 0, errBadImageURL
+	}
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil {
+		return 0, errBadImageURL
+	}
+	left := time.Until(time.Unix(expires, 0))
+	if left <= 0 {
+		return 0, errBadImageURL
+	}
+	want := imageSignature(key, c.Param("id"), size, c.Query("expires"))
+	if subtle.ConstantTimeCompare([]byte(want), []byte(c.Query("sig"))) != 1 {
+		return 0, errBadImageURL
+	}
+	return left, nil
+}
+
+// GetImageURL hands out a signed link to a photo the current user may see,
+// for photos that do not come with a post, like profile photos.
+func GetImageURL(photos *PhotoService, apiURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		size := c.DefaultQuery("size", SizeMedium)
+		if _, known := renditionSizes[size]; !known {
+			c.JSON(400, gin.H{"error": "size must be thumb, medium or original"})
+			return
+		}
+		id, err := parseUint(c.Param("id"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": errNoImage.Error()})
+			return
+		}
+		photo, err := photos.Visible(c.Request.Context(), currentUser(c).ID, id)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"url": signImageURL(apiURL, photo.ID, size, time.Now())})
+	}
+}
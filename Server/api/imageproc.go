@@ -0,0 +1,219 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/nfnt/resize"
+	"golang.org/x/image/webp"
+)
+
+// Image sizes GetImageById can serve.
+const (
+	SizeThumb    = "thumb"
+	SizeMedium   = "medium"
+	SizeOriginal = "original"
+)
+
+// renditionSizes is the longest side of each stored rendition. The original is
+// capped too, so a phone camera upload does not get served at full size.
+var renditionSizes = map[string]uint{
+	SizeThumb:    256,
+	SizeMedium:   1024,
+	SizeOriginal: 2048,
+}
+
+const (
+	maxImageUpload = 10 << 20 // bytes
+	maxImagePixels = 50 << 20 // width * height, to refuse decompression bombs
+)
+
+var errUnsupportedImage = errors.New("image must be a jpeg, png, gif or webp")
+
+// sniffImageType tells the format of an image from its first bytes, ignoring
+// whatever the file name or content type claims.
+func sniffImageType(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "jpeg", nil
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "png", nil
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "gif", nil
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "webp", nil
+	}
+	return "", errUnsupportedImage
+}
+
+// decodeImage decodes an uploaded image of any supported format, checking its
+// size before decoding it. Animated gifs keep their first frame.
+func decodeImage(data []byte) (image.Image, error) {
+	format, err := sniffImageType(data)
+	if err != nil {
+		return nil, err
+	}
+	var decodeConfig func(*bytes.Reader) (image.Config, error)
+	var decode func(*bytes.Reader) (image.Image, error)
+	switch format {
+	case "jpeg":
+		decodeConfig = func(r *bytes.Reader) (image.Config, error) { return jpeg.DecodeConfig(r) }
+		decode = func(r *bytes.Reader) (image.Image, error) { return jpeg.Decode(r) }
+	case "png":
+		decodeConfig = func(r *bytes.Reader) (image.Config, error) { return png.DecodeConfig(r) }
+		decode = func(r *bytes.Reader) (image.Image, error) { return png.Decode(r) }
+	case "gif":
+		decodeConfig = func(r *bytes.Reader) (image.Config, error) { return gif.DecodeConfig(r) }
+		decode = func(r *bytes.Reader) (image.Image, error) { return gif.Decode(r) }
+	case "webp":
+		decodeConfig = func(r *bytes.Reader) (image.Config, error) { return webp.DecodeConfig(r) }
+		decode = func(r *bytes.Reader) (image.Image, error) { return webp.Decode(r) }
+	}
+	config, err := decodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %v image: %v", format, err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return nil, fmt.Errorf("image of %vx%v pixels is too large", config.Width, config.Height)
+	}
+	img, err := decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %v image: %v", format, err)
+	}
+	if format == "jpeg" {
+		img = orient(img, jpegOrientation(data))
+	}
+	return img, nil
+}
+
+// jpegOrientation reads the EXIF orientation tag of a jpeg, 1 (upright) if it
+// has none.
+func jpegOrientation(data []byte) int {
+	// walk the marker segments up to the start of the image data
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xda || length < 2 || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation finds the orientation tag in the first IFD of a TIFF
+// structure.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// orient turns an image with the given EXIF orientation upright.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// orientations 5 to 8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // upside down, mirrored
+				dx, dy = x, h-1-y
+			case 5: // rotated left, mirrored
+				dx, dy = y, x
+			case 6: // rotated left
+				dx, dy = h-1-y, x
+			case 7: // rotated right, mirrored
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated right
+				dx, dy = y, w-1-x
+			}
+			out.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// flatten draws the image onto white, since jpeg has no transparency.
+func flatten(img image.Image) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Over)
+	return out
+}
+
+// renderImage decodes an upload and encodes every rendition of it as a jpeg.
+// Re-encoding keeps nothing but the pixels, so EXIF data such as the GPS
+// location the photo was taken at never reaches the store.
+func renderImage(data []byte) (map[string][]byte, error) {
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	img = flatten(img)
+	renditions := map[string][]byte{}
+	for size, max := range renditionSizes {
+		var buf bytes.Buffer
+		// Thumbnail keeps the aspect ratio and never scales up
+		err = jpeg.Encode(&buf, resize.Thumbnail(max, max, img, resize.Lanczos3), &jpeg.Options{Quality: 85})
+		if err != nil {
+			return nil, err
+		}
+		renditions[size] = buf.Bytes()
+	}
+	return renditions, nil
+}
@@ -0,0 +1,409 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pngHeader is the start of a png claiming the given size, enough for its
+// size to be read but not for it to be decoded.
+func pngHeader(width uint32, height uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	ihdr[8], ihdr[9] = 8, 2 // 8 bit RGB
+	chunk := append([]byte("IHDR"), ihdr...)
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&buf, binary.BigEndian, uint32(len(ihdr)))
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return buf.Bytes()
+}
+
+// imageURL asks the api for a signed link to the photo as the user.
+func (s *testServer) imageURL(user testUser, id string, size string) string {
+	s.t.Helper()
+	rec := s.call("GET", "/image/"+id+"/url?size="+size, user.Token, nil)
+	wantStatus(s.t, rec, 200)
+	return decode[map[string]string](s.t, rec)["url"]
+}
+
+func TestUploadImage(t *testing.T) {
+	s := newTestServer(t)
+	user := s.newUser("ada")
+	sample := pngImage(t, 600, 300)
+	img, err := png.Decode(bytes.NewReader(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jpegData, gifData bytes.Buffer
+	jpeg.Encode(&jpegData, img, nil)
+	gif.Encode(&gifData, img, nil)
+
+	tests := []struct {
+		name   string
+		field  string
+		data   []byte
+		status int
+		error  string
+	}{
+		{"png", "image", sample, 200, ""},
+		{"jpeg", "image", jpegData.Bytes(), 200, ""},
+		{"gif", "image", gifData.Bytes(), 200, ""},
+		{"wrong field", "file", sample, 400, "no image file"},
+		{"text", "image", []byte("just some text, not a picture"), 415, "jpeg, png, gif or webp"},
+		{"empty", "image", nil, 415, "jpeg, png, gif or webp"},
+		{"truncated", "image", sample[:len(sample)/2], 400, "error decoding png"},
+		{"header only", "image", pngHeader(600, 300), 400, "png"},
+		{"decompression bomb", "image", pngHeader(20000, 20000), 400, "too large"},
+		{"too big", "image", append(sample, make([]byte, maxImageUpload)...), 413, "at most 10 MB"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := s.uploadRequest(user.Token, test.field, test.data)
+			if test.status != 200 {
+				wantError(t, rec, test.status, test.error)
+				return
+			}
+			wantStatus(t, rec, 200)
+			if decode[map[string]string](t, rec)["imageID"] == "" {
+				t.Fatalf("no image id in %v", rec.Body.String())
+			}
+		})
+	}
+
+	req := s.newRequest("POST", "/image", user.Token, "not a form")
+	wantError(t, s.serve(req), 400, "no image file")
+
+	var photos int64
+	s.db.Model(&Photo{}).Count(&photos)
+	if photos != 3 {
+		t.Fatalf("%v photos were stored, want 3", photos)
+	}
+}
+
+func TestImageRenditions(t *testing.T) {
+	s := newTestServer(t)
+	user := s.newUser("ada")
+	rec := s.uploadRequest(user.Token, "image", pngImage(t, 600, 300))
+	wantStatus(t, rec, 200)
+	id := decode[map[string]string](t, rec)["imageID"]
+
+	sizes := map[string]image.Point{
+		SizeThumb:    {256, 128},
+		SizeMedium:   {600, 300},
+		SizeOriginal: {600, 300},
+	}
+	for size, want := range sizes {
+		t.Run(size, func(t *testing.T) {
+			rec := s.fetch(s.imageURL(user, id, size))
+			wantStatus(t, rec, 200)
+			if !strings.HasPrefix(rec.Header().Get("Cache-Control"), "private, max-age=") {
+				t.Errorf("unexpected Cache-Control %q", rec.Header().Get("Cache-Control"))
+			}
+			config, format, err := image.DecodeConfig(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != "jpeg" || config.Width != want.X || config.Height != want.Y {
+				t.Fatalf("got a %vx%v %v, want a %vx%v jpeg", config.Width, config.Height, format, want.X, want.Y)
+			}
+		})
+	}
+}
+
+func TestImageLinks(t *testing.T) {
+	s := newTestServer(t)
+	user := s.newUser("ada")
+	id := s.upload(user)
+	link := s.imageURL(user, id, SizeMedium)
+	wantStatus(t, s.fetch(link), 200)
+
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// with is the path of the link to the photo with the id, its query changed
+	// without signing it again
+	with := func(change func(query url.Values), id string) string {
+		query := parsed.Query()
+		change(query)
+		return "/images/" + id + "?" + query.Encode()
+	}
+	expired := time.Now().Add(-time.Minute).Unix()
+	key, _ := imageURLKey(testKeys.Active)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"no signature", "/images/" + id, 403},
+		{"tampered signature", with(func(q url.Values) { q.Set("sig", q.Get("sig")+"x") }, id), 403},
+		{"other size", with(func(q url.Values) { q.Set("size", SizeOriginal) }, id), 403},
+		{"later expiry", with(func(q url.Values) { q.Set("expires", fmt.Sprint(time.Now().Add(48*time.Hour).Unix())) }, id), 403},
+		{"unknown key", with(func(q url.Values) { q.Set("kid", "old") }, id), 403},
+		{"other photo", with(func(q url.Values) {}, "999"), 403},
+		{"expired", with(func(q url.Values) {
+			q.Set("expires", fmt.Sprint(expired))
+			q.Set("sig", imageSignature(key, id, SizeMedium, fmt.Sprint(expired)))
+		}, id), 403},
+		{"unknown size", with(func(q url.Values) { q.Set("size", "huge") }, id), 400},
+		{"not a number", with(func(q url.Values) {}, "photo"), 400},
+		{"missing photo", strings.TrimPrefix(signImageURL(testAPIURL, 999, SizeMedium, time.Now()), testAPIURL), 404},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wantStatus(t, s.call("GET", test.path, "", nil), test.status)
+		})
+	}
+}
+
+func TestImageAccess(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	outsider := s.newUser("outsider")
+	community := s.newCommunity(ada, "garden", VisibilityPublic)
+	s.join(bob, community)
+	loose := s.upload(ada)
+	posted := s.upload(ada)
+	offer := s.newOffer(ada, community, "bike", posted)
+
+	// photos not on a post are seen by users sharing a community, post photos
+	// by members of the post's community
+	for _, id := range []string{loose, posted} {
+		wantStatus(t, s.fetch(s.imageURL(bob, id, SizeThumb)), 200)
+		wantError(t, s.call("GET", "/image/"+id+"/url", outsider.Token, nil), 404, "image not found")
+	}
+	wantError(t, s.call("GET", "/image/999/url", ada.Token, nil), 404, "image not found")
+	wantError(t, s.call("GET", "/image/"+loose+"/url?size=huge", ada.Token, nil), 400, "size must be")
+
+	wantStatus(t, s.call("POST", communityPath(community, "leave"), bob.Token, nil), 200)
+	wantError(t, s.call("GET", "/image/"+posted+"/url", bob.Token, nil), 404, "image not found")
+	link := s.imageURL(ada, posted, SizeMedium)
+	wantStatus(t, s.call("DELETE", offerPath(offer, ""), ada.Token, nil), 200)
+	// the photos go with the offer
+	wantError(t, s.fetch(link), 404, "image not found")
+}
+
+// photoFiles returns the stored files of the photo's renditions.
+func (s *testServer) photoFiles(id string) []string {
+	s.t.Helper()
+	var photo Photo
+	err := s.db.First(&photo, id).Error
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return photoFiles([]Photo{photo})
+}
+
+// stored tells whether the image store has the file.
+func (s *testServer) stored(name string) bool {
+	file, err := s.images.Open(context.Background(), name)
+	if err != nil {
+		return false
+	}
+	file.Close()
+	return true
+}
+
+func TestDeletePhotoFiles(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	community := s.newCommunity(ada, "garden", VisibilityPublic)
+	upload := func(w int) string {
+		rec := s.uploadRequest(ada.Token, "image", pngImage(t, w, 300))
+		wantStatus(t, rec, 200)
+		return decode[map[string]string](t, rec)["imageID"]
+	}
+	removed, kept, copied := upload(600), upload(500), upload(500)
+	offer := s.newOffer(ada, community, "bike", removed, kept)
+	request := s.newRequestPost(ada, community, "ladder")
+	wantStatus(t, s.call("POST", fmt.Sprintf("/request/%v/photos", request.ID), ada.Token, gin.H{"image_ids": copied}), 200)
+
+	removedFiles, keptFiles := s.photoFiles(removed), s.photoFiles(kept)
+	for _, name := range append(removedFiles, keptFiles...) {
+		if !s.stored(name) {
+			t.Fatalf("%v was not stored", name)
+		}
+	}
+	wantStatus(t, s.call("DELETE", offerPath(offer, "photos/"+removed), ada.Token, nil), 200)
+	if err := s.db.Unscoped().First(&Photo{}, removed).Error; err == nil {
+		t.Fatal("the removed photo is still in the database")
+	}
+	for _, name := range removedFiles {
+		if s.stored(name) {
+			t.Fatalf("%v was not deleted with the photo", name)
+		}
+	}
+
+	// the request shows the same picture, so its files stay until the request
+	// goes too
+	wantStatus(t, s.call("DELETE", offerPath(offer, ""), ada.Token, nil), 200)
+	for _, name := range keptFiles {
+		if !s.stored(name) {
+			t.Fatalf("%v was deleted while the request still shows it", name)
+		}
+	}
+	wantStatus(t, s.call("DELETE", fmt.Sprintf("/request/%v", request.ID), ada.Token, nil), 200)
+	for _, name := range keptFiles {
+		if s.stored(name) {
+			t.Fatalf("%v was not deleted with the request", name)
+		}
+	}
+}
+
+// fakeS3 stands in for an S3 service: it keeps objects in memory and turns
+// away requests that are not signed with the test credentials.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]bool
+	objects map[string][]byte
+}
+
+func newFakeS3(t *testing.T) *httptest.Server {
+	fake := &fakeS3{buckets: map[string]bool{}, objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// checkSignature signs the request again as the service sees it, with the
+// credentials of the test account.
+func (f *fakeS3) checkSignature(r *http.Request, body []byte) error {
+	if r.Header.Get("x-amz-content-sha256") != sha256Hex(body) {
+		return fmt.Errorf("x-amz-content-sha256 %q does not match the body", r.Header.Get("x-amz-content-sha256"))
+	}
+	signed, err := time.Parse("20060102T150405Z", r.Header.Get("x-amz-date"))
+	if err != nil || time.Since(signed).Abs() > 5*time.Minute {
+		return fmt.Errorf("bad x-amz-date %q", r.Header.Get("x-amz-date"))
+	}
+	want := r.Clone(r.Context())
+	want.URL.Host = r.Host
+	want.Header.Del("Authorization")
+	account := &S3ImageStore{Region: "eu-test", AccessKey: "access", SecretKey: "secret"}
+	account.sign(want, body, signed)
+	if r.Header.Get("Authorization") != want.Header.Get("Authorization") {
+		return fmt.Errorf("Authorization %q, want %q", r.Header.Get("Authorization"), want.Header.Get("Authorization"))
+	}
+	return nil
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = f.checkSignature(r, body)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "<Error><Code>SignatureDoesNotMatch</Code><Message>"+err.Error()+"</Message></Error>")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case key == "" && r.Method == "HEAD":
+		if !f.buckets[bucket] {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case key == "" && r.Method == "PUT":
+		f.buckets[bucket] = true
+	case !f.buckets[bucket]:
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "<Error><Code>NoSuchBucket</Code></Error>")
+	case r.Method == "PUT":
+		f.objects[r.URL.Path] = body
+	case r.Method == "GET":
+		data, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		w.Write(data)
+	case r.Method == "DELETE":
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestS3ImageStore(t *testing.T) {
+	server := newFakeS3(t)
+	ctx := context.Background()
+	store, err := NewImageStore(ImageStoreConfig{Backend: "s3", S3Endpoint: server.URL + "/", S3Region: "eu-test",
+		S3Bucket: "images", S3AccessKey: "access", S3SecretKey: Secret("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a second start finds the bucket there
+	err = store.(*S3ImageStore).EnsureBucket(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := pngImage(t, 4, 4)
+	err = store.Put(ctx, "a.png", data, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := store.Open(ctx, "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(file)
+	file.Close()
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %v bytes back, want the %v stored", len(got), len(data))
+	}
+	err = store.Put(ctx, "../a.png", data, "image/png")
+	if err == nil {
+		t.Fatal("stored an image under a path")
+	}
+
+	err = store.Delete(ctx, "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// deleting twice is not an error, like for the local store
+	err = store.Delete(ctx, "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := &LocalImageStore{Dir: t.TempDir()}
+	for _, backend := range []ImageStore{store, local} {
+		_, err = backend.Open(ctx, "a.png")
+		if !errors.Is(err, ErrImageNotFound) {
+			t.Fatalf("%T: opening a missing image gave %v, want %v", backend, err, ErrImageNotFound)
+		}
+	}
+
+	_, err = NewImageStore(ImageStoreConfig{Backend: "s3", S3Endpoint: server.URL, S3Region: "eu-test",
+		S3Bucket: "images", S3AccessKey: "wrong", S3SecretKey: Secret("secret")})
+	if err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Fatalf("starting with credentials the endpoint refuses gave %v", err)
+	}
+}
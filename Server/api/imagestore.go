@@ -0,0 +1,296 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrImageNotFound = errors.New("image not found")
+
+// ImageStore keeps the encoded image files that Photo.Path points at.
+type ImageStore interface {
+	Put(ctx context.Context, name string, data []byte, contentType string) error
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	Delete(ctx context.Context, name string) error
+}
+
+type ImageStoreConfig struct {
+	Backend     string `json:"backend"` // "local" or "s3"
+	Dir         string `json:"dir"`
+	S3Endpoint  string `json:"s3_endpoint"`
+	S3Region    string `json:"s3_region"`
+	S3Bucket    string `json:"s3_bucket"`
+	S3AccessKey string `json:"s3_access_key"`
+	S3SecretKey Secret `json:"s3_secret_key"`
+}
+
+func NewImageStore(cfg ImageStoreConfig) (ImageStore, error) {
+	switch cfg.Backend {
+	case "local":
+		err := os.MkdirAll(cfg.Dir, 0o755)
+		if err != nil {
+			return nil, fmt.Errorf("error creating image directory: %v", err)
+		}
+		return &LocalImageStore{Dir: cfg.Dir}, nil
+	case "s3":
+		if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+			return nil, fmt.Errorf("s3 image store needs an endpoint and a bucket")
+		}
+		store := &S3ImageStore{
+			Endpoint:  strings.TrimRight(cfg.S3Endpoint, "/"),
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey.Value(),
+			Client:    &http.Client{Timeout: 30 * time.Second},
+		}
+		err := store.EnsureBucket(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("unknown image store backend %q", cfg.Backend)
+}
+
+// contentAddressedName names an image after the sha256 of its bytes so that
+// names never collide and never reveal the uploaded file name.
+func contentAddressedName(data []byte, ext string) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) + ext
+}
+
+// validImageName rejects names that could escape the store.
+func validImageName(name string) bool {
+	return name != "" && !strings.Contains(name, "/") && !strings.Contains(name, `\`) && !strings.HasPrefix(name, ".")
+}
+
+type LocalImageStore struct {
+	Dir string
+}
+
+func (s *LocalImageStore) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	if !validImageName(name) {
+		return fmt.Errorf("invalid image name %q", name)
+	}
+	tmp, err := os.CreateTemp(s.Dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.Dir, name))
+}
+
+func (s *LocalImageStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if !validImageName(name) {
+		return nil, ErrImageNotFound
+	}
+	file, err := os.Open(filepath.Join(s.Dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrImageNotFound
+	}
+	return file, err
+}
+
+func (s *LocalImageStore) Delete(ctx context.Context, name string) error {
+	if !validImageName(name) {
+		return fmt.Errorf("invalid image name %q", name)
+	}
+	err := os.Remove(filepath.Join(s.Dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// S3ImageStore talks to any S3 compatible service (AWS, MinIO, ...) using
+// path style addressing and AWS signature version 4.
+type S3ImageStore struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+func (s *S3ImageStore) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	if !validImageName(name) {
+		return fmt.Errorf("invalid image name %q", name)
+	}
+	resp, err := s.do(ctx, "PUT", "/"+s.Bucket+"/"+name, data, map[string]string{"Content-Type": contentType})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *S3ImageStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if !validImageName(name) {
+		return nil, ErrImageNotFound
+	}
+	resp, err := s.do(ctx, "GET", "/"+s.Bucket+"/"+name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrImageNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+	return resp.Body, nil
+}
+
+func (s *S3ImageStore) Delete(ctx context.Context, name string) error {
+	if !validImageName(name) {
+		return fmt.Errorf("invalid image name %q", name)
+	}
+	resp, err := s.do(ctx, "DELETE", "/"+s.Bucket+"/"+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK &&
+		resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+// EnsureBucket creates the bucket unless it already exists.
+func (s *S3ImageStore) EnsureBucket(ctx context.Context) error {
+	resp, err := s.do(ctx, "HEAD", "/"+s.Bucket, nil, nil)
+	if err != nil {
+		return fmt.Errorf("error reaching s3 endpoint: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	resp, err = s.do(ctx, "PUT", "/"+s.Bucket, nil, nil)
+	if err != nil {
+		return fmt.Errorf("error creating bucket: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 error: %v: %s", resp.Status, bytes.TrimSpace(body))
+}
+
+func (s *S3ImageStore) do(ctx context.Context, method string, path string, body []byte, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.Client.Do(req)
+}
+
+// sign adds an AWS signature version 4 Authorization header to req.
+func (s *S3ImageStore) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key := range req.Header {
+		lower := strings.ToLower(key)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(key))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range values[key] {
+			parts = append(parts, url.QueryEscape(key)+"="+url.QueryEscape(value))
+		}
+	}
+	return strings.ReplaceAll(strings.Join(parts, "&"), "+", "%20")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,347 @@
+// Package schemav1 is the database schema as it was at version 1, when the
+// server still migrated itself with AutoMigrate on every start. The types are
+// copies of the api models of that time, with the same names so gorm derives
+// the same table and constraint names; migrations must not use the live
+// models, which keep changing after the migration was written.
+package schemav1
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// roleOwner is the membership role of a community's owner.
+const roleOwner = "owner"
+
+type User struct {
+	gorm.Model
+	UserName          string
+	Email             string `gorm:"unique"`
+	EmailVerifiedAt   *time.Time
+	PasswordHash      string
+	IsAdmin           bool      `gorm:"default:false"`
+	Offers            []Offer   `gorm:"foreignKey:UserID"`
+	Requests          []Request `gorm:"foreignKey:UserID"`
+	DisplayName       string    `gorm:"size:64"`
+	Bio               string    `gorm:"size:1000"`
+	HomeCity          string    `gorm:"size:100"`
+	AvatarID          *uint
+	SessionsRevokedAt *time.Time
+	Communities       []Community `gorm:"many2many:user_communities;"`
+	OwnedCommunities  []Community `gorm:"foreignKey:OwnerID"`
+	MessagesInbox     []Message   `gorm:"foreignKey:ReciverID"`
+	MessagesOutbox    []Message   `gorm:"foreignKey:SenderID"`
+}
+
+type Photo struct {
+	gorm.Model
+	Path       string `gorm:"index"`
+	OfferID    *uint
+	RequestID  *uint
+	UserID     uint
+	MediumPath string
+	ThumbPath  string
+	Position   int `gorm:"default:0"`
+	Caption    string
+}
+
+type Offer struct {
+	gorm.Model
+	Title         string
+	Description   string
+	Photos        []Photo `gorm:"foreignKey:OfferID"`
+	UserID        uint
+	CommunityID   uint
+	Status        string    `gorm:"default:open"`
+	Messages      []Message `gorm:"foreignKey:OfferID"`
+	CreatedAt     time.Time
+	MessagesInbox []Message `gorm:"foreignKey:OfferID"`
+}
+
+type Request struct {
+	gorm.Model
+	Title       string
+	Description string
+	Photos      []Photo `gorm:"foreignKey:RequestID"`
+	UserID      uint
+	CommunityID uint
+	Messages    []Message `gorm:"foreignKey:RequestID"`
+	CreatedAt   time.Time
+}
+
+type Community struct {
+	gorm.Model
+	Name       string `gorm:"unique"`
+	Country    string
+	City       string
+	OwnerID    *uint
+	Visibility string    `gorm:"size:16;default:public"`
+	Users      []User    `gorm:"many2many:user_communities;"`
+	Offers     []Offer   `gorm:"foreignKey:CommunityID"`
+	Requests   []Request `gorm:"foreignKey:CommunityID"`
+}
+
+type Message struct {
+	gorm.Model
+	Text           string
+	SenderID       uint
+	ReciverID      uint
+	OfferID        *uint
+	RequestID      *uint
+	ConversationID *uint `gorm:"index"`
+	DeliveredAt    *time.Time
+	ReadAt         *time.Time
+}
+
+type Membership struct {
+	UserID      uint   `gorm:"primaryKey"`
+	CommunityID uint   `gorm:"primaryKey"`
+	Role        string `gorm:"size:16;default:member"`
+	CreatedAt   time.Time
+}
+
+func (Membership) TableName() string {
+	return "user_communities"
+}
+
+type RefreshToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	TokenHash string `gorm:"size:64;uniqueIndex"`
+	Family    string `gorm:"size:64;index"`
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
+
+type EmailToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	Purpose   string `gorm:"size:16"`
+	TokenHash string `gorm:"size:64;uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+type CommunityBan struct {
+	gorm.Model
+	CommunityID uint `gorm:"uniqueIndex:idx_community_bans_community_user"`
+	UserID      uint `gorm:"uniqueIndex:idx_community_bans_community_user"`
+	BannedByID  uint
+	Reason      string
+}
+
+type ModerationAction struct {
+	gorm.Model
+	CommunityID  uint `gorm:"index"`
+	ActorID      uint
+	Action       string `gorm:"size:32"`
+	TargetUserID *uint
+	OfferID      *uint
+	RequestID    *uint
+	Reason       string
+}
+
+type JoinRequest struct {
+	gorm.Model
+	CommunityID uint `gorm:"index"`
+	UserID      uint `gorm:"index"`
+	Message     string
+	Status      string `gorm:"size:16;default:pending"`
+	DecidedByID *uint
+	DecidedAt   *time.Time
+}
+
+type Invite struct {
+	gorm.Model
+	CommunityID uint `gorm:"index"`
+	CreatedByID uint
+	Code        string `gorm:"size:64;uniqueIndex"`
+	MaxUses     int
+	Uses        int
+	ExpiresAt   *time.Time
+	RevokedAt   *time.Time
+}
+
+type Conversation struct {
+	gorm.Model
+	OfferID       *uint `gorm:"index"`
+	RequestID     *uint `gorm:"index"`
+	LastMessageAt *time.Time
+	Participants  []ConversationParticipant
+}
+
+type ConversationParticipant struct {
+	ConversationID uint `gorm:"primaryKey"`
+	UserID         uint `gorm:"primaryKey;index"`
+	LastReadAt     *time.Time
+}
+
+type Block struct {
+	BlockerID uint `gorm:"primaryKey"`
+	BlockedID uint `gorm:"primaryKey;index"`
+	CreatedAt time.Time
+}
+
+type Report struct {
+	gorm.Model
+	ReporterID   uint   `gorm:"index"`
+	Kind         string `gorm:"size:16"`
+	TargetID     uint
+	TargetUserID uint  `gorm:"index"`
+	CommunityID  *uint `gorm:"index"`
+	Reason       string
+	Status       string `gorm:"size:16;default:open;index"`
+	ResolvedByID *uint
+	ResolvedAt   *time.Time
+	Resolution   string
+}
+
+type DataExport struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	Status    string `gorm:"size:16;default:pending;index"`
+	File      string
+	Size      int64
+	Error     string
+	ReadyAt   *time.Time
+	ExpiresAt *time.Time `gorm:"index"`
+}
+
+// setupMembership makes gorm use Membership for the user_communities table.
+func setupMembership(tx *gorm.DB) error {
+	err := tx.SetupJoinTable(&User{}, "Communities", &Membership{})
+	if err != nil {
+		return err
+	}
+	return tx.SetupJoinTable(&Community{}, "Users", &Membership{})
+}
+
+// models are the tables of version 1, each after the tables it refers to.
+func models() []interface{} {
+	return []interface{}{&User{}, &Community{}, &Membership{}, &Offer{}, &Request{}, &Photo{}, &Message{},
+		&Conversation{}, &ConversationParticipant{}, &RefreshToken{}, &EmailToken{}, &CommunityBan{},
+		&ModerationAction{}, &JoinRequest{}, &Invite{}, &Block{}, &Report{}, &DataExport{}}
+}
+
+// Up creates the version 1 schema. Databases set up before migrations were
+// numbered already have most of it; AutoMigrate only adds what they lack, and
+// the backfills fill in what those older versions did not store, so such a
+// database is taken over as it is.
+func Up(tx *gorm.DB) error {
+	err := setupMembership(tx)
+	if err != nil {
+		return err
+	}
+	err = tx.AutoMigrate(models()...)
+	if err != nil {
+		return err
+	}
+	err = backfillOwnerRoles(tx)
+	if err != nil {
+		return err
+	}
+	err = backfillConversations(tx)
+	if err != nil {
+		return err
+	}
+	return backfillReadState(tx)
+}
+
+// Down drops every table of version 1, those referring to others first. They
+// are dropped one by one, gorm leaves out tables that refer to each other when
+// it orders them itself.
+func Down(tx *gorm.DB) error {
+	tables := models()
+	for i := len(tables) - 1; i >= 0; i-- {
+		err := tx.Migrator().DropTable(tables[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillOwnerRoles gives community owners who joined before roles existed
+// the owner role.
+func backfillOwnerRoles(tx *gorm.DB) error {
+	var communities []Community
+	result := tx.Where("owner_id IS NOT NULL").Find(&communities)
+	if result.Error != nil {
+		return result.Error
+	}
+	for _, community := range communities {
+		result = tx.Model(&Membership{}).
+			Where("user_id = ? AND community_id = ? AND role <> ?", *community.OwnerID, community.ID, roleOwner).
+			Update("role", roleOwner)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+// backfillConversations puts the messages sent before conversations existed
+// into conversations.
+func backfillConversations(tx *gorm.DB) error {
+	var messages []Message
+	result := tx.Where("conversation_id IS NULL").Order("id").Find(&messages)
+	if result.Error != nil {
+		return result.Error
+	}
+	for _, message := range messages {
+		var conversation Conversation
+		query := tx.
+			Where("id IN (?)", tx.Model(&ConversationParticipant{}).Select("conversation_id").Where("user_id = ?", message.SenderID)).
+			Where("id IN (?)", tx.Model(&ConversationParticipant{}).Select("conversation_id").Where("user_id = ?", message.ReciverID))
+		if message.RequestID != nil {
+			query = query.Where("request_id = ?", *message.RequestID)
+		} else {
+			query = query.Where("request_id IS NULL")
+		}
+		if message.OfferID != nil {
+			query = query.Where("offer_id = ?", *message.OfferID)
+		} else {
+			query = query.Where("offer_id IS NULL")
+		}
+		result = query.First(&conversation)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			participants := []ConversationParticipant{{UserID: message.SenderID}}
+			if message.ReciverID != message.SenderID {
+				participants = append(participants, ConversationParticipant{UserID: message.ReciverID})
+			}
+			conversation = Conversation{OfferID: message.OfferID, RequestID: message.RequestID, Participants: participants}
+			result = tx.Create(&conversation)
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Model(&message).Update("conversation_id", conversation.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Model(&Conversation{}).
+			Where("id = ? AND (last_message_at IS NULL OR last_message_at < ?)", conversation.ID, message.CreatedAt).
+			Update("last_message_at", message.CreatedAt)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+// backfillReadState marks the messages older than the receiver's last visit
+// to the conversation as read, for messages sent before they had read
+// receipts.
+func backfillReadState(tx *gorm.DB) error {
+	return tx.Model(&Message{}).
+		Where("read_at IS NULL AND EXISTS (SELECT 1 FROM conversation_participants " +
+			"WHERE conversation_participants.conversation_id = messages.conversation_id " +
+			"AND conversation_participants.user_id = messages.reciver_id " +
+			"AND conversation_participants.last_read_at >= messages.created_at)").
+		Updates(map[string]interface{}{
+			"read_at":      gorm.Expr("created_at"),
+			"delivered_at": gorm.Expr("COALESCE(delivered_at, created_at)"),
+		}).Error
+}
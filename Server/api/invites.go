@@ -0,0 +1,286 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	VisibilityPublic  = "public"
+	VisibilityRequest = "request"
+	VisibilityInvite  = "invite"
+)
+
+var visibilities = map[string]bool{
+	VisibilityPublic:  true,
+	VisibilityRequest: true,
+	VisibilityInvite:  true,
+}
+
+const (
+	JoinPending  = "pending"
+	JoinApproved = "approved"
+	JoinRejected = "rejected"
+)
+
+const (
+	ActionSetVisibility = "set_visibility"
+	ActionApproveJoin   = "approve_join"
+	ActionRejectJoin    = "reject_join"
+	ActionCreateInvite  = "create_invite"
+	ActionRevokeInvite  = "revoke_invite"
+	ActionJoinInvite    = "join_invite"
+)
+
+// JoinRequest asks the moderators of a request-to-join community to let a
+// user in.
+type JoinRequest struct {
+	gorm.Model
+	CommunityID uint       `gorm:"index" json:"community_id"`
+	UserID      uint       `gorm:"index" json:"user_id"`
+	Message     string     `json:"message"`
+	Status      string     `gorm:"size:16;default:pending" json:"status"`
+	DecidedByID *uint      `json:"decided_by_id"`
+	DecidedAt   *time.Time `json:"decided_at"`
+}
+
+// Invite is a code that lets whoever has it join a community, however the
+// community is set up. A MaxUses of 0 means the code can be used any number
+// of times until it expires or is revoked.
+type Invite struct {
+	gorm.Model
+	CommunityID uint       `gorm:"index" json:"community_id"`
+	CreatedByID uint       `json:"created_by_id"`
+	Code        string     `gorm:"size:64;uniqueIndex" json:"code"`
+	MaxUses     int        `json:"max_uses"`
+	Uses        int        `json:"uses"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+}
+
+type VisibilityInput struct {
+	Visibility string `json:"visibility" binding:"required"`
+}
+
+type JoinDecisionInput struct {
+	RequestID string `json:"request_id" binding:"required"`
+}
+
+// CreateInviteInput leaves MaxUses and ExpiresInHours empty for no limit.
+type CreateInviteInput struct {
+	MaxUses        string `json:"max_uses"`
+	ExpiresInHours string `json:"expires_in_hours"`
+}
+
+// optionalCount parses an empty string as 0.
+func optionalCount(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a count", s)
+	}
+	return n, nil
+}
+
+type RevokeInviteInput struct {
+	InviteID string `json:"invite_id" binding:"required"`
+}
+
+type InviteCodeInput struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type JoinRequestInfo struct {
+	JoinRequest
+	UserName string `json:"username"`
+}
+
+func (invite Invite) usable(now time.Time) bool {
+	if invite.RevokedAt != nil {
+		return false
+	}
+	if invite.ExpiresAt != nil && now.After(*invite.ExpiresAt) {
+		return false
+	}
+	return invite.MaxUses == 0 || invite.Uses < invite.MaxUses
+}
+
+func SetCommunityVisibility(communities *CommunityService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		communityID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		var input VisibilityInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		community, err := communities.SetVisibility(c.Request.Context(), currentUser(c).ID, communityID, input.Visibility)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, community)
+	}
+}
+
+func GetJoinRequests(communities *CommunityService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		communityID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		requests, err := communities.JoinRequests(c.Request.Context(), currentUser(c).ID, communityID)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, requests)
+	}
+}
+
+// decideJoinRequest approves or rejects a pending join request.
+func decideJoinRequest(communities *CommunityService, approve bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		communityID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		var input JoinDecisionInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		requestID, err := parseUint(input.RequestID)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "no such pending join request"})
+			return
+		}
+		request, err := communities.DecideJoinRequest(c.Request.Context(), currentUser(c).ID, communityID, requestID, approve)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"request_id": request.ID, "status": request.Status})
+	}
+}
+
+func ApproveJoinRequest(communities *CommunityService) gin.HandlerFunc {
+	return decideJoinRequest(communities, true)
+}
+
+func RejectJoinRequest(communities *CommunityService) gin.HandlerFunc {
+	return decideJoinRequest(communities, false)
+}
+
+func CreateInvite(communities *CommunityService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		communityID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		var input CreateInviteInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		maxUses, err := optionalCount(input.MaxUses)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "max_uses: " + err.Error()})
+			return
+		}
+		expiresInHours, err := optionalCount(input.ExpiresInHours)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "expires_in_hours: " + err.Error()})
+			return
+		}
+		invite, err := communities.CreateInvite(c.Request.Context(), currentUser(c).ID, communityID, maxUses,
+			time.Duration(expiresInHours)*time.Hour)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, invite)
+	}
+}
+
+func GetInvites(communities *CommunityService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		communityID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		invites, err := communities.Invites(c.Request.Context(), currentUser(c).ID, communityID)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, invites)
+	}
+}
+
+func RevokeInvite(communities *CommunityService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		communityID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		var input RevokeInviteInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		inviteID, err := parseUint(input.InviteID)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "no such invite"})
+			return
+		}
+		err = communities.RevokeInvite(c.Request.Context(), currentUser(c).ID, communityID, inviteID)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"revoked": input.InviteID})
+	}
+}
+
+// GetInvite shows which community an invite code is for, so the client can
+// ask the user before joining.
+func GetInvite(communities *CommunityService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		community, err := communities.Invite(c.Request.Context(), c.Param("code"))
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"community": community})
+	}
+}
+
+func JoinWithInvite(communities *CommunityService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input InviteCodeInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		invite, err := communities.JoinWithInvite(c.Request.Context(), currentUser(c).ID, input.Code)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"community_id": invite.CommunityID})
+	}
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends the emails the api sends on its own, like verification links.
+type Mailer interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+type MailerConfig struct {
+	Backend      string `json:"backend"` // "smtp", "file" or "memory"
+	Dir          string `json:"dir"`
+	SMTPAddr     string `json:"smtp_addr"`
+	SMTPFrom     string `json:"smtp_from"`
+	SMTPUsername string `json:"smtp_username"`
+	SMTPPassword Secret `json:"smtp_password"`
+}
+
+func NewMailer(cfg MailerConfig) (Mailer, error) {
+	switch cfg.Backend {
+	case "smtp":
+		if cfg.SMTPAddr == "" || cfg.SMTPFrom == "" {
+			return nil, fmt.Errorf("smtp mailer needs an address and a from address")
+		}
+		return &SMTPMailer{
+			Addr:     cfg.SMTPAddr,
+			From:     cfg.SMTPFrom,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword.Value(),
+		}, nil
+	case "file":
+		err := os.MkdirAll(cfg.Dir, 0o755)
+		if err != nil {
+			return nil, fmt.Errorf("error creating mail directory: %v", err)
+		}
+		return &FileMailer{Dir: cfg.Dir}, nil
+	case "memory":
+		return &MemoryMailer{}, nil
+	}
+	return nil, fmt.Errorf("unknown mailer backend %q", cfg.Backend)
+}
+
+// message formats the mail as a plain text RFC 5322 message.
+func (mail Mail) message(from string) []byte {
+	var b strings.Builder
+	if from != "" {
+		b.WriteString("From: " + from + "\r\n")
+	}
+	b.WriteString("To: " + mail.To + "\r\n")
+	b.WriteString("Subject: " + mail.Subject + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(mail.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// validHeader rejects values that would let a user inject extra headers.
+func validHeader(s string) bool {
+	return !strings.ContainsAny(s, "\r\n")
+}
+
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, mail Mail) error {
+	if !validHeader(mail.To) || !validHeader(mail.Subject) {
+		return fmt.Errorf("invalid mail header")
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := strings.Cut(m.Addr, ":")
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{mail.To}, mail.message(m.From))
+}
+
+// FileMailer writes every mail to its own file, for local development.
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(ctx context.Context, mail Mail) error {
+	if !validHeader(mail.To) || !validHeader(mail.Subject) {
+		return fmt.Errorf("invalid mail header")
+	}
+	name := fmt.Sprintf("%d.eml", time.Now().UnixNano())
+	return os.WriteFile(filepath.Join(m.Dir, name), mail.message(""), 0o600)
+}
+
+// MemoryMailer keeps the mails it was asked to send, for tests.
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+func (m *MemoryMailer) Send(ctx context.Context, mail Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+// Sent returns the mails sent so far.
+func (m *MemoryMailer) Sent() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Mail(nil), m.sent...)
+}
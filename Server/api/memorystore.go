@@ -0,0 +1,1067 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MemoryStore keeps everything in memory, for testing the services without a
+// database. Rows are kept without their associations; soft deletes are not
+// modelled.
+type MemoryStore struct {
+	mu   *sync.Mutex
+	data *memoryData
+	// inTx is set on the store a transaction hands to its function, which
+	// already holds the lock
+	inTx bool
+}
+
+type memoryData struct {
+	lastID        uint
+	users         map[uint]User
+	blocks        []Block
+	communities   map[uint]Community
+	memberships   []Membership
+	bans          []CommunityBan
+	joinRequests  map[uint]JoinRequest
+	invites       map[uint]Invite
+	actions       map[uint]ModerationAction
+	offers        map[uint]Offer
+	requests      map[uint]Request
+	messages      map[uint]Message
+	conversations map[uint]Conversation
+	photos        map[uint]Photo
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{mu: &sync.Mutex{}, data: &memoryData{
+		users:         map[uint]User{},
+		communities:   map[uint]Community{},
+		joinRequests:  map[uint]JoinRequest{},
+		invites:       map[uint]Invite{},
+		actions:       map[uint]ModerationAction{},
+		offers:        map[uint]Offer{},
+		requests:      map[uint]Request{},
+		messages:      map[uint]Message{},
+		conversations: map[uint]Conversation{},
+		photos:        map[uint]Photo{},
+	}}
+}
+
+func copyMap[T any](m map[uint]T) map[uint]T {
+	out := make(map[uint]T, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func (d *memoryData) clone() *memoryData {
+	return &memoryData{
+		lastID:        d.lastID,
+		users:         copyMap(d.users),
+		blocks:        append([]Block(nil), d.blocks...),
+		communities:   copyMap(d.communities),
+		memberships:   append([]Membership(nil), d.memberships...),
+		bans:          append([]CommunityBan(nil), d.bans...),
+		joinRequests:  copyMap(d.joinRequests),
+		invites:       copyMap(d.invites),
+		actions:       copyMap(d.actions),
+		offers:        copyMap(d.offers),
+		requests:      copyMap(d.requests),
+		messages:      copyMap(d.messages),
+		conversations: copyMap(d.conversations),
+		photos:        copyMap(d.photos),
+	}
+}
+
+// lock takes the lock unless the store belongs to a transaction, and returns
+// the function that releases it.
+func (s *MemoryStore) lock() func() {
+	if s.inTx {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+// newModel fills in the id and timestamps of a new row.
+func (s *MemoryStore) newModel() gorm.Model {
+	s.data.lastID++
+	now := time.Now()
+	return gorm.Model{ID: s.data.lastID, CreatedAt: now, UpdatedAt: now}
+}
+
+// Transaction runs fn on a copy of the data, which replaces the data if fn
+// succeeds.
+func (s *MemoryStore) Transaction(ctx context.Context, fn func(store Store) error) error {
+	defer s.lock()()
+	tx := &MemoryStore{mu: s.mu, data: s.data.clone(), inTx: true}
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	*s.data = *tx.data
+	return nil
+}
+
+// AddBlock records that the blocker blocked the other user.
+func (s *MemoryStore) AddBlock(blockerID uint, blockedID uint) {
+	defer s.lock()()
+	s.data.blocks = append(s.data.blocks, Block{BlockerID: blockerID, BlockedID: blockedID, CreatedAt: time.Now()})
+}
+
+// AddBan bans the user from the community.
+func (s *MemoryStore) AddBan(communityID uint, userID uint) {
+	defer s.lock()()
+	s.data.bans = append(s.data.bans, CommunityBan{Model: s.newModel(), CommunityID: communityID, UserID: userID})
+}
+
+// SetAvatar makes the photo the user's avatar.
+func (s *MemoryStore) SetAvatar(userID uint, photoID uint) {
+	defer s.lock()()
+	user := s.data.users[userID]
+	user.AvatarID = &photoID
+	s.data.users[userID] = user
+}
+
+func (s *MemoryStore) CreateUser(ctx context.Context, user *User) error {
+	defer s.lock()()
+	for _, other := range s.data.users {
+		if other.Email == user.Email {
+			return errEmailInUse
+		}
+	}
+	user.Model = s.newModel()
+	s.data.users[user.ID] = *user
+	return nil
+}
+
+func (s *MemoryStore) FindUser(ctx context.Context, id uint) (User, error) {
+	defer s.lock()()
+	user, ok := s.data.users[id]
+	if !ok {
+		return user, errNotFound
+	}
+	return user, nil
+}
+
+func (s *MemoryStore) FindUserByEmail(ctx context.Context, email string) (User, error) {
+	defer s.lock()()
+	for _, user := range s.data.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return User{}, errNotFound
+}
+
+func (s *MemoryStore) FindUsers(ctx context.Context, ids []uint) ([]User, error) {
+	defer s.lock()()
+	var users []User
+	for _, id := range ids {
+		if user, ok := s.data.users[id]; ok {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+// blocked tells whether either user blocked the other.
+func (s *MemoryStore) blocked(userA uint, userB uint) bool {
+	for _, block := range s.data.blocks {
+		if (block.BlockerID == userA && block.BlockedID == userB) || (block.BlockerID == userB && block.BlockedID == userA) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) UpdateProfile(ctx context.Context, user User) error {
+	defer s.lock()()
+	stored, ok := s.data.users[user.ID]
+	if !ok {
+		return nil
+	}
+	stored.DisplayName, stored.Bio, stored.HomeCity, stored.AvatarID = user.DisplayName, user.Bio, user.HomeCity, user.AvatarID
+	s.data.users[user.ID] = stored
+	return nil
+}
+
+func (s *MemoryStore) IsBlocked(ctx context.Context, userA uint, userB uint) (bool, error) {
+	defer s.lock()()
+	return s.blocked(userA, userB), nil
+}
+
+func (s *MemoryStore) CreateBlock(ctx context.Context, block *Block) error {
+	defer s.lock()()
+	for _, other := range s.data.blocks {
+		if other.BlockerID == block.BlockerID && other.BlockedID == block.BlockedID {
+			*block = other
+			return nil
+		}
+	}
+	block.CreatedAt = time.Now()
+	s.data.blocks = append(s.data.blocks, *block)
+	return nil
+}
+
+func (s *MemoryStore) DeleteBlock(ctx context.Context, blockerID uint, blockedID uint) error {
+	defer s.lock()()
+	kept := s.data.blocks[:0]
+	for _, block := range s.data.blocks {
+		if block.BlockerID != blockerID || block.BlockedID != blockedID {
+			kept = append(kept, block)
+		}
+	}
+	s.data.blocks = kept
+	return nil
+}
+
+func (s *MemoryStore) BlockedUsers(ctx context.Context, blockerID uint) ([]BlockedUser, error) {
+	defer s.lock()()
+	blocked := []BlockedUser{}
+	for i := len(s.data.blocks) - 1; i >= 0; i-- {
+		block := s.data.blocks[i]
+		if user, ok := s.data.users[block.BlockedID]; ok && block.BlockerID == blockerID {
+			blocked = append(blocked, BlockedUser{UserID: user.ID, UserName: user.UserName, CreatedAt: block.CreatedAt})
+		}
+	}
+	return blocked, nil
+}
+
+func (s *MemoryStore) CreateCommunity(ctx context.Context, community *Community) error {
+	defer s.lock()()
+	community.Model = s.newModel()
+	s.data.communities[community.ID] = *community
+	s.data.memberships = append(s.data.memberships, Membership{UserID: *community.OwnerID,
+		CommunityID: community.ID, Role: RoleOwner, CreatedAt: community.CreatedAt})
+	return nil
+}
+
+func (s *MemoryStore) FindCommunity(ctx context.Context, id uint) (Community, error) {
+	defer s.lock()()
+	community, ok := s.data.communities[id]
+	if !ok {
+		return community, errNotFound
+	}
+	return community, nil
+}
+
+// sortedValues returns the rows of the map by id.
+func sortedValues[T any](m map[uint]T) []T {
+	ids := make([]uint, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	values := make([]T, 0, len(m))
+	for _, id := range ids {
+		values = append(values, m[id])
+	}
+	return values
+}
+
+func (s *MemoryStore) UpdateCommunity(ctx context.Context, community Community) error {
+	defer s.lock()()
+	stored, ok := s.data.communities[community.ID]
+	if !ok {
+		return errNotFound
+	}
+	stored.Visibility, stored.OwnerID = community.Visibility, community.OwnerID
+	s.data.communities[community.ID] = stored
+	return nil
+}
+
+func (s *MemoryStore) ListCommunities(ctx context.Context, country string) ([]Community, error) {
+	defer s.lock()()
+	var communities []Community
+	for _, community := range sortedValues(s.data.communities) {
+		if community.Visibility != VisibilityInvite && (country == "" || community.Country == country) {
+			communities = append(communities, community)
+		}
+	}
+	return communities, nil
+}
+
+func (s *MemoryStore) UserCommunities(ctx context.Context, userID uint) ([]Community, error) {
+	defer s.lock()()
+	var communities []Community
+	for _, membership := range s.data.memberships {
+		if membership.UserID == userID {
+			communities = append(communities, s.data.communities[membership.CommunityID])
+		}
+	}
+	return communities, nil
+}
+
+func (s *MemoryStore) FindCommunities(ctx context.Context, ids []uint) ([]Community, error) {
+	defer s.lock()()
+	var communities []Community
+	for _, id := range ids {
+		if community, ok := s.data.communities[id]; ok {
+			communities = append(communities, community)
+		}
+	}
+	return communities, nil
+}
+
+func (s *MemoryStore) FindMembership(ctx context.Context, userID uint, communityID uint) (Membership, error) {
+	defer s.lock()()
+	for _, membership := range s.data.memberships {
+		if membership.UserID == userID && membership.CommunityID == communityID {
+			return membership, nil
+		}
+	}
+	return Membership{}, errNotFound
+}
+
+func (s *MemoryStore) AddMembership(ctx context.Context, membership Membership) error {
+	defer s.lock()()
+	membership.CreatedAt = time.Now()
+	s.data.memberships = append(s.data.memberships, membership)
+	return nil
+}
+
+func (s *MemoryStore) ShareCommunity(ctx context.Context, userA uint, userB uint) (bool, error) {
+	defer s.lock()()
+	communities := map[uint]bool{}
+	for _, membership := range s.data.memberships {
+		if membership.UserID == userB {
+			communities[membership.CommunityID] = true
+		}
+	}
+	for _, membership := range s.data.memberships {
+		if membership.UserID == userA && communities[membership.CommunityID] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *MemoryStore) IsBanned(ctx context.Context, userID uint, communityID uint) (bool, error) {
+	defer s.lock()()
+	for _, ban := range s.data.bans {
+		if ban.UserID == userID && ban.CommunityID == communityID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *MemoryStore) FindPendingJoinRequest(ctx context.Context, userID uint, communityID uint) (JoinRequest, error) {
+	defer s.lock()()
+	for _, request := range sortedValues(s.data.joinRequests) {
+		if request.UserID == userID && request.CommunityID == communityID && request.Status == JoinPending {
+			return request, nil
+		}
+	}
+	return JoinRequest{}, errNotFound
+}
+
+func (s *MemoryStore) CreateJoinRequest(ctx context.Context, request *JoinRequest) error {
+	defer s.lock()()
+	request.Model = s.newModel()
+	s.data.joinRequests[request.ID] = *request
+	return nil
+}
+
+func (s *MemoryStore) RemoveMembership(ctx context.Context, userID uint, communityID uint) error {
+	defer s.lock()()
+	memberships := s.data.memberships[:0:0]
+	for _, membership := range s.data.memberships {
+		if membership.UserID != userID || membership.CommunityID != communityID {
+			memberships = append(memberships, membership)
+		}
+	}
+	s.data.memberships = memberships
+	return nil
+}
+
+func (s *MemoryStore) SetRole(ctx context.Context, userID uint, communityID uint, role string) error {
+	defer s.lock()()
+	for i, membership := range s.data.memberships {
+		if membership.UserID == userID && membership.CommunityID == communityID {
+			s.data.memberships[i].Role = role
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) CommunityMembers(ctx context.Context, communityID uint) ([]MemberInfo, error) {
+	defer s.lock()()
+	members := []MemberInfo{}
+	for _, membership := range s.data.memberships {
+		user, ok := s.data.users[membership.UserID]
+		if membership.CommunityID != communityID || !ok {
+			continue
+		}
+		members = append(members, MemberInfo{UserID: user.ID, UserName: user.UserName, Role: membership.Role,
+			JoinedAt: membership.CreatedAt})
+	}
+	return members, nil
+}
+
+func (s *MemoryStore) CreateBan(ctx context.Context, ban *CommunityBan) error {
+	defer s.lock()()
+	ban.Model = s.newModel()
+	s.data.bans = append(s.data.bans, *ban)
+	return nil
+}
+
+func (s *MemoryStore) DeleteBan(ctx context.Context, userID uint, communityID uint) (bool, error) {
+	defer s.lock()()
+	bans := s.data.bans[:0:0]
+	for _, ban := range s.data.bans {
+		if ban.UserID != userID || ban.CommunityID != communityID {
+			bans = append(bans, ban)
+		}
+	}
+	deleted := len(bans) < len(s.data.bans)
+	s.data.bans = bans
+	return deleted, nil
+}
+
+func (s *MemoryStore) CommunityBans(ctx context.Context, communityID uint) ([]CommunityBan, error) {
+	defer s.lock()()
+	bans := []CommunityBan{}
+	for i := len(s.data.bans) - 1; i >= 0; i-- {
+		if s.data.bans[i].CommunityID == communityID {
+			bans = append(bans, s.data.bans[i])
+		}
+	}
+	return bans, nil
+}
+
+func (s *MemoryStore) FindJoinRequest(ctx context.Context, id uint) (JoinRequest, error) {
+	defer s.lock()()
+	request, ok := s.data.joinRequests[id]
+	if !ok {
+		return request, errNotFound
+	}
+	return request, nil
+}
+
+func (s *MemoryStore) PendingJoinRequests(ctx context.Context, communityID uint) ([]JoinRequestInfo, error) {
+	defer s.lock()()
+	requests := []JoinRequestInfo{}
+	for _, request := range sortedValues(s.data.joinRequests) {
+		user, ok := s.data.users[request.UserID]
+		if request.CommunityID == communityID && request.Status == JoinPending && ok {
+			requests = append(requests, JoinRequestInfo{JoinRequest: request, UserName: user.UserName})
+		}
+	}
+	return requests, nil
+}
+
+func (s *MemoryStore) UpdateJoinRequest(ctx context.Context, request JoinRequest) error {
+	defer s.lock()()
+	stored, ok := s.data.joinRequests[request.ID]
+	if !ok {
+		return errNotFound
+	}
+	stored.Status, stored.DecidedByID, stored.DecidedAt = request.Status, request.DecidedByID, request.DecidedAt
+	s.data.joinRequests[request.ID] = stored
+	return nil
+}
+
+func (s *MemoryStore) CreateInvite(ctx context.Context, invite *Invite) error {
+	defer s.lock()()
+	invite.Model = s.newModel()
+	s.data.invites[invite.ID] = *invite
+	return nil
+}
+
+func (s *MemoryStore) FindInviteByCode(ctx context.Context, code string) (Invite, error) {
+	defer s.lock()()
+	for _, invite := range s.data.invites {
+		if invite.Code == code {
+			return invite, nil
+		}
+	}
+	return Invite{}, errNotFound
+}
+
+func (s *MemoryStore) CommunityInvites(ctx context.Context, communityID uint) ([]Invite, error) {
+	defer s.lock()()
+	invites := []Invite{}
+	all := sortedValues(s.data.invites)
+	for i := len(all) - 1; i >= 0; i-- {
+		if all[i].CommunityID == communityID && all[i].RevokedAt == nil {
+			invites = append(invites, all[i])
+		}
+	}
+	return invites, nil
+}
+
+func (s *MemoryStore) RevokeInvite(ctx context.Context, communityID uint, id uint, at time.Time) (bool, error) {
+	defer s.lock()()
+	invite, ok := s.data.invites[id]
+	if !ok || invite.CommunityID != communityID || invite.RevokedAt != nil {
+		return false, nil
+	}
+	invite.RevokedAt = &at
+	s.data.invites[id] = invite
+	return true, nil
+}
+
+func (s *MemoryStore) UseInvite(ctx context.Context, id uint) (bool, error) {
+	defer s.lock()()
+	invite, ok := s.data.invites[id]
+	if !ok || invite.RevokedAt != nil || (invite.MaxUses != 0 && invite.Uses >= invite.MaxUses) {
+		return false, nil
+	}
+	invite.Uses++
+	s.data.invites[id] = invite
+	return true, nil
+}
+
+func (s *MemoryStore) RecordModeration(ctx context.Context, action *ModerationAction) error {
+	defer s.lock()()
+	action.Model = s.newModel()
+	s.data.actions[action.ID] = *action
+	return nil
+}
+
+func (s *MemoryStore) ModerationLog(ctx context.Context, communityID uint, before uint, limit int) ([]ModerationAction, error) {
+	defer s.lock()()
+	var actions []ModerationAction
+	all := sortedValues(s.data.actions)
+	for i := len(all) - 1; i >= 0 && len(actions) < limit; i-- {
+		if all[i].CommunityID == communityID && (before == 0 || all[i].ID < before) {
+			actions = append(actions, all[i])
+		}
+	}
+	return actions, nil
+}
+
+// postPhotos returns the photos of the post in gallery order.
+func (s *MemoryStore) postPhotos(kind string, postID uint) []Photo {
+	photos := []Photo{}
+	for _, photo := range sortedValues(s.data.photos) {
+		if id := photo.postID(kind); id != nil && *id == postID {
+			photos = append(photos, photo)
+		}
+	}
+	sort.SliceStable(photos, func(i, j int) bool { return photos[i].Position < photos[j].Position })
+	return photos
+}
+
+func (s *MemoryStore) CreateOffer(ctx context.Context, offer *Offer) error {
+	defer s.lock()()
+	offer.Model = s.newModel()
+	offer.CreatedAt = offer.Model.CreatedAt
+	offer.Photos = nil
+	s.data.offers[offer.ID] = *offer
+	return nil
+}
+
+func (s *MemoryStore) FindOffer(ctx context.Context, id uint) (Offer, error) {
+	defer s.lock()()
+	offer, ok := s.data.offers[id]
+	if !ok {
+		return offer, errNotFound
+	}
+	offer.Photos = s.postPhotos(SearchOffer, id)
+	return offer, nil
+}
+
+// postRow is what a listing filters and orders offers and requests by.
+type postRow struct {
+	id          uint
+	userID      uint
+	communityID uint
+	title       string
+	description string
+	createdAt   time.Time
+}
+
+// listPosts picks the ids of the rows of a listing page the way filterPosts
+// does in the database, with one more if there is a next page.
+func (s *MemoryStore) listPosts(kind string, rows []postRow, filter PostFilter) []uint {
+	query := filter.Query
+	communities := map[uint]bool{}
+	for _, id := range filter.CommunityIDs {
+		communities[id] = true
+	}
+	keyword := strings.ToLower(query.Keyword)
+	var listed []postRow
+	for _, row := range rows {
+		switch {
+		case !communities[row.communityID], s.blocked(filter.ViewerID, row.userID):
+		case keyword != "" && !strings.Contains(strings.ToLower(row.title), keyword) &&
+			!strings.Contains(strings.ToLower(row.description), keyword):
+		case query.HasPhoto && len(s.postPhotos(kind, row.id)) == 0:
+		case !query.From.IsZero() && row.createdAt.Before(query.From):
+		case !query.To.IsZero() && !row.createdAt.Before(query.To):
+		default:
+			listed = append(listed, row)
+		}
+	}
+	// before tells whether row a is listed before row b
+	before := func(a postRow, b postRow) bool {
+		if !a.createdAt.Equal(b.createdAt) {
+			return a.createdAt.After(b.createdAt) != query.Oldest
+		}
+		return a.id > b.id != query.Oldest
+	}
+	sort.Slice(listed, func(i, j int) bool { return before(listed[i], listed[j]) })
+	var ids []uint
+	for _, row := range listed {
+		if query.Cursor != nil && !before(postRow{id: query.Cursor.ID, createdAt: query.Cursor.CreatedAt}, row) {
+			continue
+		}
+		if len(ids) > query.Limit {
+			break
+		}
+		ids = append(ids, row.id)
+	}
+	return ids
+}
+
+func (s *MemoryStore) ListOffers(ctx context.Context, filter PostFilter) ([]Offer, error) {
+	defer s.lock()()
+	var rows []postRow
+	for _, offer := range s.data.offers {
+		if filter.Query.Closed || offer.Status == OfferOpen || offer.Status == OfferReserved {
+			rows = append(rows, postRow{id: offer.ID, userID: offer.UserID, communityID: offer.CommunityID,
+				title: offer.Title, description: offer.Description, createdAt: offer.CreatedAt})
+		}
+	}
+	offers := []Offer{}
+	for _, id := range s.listPosts(SearchOffer, rows, filter) {
+		offer := s.data.offers[id]
+		offer.Photos = s.postPhotos(SearchOffer, id)
+		offers = append(offers, offer)
+	}
+	return offers, nil
+}
+
+func (s *MemoryStore) UpdateOffer(ctx context.Context, offer Offer) error {
+	defer s.lock()()
+	stored, ok := s.data.offers[offer.ID]
+	if !ok {
+		return errNotFound
+	}
+	stored.Title, stored.Description, stored.Status = offer.Title, offer.Description, offer.Status
+	s.data.offers[offer.ID] = stored
+	return nil
+}
+
+func (s *MemoryStore) DeleteOffer(ctx context.Context, id uint) error {
+	defer s.lock()()
+	delete(s.data.offers, id)
+	return nil
+}
+
+func (s *MemoryStore) CreateRequest(ctx context.Context, request *Request) error {
+	defer s.lock()()
+	request.Model = s.newModel()
+	request.CreatedAt = request.Model.CreatedAt
+	request.Photos = nil
+	s.data.requests[request.ID] = *request
+	return nil
+}
+
+func (s *MemoryStore) FindRequest(ctx context.Context, id uint) (Request, error) {
+	defer s.lock()()
+	request, ok := s.data.requests[id]
+	if !ok {
+		return request, errNotFound
+	}
+	request.Photos = s.postPhotos(SearchRequest, id)
+	return request, nil
+}
+
+func (s *MemoryStore) ListRequests(ctx context.Context, filter PostFilter) ([]Request, error) {
+	defer s.lock()()
+	var rows []postRow
+	for _, request := range s.data.requests {
+		rows = append(rows, postRow{id: request.ID, userID: request.UserID, communityID: request.CommunityID,
+			title: request.Title, description: request.Description, createdAt: request.CreatedAt})
+	}
+	requests := []Request{}
+	for _, id := range s.listPosts(SearchRequest, rows, filter) {
+		request := s.data.requests[id]
+		request.Photos = s.postPhotos(SearchRequest, id)
+		requests = append(requests, request)
+	}
+	return requests, nil
+}
+
+func (s *MemoryStore) UpdateRequest(ctx context.Context, request Request) error {
+	defer s.lock()()
+	stored, ok := s.data.requests[request.ID]
+	if !ok {
+		return errNotFound
+	}
+	stored.Title, stored.Description = request.Title, request.Description
+	s.data.requests[request.ID] = stored
+	return nil
+}
+
+func (s *MemoryStore) DeleteRequest(ctx context.Context, id uint) error {
+	defer s.lock()()
+	delete(s.data.requests, id)
+	return nil
+}
+
+func (s *MemoryStore) UserPosts(ctx context.Context, userID uint, communityIDs []uint) (UserActivity, error) {
+	defer s.lock()()
+	communities := map[uint]bool{}
+	for _, id := range communityIDs {
+		communities[id] = true
+	}
+	activity := UserActivity{Offers: []Offer{}, Requests: []Request{}}
+	// the newest rows have the highest ids
+	offers := sortedValues(s.data.offers)
+	for i := len(offers) - 1; i >= 0; i-- {
+		offer := offers[i]
+		if offer.UserID == userID && communities[offer.CommunityID] &&
+			(offer.Status == OfferOpen || offer.Status == OfferReserved) {
+			offer.Photos = s.postPhotos(SearchOffer, offer.ID)
+			activity.Offers = append(activity.Offers, offer)
+		}
+	}
+	requests := sortedValues(s.data.requests)
+	for i := len(requests) - 1; i >= 0; i-- {
+		request := requests[i]
+		if request.UserID == userID && communities[request.CommunityID] {
+			request.Photos = s.postPhotos(SearchRequest, request.ID)
+			activity.Requests = append(activity.Requests, request)
+		}
+	}
+	return activity, nil
+}
+
+// sameID tells whether two optional ids are both unset or equal.
+func sameID(a *uint, b *uint) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// conversationBetween finds the conversation between the two users about the
+// post.
+func (s *MemoryStore) conversationBetween(userA uint, userB uint, offerID *uint, requestID *uint) (Conversation, bool) {
+	for _, conversation := range sortedValues(s.data.conversations) {
+		if !sameID(conversation.OfferID, offerID) || !sameID(conversation.RequestID, requestID) {
+			continue
+		}
+		hasA, hasB := false, false
+		for _, participant := range conversation.Participants {
+			hasA = hasA || participant.UserID == userA
+			hasB = hasB || participant.UserID == userB
+		}
+		if hasA && hasB {
+			return conversation, true
+		}
+	}
+	return Conversation{}, false
+}
+
+// conversationFor returns the id of the conversation between the two users
+// about the post, starting it if there is none.
+func (s *MemoryStore) conversationFor(userA uint, userB uint, offerID *uint, requestID *uint) uint {
+	if conversation, ok := s.conversationBetween(userA, userB, offerID, requestID); ok {
+		return conversation.ID
+	}
+	participants := []ConversationParticipant{{UserID: userA}}
+	if userB != userA {
+		participants = append(participants, ConversationParticipant{UserID: userB})
+	}
+	conversation := Conversation{Model: s.newModel(), OfferID: offerID, RequestID: requestID, Participants: participants}
+	for i := range conversation.Participants {
+		conversation.Participants[i].ConversationID = conversation.ID
+	}
+	s.data.conversations[conversation.ID] = conversation
+	return conversation.ID
+}
+
+func (s *MemoryStore) CreateMessage(ctx context.Context, message *Message) error {
+	defer s.lock()()
+	conversationID := s.conversationFor(message.SenderID, message.ReceiverID, message.OfferID, message.RequestID)
+	message.ConversationID = &conversationID
+	message.Model = s.newModel()
+	s.data.messages[message.ID] = *message
+	conversation := s.data.conversations[conversationID]
+	conversation.LastMessageAt = &message.CreatedAt
+	// the participants may be shared with the data a transaction started from
+	conversation.Participants = append([]ConversationParticipant(nil), conversation.Participants...)
+	for i := range conversation.Participants {
+		if conversation.Participants[i].UserID == message.SenderID {
+			conversation.Participants[i].LastReadAt = &message.CreatedAt
+		}
+	}
+	s.data.conversations[conversationID] = conversation
+	return nil
+}
+
+func (s *MemoryStore) Messages(ctx context.Context, filter MessageFilter) ([]Message, error) {
+	defer s.lock()()
+	var messages []Message
+	for _, message := range sortedValues(s.data.messages) {
+		between := (message.SenderID == filter.UserID && message.ReceiverID == filter.OtherUserID) ||
+			(message.SenderID == filter.OtherUserID && message.ReceiverID == filter.UserID)
+		if !between {
+			continue
+		}
+		if filter.RequestID != nil && !sameID(message.RequestID, filter.RequestID) {
+			continue
+		}
+		if filter.RequestID == nil && filter.OfferID != nil && !sameID(message.OfferID, filter.OfferID) {
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func (s *MemoryStore) MarkDelivered(ctx context.Context, ids []uint, at time.Time) error {
+	defer s.lock()()
+	for _, id := range ids {
+		message, ok := s.data.messages[id]
+		if ok && message.DeliveredAt == nil {
+			message.DeliveredAt = &at
+			s.data.messages[id] = message
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) PostSenders(ctx context.Context, kind string, postID uint) ([]uint, error) {
+	defer s.lock()()
+	seen := map[uint]bool{}
+	ids := []uint{}
+	for _, message := range sortedValues(s.data.messages) {
+		id := message.OfferID
+		if kind == SearchRequest {
+			id = message.RequestID
+		}
+		if id != nil && *id == postID && !seen[message.SenderID] {
+			seen[message.SenderID] = true
+			ids = append(ids, message.SenderID)
+		}
+	}
+	return ids, nil
+}
+
+func (s *MemoryStore) UserConversations(ctx context.Context, userID uint, offerID *uint, requestID *uint) ([]Conversation, error) {
+	defer s.lock()()
+	var conversations []Conversation
+	for _, conversation := range sortedValues(s.data.conversations) {
+		if requestID != nil && !sameID(conversation.RequestID, requestID) ||
+			requestID == nil && offerID != nil && !sameID(conversation.OfferID, offerID) {
+			continue
+		}
+		for _, participant := range conversation.Participants {
+			if participant.UserID == userID {
+				conversations = append(conversations, conversation)
+				break
+			}
+		}
+	}
+	// conversations without messages last
+	sort.SliceStable(conversations, func(i, j int) bool {
+		a, b := conversations[i].LastMessageAt, conversations[j].LastMessageAt
+		return a != nil && (b == nil || a.After(*b))
+	})
+	return conversations, nil
+}
+
+func (s *MemoryStore) FindConversation(ctx context.Context, id uint) (Conversation, error) {
+	defer s.lock()()
+	conversation, ok := s.data.conversations[id]
+	if !ok {
+		return conversation, errNotFound
+	}
+	return conversation, nil
+}
+
+func (s *MemoryStore) FindConversationBetween(ctx context.Context, userA uint, userB uint, offerID *uint, requestID *uint) (Conversation, error) {
+	defer s.lock()()
+	conversation, ok := s.conversationBetween(userA, userB, offerID, requestID)
+	if !ok {
+		return conversation, errNotFound
+	}
+	return conversation, nil
+}
+
+func (s *MemoryStore) SummarizeConversations(ctx context.Context, conversations []Conversation, userID uint) ([]ConversationSummary, error) {
+	defer s.lock()()
+	summaries := []ConversationSummary{}
+	for _, conversation := range conversations {
+		summary := ConversationSummary{
+			ID:            conversation.ID,
+			OfferID:       conversation.OfferID,
+			RequestID:     conversation.RequestID,
+			LastMessageAt: conversation.LastMessageAt,
+			OtherUserID:   userID,
+		}
+		for _, participant := range conversation.Participants {
+			if participant.UserID != userID {
+				summary.OtherUserID = participant.UserID
+			}
+		}
+		summary.OtherUserName = s.data.users[summary.OtherUserID].UserName
+		if conversation.RequestID != nil {
+			summary.PostTitle = deletedPostTitle
+			if request, ok := s.data.requests[*conversation.RequestID]; ok {
+				summary.PostTitle = request.Title
+			}
+		} else if conversation.OfferID != nil {
+			summary.PostTitle = deletedPostTitle
+			if offer, ok := s.data.offers[*conversation.OfferID]; ok {
+				summary.PostTitle = offer.Title
+			}
+		}
+		for _, message := range sortedValues(s.data.messages) {
+			if !sameID(message.ConversationID, &conversation.ID) {
+				continue
+			}
+			last := message
+			summary.LastMessage = &last
+			if message.ReceiverID == userID && message.ReadAt == nil {
+				summary.Unread++
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+func (s *MemoryStore) ConversationMessages(ctx context.Context, conversationID uint) ([]Message, error) {
+	defer s.lock()()
+	messages := []Message{}
+	for _, message := range sortedValues(s.data.messages) {
+		if sameID(message.ConversationID, &conversationID) {
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+func (s *MemoryStore) MarkConversationRead(ctx context.Context, conversationID uint, userID uint, at time.Time) (int64, error) {
+	defer s.lock()()
+	var read int64
+	for id, message := range s.data.messages {
+		if sameID(message.ConversationID, &conversationID) && message.ReceiverID == userID && message.ReadAt == nil {
+			message.ReadAt = &at
+			if message.DeliveredAt == nil {
+				message.DeliveredAt = &at
+			}
+			s.data.messages[id] = message
+			read++
+		}
+	}
+	conversation, ok := s.data.conversations[conversationID]
+	if !ok {
+		return read, nil
+	}
+	conversation.Participants = append([]ConversationParticipant(nil), conversation.Participants...)
+	for i := range conversation.Participants {
+		if conversation.Participants[i].UserID == userID {
+			conversation.Participants[i].LastReadAt = &at
+		}
+	}
+	s.data.conversations[conversationID] = conversation
+	return read, nil
+}
+
+func (s *MemoryStore) UnreadCount(ctx context.Context, userID uint) (int64, error) {
+	defer s.lock()()
+	var unread int64
+	for _, message := range s.data.messages {
+		if message.ReceiverID == userID && message.ReadAt == nil {
+			unread++
+		}
+	}
+	return unread, nil
+}
+
+func (s *MemoryStore) CreatePhoto(ctx context.Context, photo *Photo) error {
+	defer s.lock()()
+	photo.Model = s.newModel()
+	s.data.photos[photo.ID] = *photo
+	return nil
+}
+
+func (s *MemoryStore) FindPhoto(ctx context.Context, id uint) (Photo, error) {
+	defer s.lock()()
+	photo, ok := s.data.photos[id]
+	if !ok {
+		return photo, errNotFound
+	}
+	return photo, nil
+}
+
+func (s *MemoryStore) PostPhotos(ctx context.Context, kind string, postID uint) ([]Photo, error) {
+	defer s.lock()()
+	return s.postPhotos(kind, postID), nil
+}
+
+func (s *MemoryStore) ClaimPhoto(ctx context.Context, photoID uint, userID uint, kind string, postID uint, position int, caption string) (bool, error) {
+	defer s.lock()()
+	photo, ok := s.data.photos[photoID]
+	if !ok || photo.UserID != userID || photo.OfferID != nil || photo.RequestID != nil {
+		return false, nil
+	}
+	for _, user := range s.data.users {
+		if user.AvatarID != nil && *user.AvatarID == photoID {
+			return false, nil
+		}
+	}
+	if kind == SearchRequest {
+		photo.RequestID = &postID
+	} else {
+		photo.OfferID = &postID
+	}
+	photo.Position = position
+	photo.Caption = caption
+	s.data.photos[photoID] = photo
+	return true, nil
+}
+
+func (s *MemoryStore) SetPhotoCaption(ctx context.Context, id uint, caption string) error {
+	defer s.lock()()
+	photo, ok := s.data.photos[id]
+	if ok {
+		photo.Caption = caption
+		s.data.photos[id] = photo
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetPhotoPosition(ctx context.Context, id uint, position int) error {
+	defer s.lock()()
+	photo, ok := s.data.photos[id]
+	if ok {
+		photo.Position = position
+		s.data.photos[id] = photo
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeletePhotos(ctx context.Context, ids []uint) error {
+	defer s.lock()()
+	for _, id := range ids {
+		delete(s.data.photos, id)
+	}
+	return nil
+}
+
+func (s *MemoryStore) FileInUse(ctx context.Context, name string) (bool, error) {
+	defer s.lock()()
+	for _, photo := range s.data.photos {
+		if photo.Path == name || photo.MediumPath == name || photo.ThumbPath == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
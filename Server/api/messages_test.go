@@ -0,0 +1,494 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/logger"
+)
+
+// history lists the messages the user exchanged with the other user, as the
+// inbox asks for them.
+func (s *testServer) history(user testUser, other testUser, headers map[string]string) []Message {
+	s.t.Helper()
+	req := s.newRequest("GET", "/messages", user.Token, nil)
+	req.Header.Set("otherUserID", fmt.Sprint(other.ID))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := s.serve(req)
+	wantStatus(s.t, rec, 200)
+	return decode[[]Message](s.t, rec)
+}
+
+func (s *testServer) unread(user testUser) int64 {
+	s.t.Helper()
+	rec := s.call("GET", "/unread", user.Token, nil)
+	wantStatus(s.t, rec, 200)
+	return decode[map[string]int64](s.t, rec)["unread"]
+}
+
+func messageTexts(messages []Message) []string {
+	texts := []string{}
+	for _, message := range messages {
+		texts = append(texts, message.Text)
+	}
+	return texts
+}
+
+func TestSendMessage(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	outsider := s.newUser("outsider")
+	community := s.newCommunity(ada, "garden", VisibilityPublic)
+	s.join(bob, community)
+	bike := s.newOffer(ada, community, "bike")
+	lamp := s.newOffer(ada, community, "lamp")
+	ladder := s.newRequestPost(ada, community, "ladder")
+
+	message := s.sendMessage(bob, ada, "is the bike still there?", bike)
+	if message.SenderID != bob.ID || message.ReceiverID != ada.ID || message.OfferID == nil || *message.OfferID != bike.ID ||
+		message.ConversationID == nil || message.DeliveredAt != nil {
+		t.Fatalf("unexpected message %+v", message)
+	}
+	s.sendMessage(ada, bob, "it is", bike)
+	s.sendMessage(bob, ada, "and the lamp?", lamp)
+	wantStatus(t, s.call("POST", "/messages", bob.Token, gin.H{"text": "I have a ladder", "receiver_id": fmt.Sprint(ada.ID),
+		"request_id": fmt.Sprint(ladder.ID)}), 200)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    []string
+	}{
+		{"all", nil, []string{"is the bike still there?", "it is", "and the lamp?", "I have a ladder"}},
+		{"offer", map[string]string{"offerID": fmt.Sprint(bike.ID)}, []string{"is the bike still there?", "it is"}},
+		{"request", map[string]string{"requestID": fmt.Sprint(ladder.ID)}, []string{"I have a ladder"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := messageTexts(s.history(ada, bob, test.headers)); fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Fatalf("history is %q, want %q", got, test.want)
+			}
+		})
+	}
+	// loading the history delivered bob's messages to ada, but not ada's to bob
+	for _, message := range s.history(bob, ada, map[string]string{"offerID": fmt.Sprint(bike.ID)}) {
+		if message.DeliveredAt == nil {
+			t.Fatalf("message %q was not delivered", message.Text)
+		}
+	}
+
+	req := s.newRequest("GET", "/messages", ada.Token, nil)
+	wantError(t, s.serve(req), 400, "otherUserID is empty")
+	req.Header.Set("otherUserID", "bob")
+	wantError(t, s.serve(req), 400, "otherUserID is not a number")
+	req.Header.Set("otherUserID", fmt.Sprint(bob.ID))
+	req.Header.Set("offerID", "bike")
+	wantError(t, s.serve(req), 400, "offerID is not a number")
+
+	send := func(to string, offer string) gin.H {
+		return gin.H{"text": "hello", "receiver_id": to, "offer_id": offer}
+	}
+	errorTests := []struct {
+		name   string
+		input  gin.H
+		status int
+		error  string
+	}{
+		{"no shared community", send(fmt.Sprint(outsider.ID), fmt.Sprint(bike.ID)), 400, "do not share a community"},
+		{"unknown receiver", send("999", fmt.Sprint(bike.ID)), 400, "receiver does not exist"},
+		{"bad receiver", send("ada", fmt.Sprint(bike.ID)), 400, "error parsing receiver id"},
+		{"unknown offer", send(fmt.Sprint(ada.ID), "999"), 404, "not found"},
+		{"no post", send(fmt.Sprint(ada.ID), ""), 400, "error parsing offer id"},
+		{"no text", gin.H{"receiver_id": fmt.Sprint(ada.ID), "offer_id": fmt.Sprint(bike.ID)}, 400, "Text"},
+	}
+	for _, test := range errorTests {
+		t.Run(test.name, func(t *testing.T) {
+			wantError(t, s.call("POST", "/messages", bob.Token, test.input), test.status, test.error)
+		})
+	}
+
+	// cat shares the garden with bob and the kitchen with ada
+	cat := s.newUser("cat")
+	s.join(cat, community)
+	kitchen := s.newCommunity(cat, "kitchen", VisibilityPublic)
+	s.join(ada, kitchen)
+	pan := s.newOffer(cat, kitchen, "pan")
+	// bob is not in the kitchen, the pan looks like it does not exist
+	wantError(t, s.call("POST", "/messages", bob.Token, send(fmt.Sprint(cat.ID), fmt.Sprint(pan.ID))), 404, "not found")
+	wantError(t, s.call("POST", "/messages", ada.Token, send(fmt.Sprint(bob.ID), fmt.Sprint(pan.ID))), 403,
+		"receiver does not belong")
+	// only the author is written to about a post, until they answer
+	wantError(t, s.call("POST", "/messages", bob.Token, send(fmt.Sprint(cat.ID), fmt.Sprint(bike.ID))), 403,
+		"not the author")
+	wantError(t, s.call("POST", "/messages", ada.Token, send(fmt.Sprint(cat.ID), fmt.Sprint(bike.ID))), 403,
+		"not the author")
+	s.sendMessage(ada, cat, "is the pan still there?", pan)
+	s.sendMessage(cat, ada, "it is", pan)
+}
+
+func TestConversations(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	cat := s.newUser("cat")
+	community := s.newCommunity(ada, "garden", VisibilityPublic)
+	s.join(bob, community)
+	s.join(cat, community)
+	bike := s.newOffer(ada, community, "bike")
+	lamp := s.newOffer(ada, community, "lamp")
+
+	s.sendMessage(bob, ada, "is the bike still there?", bike)
+	s.sendMessage(bob, ada, "I could pick it up today", bike)
+	s.sendMessage(cat, ada, "I like the lamp", lamp)
+	if got := s.unread(ada); got != 3 {
+		t.Fatalf("ada has %v unread messages, want 3", got)
+	}
+	if got := s.unread(bob); got != 0 {
+		t.Fatalf("bob has %v unread messages, want 0", got)
+	}
+
+	rec := s.call("GET", "/conversations", ada.Token, nil)
+	wantStatus(t, rec, 200)
+	inbox := decode[[]ConversationSummary](t, rec)
+	if len(inbox) != 2 {
+		t.Fatalf("ada has %v conversations, want 2", len(inbox))
+	}
+	latest, older := inbox[0], inbox[1]
+	if latest.OtherUserName != "cat" || latest.PostTitle != "lamp" || latest.Unread != 1 ||
+		older.OtherUserName != "bob" || older.PostTitle != "bike" || older.Unread != 2 ||
+		older.LastMessage == nil || older.LastMessage.Text != "I could pick it up today" {
+		t.Fatalf("unexpected inbox %+v", inbox)
+	}
+	rec = s.call("GET", fmt.Sprintf("/conversations?offerID=%v", bike.ID), ada.Token, nil)
+	wantStatus(t, rec, 200)
+	if got := decode[[]ConversationSummary](t, rec); len(got) != 1 || got[0].ID != older.ID {
+		t.Fatalf("unexpected conversations about the bike %+v", got)
+	}
+
+	path := fmt.Sprintf("/conversations/%v", older.ID)
+	rec = s.call("GET", path, ada.Token, nil)
+	wantStatus(t, rec, 200)
+	conversation := decode[struct {
+		Conversation ConversationSummary `json:"conversation"`
+		Messages     []Message           `json:"messages"`
+	}](t, rec)
+	if conversation.Conversation.OtherUserID != bob.ID || len(conversation.Messages) != 2 ||
+		conversation.Messages[0].DeliveredAt == nil {
+		t.Fatalf("unexpected conversation %+v", conversation)
+	}
+	wantError(t, s.call("GET", path, cat.Token, nil), 403, "not part of the conversation")
+	wantError(t, s.call("GET", "/conversations/999", ada.Token, nil), 404, "conversation not found")
+
+	wantError(t, s.call("POST", path+"/read", cat.Token, nil), 403, "not part of the conversation")
+	rec = s.call("POST", path+"/read", ada.Token, nil)
+	wantStatus(t, rec, 200)
+	if read := decode[map[string]int64](t, rec)["read"]; read != 2 {
+		t.Fatalf("marked %v messages read, want 2", read)
+	}
+	rec = s.call("POST", path+"/read", ada.Token, nil)
+	if read := decode[map[string]int64](t, rec)["read"]; read != 0 {
+		t.Fatalf("marked %v messages read again", read)
+	}
+	if got := s.unread(ada); got != 1 {
+		t.Fatalf("ada has %v unread messages, want 1", got)
+	}
+	// replying counts as reading
+	s.sendMessage(ada, cat, "it is yours", lamp)
+	if got := s.unread(ada); got != 0 {
+		t.Fatalf("ada has %v unread messages, want 0", got)
+	}
+}
+
+func TestConversationKey(t *testing.T) {
+	s := newTestServer(t)
+	offerID := uint(5)
+	first, err := conversationFor(s.db, 1, 2, &offerID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := conversationFor(s.db, 2, 1, &offerID, nil)
+	if err != nil || again.ID != first.ID {
+		t.Fatalf("got conversation %v, %v, want %v", again.ID, err, first.ID)
+	}
+	other, err := conversationFor(s.db, 1, 2, nil, &offerID)
+	if err != nil || other.ID == first.ID {
+		t.Fatalf("a request shares the conversation about the offer: %v, %v", other.ID, err)
+	}
+	key := conversationKey(1, 2, &offerID, nil)
+	if err := s.db.Create(&Conversation{ParticipantKey: &key}).Error; err == nil {
+		t.Fatal("a second conversation about the offer was stored")
+	}
+}
+
+func TestMergeDuplicateConversations(t *testing.T) {
+	db, err := OpenDB(DatabaseConfig{Driver: DriverSQLite, DSN: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Logger = logger.Discard
+	err = MigrateTo(db, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		"INSERT INTO users (id, user_name, email) VALUES (1, 'ada', 'ada@example.com'), (2, 'bob', 'bob@example.com')",
+		"INSERT INTO communities (id, name) VALUES (1, 'garden')",
+		"INSERT INTO offers (id, title, user_id, community_id) VALUES (5, 'bike', 1, 1)",
+	} {
+		err = db.Exec(stmt).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// two messages sent at once used to start two threads about the offer
+	earlier, later := time.Now().Add(-time.Hour), time.Now()
+	for i, at := range []time.Time{earlier, later} {
+		id := uint(i + 1)
+		err = db.Exec("INSERT INTO conversations (id, offer_id, last_message_at) VALUES (?, 5, ?)", id, at).Error
+		if err == nil {
+			err = db.Exec("INSERT INTO conversation_participants (conversation_id, user_id) VALUES (?, 1), (?, 2)", id, id).Error
+		}
+		if err == nil {
+			err = db.Exec("INSERT INTO messages (text, sender_id, receiver_id, offer_id, conversation_id, created_at) VALUES (?, 1, 2, 5, ?, ?)",
+				fmt.Sprint("message ", id), id, at).Error
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = MigrateUp(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conversations []Conversation
+	db.Find(&conversations)
+	if len(conversations) != 1 || conversations[0].ID != 1 || !conversations[0].LastMessageAt.Equal(later) {
+		t.Fatalf("unexpected conversations %+v", conversations)
+	}
+	var moved int64
+	db.Model(&Message{}).Where("conversation_id = 1").Count(&moved)
+	if moved != 2 {
+		t.Fatalf("the kept conversation has %v messages, want 2", moved)
+	}
+	offerID := uint(5)
+	found, err := conversationFor(db, 2, 1, &offerID, nil)
+	if err != nil || found.ID != 1 {
+		t.Fatalf("got conversation %v, %v after the merge", found.ID, err)
+	}
+	err = MigrateTo(db, 3)
+	if err != nil {
+		t.Fatalf("reverting the key: %v", err)
+	}
+}
+
+func TestTyping(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	community := s.newCommunity(ada, "garden", VisibilityPublic)
+	s.join(bob, community)
+	bike := s.newOffer(ada, community, "bike")
+	events, unsubscribe := s.events.Subscribe(ada.ID)
+	defer unsubscribe()
+
+	typing := gin.H{"receiver_id": fmt.Sprint(ada.ID), "offer_id": fmt.Sprint(bike.ID)}
+	sent := func() bool {
+		t.Helper()
+		rec := s.call("POST", "/typing", bob.Token, typing)
+		wantStatus(t, rec, 200)
+		return decode[map[string]bool](t, rec)["sent"]
+	}
+	// users who have not talked yet are not told
+	if sent() {
+		t.Fatal("typing was sent before the first message")
+	}
+	s.sendMessage(bob, ada, "hello", bike)
+	<-events
+	if !sent() {
+		t.Fatal("typing was not sent")
+	}
+	select {
+	case event := <-events:
+		if event.Type != EventTyping {
+			t.Fatalf("got a %v event, want %v", event.Type, EventTyping)
+		}
+	default:
+		t.Fatal("ada got no typing event")
+	}
+	wantStatus(t, s.call("POST", "/block", ada.Token, gin.H{"user_id": fmt.Sprint(bob.ID)}), 200)
+	if sent() {
+		t.Fatal("typing was sent to a user who blocked the sender")
+	}
+	wantStatus(t, s.call("POST", "/typing", bob.Token, gin.H{"receiver_id": "ada"}), 400)
+	wantStatus(t, s.call("POST", "/typing", bob.Token, gin.H{"receiver_id": fmt.Sprint(ada.ID), "offer_id": "bike"}), 400)
+	wantStatus(t, s.call("POST", "/typing", bob.Token, gin.H{}), 400)
+}
+
+// sseEvent is one server-sent event.
+type sseEvent struct {
+	Type string
+	Data string
+}
+
+// readEvents parses the server-sent events of the stream onto a channel until
+// the stream ends.
+func readEvents(body *bufio.Reader) <-chan sseEvent {
+	events := make(chan sseEvent)
+	go func() {
+		defer close(events)
+		var event sseEvent
+		for {
+			line, err := body.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case strings.HasPrefix(line, "event:"):
+				event.Type = strings.TrimPrefix(line, "event:")
+			case strings.HasPrefix(line, "data:"):
+				event.Data = strings.TrimPrefix(line, "data:")
+			case line == "":
+				events <- event
+				event = sseEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("the event stream ended")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event within 5 seconds")
+	}
+	return sseEvent{}
+}
+
+func TestStreamEvents(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	community := s.newCommunity(ada, "garden", VisibilityPublic)
+	s.join(bob, community)
+	bike := s.newOffer(ada, community, "bike")
+
+	server := httptest.NewServer(s.router)
+	defer server.Close()
+	wantStatus(t, s.call("GET", "/events", "", nil), 401)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+ada.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("got status %v with content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	events := readEvents(bufio.NewReader(resp.Body))
+	if event := nextEvent(t, events); event.Type != "ready" {
+		t.Fatalf("the first event is %+v, want ready", event)
+	}
+
+	sent := s.sendMessage(bob, ada, "is the bike still there?", bike)
+	event := nextEvent(t, events)
+	var got Message
+	err = json.Unmarshal([]byte(event.Data), &got)
+	if err != nil || event.Type != EventMessage || got.ID != sent.ID || got.Text != sent.Text {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	// the connected receiver got the message as it was sent
+	if sent.DeliveredAt == nil {
+		t.Fatal("a message pushed to the receiver is not delivered")
+	}
+
+	conversation := fmt.Sprintf("/conversations/%v/read", *sent.ConversationID)
+	s.sendMessage(ada, bob, "it is", bike)
+	if event := nextEvent(t, events); event.Type != EventMessage {
+		t.Fatalf("the sender did not get their own message, got %+v", event)
+	}
+	wantStatus(t, s.call("POST", conversation, bob.Token, nil), 200)
+	if event := nextEvent(t, events); event.Type != EventRead || !strings.Contains(event.Data, fmt.Sprintf(`"reader_id":%v`, bob.ID)) {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	community := s.newCommunity(ada, "garden", VisibilityPublic)
+	s.join(bob, community)
+	bike := s.newOffer(ada, community, "bike")
+	drill := s.newOffer(bob, community, "drill")
+	s.newRequestPost(bob, community, "ladder")
+
+	wantError(t, s.call("POST", "/block", ada.Token, gin.H{"user_id": fmt.Sprint(ada.ID)}), 400, "can not block yourself")
+	wantError(t, s.call("POST", "/block", ada.Token, gin.H{"user_id": "999"}), 400, "user does not exist")
+	wantError(t, s.call("POST", "/block", ada.Token, gin.H{"user_id": "bob"}), 400, "must be a number")
+	wantStatus(t, s.call("POST", "/block", ada.Token, gin.H{"user_id": fmt.Sprint(bob.ID)}), 200)
+	wantStatus(t, s.call("POST", "/block", ada.Token, gin.H{"user_id": fmt.Sprint(bob.ID)}), 200)
+
+	rec := s.call("GET", "/blocks", ada.Token, nil)
+	wantStatus(t, rec, 200)
+	if blocked := decode[[]BlockedUser](t, rec); len(blocked) != 1 || blocked[0].UserName != "bob" {
+		t.Fatalf("unexpected blocks %+v", blocked)
+	}
+	rec = s.call("GET", "/blocks", bob.Token, nil)
+	if blocked := decode[[]BlockedUser](t, rec); len(blocked) != 0 {
+		t.Fatalf("bob blocked %+v", blocked)
+	}
+
+	// neither side can write to the other, nor sees the other's posts
+	wantError(t, s.call("POST", "/messages", bob.Token, gin.H{"text": "hello", "receiver_id": fmt.Sprint(ada.ID),
+		"offer_id": fmt.Sprint(bike.ID)}), 403, "blocked")
+	wantError(t, s.call("POST", "/messages", ada.Token, gin.H{"text": "hello", "receiver_id": fmt.Sprint(bob.ID),
+		"offer_id": fmt.Sprint(drill.ID)}), 403, "blocked")
+	for _, user := range []testUser{ada, bob} {
+		rec = s.call("GET", fmt.Sprintf("/offers/%v", community.ID), user.Token, nil)
+		if got := offerTitles(t, decode[Page[OfferListItem]](t, rec)); len(got) != 1 {
+			t.Fatalf("%v sees the offers %v", user.Name, got)
+		}
+	}
+	rec = s.call("GET", fmt.Sprintf("/requests/%v", community.ID), ada.Token, nil)
+	if got := decode[Page[RequestListItem]](t, rec); len(got.Items) != 0 {
+		t.Fatalf("ada sees the requests %+v", got.Items)
+	}
+	rec = s.call("GET", fmt.Sprintf("/user/%v/activity", bob.ID), ada.Token, nil)
+	wantStatus(t, rec, 200)
+	if activity := decode[UserActivity](t, rec); len(activity.Offers)+len(activity.Requests) != 0 {
+		t.Fatalf("ada sees the activity %+v", activity)
+	}
+
+	// only the blocker can lift the block
+	wantStatus(t, s.call("POST", "/unblock", bob.Token, gin.H{"user_id": fmt.Sprint(ada.ID)}), 200)
+	wantStatus(t, s.call("POST", "/messages", bob.Token, gin.H{"text": "hello", "receiver_id": fmt.Sprint(ada.ID),
+		"offer_id": fmt.Sprint(bike.ID)}), 403)
+	wantStatus(t, s.call("POST", "/unblock", ada.Token, gin.H{"user_id": fmt.Sprint(bob.ID)}), 200)
+	s.sendMessage(bob, ada, "hello", bike)
+	wantStatus(t, s.call("POST", "/unblock", ada.Token, gin.H{}), 400)
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	contextUserKey   = "user"
+	contextUserIDKey = "userID"
+)
+
+// bearerToken returns the token of an "Authorization: Bearer <token>" header.
+func bearerToken(c *gin.Context) string {
+	scheme, token, found := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// RequireAuth rejects requests without a valid access token and puts the
+// user the token belongs to on the context, see currentUser and
+// currentUserID.
+func RequireAuth(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := bearerToken(c)
+		if tokenString == "" {
+			c.AbortWithStatusJSON(401, gin.H{"error": "missing bearer token"})
+			return
+		}
+		userID, issuedAt, err := validateJWT(tokenString)
+		if err != nil {
+			c.AbortWithStatusJSON(401, gin.H{"error": err.Error()})
+			return
+		}
+		var user User
+		result := db.First(&user, userID)
+		if result.Error != nil {
+			c.AbortWithStatusJSON(401, gin.H{"error": "user no longer exists"})
+			return
+		}
+		// tokens carry whole seconds, so the session that revoked the others
+		// and got a new token in the same second keeps working
+		if user.SessionsRevokedAt != nil && issuedAt.Before(user.SessionsRevokedAt.Truncate(time.Second)) {
+			c.AbortWithStatusJSON(401, gin.H{"error": "session was signed out"})
+			return
+		}
+		c.Set(contextUserKey, user)
+		c.Set(contextUserIDKey, fmt.Sprint(user.ID))
+		c.Next()
+	}
+}
+
+// currentUser returns the user RequireAuth authenticated.
+func currentUser(c *gin.Context) User {
+	return c.MustGet(contextUserKey).(User)
+}
+
+// currentUserID returns the id of the user RequireAuth authenticated, in the
+// string form the other helpers take.
+func currentUserID(c *gin.Context) string {
+	return c.GetString(contextUserIDKey)
+}
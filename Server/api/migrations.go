@@ -0,0 +1,429 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/sashamorecode/Comradery/Server/api/internal/schemav1"
+	"gorm.io/gorm"
+)
+
+// Migration is one numbered step of the database schema. The server no longer
+// changes the schema when it starts, every change to the models needs a
+// migration here, run with the migrate command.
+//
+// Up and Down run in a transaction together with the bookkeeping in
+// schema_migrations. MySQL commits schema changes right away, so there a
+// failed migration can be left half applied and has to be cleaned up by hand.
+type Migration struct {
+	Version uint
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+var migrations = []Migration{
+	{Version: 1, Name: "baseline", Up: schemav1.Up, Down: schemav1.Down},
+	{Version: 2, Name: "rename messages.reciver_id to receiver_id", Up: renameReceiverUp, Down: renameReceiverDown},
+	{Version: 3, Name: "fulltext search indexes", Up: fullTextIndexesUp, Down: fullTextIndexesDown},
+	{Version: 4, Name: "unique conversations.participant_key", Up: participantKeyUp, Down: participantKeyDown},
+	{Version: 5, Name: "data_exports.claimed_at", Up: claimedAtUp, Down: claimedAtDown},
+}
+
+// SchemaMigration records a migration applied to the database.
+type SchemaMigration struct {
+	Version   uint `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// MigrationState is a line of the migrate status command. AppliedAt is nil
+// for migrations still to run; Unknown marks migrations applied by a newer
+// version of the server.
+type MigrationState struct {
+	Version   uint
+	Name      string
+	AppliedAt *time.Time
+	Unknown   bool
+}
+
+// LatestSchemaVersion is the schema version this server is written for.
+func LatestSchemaVersion() uint {
+	return migrations[len(migrations)-1].Version
+}
+
+func findMigration(version uint) (Migration, bool) {
+	for _, migration := range migrations {
+		if migration.Version == version {
+			return migration, true
+		}
+	}
+	return Migration{}, false
+}
+
+// appliedMigrations reads schema_migrations, which a database that was never
+// migrated does not have yet.
+func appliedMigrations(db *gorm.DB) (map[uint]SchemaMigration, error) {
+	applied := map[uint]SchemaMigration{}
+	if !db.Migrator().HasTable(&SchemaMigration{}) {
+		return applied, nil
+	}
+	var rows []SchemaMigration
+	result := db.Find(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// highestVersion is the version a database with the applied migrations is
+// at, 0 for an empty database.
+func highestVersion(applied map[uint]SchemaMigration) uint {
+	var version uint
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version
+}
+
+// SchemaVersion is the highest migration applied to the database.
+func SchemaVersion(db *gorm.DB) (uint, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	return highestVersion(applied), nil
+}
+
+// MigrationStatus lists the migrations this server knows and those applied to
+// the database, by version.
+func MigrationStatus(db *gorm.DB) ([]MigrationState, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var states []MigrationState
+	for _, migration := range migrations {
+		state := MigrationState{Version: migration.Version, Name: migration.Name}
+		if row, ok := applied[migration.Version]; ok {
+			state.AppliedAt = &row.AppliedAt
+		}
+		states = append(states, state)
+	}
+	for version, row := range applied {
+		if _, ok := findMigration(version); !ok {
+			appliedAt := row.AppliedAt
+			states = append(states, MigrationState{Version: version, Name: row.Name, AppliedAt: &appliedAt, Unknown: true})
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Version < states[j].Version
+	})
+	return states, nil
+}
+
+// CheckSchema refuses a database with migrations still to run, the models
+// would not match its tables. A database migrated further than this server
+// knows is only warned about, so an older server keeps running while a
+// rollout of a newer one is underway. On MySQL it also checks that the
+// FULLTEXT indexes the search needs are in place.
+func CheckSchema(db *gorm.DB) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	version := highestVersion(applied)
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			return fmt.Errorf("the database schema is at version %d but this server needs version %d, run the migrate up command first",
+				version, LatestSchemaVersion())
+		}
+	}
+	if version > LatestSchemaVersion() {
+		log.Printf("Warning: the database schema is at version %d, newer than the %d this server knows", version, LatestSchemaVersion())
+	}
+	return checkFullTextIndexes(db)
+}
+
+func applyMigration(db *gorm.DB, migration Migration) error {
+	log.Printf("Applying migration %d: %v", migration.Version, migration.Name)
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := migration.Up(tx)
+		if err != nil {
+			return fmt.Errorf("error applying migration %d: %v", migration.Version, err)
+		}
+		return tx.Create(&SchemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error
+	})
+}
+
+func revertMigration(db *gorm.DB, migration Migration) error {
+	log.Printf("Reverting migration %d: %v", migration.Version, migration.Name)
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := migration.Down(tx)
+		if err != nil {
+			return fmt.Errorf("error reverting migration %d: %v", migration.Version, err)
+		}
+		return tx.Delete(&SchemaMigration{Version: migration.Version}).Error
+	})
+}
+
+// MigrateTo applies or reverts migrations one at a time until the database is
+// at the given version. Version 0 is an empty database.
+func MigrateTo(db *gorm.DB, version uint) error {
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("unknown schema version %d, the latest is %d", version, LatestSchemaVersion())
+	}
+	err := db.AutoMigrate(&SchemaMigration{})
+	if err != nil {
+		return fmt.Errorf("error creating the migrations table: %v", err)
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for v := range applied {
+		if _, ok := findMigration(v); !ok && v > version {
+			return fmt.Errorf("migration %d was applied by a newer server and can only be reverted by it", v)
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.Version]; ok && migration.Version > version {
+			err = revertMigration(db, migration)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; !ok && migration.Version <= version {
+			err = applyMigration(db, migration)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MigrateUp applies every migration still to run.
+func MigrateUp(db *gorm.DB) error {
+	return MigrateTo(db, LatestSchemaVersion())
+}
+
+// MigrateDown reverts the last applied migration.
+func MigrateDown(db *gorm.DB) error {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return fmt.Errorf("there are no migrations to revert")
+	}
+	var previous uint
+	for _, migration := range migrations {
+		if migration.Version < version {
+			previous = migration.Version
+		}
+	}
+	return MigrateTo(db, previous)
+}
+
+// messageReceiver is as much of the messages table as renaming reciver_id
+// needs: MySQL before 8.0 renames a column by restating its type.
+type messageReceiver struct {
+	ReceiverID uint
+}
+
+func (messageReceiver) TableName() string {
+	return "messages"
+}
+
+func renameReceiverUp(tx *gorm.DB) error {
+	return tx.Migrator().RenameColumn(&messageReceiver{}, "reciver_id", "receiver_id")
+}
+
+func renameReceiverDown(tx *gorm.DB) error {
+	return tx.Migrator().RenameColumn(&schemav1.Message{}, "receiver_id", "reciver_id")
+}
+
+// fullTextIndexes are the MySQL FULLTEXT indexes MySQLSearchIndex searches
+// through. Other databases don't have them and use the memory index.
+var fullTextIndexes = []struct {
+	table   string
+	name    string
+	columns string
+}{
+	{"offers", "ft_offers_title_description", "title, description"},
+	{"requests", "ft_requests_title_description", "title, description"},
+	{"communities", "ft_communities_name_city", "name, city"},
+}
+
+func fullTextIndexesUp(tx *gorm.DB) error {
+	if tx.Dialector.Name() != DriverMySQL {
+		return nil
+	}
+	for _, index := range fullTextIndexes {
+		// servers before migration 3 created the indexes when they started
+		if tx.Migrator().HasIndex(index.table, index.name) {
+			continue
+		}
+		result := tx.Exec("CREATE FULLTEXT INDEX " + index.name + " ON " + index.table + " (" + index.columns + ")")
+		if result.Error != nil {
+			return fmt.Errorf("error creating fulltext index %v: %v", index.name, result.Error)
+		}
+	}
+	return nil
+}
+
+func fullTextIndexesDown(tx *gorm.DB) error {
+	if tx.Dialector.Name() != DriverMySQL {
+		return nil
+	}
+	for _, index := range fullTextIndexes {
+		err := tx.Migrator().DropIndex(index.table, index.name)
+		if err != nil {
+			return fmt.Errorf("error dropping fulltext index %v: %v", index.name, err)
+		}
+	}
+	return nil
+}
+
+// checkFullTextIndexes makes sure the indexes of migration 3 are still there
+// on MySQL, the searches fail without them.
+func checkFullTextIndexes(db *gorm.DB) error {
+	if db.Dialector.Name() != DriverMySQL {
+		return nil
+	}
+	for _, index := range fullTextIndexes {
+		if !db.Migrator().HasIndex(index.table, index.name) {
+			return fmt.Errorf("the fulltext index %v is missing, run the migrate down and up commands to recreate it", index.name)
+		}
+	}
+	return nil
+}
+
+// keyedConversation is as much of the conversations table as migration 4
+// needs.
+type keyedConversation struct {
+	ID             uint
+	LastMessageAt  *time.Time
+	OfferID        *uint
+	RequestID      *uint
+	ParticipantKey *string `gorm:"size:100;uniqueIndex"`
+}
+
+func (keyedConversation) TableName() string {
+	return "conversations"
+}
+
+// participantKeyUp keys the conversations by their users and post. Threads
+// started twice before the key existed are merged into the older one.
+func participantKeyUp(tx *gorm.DB) error {
+	err := tx.Migrator().AddColumn(&keyedConversation{}, "ParticipantKey")
+	if err != nil {
+		return err
+	}
+	var conversations []keyedConversation
+	result := tx.Order("id").Find(&conversations)
+	if result.Error != nil {
+		return result.Error
+	}
+	var participants []struct {
+		ConversationID uint
+		UserID         uint
+	}
+	result = tx.Table("conversation_participants").Select("conversation_id, user_id").Order("user_id").Scan(&participants)
+	if result.Error != nil {
+		return result.Error
+	}
+	users := map[uint][]uint{}
+	for _, participant := range participants {
+		users[participant.ConversationID] = append(users[participant.ConversationID], participant.UserID)
+	}
+	kept := map[string]uint{}
+	for _, conversation := range conversations {
+		ids := users[conversation.ID]
+		if len(ids) == 0 {
+			continue
+		}
+		key := conversationKey(ids[0], ids[len(ids)-1], conversation.OfferID, conversation.RequestID)
+		older, ok := kept[key]
+		if !ok {
+			kept[key] = conversation.ID
+			err = tx.Model(&keyedConversation{}).Where("id = ?", conversation.ID).Update("participant_key", key).Error
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = mergeConversation(tx, conversation, older)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Migrator().CreateIndex(&keyedConversation{}, "ParticipantKey")
+}
+
+// mergeConversation moves the messages of the conversation to the older one
+// about the same post and removes it.
+func mergeConversation(tx *gorm.DB, conversation keyedConversation, olderID uint) error {
+	err := tx.Table("messages").Where("conversation_id = ?", conversation.ID).Update("conversation_id", olderID).Error
+	if err != nil {
+		return err
+	}
+	if conversation.LastMessageAt != nil {
+		err = tx.Model(&keyedConversation{}).
+			Where("id = ? AND (last_message_at IS NULL OR last_message_at < ?)", olderID, *conversation.LastMessageAt).
+			Update("last_message_at", *conversation.LastMessageAt).Error
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Table("conversation_participants").Where("conversation_id = ?", conversation.ID).
+		Delete(&ConversationParticipant{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Delete(&keyedConversation{}, conversation.ID).Error
+}
+
+func participantKeyDown(tx *gorm.DB) error {
+	err := tx.Migrator().DropIndex(&keyedConversation{}, "ParticipantKey")
+	if err != nil {
+		return err
+	}
+	// the sqlite migrator drops a column by copying the table, which the
+	// foreign keys of conversation_participants refuse
+	return tx.Exec("ALTER TABLE conversations DROP COLUMN participant_key").Error
+}
+
+// claimedExport is as much of the data_exports table as migration 5 needs.
+type claimedExport struct {
+	ClaimedAt *time.Time
+}
+
+func (claimedExport) TableName() string {
+	return "data_exports"
+}
+
+// claimedAtUp adds when an export was claimed. Exports running when the
+// column is added have no claim time and are started over by the next worker.
+func claimedAtUp(tx *gorm.DB) error {
+	return tx.Migrator().AddColumn(&claimedExport{}, "ClaimedAt")
+}
+
+func claimedAtDown(tx *gorm.DB) error {
+	return tx.Migrator().DropColumn(&claimedExport{}, "ClaimedAt")
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// schemaAt checks that the database is at the version, by its
+// schema_migrations rows and by the tables and columns each migration adds.
+func schemaAt(t *testing.T, db *gorm.DB, version uint) {
+	t.Helper()
+	got, err := SchemaVersion(db)
+	if err != nil || got != version {
+		t.Fatalf("schema version is %v, %v, want %v", got, err, version)
+	}
+	states, err := MigrationStatus(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != len(migrations) {
+		t.Fatalf("status lists %v migrations, want %v", len(states), len(migrations))
+	}
+	for _, state := range states {
+		if applied := state.AppliedAt != nil; applied != (state.Version <= version) || state.Unknown {
+			t.Fatalf("at version %v migration %v is %+v", version, state.Version, state)
+		}
+	}
+	err = CheckSchema(db)
+	if (err == nil) != (version == LatestSchemaVersion()) {
+		t.Fatalf("at version %v the schema check gives %v", version, err)
+	}
+
+	migrator := db.Migrator()
+	checks := []struct {
+		since uint
+		until uint
+		table string
+		field string
+		name  string
+	}{
+		{1, 0, "users", "", "the users table"},
+		{1, 1, "messages", "reciver_id", "messages.reciver_id"},
+		{2, 0, "messages", "receiver_id", "messages.receiver_id"},
+		{4, 0, "conversations", "participant_key", "conversations.participant_key"},
+		{5, 0, "data_exports", "claimed_at", "data_exports.claimed_at"},
+	}
+	for _, check := range checks {
+		want := version >= check.since && (check.until == 0 || version <= check.until)
+		var has bool
+		if check.field == "" {
+			has = migrator.HasTable(check.table)
+		} else {
+			has = migrator.HasTable(check.table) && migrator.HasColumn(check.table, check.field)
+		}
+		if has != want {
+			t.Fatalf("at version %v %v is there: %v, want %v", version, check.name, has, want)
+		}
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	db, err := OpenDB(DatabaseConfig{Driver: DriverSQLite, DSN: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Logger = logger.Discard
+	schemaAt(t, db, 0)
+
+	err = MigrateTo(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemaAt(t, db, 1)
+	// a message stored by the version 1 schema survives the migrations
+	for _, stmt := range []string{
+		"INSERT INTO users (id, user_name, email) VALUES (1, 'ada', 'ada@example.com'), (2, 'bob', 'bob@example.com')",
+		"INSERT INTO communities (id, name) VALUES (1, 'garden')",
+		"INSERT INTO offers (id, title, user_id, community_id) VALUES (5, 'bike', 1, 1)",
+		"INSERT INTO messages (id, text, sender_id, reciver_id, offer_id) VALUES (1, 'is the bike still there?', 2, 1, 5)",
+	} {
+		err = db.Exec(stmt).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for version := uint(2); version <= LatestSchemaVersion(); version++ {
+		err = MigrateTo(db, version)
+		if err != nil {
+			t.Fatalf("migrating to %v: %v", version, err)
+		}
+		schemaAt(t, db, version)
+	}
+	var message Message
+	err = db.First(&message, 1).Error
+	if err != nil || message.ReceiverID != 1 || message.SenderID != 2 {
+		t.Fatalf("the message is %+v, %v after migrating up", message, err)
+	}
+	err = MigrateUp(db)
+	if err != nil {
+		t.Fatalf("migrating up an up to date database: %v", err)
+	}
+	schemaAt(t, db, LatestSchemaVersion())
+
+	for version := LatestSchemaVersion(); version > 0; version-- {
+		err = MigrateDown(db)
+		if err != nil {
+			t.Fatalf("reverting migration %v: %v", version, err)
+		}
+		schemaAt(t, db, version-1)
+		if version-1 == 1 {
+			var receiver uint
+			err = db.Raw("SELECT reciver_id FROM messages WHERE id = 1").Scan(&receiver).Error
+			if err != nil || receiver != 1 {
+				t.Fatalf("the message went to %v, %v after migrating down", receiver, err)
+			}
+		}
+	}
+	err = MigrateDown(db)
+	if err == nil {
+		t.Fatal("reverted a migration of an empty database")
+	}
+	err = MigrateTo(db, LatestSchemaVersion()+1)
+	if err == nil {
+		t.Fatal("migrated to a version this server does not know")
+	}
+}
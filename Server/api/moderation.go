@@ -0,0 +1,291 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	RoleOwner     = "owner"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+// roleRank orders the roles; a member may only moderate members ranked below
+// them.
+var roleRank = map[string]int{
+	RoleMember:    1,
+	RoleModerator: 2,
+	RoleOwner:     3,
+}
+
+// Membership is the user_communities join table with the member's role.
+type Membership struct {
+	UserID      uint   `gorm:"primaryKey" json:"user_id"`
+	CommunityID uint   `gorm:"primaryKey" json:"community_id"`
+	Role        string `gorm:"size:16;default:member" json:"role"`
+	CreatedAt   time.Time
+}
+
+func (Membership) TableName() string {
+	return "user_communities"
+}
+
+// CommunityBan keeps a user out of a community until a moderator lifts it.
+type CommunityBan struct {
+	gorm.Model
+	CommunityID uint   `gorm:"uniqueIndex:idx_community_bans_community_user" json:"community_id"`
+	UserID      uint   `gorm:"uniqueIndex:idx_community_bans_community_user" json:"user_id"`
+	BannedByID  uint   `json:"banned_by_id"`
+	Reason      string `json:"reason"`
+}
+
+const (
+	ActionKick       = "kick"
+	ActionBan        = "ban"
+	ActionUnban      = "unban"
+	ActionPromote    = "promote"
+	ActionDemote     = "demote"
+	ActionRemovePost = "remove_post"
+	ActionTransfer   = "transfer_ownership"
+	ActionLeave      = "leave"
+)
+
+// ModerationAction is one entry of a community's audit trail.
+type ModerationAction struct {
+	gorm.Model
+	CommunityID  uint   `gorm:"index" json:"community_id"`
+	ActorID      uint   `json:"actor_id"`
+	Action       string `gorm:"size:32" json:"action"`
+	TargetUserID *uint  `json:"target_user_id"`
+	OfferID      *uint  `json:"offer_id"`
+	RequestID    *uint  `json:"request_id"`
+	Reason       string `json:"reason"`
+}
+
+type ModerationInput struct {
+	UserID string `json:"user_id" binding:"required"`
+	Reason string `json:"reason"`
+}
+
+type RemovePostInput struct {
+	Kind   string `json:"kind" binding:"required"`
+	ID     string `json:"id" binding:"required"`
+	Reason string `json:"reason"`
+}
+
+type MemberInfo struct {
+	UserID   uint      `json:"user_id"`
+	UserName string    `json:"username"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// setupMembership makes gorm use Membership for the user_communities table.
+// It has to run before the communities of a user are looked up.
+func setupMembership(db *gorm.DB) error {
+	err := db.SetupJoinTable(&User{}, "Communities", &Membership{})
+	if err != nil {
+		return err
+	}
+	return db.SetupJoinTable(&Community{}, "Users", &Membership{})
+}
+
+func findMembership(db *gorm.DB, userID uint, communityID uint) (Membership, error) {
+	var membership Membership
+	result := db.Where("user_id = ? AND community_id = ?", userID, communityID).First(&membership)
+	return membership, result.Error
+}
+
+func isBanned(db *gorm.DB, userID uint, communityID uint) (bool, error) {
+	var count int64
+	result := db.Model(&CommunityBan{}).Where("user_id = ? AND community_id = ?", userID, communityID).Count(&count)
+	return count > 0, result.Error
+}
+
+func recordModeration(db *gorm.DB, action ModerationAction) error {
+	return db.Create(&action).Error
+}
+
+// moderationInput binds the input and parses the id of the targeted user.
+func moderationInput(c *gin.Context) (ModerationInput, uint, bool) {
+	var input ModerationInput
+	err := c.BindJSON(&input)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return input, 0, false
+	}
+	targetID, err := parseUint(input.UserID)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "user_id must be a number"})
+		return input, 0, false
+	}
+	return input, targetID, true
+}
+
+// moderateMember runs act on the user named in the input and answers with
+// what answer makes of their id.
+func moderateMember(act func(ctx context.Context, actorID uint, communityID uint, targetID uint, reason string) error,
+	answer func(targetID uint) gin.H) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		communityID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		input, targetID, ok := moderationInput(c)
+		if !ok {
+			return
+		}
+		err := act(c.Request.Context(), currentUser(c).ID, communityID, targetID, input.Reason)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, answer(targetID))
+	}
+}
+
+func GetCommunityMembers(communities *CommunityService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		communityID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		community, actor, members, err := communities.Members(c.Request.Context(), currentUser(c).ID, communityID)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"community": community, "role": actor.Role, "members": members})
+	}
+}
+
+func KickMember(communities *CommunityService) gin.HandlerFunc {
+	return moderateMember(communities.Kick, func(targetID uint) gin.H {
+		return gin.H{"kicked": targetID}
+	})
+}
+
+// BanMember bans a user from the community. The user does not have to be a
+// member, so that someone who just left can still be kept out.
+func BanMember(communities *CommunityService) gin.HandlerFunc {
+	return moderateMember(communities.Ban, func(targetID uint) gin.H {
+		return gin.H{"banned": targetID}
+	})
+}
+
+func UnbanMember(communities *CommunityService) gin.HandlerFunc {
+	return moderateMember(communities.Unban, func(targetID uint) gin.H {
+		return gin.H{"unbanned": targetID}
+	})
+}
+
+func GetCommunityBans(communities *CommunityService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		communityID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		bans, err := communities.Bans(c.Request.Context(), currentUser(c).ID, communityID)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, bans)
+	}
+}
+
+func PromoteMember(communities *CommunityService) gin.HandlerFunc {
+	return moderateMember(communities.Promote, func(targetID uint) gin.H {
+		return gin.H{"user_id": targetID, "role": RoleModerator}
+	})
+}
+
+func DemoteMember(communities *CommunityService) gin.HandlerFunc {
+	return moderateMember(communities.Demote, func(targetID uint) gin.H {
+		return gin.H{"user_id": targetID, "role": RoleMember}
+	})
+}
+
+// TransferOwnership hands the community to another member. The old owner
+// stays on as a moderator.
+func TransferOwnership(communities *CommunityService) gin.HandlerFunc {
+	return moderateMember(communities.TransferOwnership, func(targetID uint) gin.H {
+		return gin.H{"owner_id": targetID}
+	})
+}
+
+func LeaveCommunity(communities *CommunityService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		communityID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		err := communities.Leave(c.Request.Context(), currentUser(c).ID, communityID)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"left": communityID})
+	}
+}
+
+var errOutranked = errors.New("can only remove posts of members with a lower role")
+
+// RemovePost lets moderators take down an offer or request posted to their
+// community. Posts by members ranked as high as the moderator are off limits.
+func RemovePost(posts *PostService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		communityID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		var input RemovePostInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		postID, err := parseUint(input.ID)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "id must be a number"})
+			return
+		}
+		err = posts.Remove(c.Request.Context(), currentUser(c).ID, communityID, input.Kind, postID, input.Reason)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"removed": postID, "kind": input.Kind})
+	}
+}
+
+func GetModerationLog(communities *CommunityService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		communityID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		query, err := parseListQuery(c)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		page, err := communities.ModerationLog(c.Request.Context(), currentUser(c).ID, communityID, query)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, page)
+	}
+}
+
+func parseUint(s string) (uint, error) {
+	n, err := strconv.ParseUint(s, 10, 64)
+	return uint(n), err
+}
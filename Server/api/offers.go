@@ -0,0 +1,99 @@
+package api
+
+import "github.com/gin-gonic/gin"
+
+const (
+	OfferOpen      = "open"
+	OfferReserved  = "reserved"
+	OfferGiven     = "given"
+	OfferWithdrawn = "withdrawn"
+)
+
+// offerTransitions lists the statuses an offer may move to from each status.
+var offerTransitions = map[string][]string{
+	OfferOpen:      {OfferReserved, OfferGiven, OfferWithdrawn},
+	OfferReserved:  {OfferOpen, OfferGiven, OfferWithdrawn},
+	OfferGiven:     {},
+	OfferWithdrawn: {OfferOpen},
+}
+
+// activeOfferStatuses are the statuses listed unless closed offers are asked for.
+var activeOfferStatuses = []string{OfferOpen, OfferReserved}
+
+func canTransition(from string, to string) bool {
+	for _, status := range offerTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+type UpdateOfferInput struct {
+	Title       string `json:"title" binding:"required"`
+	Description string `json:"description" binding:"required"`
+}
+
+type OfferStatusInput struct {
+	Status string `json:"status" binding:"required"`
+}
+
+func UpdateOffer(posts *PostService, apiURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		var input UpdateOfferInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		offer, err := posts.UpdateOffer(c.Request.Context(), currentUser(c).ID, id, input)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		signPhotos(apiURL, offer.Photos)
+		c.JSON(200, offer)
+	}
+}
+
+func SetOfferStatus(posts *PostService, apiURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		var input OfferStatusInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		offer, err := posts.SetOfferStatus(c.Request.Context(), currentUser(c).ID, id, input.Status)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		signPhotos(apiURL, offer.Photos)
+		c.JSON(200, offer)
+	}
+}
+
+// DeleteOffer deletes the offer together with its photos.
+func DeleteOffer(posts *PostService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		err := posts.DeleteOffer(c.Request.Context(), currentUser(c).ID, id)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"deleted": id})
+	}
+}
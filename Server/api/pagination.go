@@ -0,0 +1,205 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// Page is the envelope every paginated listing is returned in. NextCursor is
+// empty on the last page.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor"`
+}
+
+type OfferListItem struct {
+	Offer
+	CommunityName string `json:"community_name"`
+}
+
+type RequestListItem struct {
+	Request
+	CommunityName string `json:"community_name"`
+}
+
+// ListQuery holds the paging, sorting and filtering parameters of a listing
+// request.
+type ListQuery struct {
+	Limit       int
+	Cursor      *listCursor
+	Oldest      bool
+	Keyword     string
+	CommunityID uint
+	HasPhoto    bool
+	From        time.Time
+	To          time.Time
+	// Closed also lists the offers that were given away or withdrawn
+	Closed bool
+}
+
+// listCursor points at the last item of the previous page.
+type listCursor struct {
+	CreatedAt time.Time
+	ID        uint
+}
+
+func (cur listCursor) encode() string {
+	raw := cur.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + strconv.FormatUint(uint64(cur.ID), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(s string) (*listCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	createdAt, id, found := strings.Cut(string(raw), "|")
+	if !found {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &listCursor{CreatedAt: t, ID: uint(n)}, nil
+}
+
+// parseDate accepts either a full RFC 3339 timestamp or a plain date.
+func parseDate(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// parseListQuery reads limit, cursor, sort (newest or oldest), q, community,
+// has_photo, from, to and closed from the query string.
+func parseListQuery(c *gin.Context) (ListQuery, error) {
+	query := ListQuery{Limit: defaultPageLimit}
+	var err error
+	if limit := c.Query("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 {
+			return query, fmt.Errorf("limit must be a positive number")
+		}
+		if query.Limit > maxPageLimit {
+			query.Limit = maxPageLimit
+		}
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		query.Cursor, err = decodeCursor(cursor)
+		if err != nil {
+			return query, err
+		}
+	}
+	switch c.DefaultQuery("sort", "newest") {
+	case "newest":
+	case "oldest":
+		query.Oldest = true
+	default:
+		return query, fmt.Errorf("sort must be newest or oldest")
+	}
+	query.Keyword = strings.TrimSpace(c.Query("q"))
+	if community := c.Query("community"); community != "" {
+		id, err := strconv.Atoi(community)
+		if err != nil {
+			return query, fmt.Errorf("community must be a number")
+		}
+		query.CommunityID = uint(id)
+	}
+	query.HasPhoto = c.Query("has_photo") == "true"
+	query.Closed = c.Query("closed") == "true"
+	if from := c.Query("from"); from != "" {
+		query.From, err = parseDate(from)
+		if err != nil {
+			return query, fmt.Errorf("from must be a date")
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		query.To, err = parseDate(to)
+		if err != nil {
+			return query, fmt.Errorf("to must be a date")
+		}
+		if len(to) == len("2006-01-02") {
+			query.To = query.To.Add(24 * time.Hour)
+		}
+	}
+	return query, nil
+}
+
+// escapeLike escapes the LIKE wildcards in a user supplied keyword, for use
+// with ESCAPE '!' which every supported database understands.
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+// listCommunities narrows the communities of a listing to the one the query
+// asks for, which the user has to belong to.
+func listCommunities(communityIDs []uint, query ListQuery) ([]uint, error) {
+	if query.CommunityID == 0 {
+		return communityIDs, nil
+	}
+	for _, id := range communityIDs {
+		if id == query.CommunityID {
+			return []uint{query.CommunityID}, nil
+		}
+	}
+	return nil, errNotMember
+}
+
+// filterPosts applies the keyword, photo, date and cursor filters and the
+// order of the query to a listing of the offers or requests table, asking for
+// one row more than the page holds to know whether there is a next page.
+func filterPosts(tx *gorm.DB, table string, kind string, query ListQuery) *gorm.DB {
+	if query.Keyword != "" {
+		// LOWER on both sides, LIKE is case sensitive on postgres
+		like := "%" + escapeLike(strings.ToLower(query.Keyword)) + "%"
+		tx = tx.Where("(LOWER(title) LIKE ? ESCAPE '!' OR LOWER(description) LIKE ? ESCAPE '!')", like, like)
+	}
+	if query.HasPhoto {
+		tx = tx.Where("EXISTS (SELECT 1 FROM photos WHERE photos." + photoColumn(kind) + " = " + table +
+			".id AND photos.deleted_at IS NULL)")
+	}
+	if !query.From.IsZero() {
+		tx = tx.Where("created_at >= ?", query.From)
+	}
+	if !query.To.IsZero() {
+		tx = tx.Where("created_at < ?", query.To)
+	}
+	order := "created_at DESC, id DESC"
+	if query.Oldest {
+		order = "created_at ASC, id ASC"
+	}
+	if query.Cursor != nil {
+		op := "<"
+		if query.Oldest {
+			op = ">"
+		}
+		tx = tx.Where("(created_at "+op+" ? OR (created_at = ? AND id "+op+" ?))",
+			query.Cursor.CreatedAt, query.Cursor.CreatedAt, query.Cursor.ID)
+	}
+	return tx.Preload("Photos", orderedPhotos).Order(order).Limit(query.Limit + 1)
+}
+
+// userCommunityIDs returns the ids of the communities the user is a member of.
+func userCommunityIDs(db *gorm.DB, userID string) ([]uint, error) {
+	var ids []uint
+	result := db.Table("user_communities").Where("user_id = ?", userID).Pluck("community_id", &ids)
+	return ids, result.Error
+}
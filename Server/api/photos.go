@@ -0,0 +1,199 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxPostPhotos is how many photos an offer or request can show.
+const maxPostPhotos = 10
+
+// AddPhotosInput attaches uploaded images to a post. ImageIDs is a comma
+// separated list of the ids returned by POST /image.
+type AddPhotosInput struct {
+	ImageIDs string `json:"image_ids" binding:"required"`
+	Caption  string `json:"caption"`
+}
+
+type CaptionPhotoInput struct {
+	Caption string `json:"caption"`
+}
+
+// ReorderPhotosInput lists every photo of a post, comma separated, in the
+// order they should be shown.
+type ReorderPhotosInput struct {
+	PhotoIDs string `json:"photo_ids" binding:"required"`
+}
+
+// orderedPhotos sorts preloaded photos the way the owner arranged them.
+func orderedPhotos(db *gorm.DB) *gorm.DB {
+	return db.Order("position, id")
+}
+
+// parseIDList parses a comma separated list of ids, skipping blanks.
+func parseIDList(s string) ([]uint, error) {
+	var ids []uint
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := parseUint(field)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an id", field)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// postImageIDs collects the images a new post is created with, from the
+// single image_id the old clients send and the image_ids list. Anything
+// that does not parse is ignored, as posts without images are fine.
+func postImageIDs(imageID string, imageIDs string) []uint {
+	ids, _ := parseIDList(imageIDs)
+	if id, err := parseUint(strings.TrimSpace(imageID)); err == nil {
+		ids = append([]uint{id}, ids...)
+	}
+	return ids
+}
+
+// photoColumn is the column that ties a photo to a post of the given kind.
+func photoColumn(kind string) string {
+	if kind == SearchRequest {
+		return "request_id"
+	}
+	return "offer_id"
+}
+
+// photoFiles lists the stored files of the photos' renditions.
+func photoFiles(photos []Photo) []string {
+	var files []string
+	for _, photo := range photos {
+		files = append(files, photo.Path, photo.MediumPath, photo.ThumbPath)
+	}
+	return files
+}
+
+// photoIDs lists the ids of the photos.
+func photoIDs(photos []Photo) []uint {
+	ids := make([]uint, 0, len(photos))
+	for _, photo := range photos {
+		ids = append(ids, photo.ID)
+	}
+	return ids
+}
+
+// postID is the id of the post of the given kind the photo is on, nil if it
+// is not on one.
+func (p Photo) postID(kind string) *uint {
+	if kind == SearchRequest {
+		return p.RequestID
+	}
+	return p.OfferID
+}
+
+// postPhotos answers with the gallery of a post, or with the error that
+// came instead.
+func postPhotos(c *gin.Context, apiURL string, photos []Photo, err error) {
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	signPhotos(apiURL, photos)
+	c.JSON(200, photos)
+}
+
+// AddPostPhotos adds uploaded images to the end of an offer's or request's
+// gallery.
+func AddPostPhotos(posts *PostService, apiURL string, kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		postID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		var input AddPhotosInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		imageIDs, err := parseIDList(input.ImageIDs)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		photos, err := posts.AddPhotos(c.Request.Context(), currentUser(c).ID, kind, postID, imageIDs, input.Caption)
+		postPhotos(c, apiURL, photos, err)
+	}
+}
+
+func CaptionPostPhoto(posts *PostService, apiURL string, kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		postID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		photoID, ok := paramID(c, "photoID")
+		if !ok {
+			return
+		}
+		var input CaptionPhotoInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		photo, err := posts.CaptionPhoto(c.Request.Context(), currentUser(c).ID, kind, postID, photoID, input.Caption)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		signPhotos(apiURL, []Photo{photo})
+		c.JSON(200, photo)
+	}
+}
+
+// RemovePostPhoto takes a photo off the post and deletes its files, unless
+// another photo uses the same picture.
+func RemovePostPhoto(posts *PostService, apiURL string, kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		postID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		photoID, ok := paramID(c, "photoID")
+		if !ok {
+			return
+		}
+		photos, err := posts.RemovePhoto(c.Request.Context(), currentUser(c).ID, kind, postID, photoID)
+		postPhotos(c, apiURL, photos, err)
+	}
+}
+
+// ReorderPostPhotos arranges the gallery in the given order. The list has to
+// name every photo of the post exactly once.
+func ReorderPostPhotos(posts *PostService, apiURL string, kind string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		postID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		var input ReorderPhotosInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		order, err := parseIDList(input.PhotoIDs)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		photos, err := posts.ReorderPhotos(c.Request.Context(), currentUser(c).ID, kind, postID, order)
+		postPhotos(c, apiURL, photos, err)
+	}
+}
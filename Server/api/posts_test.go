@@ -0,0 +1,364 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func offerPath(offer Offer, action string) string {
+	return strings.TrimSuffix(fmt.Sprintf("/offer/%v/%v", offer.ID, action), "/")
+}
+
+// offerTitles lists the titles on a page of offers.
+func offerTitles(t *testing.T, page Page[OfferListItem]) []string {
+	t.Helper()
+	titles := []string{}
+	for _, offer := range page.Items {
+		titles = append(titles, offer.Title)
+	}
+	return titles
+}
+
+func TestCreateOffer(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	outsider := s.newUser("outsider")
+	community := s.newCommunity(ada, "garden", VisibilityPublic)
+	s.join(bob, community)
+	imageID := s.upload(ada)
+
+	offer := s.newOffer(ada, community, "bike", imageID)
+	if offer.Status != OfferOpen || offer.CommunityID != community.ID {
+		t.Fatalf("unexpected offer %+v", offer)
+	}
+	rec := s.call("GET", offerPath(offer, ""), bob.Token, nil)
+	wantStatus(t, rec, 200)
+	got := decode[Offer](t, rec)
+	if got.Title != "bike" || len(got.Photos) != 1 || got.Photos[0].URL == "" || got.Photos[0].ThumbURL == "" {
+		t.Fatalf("unexpected offer %+v", got)
+	}
+	wantStatus(t, s.fetch(got.Photos[0].URL), 200)
+
+	wantError(t, s.call("GET", offerPath(offer, ""), outsider.Token, nil), 403, "does not belong")
+	wantStatus(t, s.call("GET", "/offer/999", bob.Token, nil), 404)
+	wantError(t, s.call("GET", "/offer/bike", bob.Token, nil), 400, "not a number")
+
+	tests := []struct {
+		name   string
+		user   testUser
+		input  gin.H
+		status int
+		error  string
+	}{
+		{"not a member", outsider, gin.H{"title": "lamp", "description": "a lamp", "community_id": fmt.Sprint(community.ID)}, 403, "does not belong"},
+		{"no community", ada, gin.H{"title": "lamp", "description": "a lamp", "community_id": "garden"}, 400, "community id"},
+		{"no title", ada, gin.H{"description": "a lamp", "community_id": fmt.Sprint(community.ID)}, 400, "Title"},
+		{"image in use", ada, gin.H{"title": "lamp", "description": "a lamp", "community_id": fmt.Sprint(community.ID), "image_id": imageID}, 400, "not an unused image"},
+		{"image of another user", bob, gin.H{"title": "lamp", "description": "a lamp", "community_id": fmt.Sprint(community.ID), "image_ids": s.upload(ada)}, 400, "not an unused image"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wantError(t, s.call("POST", "/offers", test.user.Token, test.input), test.status, test.error)
+		})
+	}
+	// a failed offer leaves nothing behind
+	var count int64
+	s.db.Model(&Offer{}).Where("title = ?", "lamp").Count(&count)
+	if count != 0 {
+		t.Fatalf("%v offers were stored for failed requests", count)
+	}
+}
+
+func TestListOffers(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	outsider := s.newUser("outsider")
+	garden := s.newCommunity(ada, "garden", VisibilityPublic)
+	kitchen := s.newCommunity(bob, "kitchen", VisibilityPublic)
+	s.join(bob, garden)
+	s.newOffer(ada, garden, "red bike", s.upload(ada))
+	s.newOffer(bob, garden, "blue bike")
+	s.newOffer(ada, garden, "lamp")
+	given := s.newOffer(bob, garden, "sofa")
+	s.newOffer(bob, kitchen, "kettle")
+	wantStatus(t, s.call("POST", offerPath(given, "status"), bob.Token, gin.H{"status": OfferGiven}), 200)
+
+	list := func(path string, user testUser) []string {
+		t.Helper()
+		rec := s.call("GET", path, user.Token, nil)
+		wantStatus(t, rec, 200)
+		return offerTitles(t, decode[Page[OfferListItem]](t, rec))
+	}
+	gardenOffers := fmt.Sprintf("/offers/%v", garden.ID)
+	tests := []struct {
+		path string
+		user testUser
+		want []string
+	}{
+		{gardenOffers, ada, []string{"lamp", "blue bike", "red bike"}},
+		{gardenOffers + "?sort=oldest", ada, []string{"red bike", "blue bike", "lamp"}},
+		{gardenOffers + "?q=BIKE", ada, []string{"blue bike", "red bike"}},
+		{gardenOffers + "?has_photo=true", ada, []string{"red bike"}},
+		{gardenOffers + "?closed=true", ada, []string{"sofa", "lamp", "blue bike", "red bike"}},
+		{"/myOffers", ada, []string{"lamp", "blue bike", "red bike"}},
+		{"/myOffers", bob, []string{"kettle", "lamp", "blue bike", "red bike"}},
+		{fmt.Sprintf("/myOffers?community=%v", kitchen.ID), bob, []string{"kettle"}},
+		{"/myOffers", outsider, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			if got := list(test.path, test.user); fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Fatalf("listed %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// paging through one at a time gives every offer once
+	var titles []string
+	for cursor := ""; ; {
+		rec := s.call("GET", "/myOffers?limit=1&cursor="+cursor, bob.Token, nil)
+		wantStatus(t, rec, 200)
+		page := decode[Page[OfferListItem]](t, rec)
+		titles = append(titles, offerTitles(t, page)...)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if want := "[kettle lamp blue bike red bike]"; fmt.Sprint(titles) != want {
+		t.Fatalf("paged through %v, want %v", titles, want)
+	}
+
+	wantError(t, s.call("GET", gardenOffers, outsider.Token, nil), 403, "does not belong")
+	wantError(t, s.call("GET", fmt.Sprintf("/myOffers?community=%v", kitchen.ID), ada.Token, nil), 403, "does not belong")
+	wantError(t, s.call("GET", "/myOffers?cursor=nonsense", ada.Token, nil), 400, "invalid cursor")
+	wantError(t, s.call("GET", "/myOffers?sort=best", ada.Token, nil), 400, "sort")
+	wantError(t, s.call("GET", "/offers/garden", ada.Token, nil), 400, "not a number")
+}
+
+func TestEditOffer(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	community := s.newCommunity(ada, "garden", VisibilityPublic)
+	s.join(bob, community)
+	offer := s.newOffer(ada, community, "bike")
+
+	edit := gin.H{"title": "old bike", "description": "rusty"}
+	wantError(t, s.call("PUT", offerPath(offer, ""), bob.Token, edit), 403, "does not own")
+	wantStatus(t, s.call("PUT", offerPath(offer, ""), ada.Token, gin.H{"title": "old bike"}), 400)
+	rec := s.call("PUT", offerPath(offer, ""), ada.Token, edit)
+	wantStatus(t, rec, 200)
+	if got := decode[Offer](t, rec); got.Title != "old bike" || got.Description != "rusty" {
+		t.Fatalf("unexpected offer %+v", got)
+	}
+
+	transitions := []struct {
+		status string
+		code   int
+	}{
+		{"lost", 400},
+		{OfferOpen, 400},
+		{OfferReserved, 200},
+		{OfferOpen, 200},
+		{OfferWithdrawn, 200},
+		{OfferGiven, 400},
+		{OfferOpen, 200},
+		{OfferGiven, 200},
+		{OfferOpen, 400},
+	}
+	for _, transition := range transitions {
+		wantStatus(t, s.call("POST", offerPath(offer, "status"), ada.Token, gin.H{"status": transition.status}), transition.code)
+	}
+	wantError(t, s.call("POST", offerPath(offer, "status"), bob.Token, gin.H{"status": OfferOpen}), 403, "does not own")
+	wantError(t, s.call("PUT", offerPath(offer, ""), ada.Token, edit), 400, "already been given away")
+
+	wantError(t, s.call("DELETE", offerPath(offer, ""), bob.Token, nil), 403, "does not own")
+	wantStatus(t, s.call("DELETE", offerPath(offer, ""), ada.Token, nil), 200)
+	wantStatus(t, s.call("GET", offerPath(offer, ""), ada.Token, nil), 404)
+	wantStatus(t, s.call("DELETE", offerPath(offer, ""), ada.Token, nil), 404)
+}
+
+func TestRequests(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	outsider := s.newUser("outsider")
+	community := s.newCommunity(ada, "garden", VisibilityPublic)
+	s.join(bob, community)
+
+	request := s.newRequestPost(ada, community, "ladder")
+	s.newRequestPost(bob, community, "drill")
+	wantError(t, s.call("POST", "/requests", outsider.Token, gin.H{"title": "saw", "description": "a saw",
+		"community_id": fmt.Sprint(community.ID)}), 403, "does not belong")
+	wantStatus(t, s.call("POST", "/requests", ada.Token, gin.H{"title": "saw", "community_id": fmt.Sprint(community.ID)}), 400)
+
+	rec := s.call("GET", fmt.Sprintf("/request/%v", request.ID), bob.Token, nil)
+	wantStatus(t, rec, 200)
+	if got := decode[Request](t, rec); got.Title != "ladder" || got.UserID != ada.ID {
+		t.Fatalf("unexpected request %+v", got)
+	}
+	wantError(t, s.call("GET", fmt.Sprintf("/request/%v", request.ID), outsider.Token, nil), 403, "does not belong")
+
+	rec = s.call("GET", fmt.Sprintf("/requests/%v", community.ID), bob.Token, nil)
+	wantStatus(t, rec, 200)
+	if got := decode[Page[RequestListItem]](t, rec); len(got.Items) != 2 {
+		t.Fatalf("listed %v requests, want 2", len(got.Items))
+	}
+	wantError(t, s.call("GET", fmt.Sprintf("/requests/%v", community.ID), outsider.Token, nil), 403, "does not belong")
+
+	// the requests of all of bob's communities, newest first, a page at a time
+	other := s.newCommunity(bob, "workshop", VisibilityPublic)
+	s.newRequestPost(bob, other, "vice")
+	var titles []string
+	for cursor := ""; ; {
+		rec = s.call("GET", "/myRequests?limit=2&cursor="+cursor, bob.Token, nil)
+		wantStatus(t, rec, 200)
+		page := decode[Page[RequestListItem]](t, rec)
+		for _, item := range page.Items {
+			titles = append(titles, item.Title+"@"+item.CommunityName)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if fmt.Sprint(titles) != "[vice@workshop drill@garden ladder@garden]" {
+		t.Fatalf("bob's requests are %v", titles)
+	}
+	rec = s.call("GET", fmt.Sprintf("/myRequests?q=LADD&community=%v", community.ID), bob.Token, nil)
+	if got := decode[Page[RequestListItem]](t, rec); len(got.Items) != 1 || got.Items[0].Title != "ladder" {
+		t.Fatalf("unexpected filtered requests %+v", got.Items)
+	}
+	wantError(t, s.call("GET", fmt.Sprintf("/myRequests?community=%v", other.ID), ada.Token, nil), 403, "does not belong")
+
+	path := fmt.Sprintf("/request/%v", request.ID)
+	edit := gin.H{"title": "tall ladder", "description": "for the roof"}
+	wantError(t, s.call("PUT", path, bob.Token, edit), 403, "does not own")
+	rec = s.call("PUT", path, ada.Token, edit)
+	wantStatus(t, rec, 200)
+	if got := decode[Request](t, rec); got.Title != "tall ladder" {
+		t.Fatalf("unexpected request %+v", got)
+	}
+	wantError(t, s.call("DELETE", path, bob.Token, nil), 403, "does not own")
+	wantStatus(t, s.call("DELETE", path, ada.Token, nil), 200)
+	wantStatus(t, s.call("GET", path, ada.Token, nil), 404)
+}
+
+func TestPostPhotos(t *testing.T) {
+	for _, kind := range []string{SearchOffer, SearchRequest} {
+		t.Run(kind, func(t *testing.T) {
+			s := newTestServer(t)
+			ada := s.newUser("ada")
+			bob := s.newUser("bob")
+			community := s.newCommunity(ada, "garden", VisibilityPublic)
+			s.join(bob, community)
+			var path string
+			if kind == SearchOffer {
+				path = offerPath(s.newOffer(ada, community, "bike"), "photos")
+			} else {
+				path = fmt.Sprintf("/request/%v/photos", s.newRequestPost(ada, community, "ladder").ID)
+			}
+			ids := func(photos []Photo) string {
+				var ids []string
+				for _, photo := range photos {
+					ids = append(ids, fmt.Sprint(photo.ID))
+				}
+				return strings.Join(ids, ",")
+			}
+
+			first, second, third := s.upload(ada), s.upload(ada), s.upload(ada)
+			rec := s.call("POST", path, ada.Token, gin.H{"image_ids": first + "," + second, "caption": "front"})
+			wantStatus(t, rec, 200)
+			photos := decode[[]Photo](t, rec)
+			if ids(photos) != first+","+second || photos[0].Caption != "front" || photos[1].URL == "" {
+				t.Fatalf("unexpected photos %+v", photos)
+			}
+			rec = s.call("POST", path, ada.Token, gin.H{"image_ids": third})
+			wantStatus(t, rec, 200)
+			if got := ids(decode[[]Photo](t, rec)); got != first+","+second+","+third {
+				t.Fatalf("photos are %v, the new one should come last", got)
+			}
+
+			wantError(t, s.call("POST", path, bob.Token, gin.H{"image_ids": s.upload(bob)}), 403, "does not own")
+			wantError(t, s.call("POST", path, ada.Token, gin.H{"image_ids": first}), 400, "not an unused image")
+			wantError(t, s.call("POST", path, ada.Token, gin.H{"image_ids": s.upload(bob)}), 400, "not an unused image")
+			wantError(t, s.call("POST", path, ada.Token, gin.H{"image_ids": "one"}), 400, "not an id")
+			var many []string
+			for i := 0; i < maxPostPhotos-2; i++ {
+				many = append(many, s.upload(ada))
+			}
+			wantError(t, s.call("POST", path, ada.Token, gin.H{"image_ids": strings.Join(many, ",")}), 400, "at most")
+
+			wantError(t, s.call("POST", path+"/order", ada.Token, gin.H{"photo_ids": third + "," + first}), 400, "every photo")
+			wantError(t, s.call("POST", path+"/order", ada.Token, gin.H{"photo_ids": third + "," + first + "," + first}), 400, "listed twice")
+			wantError(t, s.call("POST", path+"/order", ada.Token, gin.H{"photo_ids": third + "," + first + "," + many[0]}), 400, "not a photo of this")
+			wantError(t, s.call("POST", path+"/order", bob.Token, gin.H{"photo_ids": third + "," + first + "," + second}), 403, "does not own")
+			rec = s.call("POST", path+"/order", ada.Token, gin.H{"photo_ids": third + "," + first + "," + second})
+			wantStatus(t, rec, 200)
+			if got := ids(decode[[]Photo](t, rec)); got != third+","+first+","+second {
+				t.Fatalf("photos are %v after reordering", got)
+			}
+
+			rec = s.call("PUT", path+"/"+second, ada.Token, gin.H{"caption": "back"})
+			wantStatus(t, rec, 200)
+			if got := decode[Photo](t, rec); got.Caption != "back" {
+				t.Fatalf("caption is %q", got.Caption)
+			}
+			wantError(t, s.call("PUT", path+"/"+many[0], ada.Token, gin.H{"caption": "back"}), 404, "photo not found")
+			wantError(t, s.call("PUT", path+"/"+second, bob.Token, gin.H{"caption": "mine"}), 403, "does not own")
+
+			wantError(t, s.call("DELETE", path+"/"+first, bob.Token, nil), 403, "does not own")
+			rec = s.call("DELETE", path+"/"+first, ada.Token, nil)
+			wantStatus(t, rec, 200)
+			if got := ids(decode[[]Photo](t, rec)); got != third+","+second {
+				t.Fatalf("photos are %v after removing %v", got, first)
+			}
+			wantError(t, s.call("DELETE", path+"/"+first, ada.Token, nil), 404, "photo not found")
+		})
+	}
+}
+
+func TestPostResponders(t *testing.T) {
+	s := newTestServer(t)
+	ada := s.newUser("ada")
+	bob := s.newUser("bob")
+	cat := s.newUser("cat")
+	community := s.newCommunity(ada, "garden", VisibilityPublic)
+	s.join(bob, community)
+	s.join(cat, community)
+	offer := s.newOffer(ada, community, "bike")
+	request := s.newRequestPost(ada, community, "ladder")
+
+	s.sendMessage(cat, ada, "is the bike still there?", offer)
+	s.sendMessage(bob, ada, "I would like the bike", offer)
+	s.sendMessage(ada, cat, "it is", offer)
+	s.sendMessage(cat, ada, "great", offer)
+	wantStatus(t, s.call("POST", "/messages", bob.Token, gin.H{"text": "I have a ladder", "receiver_id": fmt.Sprint(ada.ID),
+		"request_id": fmt.Sprint(request.ID)}), 200)
+
+	responders := func(path string) []string {
+		t.Helper()
+		rec := s.call("GET", path, ada.Token, nil)
+		wantStatus(t, rec, 200)
+		var names []string
+		for _, profile := range decode[[]PublicProfile](t, rec) {
+			names = append(names, profile.UserName)
+		}
+		return names
+	}
+	if got := responders(fmt.Sprintf("/offerResp/%v", offer.ID)); fmt.Sprint(got) != "[cat bob]" {
+		t.Fatalf("offer responders are %v", got)
+	}
+	if got := responders(fmt.Sprintf("/requestResp/%v", request.ID)); fmt.Sprint(got) != "[bob]" {
+		t.Fatalf("request responders are %v", got)
+	}
+	wantError(t, s.call("GET", fmt.Sprintf("/offerResp/%v", offer.ID), bob.Token, nil), 403, "does not own")
+	wantError(t, s.call("GET", fmt.Sprintf("/requestResp/%v", request.ID), cat.Token, nil), 403, "does not own")
+	wantStatus(t, s.call("GET", "/offerResp/999", ada.Token, nil), 404)
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxDisplayName = 64
+	maxBio         = 1000
+	maxHomeCity    = 100
+)
+
+type ProfileInput struct {
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	HomeCity    string `json:"home_city"`
+}
+
+// AvatarInput sets the avatar to an image from POST /image, or removes it
+// when ImageID is empty.
+type AvatarInput struct {
+	ImageID string `json:"image_id"`
+}
+
+// PublicProfile is what other users get to see of a user. It is built field
+// by field so that credentials and the email address never leave the server.
+type PublicProfile struct {
+	ID             uint      `json:"id"`
+	UserName       string    `json:"username"`
+	DisplayName    string    `json:"display_name"`
+	Bio            string    `json:"bio"`
+	HomeCity       string    `json:"home_city"`
+	AvatarURL      string    `json:"avatar_url"`
+	AvatarThumbURL string    `json:"avatar_thumb_url"`
+	MemberSince    time.Time `json:"member_since"`
+}
+
+// OwnProfile adds what only the user themselves may see.
+type OwnProfile struct {
+	PublicProfile
+	Email           string     `json:"email"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+}
+
+// ownProfile adds the user's private details to their profile.
+func ownProfile(profile PublicProfile, user User) OwnProfile {
+	return OwnProfile{PublicProfile: profile, Email: user.Email, EmailVerifiedAt: user.EmailVerifiedAt}
+}
+
+// UserActivity lists the open offers and requests of a user in the
+// communities the viewer shares with them.
+type UserActivity struct {
+	Offers   []Offer   `json:"offers"`
+	Requests []Request `json:"requests"`
+}
+
+// basicProfile is the public profile of the user without the avatar.
+func basicProfile(user User) PublicProfile {
+	return PublicProfile{
+		ID:          user.ID,
+		UserName:    user.UserName,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		HomeCity:    user.HomeCity,
+		MemberSince: user.CreatedAt,
+	}
+}
+
+// publicProfile builds the profile of the user as the viewer sees it. The
+// avatar links are only filled in if the viewer may see the avatar.
+func publicProfile(ctx context.Context, photos *PhotoService, apiURL string, viewerID uint, user User) (PublicProfile, error) {
+	profile := basicProfile(user)
+	if user.AvatarID == nil {
+		return profile, nil
+	}
+	avatar, err := photos.Visible(ctx, viewerID, *user.AvatarID)
+	if errors.Is(err, errNoImage) {
+		return profile, nil
+	}
+	if err != nil {
+		return profile, err
+	}
+	now := time.Now()
+	profile.AvatarURL = signImageURL(apiURL, avatar.ID, SizeMedium, now)
+	profile.AvatarThumbURL = signImageURL(apiURL, avatar.ID, SizeThumb, now)
+	return profile, nil
+}
+
+// checkProfileInput trims the profile fields and checks their lengths.
+func checkProfileInput(input *ProfileInput) error {
+	input.DisplayName = strings.TrimSpace(input.DisplayName)
+	input.Bio = strings.TrimSpace(input.Bio)
+	input.HomeCity = strings.TrimSpace(input.HomeCity)
+	switch {
+	case utf8.RuneCountInString(input.DisplayName) > maxDisplayName:
+		return fmt.Errorf("display name must be at most %v characters", maxDisplayName)
+	case utf8.RuneCountInString(input.Bio) > maxBio:
+		return fmt.Errorf("bio must be at most %v characters", maxBio)
+	case utf8.RuneCountInString(input.HomeCity) > maxHomeCity:
+		return fmt.Errorf("home city must be at most %v characters", maxHomeCity)
+	}
+	return nil
+}
+
+func GetUserById(users *UserService, photos *PhotoService, apiURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		user, err := users.Profile(c.Request.Context(), id)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		profile, err := publicProfile(c.Request.Context(), photos, apiURL, currentUser(c).ID, user)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, profile)
+	}
+}
+
+// GetUserActivity lists what a user has on offer and is asking for, limited
+// to the communities the viewer shares with them.
+func GetUserActivity(users *UserService, apiURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		activity, err := users.Activity(c.Request.Context(), currentUser(c).ID, id)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		for i := range activity.Offers {
+			signPhotos(apiURL, activity.Offers[i].Photos)
+		}
+		for i := range activity.Requests {
+			signPhotos(apiURL, activity.Requests[i].Photos)
+		}
+		c.JSON(200, activity)
+	}
+}
+
+// GetOwnProfile is the profile of the current user, with their email.
+func GetOwnProfile(photos *PhotoService, apiURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := currentUser(c)
+		profile, err := publicProfile(c.Request.Context(), photos, apiURL, user.ID, user)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, ownProfile(profile, user))
+	}
+}
+
+func UpdateProfile(users *UserService, photos *PhotoService, apiURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input ProfileInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		user, err := users.UpdateProfile(c.Request.Context(), currentUser(c), input)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		profile, err := publicProfile(c.Request.Context(), photos, apiURL, user.ID, user)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, ownProfile(profile, user))
+	}
+}
+
+// SetAvatar makes one of the user's uploads their avatar.
+func SetAvatar(users *UserService, photos *PhotoService, apiURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input AvatarInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		user, err := users.SetAvatar(c.Request.Context(), currentUser(c), input)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		profile, err := publicProfile(c.Request.Context(), photos, apiURL, user.ID, user)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, ownProfile(profile, user))
+	}
+}
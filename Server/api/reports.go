@@ -0,0 +1,386 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	ReportOffer   = SearchOffer
+	ReportRequest = SearchRequest
+	ReportMessage = "message"
+	ReportUser    = "user"
+)
+
+const (
+	ReportOpen      = "open"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+)
+
+const (
+	ActionResolveReport = "resolve_report"
+	ActionDismissReport = "dismiss_report"
+)
+
+// Report flags an offer, request, message or user. Reports about content
+// posted in a community go to its moderators; reports about users, and about
+// messages not tied to a post, only to site admins, who see every report.
+type Report struct {
+	gorm.Model
+	ReporterID   uint       `gorm:"index" json:"reporter_id"`
+	Kind         string     `gorm:"size:16" json:"kind"`
+	TargetID     uint       `json:"target_id"`
+	TargetUserID uint       `gorm:"index" json:"target_user_id"`
+	CommunityID  *uint      `gorm:"index" json:"community_id"`
+	Reason       string     `json:"reason"`
+	Status       string     `gorm:"size:16;default:open;index" json:"status"`
+	ResolvedByID *uint      `json:"resolved_by_id"`
+	ResolvedAt   *time.Time `json:"resolved_at"`
+	Resolution   string     `json:"resolution"`
+}
+
+type ReportInput struct {
+	Kind   string `json:"kind" binding:"required"`
+	ID     string `json:"id" binding:"required"`
+	Reason string `json:"reason" binding:"required"`
+}
+
+// ResolveReportInput closes a report as resolved or dismissed. RemovePost
+// set to "true" also removes the reported offer or request.
+type ResolveReportInput struct {
+	Status     string `json:"status" binding:"required"`
+	Note       string `json:"note"`
+	RemovePost string `json:"remove_post"`
+}
+
+type ReportInfo struct {
+	Report
+	ReporterName   string `json:"reporter_name"`
+	TargetUserName string `json:"target_user_name"`
+	Text           string `json:"text"`
+}
+
+// postCommunityID returns the community of the offer or request a message
+// was sent about, nil for messages about neither. Removed posts count.
+func postCommunityID(db *gorm.DB, message Message) (*uint, error) {
+	if message.RequestID != nil {
+		var request Request
+		result := db.Unscoped().Select("id", "community_id").First(&request, *message.RequestID)
+		return &request.CommunityID, result.Error
+	}
+	if message.OfferID != nil {
+		var offer Offer
+		result := db.Unscoped().Select("id", "community_id").First(&offer, *message.OfferID)
+		return &offer.CommunityID, result.Error
+	}
+	return nil, nil
+}
+
+// reportFor builds the report of the reporter about the target, checking that
+// the reporter can see what they report.
+func reportFor(db *gorm.DB, reporterID uint, kind string, targetID uint) (Report, error) {
+	report := Report{ReporterID: reporterID, Kind: kind, TargetID: targetID, Status: ReportOpen}
+	switch kind {
+	case ReportOffer:
+		var offer Offer
+		result := db.First(&offer, targetID)
+		if result.Error != nil {
+			return report, result.Error
+		}
+		report.TargetUserID, report.CommunityID = offer.UserID, &offer.CommunityID
+	case ReportRequest:
+		var request Request
+		result := db.First(&request, targetID)
+		if result.Error != nil {
+			return report, result.Error
+		}
+		report.TargetUserID, report.CommunityID = request.UserID, &request.CommunityID
+	case ReportMessage:
+		var message Message
+		result := db.First(&message, targetID)
+		if result.Error != nil {
+			return report, result.Error
+		}
+		if message.ReceiverID != reporterID {
+			return report, errors.New("can only report messages sent to you")
+		}
+		communityID, err := postCommunityID(db, message)
+		if err != nil {
+			return report, err
+		}
+		report.TargetUserID, report.CommunityID = message.SenderID, communityID
+		return report, nil
+	case ReportUser:
+		var user User
+		result := db.Select("id").First(&user, targetID)
+		if result.Error != nil {
+			return report, result.Error
+		}
+		report.TargetUserID = user.ID
+		return report, nil
+	default:
+		return report, errors.New("kind must be offer, request, message or user")
+	}
+	_, err := findMembership(db, reporterID, *report.CommunityID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return report, errors.New("user does not belong to community")
+	}
+	return report, err
+}
+
+// reportActor returns the membership the current user acts on the report
+// with, otherwise it writes the error response. Site admins act as owners.
+func reportActor(c *gin.Context, db *gorm.DB, report Report) (Membership, bool) {
+	user := currentUser(c)
+	if user.IsAdmin {
+		actor := Membership{UserID: user.ID, Role: RoleOwner}
+		if report.CommunityID != nil {
+			actor.CommunityID = *report.CommunityID
+		}
+		return actor, true
+	}
+	if report.CommunityID == nil {
+		c.JSON(403, gin.H{"error": "only site admins can handle this report"})
+		return Membership{}, false
+	}
+	actor, err := findMembership(db, user.ID, *report.CommunityID)
+	if err != nil || roleRank[actor.Role] < roleRank[RoleModerator] {
+		c.JSON(403, gin.H{"error": "user is not a moderator of the community"})
+		return actor, false
+	}
+	return actor, true
+}
+
+func CreateReport(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input ReportInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		targetID, err := parseUint(input.ID)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "id must be a number"})
+			return
+		}
+		userID := currentUser(c).ID
+		report, err := reportFor(db, userID, input.Kind, targetID)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if report.TargetUserID == userID {
+			c.JSON(400, gin.H{"error": "can not report yourself"})
+			return
+		}
+		// reporting the same thing twice keeps the first report
+		var existing Report
+		result := db.Where("reporter_id = ? AND kind = ? AND target_id = ? AND status = ?",
+			userID, report.Kind, report.TargetID, ReportOpen).First(&existing)
+		if result.Error == nil {
+			c.JSON(200, existing)
+			return
+		}
+		if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			c.JSON(400, gin.H{"error": result.Error.Error()})
+			return
+		}
+		report.Reason = input.Reason
+		result = db.Create(&report)
+		if result.Error != nil {
+			c.JSON(400, gin.H{"error": result.Error.Error()})
+			return
+		}
+		c.JSON(200, report)
+	}
+}
+
+// GetReports is the report queue: every report for site admins, and the
+// reports of the communities they moderate for everyone else. The status
+// query parameter picks open, resolved or dismissed reports, open by default.
+func GetReports(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := currentUser(c)
+		status := c.DefaultQuery("status", ReportOpen)
+		query := db.Model(&Report{}).
+			Select("reports.*, reporters.user_name AS reporter_name, targets.user_name AS target_user_name").
+			Joins("JOIN users reporters ON reporters.id = reports.reporter_id").
+			Joins("JOIN users targets ON targets.id = reports.target_user_id").
+			Where("reports.status = ?", status)
+		if !user.IsAdmin {
+			query = query.Where("reports.community_id IN (?)", db.Model(&Membership{}).Select("community_id").
+				Where("user_id = ? AND role IN ?", user.ID, []string{RoleModerator, RoleOwner}))
+		}
+		reports := []ReportInfo{}
+		result := query.Order("reports.created_at").Scan(&reports)
+		if result.Error != nil {
+			c.JSON(400, gin.H{"error": result.Error.Error()})
+			return
+		}
+		for i := range reports {
+			if reports[i].Kind != ReportMessage {
+				continue
+			}
+			var message Message
+			result = db.Unscoped().Select("id", "text").First(&message, reports[i].TargetID)
+			if result.Error == nil {
+				reports[i].Text = message.Text
+			}
+		}
+		c.JSON(200, reports)
+	}
+}
+
+func ResolveReport(db *gorm.DB, search SearchIndex) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		var report Report
+		result := db.First(&report, id)
+		if result.Error != nil {
+			c.JSON(404, gin.H{"error": "report not found"})
+			return
+		}
+		actor, ok := reportActor(c, db, report)
+		if !ok {
+			return
+		}
+		var input ResolveReportInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		action := ActionResolveReport
+		switch input.Status {
+		case ReportResolved:
+		case ReportDismissed:
+			action = ActionDismissReport
+		default:
+			c.JSON(400, gin.H{"error": "status must be resolved or dismissed"})
+			return
+		}
+		if report.Status != ReportOpen {
+			c.JSON(400, gin.H{"error": "report is already " + report.Status})
+			return
+		}
+		var post interface{}
+		var removal ModerationAction
+		if input.RemovePost == "true" {
+			if report.CommunityID == nil || (report.Kind != ReportOffer && report.Kind != ReportRequest) {
+				c.JSON(400, gin.H{"error": "only reported offers and requests can be removed"})
+				return
+			}
+			post, removal, err = findCommunityPost(db, *report.CommunityID, report.Kind, report.TargetID)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			removal.ActorID, removal.Reason = actor.UserID, input.Note
+			if !currentUser(c).IsAdmin {
+				err = checkCanRemovePost(db, *removal.TargetUserID, actor)
+				if errors.Is(err, errOutranked) {
+					c.JSON(403, gin.H{"error": err.Error()})
+					return
+				}
+				if err != nil {
+					c.JSON(400, gin.H{"error": err.Error()})
+					return
+				}
+			}
+		}
+		now := time.Now()
+		err = db.Transaction(func(tx *gorm.DB) error {
+			// only the first of two moderators handling the report at once wins
+			result := tx.Model(&Report{}).Where("id = ? AND status = ?", report.ID, ReportOpen).
+				Updates(map[string]interface{}{
+					"status":         input.Status,
+					"resolved_by_id": actor.UserID,
+					"resolved_at":    now,
+					"resolution":     input.Note,
+				})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errors.New("report was already handled")
+			}
+			if post != nil {
+				err := deletePost(tx, post, removal)
+				if err != nil {
+					return err
+				}
+			}
+			if report.CommunityID == nil {
+				return nil
+			}
+			return recordModeration(tx, ModerationAction{CommunityID: *report.CommunityID, ActorID: actor.UserID,
+				Action: action, TargetUserID: &report.TargetUserID, Reason: input.Note})
+		})
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if post != nil {
+			removeDocument(c.Request.Context(), search, report.Kind, report.TargetID)
+		}
+		c.JSON(200, gin.H{"report_id": report.ID, "status": input.Status})
+	}
+}
+
+// findCommunityPost loads an offer or request of the community together with
+// the moderation record for removing it.
+func findCommunityPost(db *gorm.DB, communityID uint, kind string, postID uint) (interface{}, ModerationAction, error) {
+	action := ModerationAction{CommunityID: communityID, Action: ActionRemovePost}
+	switch kind {
+	case SearchOffer:
+		var offer Offer
+		result := db.Where("community_id = ?", communityID).First(&offer, postID)
+		if result.Error != nil {
+			return nil, action, result.Error
+		}
+		action.OfferID, action.TargetUserID = &offer.ID, &offer.UserID
+		return &offer, action, nil
+	case SearchRequest:
+		var request Request
+		result := db.Where("community_id = ?", communityID).First(&request, postID)
+		if result.Error != nil {
+			return nil, action, result.Error
+		}
+		action.RequestID, action.TargetUserID = &request.ID, &request.UserID
+		return &request, action, nil
+	}
+	return nil, action, fmt.Errorf("kind must be offer or request")
+}
+
+// checkCanRemovePost makes sure the actor outranks the author of a post, if
+// the author is still a member.
+func checkCanRemovePost(db *gorm.DB, authorID uint, actor Membership) error {
+	author, err := findMembership(db, authorID, actor.CommunityID)
+	if err == nil && authorID != actor.UserID && roleRank[author.Role] >= roleRank[actor.Role] {
+		return errOutranked
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	return nil
+}
+
+// deletePost removes the post and logs the removal.
+func deletePost(db *gorm.DB, post interface{}, action ModerationAction) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Delete(post).Error
+		if err != nil {
+			return err
+		}
+		return recordModeration(tx, action)
+	})
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RequestInput struct {
+	Title       string `json:"title" binding:"required"`
+	Description string `json:"description" binding:"required"`
+	CommunityID string `json:"community_id" binding:"required"`
+	ImageID     string `json:"image_id"`
+	// ImageIDs is a comma separated list of further images, shown in order
+	ImageIDs string `json:"image_ids"`
+}
+
+type UpdateRequestInput struct {
+	Title       string `json:"title" binding:"required"`
+	Description string `json:"description" binding:"required"`
+}
+
+func CreateRequest(posts *PostService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input RequestInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"binding error": err.Error()})
+			return
+		}
+		request, err := posts.CreateRequest(c.Request.Context(), currentUser(c).ID, PostInput{Title: input.Title,
+			Description: input.Description, CommunityID: input.CommunityID,
+			ImageIDs: postImageIDs(input.ImageID, input.ImageIDs)})
+		if err != nil {
+			log.Println("Error creating request: ", err)
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, request)
+	}
+}
+
+func GetRequestsByCommunityId(posts *PostService, apiURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		communityID, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		listRequests(c, posts, apiURL, communityID)
+	}
+}
+
+func GetRequestsByUserId(posts *PostService, apiURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		listRequests(c, posts, apiURL, 0)
+	}
+}
+
+// listRequests answers with a page of the requests in the community, or in
+// all of the current user's communities for 0.
+func listRequests(c *gin.Context, posts *PostService, apiURL string, communityID uint) {
+	query, err := parseListQuery(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	page, err := posts.Requests(c.Request.Context(), currentUser(c).ID, communityID, query)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	for _, item := range page.Items {
+		signPhotos(apiURL, item.Photos)
+	}
+	c.JSON(200, page)
+}
+
+func GetRequestById(posts *PostService, apiURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		request, err := posts.Request(c.Request.Context(), currentUser(c).ID, id)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		signPhotos(apiURL, request.Photos)
+		c.JSON(200, request)
+	}
+}
+
+func UpdateRequest(posts *PostService, apiURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		var input UpdateRequestInput
+		err := c.BindJSON(&input)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		request, err := posts.UpdateRequest(c.Request.Context(), currentUser(c).ID, id, input)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		signPhotos(apiURL, request.Photos)
+		c.JSON(200, request)
+	}
+}
+
+// DeleteRequest deletes the request together with its photos.
+func DeleteRequest(posts *PostService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := paramID(c, "id")
+		if !ok {
+			return
+		}
+		err := posts.DeleteRequest(c.Request.Context(), currentUser(c).ID, id)
+		if err != nil {
+			c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"deleted": id})
+	}
+}
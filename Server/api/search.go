@@ -0,0 +1,406 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	SearchOffer     = "offer"
+	SearchRequest   = "request"
+	SearchCommunity = "community"
+)
+
+// SearchDocument is the searchable part of an offer, request or community.
+// For communities Title is the name, Body the city and CommunityID the
+// community's own id. Private communities are only found by their members.
+type SearchDocument struct {
+	Kind        string
+	ID          uint
+	CommunityID uint
+	UserID      uint
+	Title       string
+	Body        string
+	Private     bool
+	CreatedAt   time.Time
+}
+
+type SearchResult struct {
+	Kind        string    `json:"kind"`
+	ID          uint      `json:"id"`
+	CommunityID uint      `json:"community_id"`
+	Title       string    `json:"title"`
+	Snippet     string    `json:"snippet"`
+	Score       float64   `json:"score"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// SearchQuery restricts offers and requests to CommunityIDs, the
+// communities the searching user belongs to, and leaves out those posted by
+// ExcludeUserIDs, the users blocked by or blocking the searching user.
+type SearchQuery struct {
+	Text           string
+	CommunityIDs   []uint
+	ExcludeUserIDs []uint
+	Limit          int
+}
+
+// SearchIndex finds offers, requests and communities by text. Index and
+// Remove keep the index in step with the database for implementations that
+// don't read from it directly.
+type SearchIndex interface {
+	Index(ctx context.Context, doc SearchDocument) error
+	Remove(ctx context.Context, kind string, id uint) error
+	Search(ctx context.Context, query SearchQuery) ([]SearchResult, error)
+}
+
+// NewSearchIndex sets up the named index, "mysql" or "memory". The memory
+// index is filled from the database.
+func NewSearchIndex(db *gorm.DB, backend string) (SearchIndex, error) {
+	switch backend {
+	case "mysql":
+		return &MySQLSearchIndex{DB: db}, nil
+	case "memory":
+		index := NewMemorySearchIndex()
+		return index, Reindex(context.Background(), db, index)
+	}
+	return nil, fmt.Errorf("unknown search index %q", backend)
+}
+
+func offerDocument(offer Offer) SearchDocument {
+	return SearchDocument{Kind: SearchOffer, ID: offer.ID, CommunityID: offer.CommunityID, UserID: offer.UserID,
+		Title: offer.Title, Body: offer.Description, CreatedAt: offer.CreatedAt}
+}
+
+func requestDocument(request Request) SearchDocument {
+	return SearchDocument{Kind: SearchRequest, ID: request.ID, CommunityID: request.CommunityID, UserID: request.UserID,
+		Title: request.Title, Body: request.Description, CreatedAt: request.CreatedAt}
+}
+
+func communityDocument(community Community) SearchDocument {
+	return SearchDocument{Kind: SearchCommunity, ID: community.ID, CommunityID: community.ID,
+		Title: community.Name, Body: community.City, Private: community.Visibility == VisibilityInvite,
+		CreatedAt: community.CreatedAt}
+}
+
+// indexOffer adds an open or reserved offer to the index and removes a
+// closed one. Index errors are logged and not returned, the database write
+// they follow has already succeeded.
+func indexOffer(ctx context.Context, search SearchIndex, offer Offer) {
+	var err error
+	if offer.Status == OfferGiven || offer.Status == OfferWithdrawn {
+		err = search.Remove(ctx, SearchOffer, offer.ID)
+	} else {
+		err = search.Index(ctx, offerDocument(offer))
+	}
+	if err != nil {
+		log.Println("Error indexing offer: ", err)
+	}
+}
+
+func indexDocument(ctx context.Context, search SearchIndex, doc SearchDocument) {
+	err := search.Index(ctx, doc)
+	if err != nil {
+		log.Println("Error indexing "+doc.Kind+": ", err)
+	}
+}
+
+func removeDocument(ctx context.Context, search SearchIndex, kind string, id uint) {
+	err := search.Remove(ctx, kind, id)
+	if err != nil {
+		log.Println("Error removing "+kind+" from index: ", err)
+	}
+}
+
+// Reindex loads every open offer, request and community into the index.
+func Reindex(ctx context.Context, db *gorm.DB, index SearchIndex) error {
+	var offers []Offer
+	result := db.Where("status IN ?", activeOfferStatuses).Find(&offers)
+	if result.Error != nil {
+		return result.Error
+	}
+	for _, offer := range offers {
+		err := index.Index(ctx, offerDocument(offer))
+		if err != nil {
+			return err
+		}
+	}
+	var requests []Request
+	result = db.Find(&requests)
+	if result.Error != nil {
+		return result.Error
+	}
+	for _, request := range requests {
+		err := index.Index(ctx, requestDocument(request))
+		if err != nil {
+			return err
+		}
+	}
+	var communities []Community
+	result = db.Find(&communities)
+	if result.Error != nil {
+		return result.Error
+	}
+	for _, community := range communities {
+		err := index.Index(ctx, communityDocument(community))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snippet shortens text to at most n runes for display in search results.
+func snippet(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n]) + "..."
+}
+
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func sortResults(results []SearchResult, limit int) []SearchResult {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].CreatedAt.After(results[j].CreatedAt)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// MySQLSearchIndex searches the tables directly through the FULLTEXT indexes
+// of migration 3, so Index and Remove have nothing to do.
+type MySQLSearchIndex struct {
+	DB *gorm.DB
+}
+
+func (s *MySQLSearchIndex) Index(ctx context.Context, doc SearchDocument) error {
+	return nil
+}
+
+func (s *MySQLSearchIndex) Remove(ctx context.Context, kind string, id uint) error {
+	return nil
+}
+
+// booleanQuery turns free text into a MySQL boolean mode query that matches
+// any of the words, including as a prefix.
+func booleanQuery(text string) string {
+	terms := searchTerms(text)
+	for i, term := range terms {
+		terms[i] = term + "*"
+	}
+	return strings.Join(terms, " ")
+}
+
+type fullTextRow struct {
+	ID          uint
+	CommunityID uint
+	Title       string
+	Body        string
+	Score       float64
+	CreatedAt   time.Time
+}
+
+func (s *MySQLSearchIndex) Search(ctx context.Context, query SearchQuery) ([]SearchResult, error) {
+	against := booleanQuery(query.Text)
+	if against == "" {
+		return []SearchResult{}, nil
+	}
+	db := s.DB.WithContext(ctx)
+	var results []SearchResult
+	collect := func(kind string, rows []fullTextRow) {
+		for _, row := range rows {
+			results = append(results, SearchResult{Kind: kind, ID: row.ID, CommunityID: row.CommunityID,
+				Title: row.Title, Snippet: snippet(row.Body, 140), Score: row.Score, CreatedAt: row.CreatedAt})
+		}
+	}
+	if len(query.CommunityIDs) > 0 {
+		posts := db
+		if len(query.ExcludeUserIDs) > 0 {
+			posts = db.Where("user_id NOT IN ?", query.ExcludeUserIDs)
+		}
+		var offers []fullTextRow
+		result := posts.Session(&gorm.Session{}).Model(&Offer{}).
+			Select("id, community_id, title, description AS body, created_at, "+
+				"MATCH(title, description) AGAINST (? IN BOOLEAN MODE) AS score", against).
+			Where("MATCH(title, description) AGAINST (? IN BOOLEAN MODE)", against).
+			Where("community_id IN ? AND status IN ?", query.CommunityIDs, activeOfferStatuses).
+			Order("score DESC").Limit(query.Limit).Scan(&offers)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		collect(SearchOffer, offers)
+		var requests []fullTextRow
+		result = posts.Session(&gorm.Session{}).Model(&Request{}).
+			Select("id, community_id, title, description AS body, created_at, "+
+				"MATCH(title, description) AGAINST (? IN BOOLEAN MODE) AS score", against).
+			Where("MATCH(title, description) AGAINST (? IN BOOLEAN MODE)", against).
+			Where("community_id IN ?", query.CommunityIDs).
+			Order("score DESC").Limit(query.Limit).Scan(&requests)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		collect(SearchRequest, requests)
+	}
+	var communities []fullTextRow
+	result := db.Model(&Community{}).
+		Select("id, id AS community_id, name AS title, city AS body, created_at, "+
+			"MATCH(name, city) AGAINST (? IN BOOLEAN MODE) AS score", against).
+		Where("MATCH(name, city) AGAINST (? IN BOOLEAN MODE)", against).
+		Where("(visibility <> ? OR id IN ?)", VisibilityInvite, query.CommunityIDs).
+		Order("score DESC").Limit(query.Limit).Scan(&communities)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	collect(SearchCommunity, communities)
+	return sortResults(results, query.Limit), nil
+}
+
+// MemorySearchIndex is an in-process index for tests and single instance
+// deployments without MySQL.
+type MemorySearchIndex struct {
+	mu   sync.RWMutex
+	docs map[string]memoryDocument
+}
+
+type memoryDocument struct {
+	SearchDocument
+	titleTerms []string
+	bodyTerms  []string
+}
+
+func NewMemorySearchIndex() *MemorySearchIndex {
+	return &MemorySearchIndex{docs: map[string]memoryDocument{}}
+}
+
+func documentKey(kind string, id uint) string {
+	return kind + ":" + strconv.FormatUint(uint64(id), 10)
+}
+
+func (s *MemorySearchIndex) Index(ctx context.Context, doc SearchDocument) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs[documentKey(doc.Kind, doc.ID)] = memoryDocument{
+		SearchDocument: doc,
+		titleTerms:     searchTerms(doc.Title),
+		bodyTerms:      searchTerms(doc.Body),
+	}
+	return nil
+}
+
+func (s *MemorySearchIndex) Remove(ctx context.Context, kind string, id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.docs, documentKey(kind, id))
+	return nil
+}
+
+// termScore counts the terms that equal or start with term, exact matches
+// weighing twice as much as prefix matches.
+func termScore(terms []string, term string) float64 {
+	score := 0.0
+	for _, t := range terms {
+		if t == term {
+			score += 2
+		} else if strings.HasPrefix(t, term) {
+			score++
+		}
+	}
+	return score
+}
+
+func (s *MemorySearchIndex) Search(ctx context.Context, query SearchQuery) ([]SearchResult, error) {
+	terms := searchTerms(query.Text)
+	results := []SearchResult{}
+	if len(terms) == 0 {
+		return results, nil
+	}
+	allowed := make(map[uint]bool, len(query.CommunityIDs))
+	for _, id := range query.CommunityIDs {
+		allowed[id] = true
+	}
+	excluded := make(map[uint]bool, len(query.ExcludeUserIDs))
+	for _, id := range query.ExcludeUserIDs {
+		excluded[id] = true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, doc := range s.docs {
+		if (doc.Kind != SearchCommunity || doc.Private) && !allowed[doc.CommunityID] {
+			continue
+		}
+		if doc.Kind != SearchCommunity && excluded[doc.UserID] {
+			continue
+		}
+		score := 0.0
+		for _, term := range terms {
+			// a hit in the title counts double
+			score += 2*termScore(doc.titleTerms, term) + termScore(doc.bodyTerms, term)
+		}
+		if score == 0 {
+			continue
+		}
+		results = append(results, SearchResult{Kind: doc.Kind, ID: doc.ID, CommunityID: doc.CommunityID,
+			Title: doc.Title, Snippet: snippet(doc.Body, 140), Score: score, CreatedAt: doc.CreatedAt})
+	}
+	return sortResults(results, query.Limit), nil
+}
+
+func Search(db *gorm.DB, search SearchIndex) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := currentUserID(c)
+		limit := defaultPageLimit
+		if l := c.Query("limit"); l != "" {
+			var err error
+			limit, err = strconv.Atoi(l)
+			if err != nil || limit < 1 {
+				c.JSON(400, gin.H{"error": "limit must be a positive number"})
+				return
+			}
+			if limit > maxPageLimit {
+				limit = maxPageLimit
+			}
+		}
+		communityIDs, err := userCommunityIDs(db, userID)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		blocked, err := blockedUserIDs(db, currentUser(c).ID)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		results, err := search.Search(c.Request.Context(), SearchQuery{
+			Text:           c.Query("q"),
+			CommunityIDs:   communityIDs,
+			ExcludeUserIDs: blocked,
+			Limit:          limit,
+		})
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"results": results})
+	}
+}
@@ -0,0 +1,1646 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// The services hold the business rules of the api, on top of a Store. Their
+// handlers only read the request, call the service and write the answer.
+// The session, account, report, search and export handlers still use the
+// database directly.
+
+var (
+	errNotMember      = errors.New("user does not belong to community")
+	errBannedMember   = errors.New("user is banned from community")
+	errAlreadyMember  = errors.New("user already belongs to community")
+	errInviteOnly     = errors.New("community is invite only")
+	errWrongPassword  = errors.New("incorrect password")
+	errEmailInUse     = errors.New("email address is already in use")
+	errNoSuchReceiver = errors.New("receiver does not exist")
+	errNoUser         = errors.New("user not found")
+	errNoSharedGroup  = errors.New("users do not share a community")
+	errStoringImage   = errors.New("error storing image")
+	errNoImage        = errors.New("image not found")
+	errNoPhoto        = errors.New("photo not found")
+	errLowerRole      = errors.New("can only moderate members with a lower role")
+	errBadInvite      = errors.New("invalid or expired invite")
+	errNoConversation = errors.New("conversation not found")
+	errNotParticipant = errors.New("user is not part of the conversation")
+)
+
+// forbiddenError is an error a handler answers with 403.
+type forbiddenError struct {
+	error
+}
+
+func (e forbiddenError) Unwrap() error {
+	return e.error
+}
+
+// errorStatus is the status a handler answers a service error with.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errBlocked), errors.Is(err, errInviteOnly), errors.Is(err, errLowerRole),
+		errors.Is(err, errOutranked), errors.Is(err, errNotParticipant), errors.Is(err, errNotMember),
+		errors.As(err, new(forbiddenError)):
+		return 403
+	case errors.Is(err, errUnsupportedImage):
+		return 415
+	case errors.Is(err, errNotFound), errors.Is(err, errNoUser), errors.Is(err, errNoImage),
+		errors.Is(err, errNoPhoto), errors.Is(err, errNoConversation):
+		return 404
+	case errors.Is(err, errStoringImage):
+		return 500
+	}
+	return 400
+}
+
+// checkMember checks that the user is a member of the community and not
+// banned from it.
+func checkMember(ctx context.Context, store CommunityStore, userID uint, communityID uint) error {
+	banned, err := store.IsBanned(ctx, userID, communityID)
+	if err != nil {
+		return err
+	}
+	if banned {
+		return errBannedMember
+	}
+	_, err = store.FindMembership(ctx, userID, communityID)
+	if errors.Is(err, errNotFound) {
+		return errNotMember
+	}
+	return err
+}
+
+// communityActor finds the community and the user's membership in it, and
+// checks that the user has at least the role.
+func communityActor(ctx context.Context, store CommunityStore, userID uint, communityID uint, role string) (Community, Membership, error) {
+	community, err := store.FindCommunity(ctx, communityID)
+	if err != nil {
+		return community, Membership{}, err
+	}
+	actor, err := store.FindMembership(ctx, userID, communityID)
+	if errors.Is(err, errNotFound) {
+		return community, actor, forbiddenError{errNotMember}
+	}
+	if err != nil {
+		return community, actor, err
+	}
+	if roleRank[actor.Role] < roleRank[role] {
+		return community, actor, forbiddenError{fmt.Errorf("only a %v can do that", role)}
+	}
+	return community, actor, nil
+}
+
+// moderationTarget finds the membership of the user the actor wants to
+// moderate, who has to rank below the actor.
+func moderationTarget(ctx context.Context, store CommunityStore, actor Membership, targetID uint) (Membership, error) {
+	if targetID == actor.UserID {
+		return Membership{}, errors.New("can not moderate yourself")
+	}
+	target, err := store.FindMembership(ctx, targetID, actor.CommunityID)
+	if errors.Is(err, errNotFound) {
+		return target, errNotMember
+	}
+	if err != nil {
+		return target, err
+	}
+	if roleRank[target.Role] >= roleRank[actor.Role] {
+		return target, errLowerRole
+	}
+	return target, nil
+}
+
+// addMember makes the user a member of the community unless they are banned
+// or already in it.
+func addMember(ctx context.Context, store CommunityStore, userID uint, communityID uint) error {
+	banned, err := store.IsBanned(ctx, userID, communityID)
+	if err != nil {
+		return err
+	}
+	if banned {
+		return errBannedMember
+	}
+	_, err = store.FindMembership(ctx, userID, communityID)
+	if err == nil {
+		return errAlreadyMember
+	}
+	if !errors.Is(err, errNotFound) {
+		return err
+	}
+	return store.AddMembership(ctx, Membership{UserID: userID, CommunityID: communityID, Role: RoleMember})
+}
+
+// requestToJoin files a pending join request, or returns the one already
+// waiting.
+func requestToJoin(ctx context.Context, store CommunityStore, userID uint, communityID uint, message string) (JoinRequest, error) {
+	banned, err := store.IsBanned(ctx, userID, communityID)
+	if err != nil {
+		return JoinRequest{}, err
+	}
+	if banned {
+		return JoinRequest{}, errBannedMember
+	}
+	request, err := store.FindPendingJoinRequest(ctx, userID, communityID)
+	if !errors.Is(err, errNotFound) {
+		return request, err
+	}
+	request = JoinRequest{CommunityID: communityID, UserID: userID, Message: message, Status: JoinPending}
+	return request, store.CreateJoinRequest(ctx, &request)
+}
+
+// attachPhotos appends the images to the end of the post's gallery. The
+// images must have been uploaded by the user and not be shown anywhere else,
+// neither on another post nor as an avatar.
+func attachPhotos(ctx context.Context, store PhotoStore, userID uint, kind string, postID uint, imageIDs []uint, caption string) error {
+	if len(imageIDs) == 0 {
+		return nil
+	}
+	photos, err := store.PostPhotos(ctx, kind, postID)
+	if err != nil {
+		return err
+	}
+	if len(photos)+len(imageIDs) > maxPostPhotos {
+		return fmt.Errorf("a %v can have at most %v photos", kind, maxPostPhotos)
+	}
+	last := 0
+	for _, photo := range photos {
+		if photo.Position > last {
+			last = photo.Position
+		}
+	}
+	for i, id := range imageIDs {
+		claimed, err := store.ClaimPhoto(ctx, id, userID, kind, postID, last+i+1, caption)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return fmt.Errorf("image %v is not an unused image of yours", id)
+		}
+	}
+	return nil
+}
+
+// deleteUnusedImages removes stored image files no photo refers to any more.
+// Files are named after their content, so two uploads of the same picture
+// share a file, which must stay for as long as either photo exists. Photos
+// removed before they were deleted for good are never served again and do
+// not keep their files.
+func deleteUnusedImages(ctx context.Context, store PhotoStore, images ImageStore, files []string) {
+	seen := map[string]bool{}
+	for _, name := range files {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		used, err := store.FileInUse(ctx, name)
+		if err != nil {
+			log.Println("Error checking image use: ", err)
+			continue
+		}
+		if used {
+			continue
+		}
+		err = images.Delete(ctx, name)
+		if err != nil {
+			log.Println("Error deleting image: ", err)
+		}
+	}
+}
+
+type UserService struct {
+	store Store
+}
+
+func NewUserService(store Store) *UserService {
+	return &UserService{store: store}
+}
+
+// SignUp creates an account with an unverified email address.
+func (s *UserService) SignUp(ctx context.Context, input SignUpInput) (User, error) {
+	email := normalizeEmail(input.Email)
+	_, err := s.store.FindUserByEmail(ctx, email)
+	if err == nil {
+		return User{}, errEmailInUse
+	}
+	if !errors.Is(err, errNotFound) {
+		return User{}, err
+	}
+	passwordHash, err := HashPassword(input.Password)
+	if err != nil {
+		return User{}, err
+	}
+	user := User{UserName: input.UserName, Email: email, PasswordHash: passwordHash}
+	return user, s.store.CreateUser(ctx, &user)
+}
+
+// SignIn returns the user the email address and password belong to.
+func (s *UserService) SignIn(ctx context.Context, input SignInInput) (User, error) {
+	user, err := s.store.FindUserByEmail(ctx, normalizeEmail(input.Email))
+	if errors.Is(err, errNotFound) {
+		// answered like a wrong password rather than with a 404
+		return user, errWrongPassword
+	}
+	if err != nil {
+		return user, err
+	}
+	if !CheckPassword(input.Password, user.PasswordHash) {
+		return user, errWrongPassword
+	}
+	return user, nil
+}
+
+func (s *UserService) Find(ctx context.Context, id uint) (User, error) {
+	return s.store.FindUser(ctx, id)
+}
+
+// Profile finds the user another user looks up.
+func (s *UserService) Profile(ctx context.Context, id uint) (User, error) {
+	user, err := s.store.FindUser(ctx, id)
+	if errors.Is(err, errNotFound) {
+		return user, errNoUser
+	}
+	return user, err
+}
+
+// UpdateProfile saves the trimmed profile fields and returns the user with
+// them.
+func (s *UserService) UpdateProfile(ctx context.Context, user User, input ProfileInput) (User, error) {
+	err := checkProfileInput(&input)
+	if err != nil {
+		return user, err
+	}
+	user.DisplayName, user.Bio, user.HomeCity = input.DisplayName, input.Bio, input.HomeCity
+	return user, s.store.UpdateProfile(ctx, user)
+}
+
+// SetAvatar makes one of the user's uploads their avatar, or removes it for
+// an empty image id. Images shown on an offer or request can not be used, so
+// removing the post does not take the avatar with it.
+func (s *UserService) SetAvatar(ctx context.Context, user User, input AvatarInput) (User, error) {
+	user.AvatarID = nil
+	if imageID := strings.TrimSpace(input.ImageID); imageID != "" {
+		id, err := parseUint(imageID)
+		if err != nil {
+			return user, errors.New("image_id must be a number")
+		}
+		photo, err := s.store.FindPhoto(ctx, id)
+		if errors.Is(err, errNotFound) || err == nil && (photo.UserID != user.ID || photo.OfferID != nil || photo.RequestID != nil) {
+			return user, errors.New("image is not an unused image of yours")
+		}
+		if err != nil {
+			return user, err
+		}
+		user.AvatarID = &photo.ID
+	}
+	return user, s.store.UpdateProfile(ctx, user)
+}
+
+// Activity lists what the user has on offer and is asking for in the
+// communities the viewer shares with them. Nothing is listed between users
+// who blocked one another.
+func (s *UserService) Activity(ctx context.Context, viewerID uint, userID uint) (UserActivity, error) {
+	activity := UserActivity{Offers: []Offer{}, Requests: []Request{}}
+	_, err := s.Profile(ctx, userID)
+	if err != nil {
+		return activity, err
+	}
+	blocked, err := s.store.IsBlocked(ctx, viewerID, userID)
+	if err != nil || blocked {
+		return activity, err
+	}
+	communities, err := s.store.UserCommunities(ctx, viewerID)
+	if err != nil {
+		return activity, err
+	}
+	communityIDs := make([]uint, 0, len(communities))
+	for _, community := range communities {
+		communityIDs = append(communityIDs, community.ID)
+	}
+	return s.store.UserPosts(ctx, userID, communityIDs)
+}
+
+// Block hides the user and the other user from each other. Blocking someone
+// twice keeps the first block.
+func (s *UserService) Block(ctx context.Context, userID uint, input BlockInput) (Block, error) {
+	var block Block
+	blockedID, err := parseUint(input.UserID)
+	if err != nil {
+		return block, errors.New("user_id must be a number")
+	}
+	if blockedID == userID {
+		return block, errors.New("can not block yourself")
+	}
+	_, err = s.store.FindUser(ctx, blockedID)
+	if errors.Is(err, errNotFound) {
+		return block, errors.New("user does not exist")
+	}
+	if err != nil {
+		return block, err
+	}
+	block = Block{BlockerID: userID, BlockedID: blockedID}
+	return block, s.store.CreateBlock(ctx, &block)
+}
+
+// Unblock lifts the user's block of the other user, if there is one.
+func (s *UserService) Unblock(ctx context.Context, userID uint, input BlockInput) error {
+	blockedID, err := parseUint(input.UserID)
+	if err != nil {
+		return errors.New("user_id must be a number")
+	}
+	return s.store.DeleteBlock(ctx, userID, blockedID)
+}
+
+// Blocks lists the users the user blocked.
+func (s *UserService) Blocks(ctx context.Context, userID uint) ([]BlockedUser, error) {
+	return s.store.BlockedUsers(ctx, userID)
+}
+
+type CommunityService struct {
+	store  Store
+	search SearchIndex
+}
+
+func NewCommunityService(store Store, search SearchIndex) *CommunityService {
+	return &CommunityService{store: store, search: search}
+}
+
+// Create starts a community owned by the user, public unless the input says
+// otherwise.
+func (s *CommunityService) Create(ctx context.Context, ownerID uint, input createCommunityInput) (Community, error) {
+	if input.Visibility == "" {
+		input.Visibility = VisibilityPublic
+	}
+	if !visibilities[input.Visibility] {
+		return Community{}, errors.New("visibility must be public, request or invite")
+	}
+	community := Community{Name: input.Name, Country: input.Country, City: input.City,
+		Visibility: input.Visibility, OwnerID: &ownerID}
+	err := s.store.CreateCommunity(ctx, &community)
+	if err != nil {
+		return community, err
+	}
+	indexDocument(ctx, s.search, communityDocument(community))
+	return community, nil
+}
+
+// Join adds the user to a public community. For a community that asks to
+// request membership it files a join request and returns it instead.
+func (s *CommunityService) Join(ctx context.Context, userID uint, communityID uint, message string) (Community, *JoinRequest, error) {
+	community, err := s.store.FindCommunity(ctx, communityID)
+	if err != nil {
+		return community, nil, err
+	}
+	switch community.Visibility {
+	case VisibilityInvite:
+		return community, nil, errInviteOnly
+	case VisibilityRequest:
+		request, err := requestToJoin(ctx, s.store, userID, community.ID, message)
+		if err != nil {
+			return community, nil, err
+		}
+		return community, &request, nil
+	}
+	return community, nil, addMember(ctx, s.store, userID, community.ID)
+}
+
+// Discover lists the communities anyone can find in the country, or in every
+// country for "" or "ALL".
+func (s *CommunityService) Discover(ctx context.Context, country string) ([]Community, error) {
+	if country == "ALL" {
+		country = ""
+	}
+	return s.store.ListCommunities(ctx, country)
+}
+
+func (s *CommunityService) ForUser(ctx context.Context, userID uint) ([]Community, error) {
+	return s.store.UserCommunities(ctx, userID)
+}
+
+func (s *CommunityService) CheckMember(ctx context.Context, userID uint, communityID uint) error {
+	return checkMember(ctx, s.store, userID, communityID)
+}
+
+// Members lists the members of the community to one of them, together with
+// the community and the viewer's own membership.
+func (s *CommunityService) Members(ctx context.Context, userID uint, communityID uint) (Community, Membership, []MemberInfo, error) {
+	community, actor, err := communityActor(ctx, s.store, userID, communityID, RoleMember)
+	if err != nil {
+		return community, actor, nil, err
+	}
+	members, err := s.store.CommunityMembers(ctx, communityID)
+	return community, actor, members, err
+}
+
+// Leave takes the user out of the community. Owners have to hand the
+// community over first.
+func (s *CommunityService) Leave(ctx context.Context, userID uint, communityID uint) error {
+	_, actor, err := communityActor(ctx, s.store, userID, communityID, RoleMember)
+	if err != nil {
+		return err
+	}
+	if actor.Role == RoleOwner {
+		return errors.New("transfer ownership before leaving")
+	}
+	return s.store.Transaction(ctx, func(store Store) error {
+		err := store.RemoveMembership(ctx, userID, communityID)
+		if err != nil {
+			return err
+		}
+		return store.RecordModeration(ctx, &ModerationAction{CommunityID: communityID, ActorID: userID,
+			Action: ActionLeave})
+	})
+}
+
+// Kick takes a member ranked below the moderator out of the community. They
+// may join again.
+func (s *CommunityService) Kick(ctx context.Context, actorID uint, communityID uint, targetID uint, reason string) error {
+	_, actor, err := communityActor(ctx, s.store, actorID, communityID, RoleModerator)
+	if err != nil {
+		return err
+	}
+	_, err = moderationTarget(ctx, s.store, actor, targetID)
+	if err != nil {
+		return err
+	}
+	return s.store.Transaction(ctx, func(store Store) error {
+		err := store.RemoveMembership(ctx, targetID, communityID)
+		if err != nil {
+			return err
+		}
+		return store.RecordModeration(ctx, &ModerationAction{CommunityID: communityID, ActorID: actorID,
+			Action: ActionKick, TargetUserID: &targetID, Reason: reason})
+	})
+}
+
+// Ban keeps a user out of the community. The user does not have to be a
+// member, so that someone who just left can still be kept out, but a member
+// has to rank below the moderator and loses their membership.
+func (s *CommunityService) Ban(ctx context.Context, actorID uint, communityID uint, targetID uint, reason string) error {
+	_, actor, err := communityActor(ctx, s.store, actorID, communityID, RoleModerator)
+	if err != nil {
+		return err
+	}
+	_, err = moderationTarget(ctx, s.store, actor, targetID)
+	member := err == nil
+	if err != nil && !errors.Is(err, errNotMember) {
+		return err
+	}
+	if !member {
+		_, err = s.store.FindUser(ctx, targetID)
+		if errors.Is(err, errNotFound) {
+			return errNoUser
+		}
+		if err != nil {
+			return err
+		}
+		banned, err := s.store.IsBanned(ctx, targetID, communityID)
+		if err != nil {
+			return err
+		}
+		if banned {
+			return errors.New("user is already banned")
+		}
+	}
+	return s.store.Transaction(ctx, func(store Store) error {
+		if member {
+			err := store.RemoveMembership(ctx, targetID, communityID)
+			if err != nil {
+				return err
+			}
+		}
+		err := store.CreateBan(ctx, &CommunityBan{CommunityID: communityID, UserID: targetID,
+			BannedByID: actorID, Reason: reason})
+		if err != nil {
+			return err
+		}
+		return store.RecordModeration(ctx, &ModerationAction{CommunityID: communityID, ActorID: actorID,
+			Action: ActionBan, TargetUserID: &targetID, Reason: reason})
+	})
+}
+
+func (s *CommunityService) Unban(ctx context.Context, actorID uint, communityID uint, targetID uint, reason string) error {
+	_, _, err := communityActor(ctx, s.store, actorID, communityID, RoleModerator)
+	if err != nil {
+		return err
+	}
+	return s.store.Transaction(ctx, func(store Store) error {
+		banned, err := store.DeleteBan(ctx, targetID, communityID)
+		if err != nil {
+			return err
+		}
+		if !banned {
+			return errors.New("user is not banned")
+		}
+		return store.RecordModeration(ctx, &ModerationAction{CommunityID: communityID, ActorID: actorID,
+			Action: ActionUnban, TargetUserID: &targetID, Reason: reason})
+	})
+}
+
+func (s *CommunityService) Bans(ctx context.Context, actorID uint, communityID uint) ([]CommunityBan, error) {
+	_, _, err := communityActor(ctx, s.store, actorID, communityID, RoleModerator)
+	if err != nil {
+		return nil, err
+	}
+	return s.store.CommunityBans(ctx, communityID)
+}
+
+func (s *CommunityService) Promote(ctx context.Context, actorID uint, communityID uint, targetID uint, reason string) error {
+	return s.setRole(ctx, actorID, communityID, targetID, reason, RoleMember, RoleModerator, ActionPromote)
+}
+
+func (s *CommunityService) Demote(ctx context.Context, actorID uint, communityID uint, targetID uint, reason string) error {
+	return s.setRole(ctx, actorID, communityID, targetID, reason, RoleModerator, RoleMember, ActionDemote)
+}
+
+// setRole lets the owner promote members to moderators or demote moderators
+// back.
+func (s *CommunityService) setRole(ctx context.Context, actorID uint, communityID uint, targetID uint, reason string,
+	from string, to string, action string) error {
+	_, actor, err := communityActor(ctx, s.store, actorID, communityID, RoleOwner)
+	if err != nil {
+		return err
+	}
+	target, err := moderationTarget(ctx, s.store, actor, targetID)
+	if err != nil {
+		return err
+	}
+	if target.Role != from {
+		return fmt.Errorf("user is not a %v", from)
+	}
+	return s.store.Transaction(ctx, func(store Store) error {
+		err := store.SetRole(ctx, targetID, communityID, to)
+		if err != nil {
+			return err
+		}
+		return store.RecordModeration(ctx, &ModerationAction{CommunityID: communityID, ActorID: actorID,
+			Action: action, TargetUserID: &targetID, Reason: reason})
+	})
+}
+
+// TransferOwnership hands the community to another member. The old owner
+// stays on as a moderator.
+func (s *CommunityService) TransferOwnership(ctx context.Context, actorID uint, communityID uint, targetID uint, reason string) error {
+	community, actor, err := communityActor(ctx, s.store, actorID, communityID, RoleOwner)
+	if err != nil {
+		return err
+	}
+	_, err = moderationTarget(ctx, s.store, actor, targetID)
+	if err != nil {
+		return err
+	}
+	community.OwnerID = &targetID
+	return s.store.Transaction(ctx, func(store Store) error {
+		err := store.SetRole(ctx, targetID, communityID, RoleOwner)
+		if err != nil {
+			return err
+		}
+		err = store.SetRole(ctx, actorID, communityID, RoleModerator)
+		if err != nil {
+			return err
+		}
+		err = store.UpdateCommunity(ctx, community)
+		if err != nil {
+			return err
+		}
+		return store.RecordModeration(ctx, &ModerationAction{CommunityID: communityID, ActorID: actorID,
+			Action: ActionTransfer, TargetUserID: &targetID, Reason: reason})
+	})
+}
+
+// ModerationLog returns a page of what the moderators of the community did,
+// the newest first.
+func (s *CommunityService) ModerationLog(ctx context.Context, actorID uint, communityID uint, query ListQuery) (Page[ModerationAction], error) {
+	page := Page[ModerationAction]{Items: []ModerationAction{}}
+	_, _, err := communityActor(ctx, s.store, actorID, communityID, RoleModerator)
+	if err != nil {
+		return page, err
+	}
+	var before uint
+	if query.Cursor != nil {
+		before = query.Cursor.ID
+	}
+	actions, err := s.store.ModerationLog(ctx, communityID, before, query.Limit+1)
+	if err != nil {
+		return page, err
+	}
+	if len(actions) > query.Limit {
+		actions = actions[:query.Limit]
+		last := actions[len(actions)-1]
+		page.NextCursor = listCursor{CreatedAt: last.CreatedAt, ID: last.ID}.encode()
+	}
+	page.Items = append(page.Items, actions...)
+	return page, nil
+}
+
+// SetVisibility lets the owner decide who may join the community.
+func (s *CommunityService) SetVisibility(ctx context.Context, actorID uint, communityID uint, visibility string) (Community, error) {
+	community, _, err := communityActor(ctx, s.store, actorID, communityID, RoleOwner)
+	if err != nil {
+		return community, err
+	}
+	if !visibilities[visibility] {
+		return community, errors.New("visibility must be public, request or invite")
+	}
+	community.Visibility = visibility
+	err = s.store.Transaction(ctx, func(store Store) error {
+		err := store.UpdateCommunity(ctx, community)
+		if err != nil {
+			return err
+		}
+		return store.RecordModeration(ctx, &ModerationAction{CommunityID: communityID, ActorID: actorID,
+			Action: ActionSetVisibility, Reason: visibility})
+	})
+	if err != nil {
+		return community, err
+	}
+	indexDocument(ctx, s.search, communityDocument(community))
+	return community, nil
+}
+
+func (s *CommunityService) JoinRequests(ctx context.Context, actorID uint, communityID uint) ([]JoinRequestInfo, error) {
+	_, _, err := communityActor(ctx, s.store, actorID, communityID, RoleModerator)
+	if err != nil {
+		return nil, err
+	}
+	return s.store.PendingJoinRequests(ctx, communityID)
+}
+
+// DecideJoinRequest lets a moderator approve or reject a pending join
+// request. Approving it makes the user a member, unless they were banned
+// since.
+func (s *CommunityService) DecideJoinRequest(ctx context.Context, actorID uint, communityID uint, requestID uint, approve bool) (JoinRequest, error) {
+	_, _, err := communityActor(ctx, s.store, actorID, communityID, RoleModerator)
+	if err != nil {
+		return JoinRequest{}, err
+	}
+	request, err := s.store.FindJoinRequest(ctx, requestID)
+	if err != nil || request.CommunityID != communityID || request.Status != JoinPending {
+		return request, errors.New("no such pending join request")
+	}
+	action := ActionRejectJoin
+	request.Status = JoinRejected
+	if approve {
+		action = ActionApproveJoin
+		request.Status = JoinApproved
+	}
+	now := time.Now()
+	request.DecidedByID, request.DecidedAt = &actorID, &now
+	err = s.store.Transaction(ctx, func(store Store) error {
+		if approve {
+			err := addMember(ctx, store, request.UserID, communityID)
+			if err != nil {
+				return err
+			}
+		}
+		err := store.UpdateJoinRequest(ctx, request)
+		if err != nil {
+			return err
+		}
+		return store.RecordModeration(ctx, &ModerationAction{CommunityID: communityID, ActorID: actorID,
+			Action: action, TargetUserID: &request.UserID})
+	})
+	return request, err
+}
+
+// CreateInvite lets a moderator make an invite code. A maxUses of 0 allows
+// any number of uses, an expiresIn of 0 keeps the code until it is revoked.
+func (s *CommunityService) CreateInvite(ctx context.Context, actorID uint, communityID uint, maxUses int, expiresIn time.Duration) (Invite, error) {
+	_, _, err := communityActor(ctx, s.store, actorID, communityID, RoleModerator)
+	if err != nil {
+		return Invite{}, err
+	}
+	code, err := randomToken()
+	if err != nil {
+		return Invite{}, err
+	}
+	invite := Invite{CommunityID: communityID, CreatedByID: actorID, Code: code, MaxUses: maxUses}
+	if expiresIn > 0 {
+		expiresAt := time.Now().Add(expiresIn)
+		invite.ExpiresAt = &expiresAt
+	}
+	err = s.store.Transaction(ctx, func(store Store) error {
+		err := store.CreateInvite(ctx, &invite)
+		if err != nil {
+			return err
+		}
+		return store.RecordModeration(ctx, &ModerationAction{CommunityID: communityID, ActorID: actorID,
+			Action: ActionCreateInvite})
+	})
+	return invite, err
+}
+
+func (s *CommunityService) Invites(ctx context.Context, actorID uint, communityID uint) ([]Invite, error) {
+	_, _, err := communityActor(ctx, s.store, actorID, communityID, RoleModerator)
+	if err != nil {
+		return nil, err
+	}
+	return s.store.CommunityInvites(ctx, communityID)
+}
+
+func (s *CommunityService) RevokeInvite(ctx context.Context, actorID uint, communityID uint, inviteID uint) error {
+	_, _, err := communityActor(ctx, s.store, actorID, communityID, RoleModerator)
+	if err != nil {
+		return err
+	}
+	return s.store.Transaction(ctx, func(store Store) error {
+		revoked, err := store.RevokeInvite(ctx, communityID, inviteID, time.Now())
+		if err != nil {
+			return err
+		}
+		if !revoked {
+			return errors.New("no such invite")
+		}
+		return store.RecordModeration(ctx, &ModerationAction{CommunityID: communityID, ActorID: actorID,
+			Action: ActionRevokeInvite})
+	})
+}
+
+// usableInvite finds the invite with the code if it can still be used.
+func (s *CommunityService) usableInvite(ctx context.Context, code string) (Invite, error) {
+	invite, err := s.store.FindInviteByCode(ctx, code)
+	if errors.Is(err, errNotFound) || err == nil && !invite.usable(time.Now()) {
+		return invite, errBadInvite
+	}
+	return invite, err
+}
+
+// Invite shows which community the invite code is for, so the user can be
+// asked before joining.
+func (s *CommunityService) Invite(ctx context.Context, code string) (Community, error) {
+	invite, err := s.usableInvite(ctx, code)
+	if err != nil {
+		return Community{}, err
+	}
+	return s.store.FindCommunity(ctx, invite.CommunityID)
+}
+
+// JoinWithInvite makes the user a member of the community the invite code
+// is for, whoever may join it otherwise. Banned users stay out.
+func (s *CommunityService) JoinWithInvite(ctx context.Context, userID uint, code string) (Invite, error) {
+	invite, err := s.usableInvite(ctx, code)
+	if err != nil {
+		return invite, err
+	}
+	err = s.store.Transaction(ctx, func(store Store) error {
+		used, err := store.UseInvite(ctx, invite.ID)
+		if err != nil {
+			return err
+		}
+		if !used {
+			return errBadInvite
+		}
+		err = addMember(ctx, store, userID, invite.CommunityID)
+		if err != nil {
+			return err
+		}
+		return store.RecordModeration(ctx, &ModerationAction{CommunityID: invite.CommunityID, ActorID: userID,
+			Action: ActionJoinInvite})
+	})
+	return invite, err
+}
+
+// PostInput is what an offer or request is created from.
+type PostInput struct {
+	Title       string
+	Description string
+	CommunityID string
+	ImageIDs    []uint
+}
+
+// PostService creates, finds, edits and deletes offers and requests and
+// their photo galleries. Posts are only shown to members of their community
+// and only changed by their authors.
+type PostService struct {
+	store  Store
+	search SearchIndex
+	images ImageStore
+}
+
+func NewPostService(store Store, search SearchIndex, images ImageStore) *PostService {
+	return &PostService{store: store, search: search, images: images}
+}
+
+// checkAuthor checks that the user may post to the community.
+func (s *PostService) checkAuthor(ctx context.Context, userID uint, communityID string) (uint, error) {
+	id, err := parseUint(communityID)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing community id: %v", err)
+	}
+	return id, checkMember(ctx, s.store, userID, id)
+}
+
+func (s *PostService) CreateOffer(ctx context.Context, userID uint, input PostInput) (Offer, error) {
+	communityID, err := s.checkAuthor(ctx, userID, input.CommunityID)
+	if err != nil {
+		return Offer{}, err
+	}
+	offer := Offer{Title: input.Title, Description: input.Description, UserID: userID,
+		CommunityID: communityID, Status: OfferOpen}
+	err = s.store.Transaction(ctx, func(store Store) error {
+		err := store.CreateOffer(ctx, &offer)
+		if err != nil {
+			return err
+		}
+		return attachPhotos(ctx, store, userID, SearchOffer, offer.ID, input.ImageIDs, "")
+	})
+	if err != nil {
+		return offer, err
+	}
+	indexOffer(ctx, s.search, offer)
+	return offer, nil
+}
+
+func (s *PostService) CreateRequest(ctx context.Context, userID uint, input PostInput) (Request, error) {
+	communityID, err := s.checkAuthor(ctx, userID, input.CommunityID)
+	if err != nil {
+		return Request{}, err
+	}
+	request := Request{Title: input.Title, Description: input.Description, UserID: userID, CommunityID: communityID}
+	err = s.store.Transaction(ctx, func(store Store) error {
+		err := store.CreateRequest(ctx, &request)
+		if err != nil {
+			return err
+		}
+		return attachPhotos(ctx, store, userID, SearchRequest, request.ID, input.ImageIDs, "")
+	})
+	if err != nil {
+		return request, err
+	}
+	indexDocument(ctx, s.search, requestDocument(request))
+	return request, nil
+}
+
+// Offer finds the offer with its photos if the viewer is in its community.
+func (s *PostService) Offer(ctx context.Context, viewerID uint, id uint) (Offer, error) {
+	offer, err := s.store.FindOffer(ctx, id)
+	if err != nil {
+		return offer, err
+	}
+	return offer, checkMember(ctx, s.store, viewerID, offer.CommunityID)
+}
+
+// Request finds the request with its photos if the viewer is in its
+// community.
+func (s *PostService) Request(ctx context.Context, viewerID uint, id uint) (Request, error) {
+	request, err := s.store.FindRequest(ctx, id)
+	if err != nil {
+		return request, err
+	}
+	return request, checkMember(ctx, s.store, viewerID, request.CommunityID)
+}
+
+// Responders lists the users who wrote to the author about their offer or
+// request, in the order they first did. Only the author may see them.
+func (s *PostService) Responders(ctx context.Context, authorID uint, kind string, postID uint) ([]User, error) {
+	err := s.ownPost(ctx, authorID, kind, postID)
+	if err != nil {
+		return nil, err
+	}
+	senderIDs, err := s.store.PostSenders(ctx, kind, postID)
+	if err != nil {
+		return nil, err
+	}
+	users, err := s.store.FindUsers(ctx, senderIDs)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]User, len(users))
+	for _, user := range users {
+		byID[user.ID] = user
+	}
+	responders := []User{}
+	for _, id := range senderIDs {
+		// the author's own replies and accounts deleted since are left out
+		if user, ok := byID[id]; ok && id != authorID {
+			responders = append(responders, user)
+		}
+	}
+	return responders, nil
+}
+
+// listed returns the communities a listing covers: the one asked for, which
+// the viewer has to be a member of, or else all of the viewer's communities.
+func (s *PostService) listed(ctx context.Context, viewerID uint, communityID uint, query ListQuery) ([]uint, error) {
+	if communityID != 0 {
+		err := checkMember(ctx, s.store, viewerID, communityID)
+		if err != nil {
+			return nil, err
+		}
+		return listCommunities([]uint{communityID}, query)
+	}
+	communities, err := s.store.UserCommunities(ctx, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint, 0, len(communities))
+	for _, community := range communities {
+		ids = append(ids, community.ID)
+	}
+	return listCommunities(ids, query)
+}
+
+// communityNames maps the ids of the communities to their names.
+func (s *PostService) communityNames(ctx context.Context, communityIDs []uint) (map[uint]string, error) {
+	communities, err := s.store.FindCommunities(ctx, communityIDs)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[uint]string, len(communities))
+	for _, community := range communities {
+		names[community.ID] = community.Name
+	}
+	return names, nil
+}
+
+// Offers returns a page of the offers in the community, or in all of the
+// viewer's communities for a communityID of 0.
+func (s *PostService) Offers(ctx context.Context, viewerID uint, communityID uint, query ListQuery) (Page[OfferListItem], error) {
+	page := Page[OfferListItem]{Items: []OfferListItem{}}
+	communityIDs, err := s.listed(ctx, viewerID, communityID, query)
+	if err != nil || len(communityIDs) == 0 {
+		return page, err
+	}
+	offers, err := s.store.ListOffers(ctx, PostFilter{CommunityIDs: communityIDs, ViewerID: viewerID, Query: query})
+	if err != nil {
+		return page, err
+	}
+	if len(offers) > query.Limit {
+		offers = offers[:query.Limit]
+		last := offers[len(offers)-1]
+		page.NextCursor = listCursor{CreatedAt: last.CreatedAt, ID: last.ID}.encode()
+	}
+	names, err := s.communityNames(ctx, communityIDs)
+	if err != nil {
+		return page, err
+	}
+	for _, offer := range offers {
+		page.Items = append(page.Items, OfferListItem{Offer: offer, CommunityName: names[offer.CommunityID]})
+	}
+	return page, nil
+}
+
+// Requests returns a page of the requests in the community, or in all of the
+// viewer's communities for a communityID of 0.
+func (s *PostService) Requests(ctx context.Context, viewerID uint, communityID uint, query ListQuery) (Page[RequestListItem], error) {
+	page := Page[RequestListItem]{Items: []RequestListItem{}}
+	communityIDs, err := s.listed(ctx, viewerID, communityID, query)
+	if err != nil || len(communityIDs) == 0 {
+		return page, err
+	}
+	requests, err := s.store.ListRequests(ctx, PostFilter{CommunityIDs: communityIDs, ViewerID: viewerID, Query: query})
+	if err != nil {
+		return page, err
+	}
+	if len(requests) > query.Limit {
+		requests = requests[:query.Limit]
+		last := requests[len(requests)-1]
+		page.NextCursor = listCursor{CreatedAt: last.CreatedAt, ID: last.ID}.encode()
+	}
+	names, err := s.communityNames(ctx, communityIDs)
+	if err != nil {
+		return page, err
+	}
+	for _, request := range requests {
+		page.Items = append(page.Items, RequestListItem{Request: request, CommunityName: names[request.CommunityID]})
+	}
+	return page, nil
+}
+
+// ownOffer finds the offer if the user posted it.
+func (s *PostService) ownOffer(ctx context.Context, userID uint, id uint) (Offer, error) {
+	offer, err := s.store.FindOffer(ctx, id)
+	if err == nil && offer.UserID != userID {
+		err = forbiddenError{errors.New("user does not own offer")}
+	}
+	return offer, err
+}
+
+// ownRequest finds the request if the user posted it.
+func (s *PostService) ownRequest(ctx context.Context, userID uint, id uint) (Request, error) {
+	request, err := s.store.FindRequest(ctx, id)
+	if err == nil && request.UserID != userID {
+		err = forbiddenError{errors.New("user does not own request")}
+	}
+	return request, err
+}
+
+// ownPost checks that the user posted the offer or request.
+func (s *PostService) ownPost(ctx context.Context, userID uint, kind string, id uint) error {
+	if kind == SearchRequest {
+		_, err := s.ownRequest(ctx, userID, id)
+		return err
+	}
+	_, err := s.ownOffer(ctx, userID, id)
+	return err
+}
+
+// UpdateOffer changes the title and description of the user's offer, unless
+// it was given away already.
+func (s *PostService) UpdateOffer(ctx context.Context, userID uint, id uint, input UpdateOfferInput) (Offer, error) {
+	offer, err := s.ownOffer(ctx, userID, id)
+	if err != nil {
+		return offer, err
+	}
+	if offer.Status == OfferGiven {
+		return offer, errors.New("offer has already been given away")
+	}
+	offer.Title = input.Title
+	offer.Description = input.Description
+	err = s.store.UpdateOffer(ctx, offer)
+	if err != nil {
+		return offer, err
+	}
+	indexOffer(ctx, s.search, offer)
+	return offer, nil
+}
+
+// SetOfferStatus moves the user's offer to the status, if offerTransitions
+// allows it.
+func (s *PostService) SetOfferStatus(ctx context.Context, userID uint, id uint, status string) (Offer, error) {
+	offer, err := s.ownOffer(ctx, userID, id)
+	if err != nil {
+		return offer, err
+	}
+	if _, known := offerTransitions[status]; !known {
+		return offer, errors.New("unknown offer status")
+	}
+	if !canTransition(offer.Status, status) {
+		return offer, fmt.Errorf("offer can not go from %v to %v", offer.Status, status)
+	}
+	offer.Status = status
+	err = s.store.UpdateOffer(ctx, offer)
+	if err != nil {
+		return offer, err
+	}
+	indexOffer(ctx, s.search, offer)
+	return offer, nil
+}
+
+func (s *PostService) DeleteOffer(ctx context.Context, userID uint, id uint) error {
+	_, err := s.ownOffer(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+	return s.deletePost(ctx, SearchOffer, id, nil)
+}
+
+func (s *PostService) UpdateRequest(ctx context.Context, userID uint, id uint, input UpdateRequestInput) (Request, error) {
+	request, err := s.ownRequest(ctx, userID, id)
+	if err != nil {
+		return request, err
+	}
+	request.Title = input.Title
+	request.Description = input.Description
+	err = s.store.UpdateRequest(ctx, request)
+	if err != nil {
+		return request, err
+	}
+	indexDocument(ctx, s.search, requestDocument(request))
+	return request, nil
+}
+
+func (s *PostService) DeleteRequest(ctx context.Context, userID uint, id uint) error {
+	_, err := s.ownRequest(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+	return s.deletePost(ctx, SearchRequest, id, nil)
+}
+
+// Remove lets a moderator take down an offer or request posted to their
+// community. Posts by members ranked as high as the moderator are off
+// limits.
+func (s *PostService) Remove(ctx context.Context, actorID uint, communityID uint, kind string, id uint, reason string) error {
+	_, actor, err := communityActor(ctx, s.store, actorID, communityID, RoleModerator)
+	if err != nil {
+		return err
+	}
+	action := ModerationAction{CommunityID: communityID, ActorID: actorID, Action: ActionRemovePost, Reason: reason}
+	var authorID, postCommunityID uint
+	switch kind {
+	case SearchOffer:
+		offer, err := s.store.FindOffer(ctx, id)
+		if err != nil {
+			return err
+		}
+		authorID, postCommunityID, action.OfferID = offer.UserID, offer.CommunityID, &offer.ID
+	case SearchRequest:
+		request, err := s.store.FindRequest(ctx, id)
+		if err != nil {
+			return err
+		}
+		authorID, postCommunityID, action.RequestID = request.UserID, request.CommunityID, &request.ID
+	default:
+		return errors.New("kind must be offer or request")
+	}
+	if postCommunityID != communityID {
+		return errNotFound
+	}
+	action.TargetUserID = &authorID
+	// the author may have left, then anyone moderating may remove it
+	author, err := s.store.FindMembership(ctx, authorID, communityID)
+	if err == nil && authorID != actorID && roleRank[author.Role] >= roleRank[actor.Role] {
+		return errOutranked
+	}
+	if err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	return s.deletePost(ctx, kind, id, &action)
+}
+
+// deletePost deletes the offer or request together with its photos, and
+// records the action if a moderator took it down. The photos' files go once
+// no other photo shows them.
+func (s *PostService) deletePost(ctx context.Context, kind string, id uint, action *ModerationAction) error {
+	var files []string
+	err := s.store.Transaction(ctx, func(store Store) error {
+		var err error
+		if kind == SearchRequest {
+			err = store.DeleteRequest(ctx, id)
+		} else {
+			err = store.DeleteOffer(ctx, id)
+		}
+		if err != nil {
+			return err
+		}
+		photos, err := store.PostPhotos(ctx, kind, id)
+		if err != nil {
+			return err
+		}
+		files = photoFiles(photos)
+		err = store.DeletePhotos(ctx, photoIDs(photos))
+		if err != nil || action == nil {
+			return err
+		}
+		return store.RecordModeration(ctx, action)
+	})
+	if err != nil {
+		return err
+	}
+	deleteUnusedImages(ctx, s.store, s.images, files)
+	removeDocument(ctx, s.search, kind, id)
+	return nil
+}
+
+// AddPhotos adds uploaded images to the end of the gallery of the user's
+// offer or request and returns the gallery.
+func (s *PostService) AddPhotos(ctx context.Context, userID uint, kind string, postID uint, imageIDs []uint, caption string) ([]Photo, error) {
+	err := s.ownPost(ctx, userID, kind, postID)
+	if err != nil {
+		return nil, err
+	}
+	err = s.store.Transaction(ctx, func(store Store) error {
+		return attachPhotos(ctx, store, userID, kind, postID, imageIDs, caption)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.store.PostPhotos(ctx, kind, postID)
+}
+
+// postPhoto finds the photo if it is on the user's offer or request.
+func (s *PostService) postPhoto(ctx context.Context, userID uint, kind string, postID uint, photoID uint) (Photo, error) {
+	err := s.ownPost(ctx, userID, kind, postID)
+	if err != nil {
+		return Photo{}, err
+	}
+	photo, err := s.store.FindPhoto(ctx, photoID)
+	if errors.Is(err, errNotFound) || err == nil && !sameID(photo.postID(kind), &postID) {
+		return Photo{}, errNoPhoto
+	}
+	return photo, err
+}
+
+func (s *PostService) CaptionPhoto(ctx context.Context, userID uint, kind string, postID uint, photoID uint, caption string) (Photo, error) {
+	photo, err := s.postPhoto(ctx, userID, kind, postID, photoID)
+	if err != nil {
+		return photo, err
+	}
+	photo.Caption = caption
+	return photo, s.store.SetPhotoCaption(ctx, photo.ID, caption)
+}
+
+// RemovePhoto takes the photo off the user's offer or request and returns
+// the gallery. Its files go unless another photo shows the same picture.
+func (s *PostService) RemovePhoto(ctx context.Context, userID uint, kind string, postID uint, photoID uint) ([]Photo, error) {
+	photo, err := s.postPhoto(ctx, userID, kind, postID, photoID)
+	if err != nil {
+		return nil, err
+	}
+	err = s.store.DeletePhotos(ctx, []uint{photo.ID})
+	if err != nil {
+		return nil, err
+	}
+	deleteUnusedImages(ctx, s.store, s.images, photoFiles([]Photo{photo}))
+	return s.store.PostPhotos(ctx, kind, postID)
+}
+
+// ReorderPhotos arranges the gallery of the user's offer or request in the
+// given order and returns it. The order has to name every photo of the post
+// exactly once.
+func (s *PostService) ReorderPhotos(ctx context.Context, userID uint, kind string, postID uint, order []uint) ([]Photo, error) {
+	err := s.ownPost(ctx, userID, kind, postID)
+	if err != nil {
+		return nil, err
+	}
+	err = s.store.Transaction(ctx, func(store Store) error {
+		photos, err := store.PostPhotos(ctx, kind, postID)
+		if err != nil {
+			return err
+		}
+		seen := map[uint]bool{}
+		for _, photo := range photos {
+			seen[photo.ID] = false
+		}
+		for _, id := range order {
+			listed, known := seen[id]
+			if !known || listed {
+				return fmt.Errorf("photo %v is not a photo of this %v or is listed twice", id, kind)
+			}
+			seen[id] = true
+		}
+		if len(order) != len(photos) {
+			return errors.New("photo_ids must list every photo")
+		}
+		for i, id := range order {
+			err = store.SetPhotoPosition(ctx, id, i+1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.store.PostPhotos(ctx, kind, postID)
+}
+
+// MessageService sends messages and pushes them to the connected clients.
+type MessageService struct {
+	store Store
+	hub   *Hub
+}
+
+func NewMessageService(store Store, hub *Hub) *MessageService {
+	return &MessageService{store: store, hub: hub}
+}
+
+// canMessage checks that the receiver exists, shares a community with the
+// sender and that neither blocked the other.
+func (s *MessageService) canMessage(ctx context.Context, senderID uint, receiverID uint) error {
+	_, err := s.store.FindUser(ctx, receiverID)
+	if errors.Is(err, errNotFound) {
+		return errNoSuchReceiver
+	}
+	if err != nil {
+		return err
+	}
+	blocked, err := s.store.IsBlocked(ctx, senderID, receiverID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return errBlocked
+	}
+	shared, err := s.store.ShareCommunity(ctx, senderID, receiverID)
+	if err != nil {
+		return err
+	}
+	if !shared {
+		return errNoSharedGroup
+	}
+	return nil
+}
+
+// checkPost checks that both users belong to the community of the post the
+// message is about, and that the message goes to the post's author or
+// continues a conversation about the post. The posts of communities the
+// sender is not part of are not found, so their ids can not be probed.
+func (s *MessageService) checkPost(ctx context.Context, message Message, communityID uint, authorID uint) error {
+	err := checkMember(ctx, s.store, message.SenderID, communityID)
+	if errors.Is(err, errNotMember) || errors.Is(err, errBannedMember) {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = checkMember(ctx, s.store, message.ReceiverID, communityID)
+	if errors.Is(err, errNotMember) || errors.Is(err, errBannedMember) {
+		return forbiddenError{errors.New("receiver does not belong to the community of the post")}
+	}
+	if err != nil || message.ReceiverID == authorID {
+		return err
+	}
+	_, err = s.store.FindConversationBetween(ctx, message.SenderID, message.ReceiverID, message.OfferID, message.RequestID)
+	if errors.Is(err, errNotFound) {
+		return forbiddenError{errors.New("receiver is not the author of the post")}
+	}
+	return err
+}
+
+// Send stores a message about an offer, or about a request if RequestID is
+// set, and pushes it to the receiver.
+func (s *MessageService) Send(ctx context.Context, senderID uint, input MessageInput) (Message, error) {
+	receiverID, err := parseUint(input.ReceiverID)
+	if err != nil {
+		return Message{}, fmt.Errorf("error parsing receiver id: %v", err)
+	}
+	message := Message{Text: input.Text, SenderID: senderID, ReceiverID: receiverID}
+	err = s.canMessage(ctx, senderID, receiverID)
+	if err != nil {
+		return message, err
+	}
+	if input.RequestID != "" {
+		requestID, err := parseUint(input.RequestID)
+		if err != nil {
+			return message, fmt.Errorf("error parsing request id: %v", err)
+		}
+		request, err := s.store.FindRequest(ctx, requestID)
+		if err != nil {
+			return message, err
+		}
+		message.RequestID = &request.ID
+		err = s.checkPost(ctx, message, request.CommunityID, request.UserID)
+		if err != nil {
+			return message, err
+		}
+	} else {
+		offerID, err := parseUint(input.OfferID)
+		if err != nil {
+			return message, fmt.Errorf("error parsing offer id: %v", err)
+		}
+		offer, err := s.store.FindOffer(ctx, offerID)
+		if err != nil {
+			return message, err
+		}
+		message.OfferID = &offer.ID
+		err = s.checkPost(ctx, message, offer.CommunityID, offer.UserID)
+		if err != nil {
+			return message, err
+		}
+	}
+	err = s.store.CreateMessage(ctx, &message)
+	if err != nil {
+		return message, err
+	}
+	s.publish(ctx, &message)
+	return message, nil
+}
+
+// publish pushes a stored message to the receiver and to the sender's other
+// connections. A message that reached one of the receiver's connections
+// counts as delivered.
+func (s *MessageService) publish(ctx context.Context, message *Message) {
+	event := Event{Type: EventMessage, Data: *message}
+	if s.hub.Publish(message.ReceiverID, event) > 0 {
+		now := time.Now()
+		err := s.store.MarkDelivered(ctx, []uint{message.ID}, now)
+		if err != nil {
+			log.Println("Error marking message delivered: ", err)
+		} else {
+			message.DeliveredAt = &now
+		}
+	}
+	if message.SenderID != message.ReceiverID {
+		s.hub.Publish(message.SenderID, event)
+	}
+}
+
+// History lists the messages between the user and another user, oldest
+// first, and marks the ones the user got as delivered.
+func (s *MessageService) History(ctx context.Context, filter MessageFilter) ([]Message, error) {
+	messages, err := s.store.Messages(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	s.markDelivered(ctx, messages, filter.UserID)
+	return messages, nil
+}
+
+// markDelivered marks the messages the user got among the messages as
+// delivered.
+func (s *MessageService) markDelivered(ctx context.Context, messages []Message, userID uint) {
+	now := time.Now()
+	var ids []uint
+	for i := range messages {
+		if messages[i].ReceiverID == userID && messages[i].DeliveredAt == nil {
+			ids = append(ids, messages[i].ID)
+			messages[i].DeliveredAt = &now
+		}
+	}
+	err := s.store.MarkDelivered(ctx, ids, now)
+	if err != nil {
+		log.Println("Error marking messages delivered: ", err)
+	}
+}
+
+// Conversations lists the user's inbox, the most recently active
+// conversations first, only those about the request or else the offer if
+// one is given.
+func (s *MessageService) Conversations(ctx context.Context, userID uint, offerID *uint, requestID *uint) ([]ConversationSummary, error) {
+	conversations, err := s.store.UserConversations(ctx, userID, offerID, requestID)
+	if err != nil {
+		return nil, err
+	}
+	return s.store.SummarizeConversations(ctx, conversations, userID)
+}
+
+// participantConversation loads the conversation if the user takes part in
+// it.
+func (s *MessageService) participantConversation(ctx context.Context, userID uint, id uint) (Conversation, error) {
+	conversation, err := s.store.FindConversation(ctx, id)
+	if errors.Is(err, errNotFound) {
+		return conversation, errNoConversation
+	}
+	if err != nil {
+		return conversation, err
+	}
+	for _, participant := range conversation.Participants {
+		if participant.UserID == userID {
+			return conversation, nil
+		}
+	}
+	return conversation, errNotParticipant
+}
+
+// Conversation returns the inbox entry and the messages of one of the user's
+// conversations, and marks the messages the user got as delivered.
+func (s *MessageService) Conversation(ctx context.Context, userID uint, id uint) (ConversationSummary, []Message, error) {
+	conversation, err := s.participantConversation(ctx, userID, id)
+	if err != nil {
+		return ConversationSummary{}, nil, err
+	}
+	summaries, err := s.store.SummarizeConversations(ctx, []Conversation{conversation}, userID)
+	if err != nil {
+		return ConversationSummary{}, nil, err
+	}
+	messages, err := s.store.ConversationMessages(ctx, conversation.ID)
+	if err != nil {
+		return ConversationSummary{}, nil, err
+	}
+	s.markDelivered(ctx, messages, userID)
+	return summaries[0], messages, nil
+}
+
+// MarkRead marks the messages the user got in the conversation as read,
+// tells the other side if there were any, and returns how many there were.
+func (s *MessageService) MarkRead(ctx context.Context, userID uint, id uint) (int64, error) {
+	conversation, err := s.participantConversation(ctx, userID, id)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	read, err := s.store.MarkConversationRead(ctx, conversation.ID, userID, now)
+	if err != nil || read == 0 {
+		return read, err
+	}
+	event := Event{Type: EventRead, Data: map[string]interface{}{
+		"conversation_id": conversation.ID,
+		"offer_id":        conversation.OfferID,
+		"request_id":      conversation.RequestID,
+		"reader_id":       userID,
+		"read_at":         now,
+	}}
+	for _, participant := range conversation.Participants {
+		if participant.UserID != userID {
+			s.hub.Publish(participant.UserID, event)
+		}
+	}
+	return read, nil
+}
+
+// Typing tells the receiver that the user is typing in their conversation
+// about the post. It tells whether the receiver was told, which they are not
+// if the two have not talked about the post yet or one blocked the other.
+func (s *MessageService) Typing(ctx context.Context, userID uint, receiverID uint, offerID *uint, requestID *uint) bool {
+	conversation, err := s.store.FindConversationBetween(ctx, userID, receiverID, offerID, requestID)
+	if err != nil {
+		return false
+	}
+	blocked, err := s.store.IsBlocked(ctx, userID, receiverID)
+	if err != nil || blocked {
+		return false
+	}
+	s.hub.Publish(receiverID, Event{Type: EventTyping, Data: map[string]interface{}{
+		"conversation_id": conversation.ID,
+		"offer_id":        conversation.OfferID,
+		"request_id":      conversation.RequestID,
+		"sender_id":       userID,
+	}})
+	return true
+}
+
+// Unread counts the messages the user has not read.
+func (s *MessageService) Unread(ctx context.Context, userID uint) (int64, error) {
+	return s.store.UnreadCount(ctx, userID)
+}
+
+// PhotoService stores uploaded images with their renditions and decides who
+// may see them.
+type PhotoService struct {
+	store  Store
+	images ImageStore
+}
+
+func NewPhotoService(store Store, images ImageStore) *PhotoService {
+	return &PhotoService{store: store, images: images}
+}
+
+// Upload renders the image in every size, stores the renditions and records
+// the photo as the user's.
+func (s *PhotoService) Upload(ctx context.Context, userID uint, data []byte) (Photo, error) {
+	renditions, err := renderImage(data)
+	if err != nil {
+		return Photo{}, err
+	}
+	paths := map[string]string{}
+	for size, rendition := range renditions {
+		paths[size] = contentAddressedName(rendition, ".jpg")
+		err = s.images.Put(ctx, paths[size], rendition, "image/jpeg")
+		if err != nil {
+			return Photo{}, fmt.Errorf("%w: %v", errStoringImage, err)
+		}
+	}
+	photo := Photo{Path: paths[SizeOriginal], MediumPath: paths[SizeMedium], ThumbPath: paths[SizeThumb], UserID: userID}
+	return photo, s.store.CreatePhoto(ctx, &photo)
+}
+
+// Open reads the given rendition of the photo.
+func (s *PhotoService) Open(ctx context.Context, id uint, size string) (io.ReadCloser, error) {
+	photo, err := s.store.FindPhoto(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.images.Open(ctx, photo.path(size))
+}
+
+// CanView tells whether the user may see the photo. Photos of an offer or
+// request are visible to the members of its community, other photos, like
+// avatars, to users sharing a community with the uploader. Uploaders always
+// see their own photos.
+func (s *PhotoService) CanView(ctx context.Context, userID uint, photo Photo) (bool, error) {
+	if photo.UserID == userID {
+		return true, nil
+	}
+	var communityID uint
+	switch {
+	case photo.OfferID != nil:
+		offer, err := s.store.FindOffer(ctx, *photo.OfferID)
+		if errors.Is(err, errNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		communityID = offer.CommunityID
+	case photo.RequestID != nil:
+		request, err := s.store.FindRequest(ctx, *photo.RequestID)
+		if errors.Is(err, errNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		communityID = request.CommunityID
+	default:
+		return s.store.ShareCommunity(ctx, userID, photo.UserID)
+	}
+	err := checkMember(ctx, s.store, userID, communityID)
+	if errors.Is(err, errNotMember) || errors.Is(err, errBannedMember) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Visible finds the photo if the user may see it. A photo the user may not
+// see is not found either, so ids can not be probed.
+func (s *PhotoService) Visible(ctx context.Context, userID uint, id uint) (Photo, error) {
+	photo, err := s.store.FindPhoto(ctx, id)
+	if errors.Is(err, errNotFound) {
+		return photo, errNoImage
+	}
+	if err != nil {
+		return photo, err
+	}
+	allowed, err := s.CanView(ctx, userID, photo)
+	if err != nil {
+		return photo, err
+	}
+	if !allowed {
+		return Photo{}, errNoImage
+	}
+	return photo, nil
+}
+
+// DeleteUnused removes the stored files no photo shows any more.
+func (s *PhotoService) DeleteUnused(ctx context.Context, files []string) {
+	deleteUnusedImages(ctx, s.store, s.images, files)
+}
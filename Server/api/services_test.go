@@ -0,0 +1,641 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serviceFixture runs the services on a MemoryStore, without a database or a
+// server.
+type serviceFixture struct {
+	t           *testing.T
+	ctx         context.Context
+	store       *MemoryStore
+	users       *UserService
+	communities *CommunityService
+	posts       *PostService
+	messages    *MessageService
+	photos      *PhotoService
+	hub         *Hub
+}
+
+func newServiceFixture(t *testing.T) *serviceFixture {
+	store := NewMemoryStore()
+	search := NewMemorySearchIndex()
+	images := &LocalImageStore{Dir: t.TempDir()}
+	hub := NewHub()
+	return &serviceFixture{
+		t:           t,
+		ctx:         context.Background(),
+		store:       store,
+		users:       NewUserService(store),
+		communities: NewCommunityService(store, search),
+		posts:       NewPostService(store, search, images),
+		messages:    NewMessageService(store, hub),
+		photos:      NewPhotoService(store, images),
+		hub:         hub,
+	}
+}
+
+func (f *serviceFixture) user(name string) User {
+	f.t.Helper()
+	user, err := f.users.SignUp(f.ctx, SignUpInput{UserName: name, Email: name + "@example.com", Password: "secret-" + name})
+	if err != nil {
+		f.t.Fatalf("signing up %v: %v", name, err)
+	}
+	return user
+}
+
+func (f *serviceFixture) community(owner User, name string, visibility string) Community {
+	f.t.Helper()
+	community, err := f.communities.Create(f.ctx, owner.ID,
+		createCommunityInput{Name: name, Country: "DE", City: "Berlin", Visibility: visibility})
+	if err != nil {
+		f.t.Fatalf("creating %v: %v", name, err)
+	}
+	return community
+}
+
+func (f *serviceFixture) join(user User, community Community) {
+	f.t.Helper()
+	_, _, err := f.communities.Join(f.ctx, user.ID, community.ID, "")
+	if err != nil {
+		f.t.Fatalf("%v joining %v: %v", user.UserName, community.Name, err)
+	}
+}
+
+func (f *serviceFixture) offer(user User, community Community, title string, imageIDs ...uint) Offer {
+	f.t.Helper()
+	offer, err := f.posts.CreateOffer(f.ctx, user.ID, PostInput{Title: title, Description: title,
+		CommunityID: fmt.Sprint(community.ID), ImageIDs: imageIDs})
+	if err != nil {
+		f.t.Fatalf("offering %v: %v", title, err)
+	}
+	return offer
+}
+
+func (f *serviceFixture) upload(user User) Photo {
+	f.t.Helper()
+	photo, err := f.photos.Upload(f.ctx, user.ID, pngImage(f.t, 40, 30))
+	if err != nil {
+		f.t.Fatalf("uploading: %v", err)
+	}
+	return photo
+}
+
+func wantErr(t *testing.T, err error, want error) {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Fatalf("got error %v, want %v", err, want)
+	}
+}
+
+func wantErrText(t *testing.T, err error, text string) {
+	t.Helper()
+	if err == nil || !strings.Contains(err.Error(), text) {
+		t.Fatalf("got error %v, want one containing %q", err, text)
+	}
+}
+
+func TestUserServiceSignIn(t *testing.T) {
+	f := newServiceFixture(t)
+	ada := f.user("ada")
+
+	_, err := f.users.SignUp(f.ctx, SignUpInput{UserName: "other", Email: " ADA@example.com", Password: "x"})
+	wantErr(t, err, errEmailInUse)
+	user, err := f.users.SignIn(f.ctx, SignInInput{Email: "Ada@Example.com", Password: "secret-ada"})
+	if err != nil || user.ID != ada.ID {
+		t.Fatalf("signed in as %+v, %v", user, err)
+	}
+	_, err = f.users.SignIn(f.ctx, SignInInput{Email: "ada@example.com", Password: "wrong"})
+	wantErr(t, err, errWrongPassword)
+	_, err = f.users.SignIn(f.ctx, SignInInput{Email: "bob@example.com", Password: "secret-bob"})
+	wantErr(t, err, errWrongPassword)
+}
+
+func TestUserServiceProfile(t *testing.T) {
+	f := newServiceFixture(t)
+	ada, bob := f.user("ada"), f.user("bob")
+	garden := f.community(ada, "garden", VisibilityPublic)
+
+	ada, err := f.users.UpdateProfile(f.ctx, ada, ProfileInput{DisplayName: " Ada ", HomeCity: "Berlin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.users.UpdateProfile(f.ctx, ada, ProfileInput{Bio: strings.Repeat("a", maxBio+1)})
+	wantErrText(t, err, "bio must be")
+	_, err = f.users.Profile(f.ctx, 999)
+	wantErr(t, err, errNoUser)
+	stored, err := f.users.Profile(f.ctx, ada.ID)
+	if err != nil || stored.DisplayName != "Ada" || stored.HomeCity != "Berlin" {
+		t.Fatalf("stored profile is %+v, %v", stored, err)
+	}
+
+	photo := f.upload(ada)
+	_, err = f.users.SetAvatar(f.ctx, bob, AvatarInput{ImageID: fmt.Sprint(photo.ID)})
+	wantErrText(t, err, "not an unused image")
+	_, err = f.users.SetAvatar(f.ctx, ada, AvatarInput{ImageID: "avatar"})
+	wantErrText(t, err, "must be a number")
+	ada, err = f.users.SetAvatar(f.ctx, ada, AvatarInput{ImageID: fmt.Sprint(photo.ID)})
+	if err != nil || ada.AvatarID == nil || *ada.AvatarID != photo.ID {
+		t.Fatalf("avatar is %v, %v", ada.AvatarID, err)
+	}
+	shown := f.upload(ada)
+	f.offer(ada, garden, "bike", shown.ID)
+	_, err = f.users.SetAvatar(f.ctx, ada, AvatarInput{ImageID: fmt.Sprint(shown.ID)})
+	wantErrText(t, err, "not an unused image")
+	ada, err = f.users.SetAvatar(f.ctx, ada, AvatarInput{})
+	if err != nil || ada.AvatarID != nil {
+		t.Fatalf("avatar is %v, %v", ada.AvatarID, err)
+	}
+}
+
+func TestUserServiceActivity(t *testing.T) {
+	f := newServiceFixture(t)
+	ada, bob, eve := f.user("ada"), f.user("bob"), f.user("eve")
+	garden := f.community(ada, "garden", VisibilityPublic)
+	kitchen := f.community(ada, "kitchen", VisibilityPublic)
+	f.join(bob, garden)
+	f.offer(ada, garden, "bike")
+	f.offer(ada, kitchen, "pan")
+
+	activity, err := f.users.Activity(f.ctx, bob.ID, ada.ID)
+	if err != nil || len(activity.Offers) != 1 || activity.Offers[0].Title != "bike" {
+		t.Fatalf("bob sees %+v, %v", activity, err)
+	}
+	activity, err = f.users.Activity(f.ctx, eve.ID, ada.ID)
+	if err != nil || len(activity.Offers) != 0 {
+		t.Fatalf("eve sees %+v, %v", activity, err)
+	}
+	_, err = f.users.Activity(f.ctx, bob.ID, 999)
+	wantErr(t, err, errNoUser)
+
+	_, err = f.users.Block(f.ctx, bob.ID, BlockInput{UserID: fmt.Sprint(bob.ID)})
+	wantErrText(t, err, "can not block yourself")
+	_, err = f.users.Block(f.ctx, bob.ID, BlockInput{UserID: "999"})
+	wantErrText(t, err, "user does not exist")
+	for i := 0; i < 2; i++ {
+		_, err = f.users.Block(f.ctx, bob.ID, BlockInput{UserID: fmt.Sprint(ada.ID)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	blocked, err := f.users.Blocks(f.ctx, bob.ID)
+	if err != nil || len(blocked) != 1 || blocked[0].UserName != "ada" {
+		t.Fatalf("bob blocked %+v, %v", blocked, err)
+	}
+	// a block hides the activity both ways
+	activity, err = f.users.Activity(f.ctx, bob.ID, ada.ID)
+	if err != nil || len(activity.Offers) != 0 {
+		t.Fatalf("bob sees %+v after blocking ada, %v", activity, err)
+	}
+	err = f.users.Unblock(f.ctx, bob.ID, BlockInput{UserID: fmt.Sprint(ada.ID)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked, err = f.users.Blocks(f.ctx, bob.ID)
+	if err != nil || len(blocked) != 0 {
+		t.Fatalf("bob still blocks %+v, %v", blocked, err)
+	}
+}
+
+func TestCommunityServiceMembership(t *testing.T) {
+	f := newServiceFixture(t)
+	owner, bob, eve := f.user("owner"), f.user("bob"), f.user("eve")
+	garden := f.community(owner, "garden", VisibilityPublic)
+	club := f.community(owner, "club", VisibilityRequest)
+	secret := f.community(owner, "secret", VisibilityInvite)
+
+	f.join(bob, garden)
+	_, _, err := f.communities.Join(f.ctx, bob.ID, garden.ID, "")
+	wantErr(t, err, errAlreadyMember)
+	_, _, err = f.communities.Join(f.ctx, bob.ID, secret.ID, "")
+	wantErr(t, err, errInviteOnly)
+	if status := errorStatus(err); status != 403 {
+		t.Fatalf("invite only answers %v", status)
+	}
+
+	_, request, err := f.communities.Join(f.ctx, bob.ID, club.ID, "let me in")
+	if err != nil || request == nil || request.Status != JoinPending {
+		t.Fatalf("join request %+v, %v", request, err)
+	}
+	wantErr(t, f.communities.CheckMember(f.ctx, bob.ID, club.ID), errNotMember)
+	_, err = f.communities.JoinRequests(f.ctx, bob.ID, club.ID)
+	wantErr(t, err, errNotMember)
+	decided, err := f.communities.DecideJoinRequest(f.ctx, owner.ID, club.ID, request.ID, true)
+	if err != nil || decided.Status != JoinApproved {
+		t.Fatalf("decided %+v, %v", decided, err)
+	}
+	if err := f.communities.CheckMember(f.ctx, bob.ID, club.ID); err != nil {
+		t.Fatalf("approved user is no member: %v", err)
+	}
+	_, err = f.communities.DecideJoinRequest(f.ctx, owner.ID, club.ID, request.ID, true)
+	wantErrText(t, err, "no such pending join request")
+
+	invite, err := f.communities.CreateInvite(f.ctx, owner.ID, secret.ID, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.communities.JoinWithInvite(f.ctx, eve.ID, invite.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.communities.JoinWithInvite(f.ctx, bob.ID, invite.Code)
+	wantErr(t, err, errBadInvite)
+
+	names := func(communities []Community) []string {
+		var names []string
+		for _, community := range communities {
+			names = append(names, community.Name)
+		}
+		return names
+	}
+	discovered, err := f.communities.Discover(f.ctx, "ALL")
+	if err != nil || fmt.Sprint(names(discovered)) != "[garden club]" {
+		t.Fatalf("discovered %v, %v", names(discovered), err)
+	}
+	joined, err := f.communities.ForUser(f.ctx, bob.ID)
+	if err != nil || fmt.Sprint(names(joined)) != "[garden club]" {
+		t.Fatalf("bob is in %v, %v", names(joined), err)
+	}
+
+	err = f.communities.Leave(f.ctx, owner.ID, garden.ID)
+	wantErrText(t, err, "transfer ownership before leaving")
+	if err := f.communities.Leave(f.ctx, bob.ID, garden.ID); err != nil {
+		t.Fatal(err)
+	}
+	wantErr(t, f.communities.CheckMember(f.ctx, bob.ID, garden.ID), errNotMember)
+}
+
+func TestCommunityServiceBans(t *testing.T) {
+	f := newServiceFixture(t)
+	owner, mod, bob, eve := f.user("owner"), f.user("mod"), f.user("bob"), f.user("eve")
+	garden := f.community(owner, "garden", VisibilityPublic)
+	f.join(mod, garden)
+	f.join(bob, garden)
+	if err := f.communities.Promote(f.ctx, owner.ID, garden.ID, mod.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	err := f.communities.Ban(f.ctx, bob.ID, garden.ID, mod.ID, "")
+	wantErrText(t, err, "only a moderator")
+	if status := errorStatus(err); status != 403 {
+		t.Fatalf("a member banning answers %v", status)
+	}
+	wantErr(t, f.communities.Ban(f.ctx, mod.ID, garden.ID, owner.ID, ""), errLowerRole)
+	if err := f.communities.Ban(f.ctx, mod.ID, garden.ID, bob.ID, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	wantErr(t, f.communities.CheckMember(f.ctx, bob.ID, garden.ID), errBannedMember)
+	_, _, err = f.communities.Join(f.ctx, bob.ID, garden.ID, "")
+	wantErr(t, err, errBannedMember)
+
+	// users who are not members can be banned before they join
+	if err := f.communities.Ban(f.ctx, mod.ID, garden.ID, eve.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	wantErrText(t, f.communities.Ban(f.ctx, mod.ID, garden.ID, eve.ID, ""), "already banned")
+	bans, err := f.communities.Bans(f.ctx, mod.ID, garden.ID)
+	if err != nil || len(bans) != 2 || bans[0].UserID != eve.ID {
+		t.Fatalf("bans %+v, %v", bans, err)
+	}
+
+	if err := f.communities.Unban(f.ctx, mod.ID, garden.ID, bob.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	wantErrText(t, f.communities.Unban(f.ctx, mod.ID, garden.ID, bob.ID, ""), "not banned")
+	f.join(bob, garden)
+
+	page, err := f.communities.ModerationLog(f.ctx, owner.ID, garden.ID, ListQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, action := range page.Items {
+		actions = append(actions, action.Action)
+	}
+	if want := "[unban ban ban promote]"; fmt.Sprint(actions) != want {
+		t.Fatalf("logged %v, want %v", actions, want)
+	}
+}
+
+// banCheckFailing is a MemoryStore whose ban lookups fail for one user.
+type banCheckFailing struct {
+	*MemoryStore
+	userID uint
+}
+
+var errStoreDown = errors.New("store is down")
+
+func (s banCheckFailing) IsBanned(ctx context.Context, userID uint, communityID uint) (bool, error) {
+	if userID == s.userID {
+		return false, errStoreDown
+	}
+	return s.MemoryStore.IsBanned(ctx, userID, communityID)
+}
+
+func TestCommunityServiceBanStoreError(t *testing.T) {
+	f := newServiceFixture(t)
+	owner, eve := f.user("owner"), f.user("eve")
+	garden := f.community(owner, "garden", VisibilityPublic)
+
+	communities := NewCommunityService(banCheckFailing{MemoryStore: f.store, userID: eve.ID}, NewMemorySearchIndex())
+	wantErr(t, communities.Ban(f.ctx, owner.ID, garden.ID, eve.ID, ""), errStoreDown)
+	wantErr(t, communities.Ban(f.ctx, owner.ID, garden.ID, 999, ""), errNoUser)
+}
+
+func TestCommunityServiceOwnership(t *testing.T) {
+	f := newServiceFixture(t)
+	owner, bob := f.user("owner"), f.user("bob")
+	garden := f.community(owner, "garden", VisibilityPublic)
+	f.join(bob, garden)
+
+	wantErrText(t, f.communities.TransferOwnership(f.ctx, bob.ID, garden.ID, owner.ID, ""), "only a owner")
+	wantErrText(t, f.communities.TransferOwnership(f.ctx, owner.ID, garden.ID, owner.ID, ""), "yourself")
+	if err := f.communities.TransferOwnership(f.ctx, owner.ID, garden.ID, bob.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	community, actor, members, err := f.communities.Members(f.ctx, owner.ID, garden.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if community.OwnerID == nil || *community.OwnerID != bob.ID || actor.Role != RoleModerator || len(members) != 2 {
+		t.Fatalf("after the transfer the community is %+v, the old owner %+v", community, actor)
+	}
+	wantErrText(t, f.communities.Demote(f.ctx, owner.ID, garden.ID, bob.ID, ""), "only a owner")
+	if err := f.communities.Demote(f.ctx, bob.ID, garden.ID, owner.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.communities.SetVisibility(f.ctx, owner.ID, garden.ID, VisibilityInvite)
+	wantErrText(t, err, "only a owner")
+}
+
+func TestPostServiceOwnership(t *testing.T) {
+	f := newServiceFixture(t)
+	ada, bob, eve := f.user("ada"), f.user("bob"), f.user("eve")
+	garden := f.community(ada, "garden", VisibilityPublic)
+	f.join(bob, garden)
+
+	_, err := f.posts.CreateOffer(f.ctx, eve.ID, PostInput{Title: "Bike", CommunityID: fmt.Sprint(garden.ID)})
+	wantErr(t, err, errNotMember)
+	offer := f.offer(bob, garden, "Bike")
+	_, err = f.posts.Offer(f.ctx, eve.ID, offer.ID)
+	wantErr(t, err, errNotMember)
+	if _, err := f.posts.Offer(f.ctx, ada.ID, offer.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.posts.UpdateOffer(f.ctx, ada.ID, offer.ID, UpdateOfferInput{Title: "Mine now"})
+	wantErrText(t, err, "does not own offer")
+	wantErrText(t, f.posts.DeleteOffer(f.ctx, ada.ID, offer.ID), "does not own offer")
+	updated, err := f.posts.UpdateOffer(f.ctx, bob.ID, offer.ID, UpdateOfferInput{Title: "Blue bike", Description: "Fast"})
+	if err != nil || updated.Title != "Blue bike" {
+		t.Fatalf("updated %+v, %v", updated, err)
+	}
+	_, err = f.posts.SetOfferStatus(f.ctx, bob.ID, offer.ID, OfferGiven)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.posts.UpdateOffer(f.ctx, bob.ID, offer.ID, UpdateOfferInput{Title: "Red bike"})
+	wantErrText(t, err, "already been given away")
+
+	request, err := f.posts.CreateRequest(f.ctx, bob.ID, PostInput{Title: "Ladder", CommunityID: fmt.Sprint(garden.ID)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.posts.UpdateRequest(f.ctx, ada.ID, request.ID, UpdateRequestInput{Title: "Mine now"})
+	wantErrText(t, err, "does not own request")
+	if err := f.posts.DeleteRequest(f.ctx, bob.ID, request.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.posts.Request(f.ctx, bob.ID, request.ID)
+	wantErr(t, err, errNotFound)
+}
+
+func TestPostServiceListings(t *testing.T) {
+	f := newServiceFixture(t)
+	ada, bob := f.user("ada"), f.user("bob")
+	garden := f.community(ada, "garden", VisibilityPublic)
+	kitchen := f.community(bob, "kitchen", VisibilityPublic)
+	f.join(bob, garden)
+	f.offer(ada, garden, "Spade")
+	f.offer(bob, garden, "Rake")
+	f.offer(bob, kitchen, "Kettle")
+
+	titles := func(page Page[OfferListItem]) string {
+		var titles []string
+		for _, item := range page.Items {
+			titles = append(titles, item.Title+"@"+item.CommunityName)
+		}
+		return fmt.Sprint(titles)
+	}
+	page, err := f.posts.Offers(f.ctx, bob.ID, 0, ListQuery{Limit: 10})
+	if err != nil || titles(page) != "[Kettle@kitchen Rake@garden Spade@garden]" {
+		t.Fatalf("bob sees %v, %v", titles(page), err)
+	}
+	page, err = f.posts.Offers(f.ctx, ada.ID, 0, ListQuery{Limit: 10})
+	if err != nil || titles(page) != "[Rake@garden Spade@garden]" {
+		t.Fatalf("ada sees %v, %v", titles(page), err)
+	}
+	_, err = f.posts.Offers(f.ctx, ada.ID, kitchen.ID, ListQuery{Limit: 10})
+	wantErr(t, err, errNotMember)
+
+	// the offers of blocked users are not listed
+	f.store.AddBlock(ada.ID, bob.ID)
+	page, err = f.posts.Offers(f.ctx, ada.ID, garden.ID, ListQuery{Limit: 10})
+	if err != nil || titles(page) != "[Spade@garden]" {
+		t.Fatalf("ada sees %v after blocking bob, %v", titles(page), err)
+	}
+}
+
+func TestPostServiceRemove(t *testing.T) {
+	f := newServiceFixture(t)
+	owner, mod, bob := f.user("owner"), f.user("mod"), f.user("bob")
+	garden := f.community(owner, "garden", VisibilityPublic)
+	kitchen := f.community(owner, "kitchen", VisibilityPublic)
+	f.join(mod, garden)
+	f.join(bob, garden)
+	if err := f.communities.Promote(f.ctx, owner.ID, garden.ID, mod.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	ownerOffer := f.offer(owner, garden, "Spade")
+	bobOffer := f.offer(bob, garden, "Rake")
+
+	wantErrText(t, f.posts.Remove(f.ctx, bob.ID, garden.ID, SearchOffer, ownerOffer.ID, ""), "only a moderator")
+	wantErr(t, f.posts.Remove(f.ctx, mod.ID, garden.ID, SearchOffer, ownerOffer.ID, ""), errOutranked)
+	wantErrText(t, f.posts.Remove(f.ctx, mod.ID, garden.ID, "post", bobOffer.ID, ""), "kind must be offer or request")
+	_, err := f.posts.Offer(f.ctx, bob.ID, bobOffer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantErr(t, f.posts.Remove(f.ctx, owner.ID, kitchen.ID, SearchOffer, bobOffer.ID, ""), errNotFound)
+	if err := f.posts.Remove(f.ctx, mod.ID, garden.ID, SearchOffer, bobOffer.ID, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.posts.Offer(f.ctx, bob.ID, bobOffer.ID)
+	wantErr(t, err, errNotFound)
+}
+
+func TestPostServicePhotos(t *testing.T) {
+	f := newServiceFixture(t)
+	ada, bob := f.user("ada"), f.user("bob")
+	garden := f.community(ada, "garden", VisibilityPublic)
+	f.join(bob, garden)
+
+	first, second := f.upload(ada), f.upload(ada)
+	offer := f.offer(ada, garden, "Spade", first.ID)
+	other := f.offer(ada, garden, "Rake")
+
+	tests := []struct {
+		name    string
+		user    User
+		postID  uint
+		photoID uint
+		want    string
+	}{
+		{"on another post", ada, other.ID, first.ID, "not an unused image of yours"},
+		{"of someone else", bob, other.ID, f.upload(bob).ID, "does not own offer"},
+		{"uploaded by someone else", ada, other.ID, f.upload(bob).ID, "not an unused image of yours"},
+		{"missing", ada, other.ID, 999, "not an unused image of yours"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := f.posts.AddPhotos(f.ctx, test.user.ID, SearchOffer, test.postID, []uint{test.photoID}, "")
+			wantErrText(t, err, test.want)
+		})
+	}
+
+	avatar := f.upload(ada)
+	f.store.SetAvatar(ada.ID, avatar.ID)
+	_, err := f.posts.AddPhotos(f.ctx, ada.ID, SearchOffer, other.ID, []uint{avatar.ID}, "")
+	wantErrText(t, err, "not an unused image of yours")
+
+	gallery, err := f.posts.AddPhotos(f.ctx, ada.ID, SearchOffer, offer.ID, []uint{second.ID}, "side")
+	if err != nil || len(gallery) != 2 || gallery[0].ID != first.ID || gallery[1].Caption != "side" {
+		t.Fatalf("gallery %+v, %v", gallery, err)
+	}
+	var many []uint
+	for i := 0; i < maxPostPhotos-1; i++ {
+		many = append(many, f.upload(ada).ID)
+	}
+	_, err = f.posts.AddPhotos(f.ctx, ada.ID, SearchOffer, offer.ID, many, "")
+	wantErrText(t, err, "at most")
+	// a failed attach leaves none of the photos on the post
+	gallery, err = f.posts.ReorderPhotos(f.ctx, ada.ID, SearchOffer, offer.ID, []uint{second.ID, first.ID})
+	if err != nil || len(gallery) != 2 || gallery[0].ID != second.ID {
+		t.Fatalf("reordered %+v, %v", gallery, err)
+	}
+	_, err = f.posts.ReorderPhotos(f.ctx, ada.ID, SearchOffer, offer.ID, []uint{second.ID})
+	wantErrText(t, err, "every photo")
+
+	_, err = f.posts.CaptionPhoto(f.ctx, ada.ID, SearchOffer, other.ID, first.ID, "wrong post")
+	wantErr(t, err, errNoPhoto)
+	gallery, err = f.posts.RemovePhoto(f.ctx, ada.ID, SearchOffer, offer.ID, first.ID)
+	if err != nil || len(gallery) != 1 {
+		t.Fatalf("gallery after removing %+v, %v", gallery, err)
+	}
+}
+
+func TestPhotoServiceCanView(t *testing.T) {
+	f := newServiceFixture(t)
+	ada, bob, eve := f.user("ada"), f.user("bob"), f.user("eve")
+	garden := f.community(ada, "garden", VisibilityPublic)
+	kitchen := f.community(eve, "kitchen", VisibilityPublic)
+	f.join(bob, garden)
+	f.join(bob, kitchen)
+
+	posted := f.upload(ada)
+	f.offer(ada, garden, "Spade", posted.ID)
+	avatar := f.upload(ada)
+
+	tests := []struct {
+		name   string
+		viewer User
+		photo  Photo
+		want   bool
+	}{
+		{"uploader", ada, posted, true},
+		{"member", bob, posted, true},
+		{"outsider", eve, posted, false},
+		{"avatar, shared community", bob, avatar, true},
+		{"avatar, no shared community", eve, avatar, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := f.photos.Visible(f.ctx, test.viewer.ID, test.photo.ID)
+			if (err == nil) != test.want {
+				t.Fatalf("visible: %v, want %v", err, test.want)
+			}
+			if err != nil {
+				wantErr(t, err, errNoImage)
+			}
+		})
+	}
+
+	f.store.AddBan(garden.ID, bob.ID)
+	_, err := f.photos.Visible(f.ctx, bob.ID, posted.ID)
+	wantErr(t, err, errNoImage)
+	_, err = f.photos.Visible(f.ctx, ada.ID, 999)
+	wantErr(t, err, errNoImage)
+}
+
+func TestMessageService(t *testing.T) {
+	f := newServiceFixture(t)
+	ada, bob, eve := f.user("ada"), f.user("bob"), f.user("eve")
+	garden := f.community(ada, "garden", VisibilityPublic)
+	f.join(bob, garden)
+	offer := f.offer(ada, garden, "Spade")
+	about := fmt.Sprint(offer.ID)
+
+	_, err := f.messages.Send(f.ctx, bob.ID, MessageInput{Text: "hi", ReceiverID: fmt.Sprint(eve.ID), OfferID: about})
+	wantErr(t, err, errNoSharedGroup)
+	_, err = f.messages.Send(f.ctx, bob.ID, MessageInput{Text: "hi", ReceiverID: "999", OfferID: about})
+	wantErr(t, err, errNoSuchReceiver)
+
+	events, unsubscribe := f.hub.Subscribe(ada.ID)
+	defer unsubscribe()
+	message, err := f.messages.Send(f.ctx, bob.ID, MessageInput{Text: "is it free?", ReceiverID: fmt.Sprint(ada.ID), OfferID: about})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event.Type != EventMessage || message.DeliveredAt == nil {
+		t.Fatalf("got %+v, the message was delivered at %v", event, message.DeliveredAt)
+	}
+	if unread, err := f.messages.Unread(f.ctx, ada.ID); err != nil || unread != 1 {
+		t.Fatalf("ada has %v unread, %v", unread, err)
+	}
+
+	inbox, err := f.messages.Conversations(f.ctx, ada.ID, &offer.ID, nil)
+	if err != nil || len(inbox) != 1 || inbox[0].OtherUserName != "bob" || inbox[0].PostTitle != "Spade" || inbox[0].Unread != 1 {
+		t.Fatalf("inbox %+v, %v", inbox, err)
+	}
+	_, _, err = f.messages.Conversation(f.ctx, eve.ID, inbox[0].ID)
+	wantErr(t, err, errNotParticipant)
+	_, _, err = f.messages.Conversation(f.ctx, ada.ID, 999)
+	wantErr(t, err, errNoConversation)
+
+	if !f.messages.Typing(f.ctx, ada.ID, bob.ID, &offer.ID, nil) {
+		t.Fatal("typing in a conversation was not sent")
+	}
+	if f.messages.Typing(f.ctx, ada.ID, eve.ID, &offer.ID, nil) {
+		t.Fatal("typing was sent without a conversation")
+	}
+	read, err := f.messages.MarkRead(f.ctx, ada.ID, inbox[0].ID)
+	if err != nil || read != 1 {
+		t.Fatalf("marked %v read, %v", read, err)
+	}
+	if unread, _ := f.messages.Unread(f.ctx, ada.ID); unread != 0 {
+		t.Fatalf("ada still has %v unread", unread)
+	}
+
+	f.store.AddBlock(ada.ID, bob.ID)
+	_, err = f.messages.Send(f.ctx, bob.ID, MessageInput{Text: "hello?", ReceiverID: fmt.Sprint(ada.ID), OfferID: about})
+	wantErr(t, err, errBlocked)
+	if f.messages.Typing(f.ctx, bob.ID, ada.ID, &offer.ID, nil) {
+		t.Fatal("typing was sent to a user who blocked the sender")
+	}
+}
@@ -0,0 +1,681 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// errNotFound is what the stores return for a record that does not exist.
+var errNotFound = errors.New("record not found")
+
+// UserStore keeps the user accounts and the blocks between them.
+type UserStore interface {
+	CreateUser(ctx context.Context, user *User) error
+	FindUser(ctx context.Context, id uint) (User, error)
+	FindUserByEmail(ctx context.Context, email string) (User, error)
+	FindUsers(ctx context.Context, ids []uint) ([]User, error)
+	// UpdateProfile saves the display name, bio, home city and avatar of the
+	// user
+	UpdateProfile(ctx context.Context, user User) error
+	// IsBlocked tells whether either user blocked the other
+	IsBlocked(ctx context.Context, userA uint, userB uint) (bool, error)
+	// CreateBlock stores the block, or loads it if the blocker already
+	// blocked the user
+	CreateBlock(ctx context.Context, block *Block) error
+	DeleteBlock(ctx context.Context, blockerID uint, blockedID uint) error
+	// BlockedUsers lists the users the user blocked, the latest first
+	BlockedUsers(ctx context.Context, blockerID uint) ([]BlockedUser, error)
+}
+
+// CommunityStore keeps the communities, their members, bans, join requests
+// and invites, and the log of what their moderators did.
+type CommunityStore interface {
+	// CreateCommunity stores the community and makes its owner a member with
+	// the owner role
+	CreateCommunity(ctx context.Context, community *Community) error
+	FindCommunity(ctx context.Context, id uint) (Community, error)
+	// UpdateCommunity saves the visibility and owner of the community
+	UpdateCommunity(ctx context.Context, community Community) error
+	// ListCommunities lists the communities that are not invite only, in the
+	// country or everywhere for an empty country
+	ListCommunities(ctx context.Context, country string) ([]Community, error)
+	UserCommunities(ctx context.Context, userID uint) ([]Community, error)
+	FindCommunities(ctx context.Context, ids []uint) ([]Community, error)
+	FindMembership(ctx context.Context, userID uint, communityID uint) (Membership, error)
+	AddMembership(ctx context.Context, membership Membership) error
+	RemoveMembership(ctx context.Context, userID uint, communityID uint) error
+	SetRole(ctx context.Context, userID uint, communityID uint, role string) error
+	// CommunityMembers lists the members that still have an account, in the
+	// order they joined
+	CommunityMembers(ctx context.Context, communityID uint) ([]MemberInfo, error)
+	// ShareCommunity tells whether the two users are members of a common
+	// community
+	ShareCommunity(ctx context.Context, userA uint, userB uint) (bool, error)
+	IsBanned(ctx context.Context, userID uint, communityID uint) (bool, error)
+	CreateBan(ctx context.Context, ban *CommunityBan) error
+	// DeleteBan lifts the ban and tells whether there was one
+	DeleteBan(ctx context.Context, userID uint, communityID uint) (bool, error)
+	// CommunityBans lists the bans, the newest first
+	CommunityBans(ctx context.Context, communityID uint) ([]CommunityBan, error)
+	FindPendingJoinRequest(ctx context.Context, userID uint, communityID uint) (JoinRequest, error)
+	CreateJoinRequest(ctx context.Context, request *JoinRequest) error
+	FindJoinRequest(ctx context.Context, id uint) (JoinRequest, error)
+	// PendingJoinRequests lists the join requests waiting for a decision,
+	// the oldest first
+	PendingJoinRequests(ctx context.Context, communityID uint) ([]JoinRequestInfo, error)
+	// UpdateJoinRequest saves the status of the request and who decided it
+	// when
+	UpdateJoinRequest(ctx context.Context, request JoinRequest) error
+	CreateInvite(ctx context.Context, invite *Invite) error
+	FindInviteByCode(ctx context.Context, code string) (Invite, error)
+	// CommunityInvites lists the invites that were not revoked, the newest
+	// first
+	CommunityInvites(ctx context.Context, communityID uint) ([]Invite, error)
+	// RevokeInvite revokes the invite of the community and tells whether
+	// there was one to revoke
+	RevokeInvite(ctx context.Context, communityID uint, id uint, at time.Time) (bool, error)
+	// UseInvite counts a use of the invite unless it was revoked or used up,
+	// and tells whether it counted. Checking and counting at once keeps
+	// concurrent joins from going over the limit
+	UseInvite(ctx context.Context, id uint) (bool, error)
+	RecordModeration(ctx context.Context, action *ModerationAction) error
+	// ModerationLog lists up to limit actions of the community, the newest
+	// first, starting below the id before unless it is 0
+	ModerationLog(ctx context.Context, communityID uint, before uint, limit int) ([]ModerationAction, error)
+}
+
+// PostFilter picks the posts of a listing: those in the communities that
+// match the query, leaving out the posts of users blocked by or blocking
+// ViewerID.
+type PostFilter struct {
+	CommunityIDs []uint
+	ViewerID     uint
+	Query        ListQuery
+}
+
+// PostStore keeps the offers and requests, found with their photos in order.
+type PostStore interface {
+	CreateOffer(ctx context.Context, offer *Offer) error
+	FindOffer(ctx context.Context, id uint) (Offer, error)
+	// ListOffers lists a page of offers, and one more if there is a next
+	// page. Closed offers are left out unless the query asks for them
+	ListOffers(ctx context.Context, filter PostFilter) ([]Offer, error)
+	// UpdateOffer saves the title, description and status of the offer
+	UpdateOffer(ctx context.Context, offer Offer) error
+	DeleteOffer(ctx context.Context, id uint) error
+	CreateRequest(ctx context.Context, request *Request) error
+	FindRequest(ctx context.Context, id uint) (Request, error)
+	// ListRequests lists a page of requests, and one more if there is a next
+	// page
+	ListRequests(ctx context.Context, filter PostFilter) ([]Request, error)
+	// UpdateRequest saves the title and description of the request
+	UpdateRequest(ctx context.Context, request Request) error
+	DeleteRequest(ctx context.Context, id uint) error
+	// UserPosts lists the open and reserved offers and the requests of the
+	// user in the communities, the newest first
+	UserPosts(ctx context.Context, userID uint, communityIDs []uint) (UserActivity, error)
+}
+
+// MessageFilter picks the messages between two users, about one post if
+// OfferID or RequestID is set.
+type MessageFilter struct {
+	UserID      uint
+	OtherUserID uint
+	OfferID     *uint
+	RequestID   *uint
+}
+
+// MessageStore keeps the messages and the conversations they belong to.
+type MessageStore interface {
+	// CreateMessage stores the message in the conversation between its
+	// sender and receiver about its post, starting the conversation if they
+	// have not talked about the post yet, and marks it read by the sender
+	CreateMessage(ctx context.Context, message *Message) error
+	// Messages lists the messages oldest first
+	Messages(ctx context.Context, filter MessageFilter) ([]Message, error)
+	// MarkDelivered sets the delivery time of those of the messages that do
+	// not have one yet
+	MarkDelivered(ctx context.Context, ids []uint, at time.Time) error
+	// PostSenders returns who sent messages about the offer or request, in
+	// the order they first did
+	PostSenders(ctx context.Context, kind string, postID uint) ([]uint, error)
+	// UserConversations lists the conversations of the user with their
+	// participants, the most recently active first, only those about the
+	// request or else the offer if one is given
+	UserConversations(ctx context.Context, userID uint, offerID *uint, requestID *uint) ([]Conversation, error)
+	// FindConversation loads the conversation with its participants
+	FindConversation(ctx context.Context, id uint) (Conversation, error)
+	// FindConversationBetween loads the conversation between the two users
+	// about the post, if they started one
+	FindConversationBetween(ctx context.Context, userA uint, userB uint, offerID *uint, requestID *uint) (Conversation, error)
+	// SummarizeConversations builds the inbox entries of the conversations
+	// for the user
+	SummarizeConversations(ctx context.Context, conversations []Conversation, userID uint) ([]ConversationSummary, error)
+	// ConversationMessages lists the messages of the conversation, oldest
+	// first
+	ConversationMessages(ctx context.Context, conversationID uint) ([]Message, error)
+	// MarkConversationRead marks the messages the user got in the
+	// conversation as read and returns how many were unread
+	MarkConversationRead(ctx context.Context, conversationID uint, userID uint, at time.Time) (int64, error)
+	// UnreadCount counts the messages the user has not read
+	UnreadCount(ctx context.Context, userID uint) (int64, error)
+}
+
+// PhotoStore keeps the uploaded photos.
+type PhotoStore interface {
+	CreatePhoto(ctx context.Context, photo *Photo) error
+	FindPhoto(ctx context.Context, id uint) (Photo, error)
+	PostPhotos(ctx context.Context, kind string, postID uint) ([]Photo, error)
+	// ClaimPhoto puts the photo on the post if it was uploaded by the user
+	// and is not shown anywhere else yet, neither on a post nor as an avatar
+	ClaimPhoto(ctx context.Context, photoID uint, userID uint, kind string, postID uint, position int, caption string) (bool, error)
+	SetPhotoCaption(ctx context.Context, id uint, caption string) error
+	SetPhotoPosition(ctx context.Context, id uint, position int) error
+	// DeletePhotos removes the photos for good
+	DeletePhotos(ctx context.Context, ids []uint) error
+	// FileInUse tells whether a photo still shows the stored file
+	FileInUse(ctx context.Context, name string) (bool, error)
+}
+
+// Store is all the storage the services use. Transaction runs fn with a
+// store whose writes are kept together or not at all.
+type Store interface {
+	UserStore
+	CommunityStore
+	PostStore
+	MessageStore
+	PhotoStore
+	Transaction(ctx context.Context, fn func(store Store) error) error
+}
+
+// GormStore keeps everything in the database.
+type GormStore struct {
+	DB *gorm.DB
+}
+
+func (s *GormStore) db(ctx context.Context) *gorm.DB {
+	return s.DB.WithContext(ctx)
+}
+
+// found turns gorm's record not found into errNotFound.
+func found(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errNotFound
+	}
+	return err
+}
+
+func (s *GormStore) Transaction(ctx context.Context, fn func(store Store) error) error {
+	return s.db(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&GormStore{DB: tx})
+	})
+}
+
+func (s *GormStore) CreateUser(ctx context.Context, user *User) error {
+	return s.db(ctx).Create(user).Error
+}
+
+func (s *GormStore) FindUser(ctx context.Context, id uint) (User, error) {
+	var user User
+	result := s.db(ctx).First(&user, id)
+	return user, found(result.Error)
+}
+
+func (s *GormStore) FindUserByEmail(ctx context.Context, email string) (User, error) {
+	var user User
+	result := s.db(ctx).Where("email = ?", email).First(&user)
+	return user, found(result.Error)
+}
+
+func (s *GormStore) FindUsers(ctx context.Context, ids []uint) ([]User, error) {
+	var users []User
+	if len(ids) == 0 {
+		return users, nil
+	}
+	result := s.db(ctx).Find(&users, ids)
+	return users, result.Error
+}
+
+func (s *GormStore) UpdateProfile(ctx context.Context, user User) error {
+	return s.db(ctx).Model(&User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+		"display_name": user.DisplayName,
+		"bio":          user.Bio,
+		"home_city":    user.HomeCity,
+		"avatar_id":    user.AvatarID,
+	}).Error
+}
+
+func (s *GormStore) IsBlocked(ctx context.Context, userA uint, userB uint) (bool, error) {
+	return isBlocked(s.db(ctx), userA, userB)
+}
+
+func (s *GormStore) CreateBlock(ctx context.Context, block *Block) error {
+	return s.db(ctx).Where(&Block{BlockerID: block.BlockerID, BlockedID: block.BlockedID}).FirstOrCreate(block).Error
+}
+
+func (s *GormStore) DeleteBlock(ctx context.Context, blockerID uint, blockedID uint) error {
+	return s.db(ctx).Where("blocker_id = ? AND blocked_id = ?", blockerID, blockedID).Delete(&Block{}).Error
+}
+
+func (s *GormStore) BlockedUsers(ctx context.Context, blockerID uint) ([]BlockedUser, error) {
+	blocked := []BlockedUser{}
+	result := s.db(ctx).Model(&Block{}).
+		Select("blocks.blocked_id AS user_id, users.user_name, blocks.created_at").
+		Joins("JOIN users ON users.id = blocks.blocked_id").
+		Where("blocks.blocker_id = ?", blockerID).
+		Order("blocks.created_at DESC").
+		Scan(&blocked)
+	return blocked, result.Error
+}
+
+func (s *GormStore) CreateCommunity(ctx context.Context, community *Community) error {
+	return s.db(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(community).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&Membership{UserID: *community.OwnerID, CommunityID: community.ID, Role: RoleOwner}).Error
+	})
+}
+
+func (s *GormStore) FindCommunity(ctx context.Context, id uint) (Community, error) {
+	var community Community
+	result := s.db(ctx).First(&community, id)
+	return community, found(result.Error)
+}
+
+func (s *GormStore) UpdateCommunity(ctx context.Context, community Community) error {
+	return s.db(ctx).Model(&Community{}).Where("id = ?", community.ID).Updates(map[string]interface{}{
+		"visibility": community.Visibility,
+		"owner_id":   community.OwnerID,
+	}).Error
+}
+
+func (s *GormStore) ListCommunities(ctx context.Context, country string) ([]Community, error) {
+	var communities []Community
+	tx := s.db(ctx).Where("visibility <> ?", VisibilityInvite)
+	if country != "" {
+		tx = tx.Where("country = ?", country)
+	}
+	result := tx.Find(&communities)
+	return communities, result.Error
+}
+
+func (s *GormStore) UserCommunities(ctx context.Context, userID uint) ([]Community, error) {
+	var communities []Community
+	err := s.db(ctx).Model(&User{Model: gorm.Model{ID: userID}}).Association("Communities").Find(&communities)
+	return communities, err
+}
+
+func (s *GormStore) FindCommunities(ctx context.Context, ids []uint) ([]Community, error) {
+	var communities []Community
+	if len(ids) == 0 {
+		return communities, nil
+	}
+	result := s.db(ctx).Find(&communities, ids)
+	return communities, result.Error
+}
+
+func (s *GormStore) FindMembership(ctx context.Context, userID uint, communityID uint) (Membership, error) {
+	membership, err := findMembership(s.db(ctx), userID, communityID)
+	return membership, found(err)
+}
+
+func (s *GormStore) AddMembership(ctx context.Context, membership Membership) error {
+	return s.db(ctx).Create(&membership).Error
+}
+
+func (s *GormStore) RemoveMembership(ctx context.Context, userID uint, communityID uint) error {
+	return s.db(ctx).Where("user_id = ? AND community_id = ?", userID, communityID).Delete(&Membership{}).Error
+}
+
+func (s *GormStore) SetRole(ctx context.Context, userID uint, communityID uint, role string) error {
+	return s.db(ctx).Model(&Membership{}).Where("user_id = ? AND community_id = ?", userID, communityID).
+		Update("role", role).Error
+}
+
+func (s *GormStore) CommunityMembers(ctx context.Context, communityID uint) ([]MemberInfo, error) {
+	members := []MemberInfo{}
+	result := s.db(ctx).Table("user_communities").
+		Select("user_communities.user_id, users.user_name, user_communities.role, user_communities.created_at AS joined_at").
+		Joins("JOIN users ON users.id = user_communities.user_id AND users.deleted_at IS NULL").
+		Where("user_communities.community_id = ?", communityID).
+		Order("user_communities.created_at").
+		Scan(&members)
+	return members, result.Error
+}
+
+func (s *GormStore) ShareCommunity(ctx context.Context, userA uint, userB uint) (bool, error) {
+	return shareCommunity(s.db(ctx), userA, userB)
+}
+
+func (s *GormStore) IsBanned(ctx context.Context, userID uint, communityID uint) (bool, error) {
+	return isBanned(s.db(ctx), userID, communityID)
+}
+
+func (s *GormStore) CreateBan(ctx context.Context, ban *CommunityBan) error {
+	return s.db(ctx).Create(ban).Error
+}
+
+func (s *GormStore) DeleteBan(ctx context.Context, userID uint, communityID uint) (bool, error) {
+	result := s.db(ctx).Unscoped().Where("community_id = ? AND user_id = ?", communityID, userID).
+		Delete(&CommunityBan{})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *GormStore) CommunityBans(ctx context.Context, communityID uint) ([]CommunityBan, error) {
+	bans := []CommunityBan{}
+	result := s.db(ctx).Where("community_id = ?", communityID).Order("created_at DESC").Find(&bans)
+	return bans, result.Error
+}
+
+func (s *GormStore) FindPendingJoinRequest(ctx context.Context, userID uint, communityID uint) (JoinRequest, error) {
+	var request JoinRequest
+	result := s.db(ctx).Where("user_id = ? AND community_id = ? AND status = ?", userID, communityID, JoinPending).
+		First(&request)
+	return request, found(result.Error)
+}
+
+func (s *GormStore) CreateJoinRequest(ctx context.Context, request *JoinRequest) error {
+	return s.db(ctx).Create(request).Error
+}
+
+func (s *GormStore) FindJoinRequest(ctx context.Context, id uint) (JoinRequest, error) {
+	var request JoinRequest
+	result := s.db(ctx).First(&request, id)
+	return request, found(result.Error)
+}
+
+func (s *GormStore) PendingJoinRequests(ctx context.Context, communityID uint) ([]JoinRequestInfo, error) {
+	requests := []JoinRequestInfo{}
+	result := s.db(ctx).Model(&JoinRequest{}).
+		Select("join_requests.*, users.user_name").
+		Joins("JOIN users ON users.id = join_requests.user_id").
+		Where("join_requests.community_id = ? AND join_requests.status = ?", communityID, JoinPending).
+		Order("join_requests.created_at").
+		Scan(&requests)
+	return requests, result.Error
+}
+
+func (s *GormStore) UpdateJoinRequest(ctx context.Context, request JoinRequest) error {
+	return s.db(ctx).Model(&JoinRequest{}).Where("id = ?", request.ID).Updates(map[string]interface{}{
+		"status":        request.Status,
+		"decided_by_id": request.DecidedByID,
+		"decided_at":    request.DecidedAt,
+	}).Error
+}
+
+func (s *GormStore) CreateInvite(ctx context.Context, invite *Invite) error {
+	return s.db(ctx).Create(invite).Error
+}
+
+func (s *GormStore) FindInviteByCode(ctx context.Context, code string) (Invite, error) {
+	var invite Invite
+	result := s.db(ctx).Where("code = ?", code).First(&invite)
+	return invite, found(result.Error)
+}
+
+func (s *GormStore) CommunityInvites(ctx context.Context, communityID uint) ([]Invite, error) {
+	invites := []Invite{}
+	result := s.db(ctx).Where("community_id = ? AND revoked_at IS NULL", communityID).
+		Order("created_at DESC").Find(&invites)
+	return invites, result.Error
+}
+
+func (s *GormStore) RevokeInvite(ctx context.Context, communityID uint, id uint, at time.Time) (bool, error) {
+	result := s.db(ctx).Model(&Invite{}).
+		Where("id = ? AND community_id = ? AND revoked_at IS NULL", id, communityID).
+		Update("revoked_at", at)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *GormStore) UseInvite(ctx context.Context, id uint) (bool, error) {
+	result := s.db(ctx).Model(&Invite{}).
+		Where("id = ? AND revoked_at IS NULL AND (max_uses = 0 OR uses < max_uses)", id).
+		Update("uses", gorm.Expr("uses + 1"))
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *GormStore) RecordModeration(ctx context.Context, action *ModerationAction) error {
+	return s.db(ctx).Create(action).Error
+}
+
+func (s *GormStore) ModerationLog(ctx context.Context, communityID uint, before uint, limit int) ([]ModerationAction, error) {
+	var actions []ModerationAction
+	tx := s.db(ctx).Where("community_id = ?", communityID)
+	if before != 0 {
+		tx = tx.Where("id < ?", before)
+	}
+	result := tx.Order("id DESC").Limit(limit).Find(&actions)
+	return actions, result.Error
+}
+
+func (s *GormStore) CreateOffer(ctx context.Context, offer *Offer) error {
+	return s.db(ctx).Create(offer).Error
+}
+
+func (s *GormStore) FindOffer(ctx context.Context, id uint) (Offer, error) {
+	var offer Offer
+	result := s.db(ctx).Preload("Photos", orderedPhotos).First(&offer, id)
+	return offer, found(result.Error)
+}
+
+func (s *GormStore) ListOffers(ctx context.Context, filter PostFilter) ([]Offer, error) {
+	db := s.db(ctx)
+	tx := db.Model(&Offer{}).Where("community_id IN ?", filter.CommunityIDs)
+	if !filter.Query.Closed {
+		tx = tx.Where("status IN ?", activeOfferStatuses)
+	}
+	tx, err := withoutBlocked(db, tx, filter.ViewerID, "user_id")
+	if err != nil {
+		return nil, err
+	}
+	var offers []Offer
+	result := filterPosts(tx, "offers", SearchOffer, filter.Query).Find(&offers)
+	return offers, result.Error
+}
+
+func (s *GormStore) UpdateOffer(ctx context.Context, offer Offer) error {
+	return s.db(ctx).Model(&Offer{}).Where("id = ?", offer.ID).Updates(map[string]interface{}{
+		"title":       offer.Title,
+		"description": offer.Description,
+		"status":      offer.Status,
+	}).Error
+}
+
+func (s *GormStore) DeleteOffer(ctx context.Context, id uint) error {
+	return s.db(ctx).Delete(&Offer{}, id).Error
+}
+
+func (s *GormStore) CreateRequest(ctx context.Context, request *Request) error {
+	return s.db(ctx).Create(request).Error
+}
+
+func (s *GormStore) FindRequest(ctx context.Context, id uint) (Request, error) {
+	var request Request
+	result := s.db(ctx).Preload("Photos", orderedPhotos).First(&request, id)
+	return request, found(result.Error)
+}
+
+func (s *GormStore) ListRequests(ctx context.Context, filter PostFilter) ([]Request, error) {
+	db := s.db(ctx)
+	tx, err := withoutBlocked(db, db.Model(&Request{}).Where("community_id IN ?", filter.CommunityIDs), filter.ViewerID, "user_id")
+	if err != nil {
+		return nil, err
+	}
+	var requests []Request
+	result := filterPosts(tx, "requests", SearchRequest, filter.Query).Find(&requests)
+	return requests, result.Error
+}
+
+func (s *GormStore) UpdateRequest(ctx context.Context, request Request) error {
+	return s.db(ctx).Model(&Request{}).Where("id = ?", request.ID).Updates(map[string]interface{}{
+		"title":       request.Title,
+		"description": request.Description,
+	}).Error
+}
+
+func (s *GormStore) DeleteRequest(ctx context.Context, id uint) error {
+	return s.db(ctx).Delete(&Request{}, id).Error
+}
+
+func (s *GormStore) UserPosts(ctx context.Context, userID uint, communityIDs []uint) (UserActivity, error) {
+	activity := UserActivity{Offers: []Offer{}, Requests: []Request{}}
+	if len(communityIDs) == 0 {
+		return activity, nil
+	}
+	db := s.db(ctx)
+	result := db.Preload("Photos", orderedPhotos).
+		Where("user_id = ? AND community_id IN ? AND status IN ?", userID, communityIDs, activeOfferStatuses).
+		Order("created_at DESC").Find(&activity.Offers)
+	if result.Error != nil {
+		return activity, result.Error
+	}
+	result = db.Preload("Photos", orderedPhotos).
+		Where("user_id = ? AND community_id IN ?", userID, communityIDs).
+		Order("created_at DESC").Find(&activity.Requests)
+	return activity, result.Error
+}
+
+func (s *GormStore) CreateMessage(ctx context.Context, message *Message) error {
+	return s.db(ctx).Transaction(func(tx *gorm.DB) error {
+		conversation, err := conversationFor(tx, message.SenderID, message.ReceiverID, message.OfferID, message.RequestID)
+		if err != nil {
+			return err
+		}
+		message.ConversationID = &conversation.ID
+		err = tx.Create(message).Error
+		if err != nil {
+			return err
+		}
+		return touchConversation(tx, conversation.ID, message.SenderID, message.CreatedAt)
+	})
+}
+
+func (s *GormStore) Messages(ctx context.Context, filter MessageFilter) ([]Message, error) {
+	var messages []Message
+	db := s.db(ctx)
+	query := db.Where(db.Where("receiver_id = ? AND sender_id = ?", filter.UserID, filter.OtherUserID).
+		Or("receiver_id = ? AND sender_id = ?", filter.OtherUserID, filter.UserID))
+	if filter.RequestID != nil {
+		query = query.Where("request_id = ?", *filter.RequestID)
+	} else if filter.OfferID != nil {
+		query = query.Where("offer_id = ?", *filter.OfferID)
+	}
+	result := query.Order("created_at").Find(&messages)
+	return messages, result.Error
+}
+
+func (s *GormStore) MarkDelivered(ctx context.Context, ids []uint, at time.Time) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.db(ctx).Model(&Message{}).Where("id IN ? AND delivered_at IS NULL", ids).Update("delivered_at", at).Error
+}
+
+func (s *GormStore) PostSenders(ctx context.Context, kind string, postID uint) ([]uint, error) {
+	var rows []struct{ SenderID uint }
+	result := s.db(ctx).Model(&Message{}).Select("sender_id, MIN(id) AS first_id").
+		Where(photoColumn(kind)+" = ?", postID).Group("sender_id").Order("first_id").Scan(&rows)
+	ids := make([]uint, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.SenderID)
+	}
+	return ids, result.Error
+}
+
+func (s *GormStore) UserConversations(ctx context.Context, userID uint, offerID *uint, requestID *uint) ([]Conversation, error) {
+	db := s.db(ctx)
+	var conversations []Conversation
+	tx := db.Preload("Participants").
+		Where("id IN (?)", db.Model(&ConversationParticipant{}).Select("conversation_id").Where("user_id = ?", userID))
+	if requestID != nil {
+		tx = tx.Where("request_id = ?", *requestID)
+	} else if offerID != nil {
+		tx = tx.Where("offer_id = ?", *offerID)
+	}
+	// conversations without messages last, postgres puts NULLs first
+	result := tx.Order("last_message_at IS NULL, last_message_at DESC").Find(&conversations)
+	return conversations, result.Error
+}
+
+func (s *GormStore) FindConversation(ctx context.Context, id uint) (Conversation, error) {
+	var conversation Conversation
+	result := s.db(ctx).Preload("Participants").First(&conversation, id)
+	return conversation, found(result.Error)
+}
+
+func (s *GormStore) FindConversationBetween(ctx context.Context, userA uint, userB uint, offerID *uint, requestID *uint) (Conversation, error) {
+	conversation, err := findConversation(s.db(ctx), conversationKey(userA, userB, offerID, requestID))
+	return conversation, found(err)
+}
+
+func (s *GormStore) SummarizeConversations(ctx context.Context, conversations []Conversation, userID uint) ([]ConversationSummary, error) {
+	return summarizeConversations(s.db(ctx), conversations, userID)
+}
+
+func (s *GormStore) ConversationMessages(ctx context.Context, conversationID uint) ([]Message, error) {
+	messages := []Message{}
+	result := s.db(ctx).Where("conversation_id = ?", conversationID).Order("created_at").Find(&messages)
+	return messages, result.Error
+}
+
+func (s *GormStore) MarkConversationRead(ctx context.Context, conversationID uint, userID uint, at time.Time) (int64, error) {
+	return markConversationRead(s.db(ctx), conversationID, userID, at)
+}
+
+func (s *GormStore) UnreadCount(ctx context.Context, userID uint) (int64, error) {
+	var unread int64
+	result := s.db(ctx).Model(&Message{}).Where("receiver_id = ? AND read_at IS NULL", userID).Count(&unread)
+	return unread, result.Error
+}
+
+func (s *GormStore) CreatePhoto(ctx context.Context, photo *Photo) error {
+	return s.db(ctx).Create(photo).Error
+}
+
+func (s *GormStore) FindPhoto(ctx context.Context, id uint) (Photo, error) {
+	var photo Photo
+	result := s.db(ctx).First(&photo, id)
+	return photo, found(result.Error)
+}
+
+func (s *GormStore) PostPhotos(ctx context.Context, kind string, postID uint) ([]Photo, error) {
+	var photos []Photo
+	result := orderedPhotos(s.db(ctx)).Where(photoColumn(kind)+" = ?", postID).Find(&photos)
+	return photos, result.Error
+}
+
+func (s *GormStore) ClaimPhoto(ctx context.Context, photoID uint, userID uint, kind string, postID uint, position int, caption string) (bool, error) {
+	db := s.db(ctx)
+	result := db.Model(&Photo{}).
+		Where("id = ? AND user_id = ? AND offer_id IS NULL AND request_id IS NULL", photoID, userID).
+		Where("id NOT IN (?)", db.Model(&User{}).Select("avatar_id").Where("avatar_id IS NOT NULL")).
+		Updates(map[string]interface{}{photoColumn(kind): postID, "position": position, "caption": caption})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *GormStore) SetPhotoCaption(ctx context.Context, id uint, caption string) error {
+	return s.db(ctx).Model(&Photo{}).Where("id = ?", id).Update("caption", caption).Error
+}
+
+func (s *GormStore) SetPhotoPosition(ctx context.Context, id uint, position int) error {
+	return s.db(ctx).Model(&Photo{}).Where("id = ?", id).Update("position", position).Error
+}
+
+func (s *GormStore) DeletePhotos(ctx context.Context, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.db(ctx).Unscoped().Delete(&Photo{}, ids).Error
+}
+
+func (s *GormStore) FileInUse(ctx context.Context, name string) (bool, error) {
+	var count int64
+	result := s.db(ctx).Model(&Photo{}).
+		Where("path = ? OR medium_path = ? OR thumb_path = ?", name, name, name).Count(&count)
+	return count > 0, result.Error
+}
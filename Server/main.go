@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"github.com/sashamorecode/Comradery/Server/api"
+	"log"
+	"os"
+
 	"github.com/gin-gonic/gin"
+	"github.com/sashamorecode/Comradery/Server/api"
 )
 
 // example image Post: curl -X POST 127.0.0.1:8000/images -F "user_id=100" -F "image=@./image.png" -H "Content-Type: multipart/form-data"
@@ -11,10 +15,57 @@ import (
 //example get image id=1: curl -X GET '127.0.0.1:8000/images1' > imgtest.jpg
 //example get user id=1: curl -X GET '127.0.0.1:8000/users1'
 func main() {
-	db := api.ConnectDB()
+	args := os.Args[1:]
+	migrate := len(args) > 0 && args[0] == "migrate"
+	if migrate {
+		args = args[1:]
+	}
+	cfg, args, err := api.LoadConfig(args)
+	if err != nil {
+		log.Fatal("Error in the configuration: ", err)
+	}
+	if migrate {
+		err = runMigrate(cfg, args)
+		if err != nil {
+			log.Fatal("Error migrating the database: ", err)
+		}
+		return
+	}
+	if len(args) > 0 {
+		log.Fatalf("Unknown command %q, the only command is migrate", args[0])
+	}
+	log.Println("Configuration: ", cfg.Redacted())
+	db, err := api.ConnectDB(cfg.Database)
+	if err != nil {
+		log.Fatal("Error setting up the database: ", err)
+	}
+	keys, err := api.SigningKeysFromConfig(cfg.JWT)
+	if err != nil {
+		log.Fatal("Error reading the signing keys: ", err)
+	}
+	err = api.SetSigningKeys(keys)
+	if err != nil {
+		log.Fatal("Error setting the signing keys: ", err)
+	}
+	images, err := api.NewImageStore(cfg.Images)
+	if err != nil {
+		log.Fatal("Error setting up the image store: ", err)
+	}
+	search, err := api.NewSearchIndex(db, cfg.Search)
+	if err != nil {
+		log.Fatal("Error setting up search: ", err)
+	}
+	mailer, err := api.NewMailer(cfg.Mail)
+	if err != nil {
+		log.Fatal("Error setting up the mailer: ", err)
+	}
+	events := api.NewHub()
+	exports := api.NewExportWorker(db, images, mailer, events, cfg.PublicURL)
+	go exports.Run(context.Background())
 	router := gin.Default()
-	api.SetupRoutes(db, router)
-	err := router.Run("127.0.0.1:8000")
+	api.SetupRoutes(db, api.Services{Images: images, Search: search, Mail: mailer,
+		Events: events, Exports: exports, PublicURL: cfg.PublicURL, APIURL: cfg.APIURL}, router)
+	err = router.Run(cfg.ListenAddr)
 	if err != nil {
 		fmt.Println("Error: ", err)
 	}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/sashamorecode/Comradery/Server/api"
+)
+
+const migrateUsage = "usage: server migrate [flags] up | down | status | to <version>"
+
+// runMigrate runs the migrate command: up applies every pending migration,
+// down reverts the last one, to moves to the given version and status lists
+// them all.
+func runMigrate(cfg api.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	db, err := api.OpenDB(cfg.Database)
+	if err != nil {
+		return err
+	}
+	switch {
+	case args[0] == "up" && len(args) == 1:
+		return api.MigrateUp(db)
+	case args[0] == "down" && len(args) == 1:
+		return api.MigrateDown(db)
+	case args[0] == "to" && len(args) == 2:
+		version, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		return api.MigrateTo(db, uint(version))
+	case args[0] == "status" && len(args) == 1:
+		states, err := api.MigrationStatus(db)
+		if err != nil {
+			return err
+		}
+		version, err := api.SchemaVersion(db)
+		if err != nil {
+			return err
+		}
+		return printMigrationStatus(states, version)
+	}
+	return errors.New(migrateUsage)
+}
+
+func printMigrationStatus(states []api.MigrationState, version uint) error {
+	fmt.Printf("schema version %d, this server needs %d\n\n", version, api.LatestSchemaVersion())
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "VERSION\tAPPLIED\tNAME")
+	for _, state := range states {
+		applied := "pending"
+		if state.AppliedAt != nil {
+			applied = state.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		name := state.Name
+		if state.Unknown {
+			name += " (unknown to this server)"
+		}
+		fmt.Fprintf(out, "%d\t%v\t%v\n", state.Version, applied, name)
+	}
+	return out.Flush()
+}